@@ -22,6 +22,7 @@ func apiFlagSet() *flag.FlagSet {
 
 	// App settings
 	fs.String("default_domain", "pgp.st", "Default email domain")
+	fs.String("mx_hosts", "pgp.st", "Comma-separated hosts the MX records of custom domains must point to")
 	fs.String("http_address", "0.0.0.0:8000", "Address of the HTTP server")
 
 	// RethinkDB connection
@@ -39,6 +40,9 @@ func apiFlagSet() *flag.FlagSet {
 	fs.String("yubicloud_id", "", "App ID for the YubiCloud API")
 	fs.String("yubicloud_key", "", "Key for the YubiCloud API")
 
+	// Autocrypt peers, the secret has to match the mailer's one
+	fs.String("peer_secret", "", "Secret used to hash the addresses of Autocrypt peers")
+
 	return fs
 }
 
@@ -35,6 +35,8 @@ func mailerFlagSet() *flag.FlagSet {
 	fs.Bool("smtp_force_tls", false, "Force TLS?")
 	fs.String("smtp_tls_cert", "", "Path to the TLS cert to use")
 	fs.String("smtp_tls_key", "", "Path to the TLS key to use")
+	fs.String("submission_address", "0.0.0.0:587", "Address of the submission server, requires TLS")
+	fs.String("lmtp_address", "", "Address of the LMTP server, host:port or unix:/path/to/socket")
 
 	// Connection parameters
 	fs.String("hostname", "pgp.st", "Hostname of the mailer")
@@ -49,11 +51,45 @@ func mailerFlagSet() *flag.FlagSet {
 	// Spamd address
 	fs.String("spamd_address", "127.0.0.1:783", "Address of the spamd server to use")
 
+	// Directory of accepted emails that are not stored yet
+	fs.String("spool_dir", "/var/spool/pgpst-mailer", "Directory of the incoming email spool")
+
+	// Threading of the emails without references
+	fs.Int("thread_window", 72, "Hours in which emails with the same subject and participants are threaded, 0 to disable")
+	fs.String("thread_secret", "", "Secret used to hash the subjects, required unless thread_window is 0, the rethread command needs the same one")
+
+	// Suppression of the emails retried by the senders
+	fs.Int("duplicate_window", 24, "Hours in which redelivered copies of an email are not stored again, 0 to disable")
+
+	// Sender policies
+	fs.Bool("policy_helo", false, "Reject clients with invalid or forged HELO names")
+	fs.Bool("policy_rdns", false, "Require a forward-confirmed reverse DNS of the clients")
+	fs.Bool("policy_dnsbl", false, "Reject clients listed in the DNSBLs")
+	fs.String("dnsbl_zones", "zen.spamhaus.org", "Comma-separated list of DNSBL zones to use")
+	fs.Bool("policy_greylist", false, "Greylist new client, sender and recipient triplets")
+	fs.Int("greylist_delay", 300, "Seconds before a greylisted triplet is accepted")
+
+	// Rate limits of the clients, networks are /24 for IPv4 and /64 for IPv6
+	fs.Int("rate_connections_ip", 10, "Max concurrent connections per IP, 0 to disable")
+	fs.Int("rate_connections_network", 30, "Max concurrent connections per network, 0 to disable")
+	fs.Int("rate_messages_ip", 30, "Max messages per minute per IP, 0 to disable")
+	fs.Int("rate_messages_network", 100, "Max messages per minute per network, 0 to disable")
+	fs.Int("rate_recipients_ip", 500, "Max recipients per hour per IP, 0 to disable")
+	fs.Int("rate_recipients_network", 2000, "Max recipients per hour per network, 0 to disable")
+	fs.Bool("rate_shared", false, "Share the rate limits between the instances using RethinkDB")
+
 	// Outbound email settings
 	fs.String("smtpd_address", "127.0.0.1:2525", "Address of the SMTP relay to use")
 	fs.Int("dkim_lru_size", 128, "Size of the in-memory DKIM key cache")
 	fs.Int("sender_concurrency", 10, "Max concurrency of the email sender")
 
+	// Sender rewriting of the forwarded emails
+	fs.String("srs_secret", "", "Secret used to sign the rewritten senders of forwarded emails, required")
+	fs.String("srs_domain", "", "Domain of the rewritten senders, defaults to the hostname")
+
+	// Autocrypt peers, the secret has to match the API's one
+	fs.String("peer_secret", "", "Secret used to hash the addresses of Autocrypt peers, required")
+
 	return fs
 }
 
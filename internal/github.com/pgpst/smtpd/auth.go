@@ -0,0 +1,149 @@
+package smtpd
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+)
+
+// Authenticator verifies the credentials passed in the AUTH command. Errors
+// of type Error are sent to the client as they are, others are replied with
+// ErrAuthInvalid.
+type Authenticator interface {
+	Authenticate(conn *Connection, username string, password string) error
+}
+
+type AuthenticatorFunc func(conn *Connection, username string, password string) error
+
+func (a AuthenticatorFunc) Authenticate(conn *Connection, username string, password string) error {
+	return a(conn, username, password)
+}
+
+// authAvailable returns whether AUTH can be used on the connection. Passwords
+// are never accepted over plaintext connections.
+func (c *Connection) authAvailable() bool {
+	return c.Server.Authenticator != nil && c.TLS != nil && c.User == ""
+}
+
+// readAuthLine sends a challenge and reads the base64-encoded response.
+func (c *Connection) readAuthLine(challenge string) ([]byte, bool) {
+	c.reply(334, base64.StdEncoding.EncodeToString([]byte(challenge)))
+
+	line, err := c.readLine()
+	if err != nil {
+		return nil, false
+	}
+
+	if line == "*" {
+		c.reply(501, "Authentication cancelled.")
+		return nil, false
+	}
+
+	data, err := base64.StdEncoding.DecodeString(line)
+	if err != nil {
+		c.reply(501, "Invalid base64 encoding.")
+		return nil, false
+	}
+
+	return data, true
+}
+
+func (c *Connection) handleAUTH(cmd *command) {
+	if c.HeloName == "" {
+		c.reply(502, "Please introduce yourself first.")
+		return
+	}
+
+	if c.Server.Authenticator == nil {
+		c.reply(502, "Unsupported command.")
+		return
+	}
+
+	if c.TLS == nil {
+		c.Error(ErrEncryptionRequired)
+		return
+	}
+
+	if c.User != "" {
+		c.reply(503, "Already authenticated.")
+		return
+	}
+
+	if c.Envelope != nil {
+		c.reply(503, "AUTH is not allowed during a mail transaction.")
+		return
+	}
+
+	if len(cmd.Fields) < 2 {
+		c.reply(501, "Missing parameter.")
+		return
+	}
+
+	var (
+		username string
+		password string
+	)
+
+	switch strings.ToUpper(cmd.Fields[1]) {
+	case "PLAIN":
+		// authzid\0authcid\0passwd, as in RFC 4616
+		var (
+			data []byte
+			ok   bool
+			err  error
+		)
+		if len(cmd.Fields) > 2 {
+			data, err = base64.StdEncoding.DecodeString(cmd.Fields[2])
+			if err != nil {
+				c.reply(501, "Invalid base64 encoding.")
+				return
+			}
+		} else if data, ok = c.readAuthLine(""); !ok {
+			return
+		}
+
+		parts := bytes.Split(data, []byte{0})
+		if len(parts) != 3 {
+			c.reply(501, "Invalid PLAIN credentials.")
+			return
+		}
+		username = string(parts[1])
+		password = string(parts[2])
+	case "LOGIN":
+		if len(cmd.Fields) > 2 {
+			data, err := base64.StdEncoding.DecodeString(cmd.Fields[2])
+			if err != nil {
+				c.reply(501, "Invalid base64 encoding.")
+				return
+			}
+			username = string(data)
+		} else {
+			data, ok := c.readAuthLine("Username:")
+			if !ok {
+				return
+			}
+			username = string(data)
+		}
+
+		data, ok := c.readAuthLine("Password:")
+		if !ok {
+			return
+		}
+		password = string(data)
+	default:
+		c.reply(504, "Unrecognized authentication mechanism.")
+		return
+	}
+
+	if err := c.Server.Authenticator.Authenticate(c, username, password); err != nil {
+		if _, ok := err.(Error); ok {
+			c.Error(err)
+		} else {
+			c.Error(ErrAuthInvalid)
+		}
+		return
+	}
+
+	c.User = username
+	c.reply(235, "2.7.0 Authentication successful")
+}
@@ -3,6 +3,8 @@ package smtpd
 import (
 	"bufio"
 	"crypto/tls"
+	"errors"
+	"io"
 	"log"
 	"net"
 	"strconv"
@@ -19,8 +21,14 @@ func (p Protocol) String() string {
 const (
 	SMTP  Protocol = "SMTP"
 	ESMTP          = "ESMTP"
+	LMTP           = "LMTP"
 )
 
+// maxLineLength is the longest command line accepted by the server.
+const maxLineLength = 64 * 1024
+
+var errLineTooLong = errors.New("smtpd: line too long")
+
 type Connection struct {
 	Server *Server
 
@@ -28,11 +36,16 @@ type Connection struct {
 	Protocol Protocol
 	Addr     net.Addr
 	TLS      *tls.ConnectionState
+	User     string // authenticated username
+
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
 
-	conn    net.Conn
-	reader  *bufio.Reader
-	writer  *bufio.Writer
-	scanner *bufio.Scanner
+	// Rejections by the delivery chain are held back until the chain
+	// returns, as LMTP clients expect one reply per recipient
+	capturing bool
+	rejection error
 
 	Envelope    *Envelope
 	Environment map[string]interface{}
@@ -45,29 +58,23 @@ func (c *Connection) serve() {
 		// Send a Welcome message
 		c.welcome()
 		for {
-			// Scan for new messages, will break when there's an error
-			for c.scanner.Scan() {
-				// Handle the textual version of the message
-				c.handle(c.scanner.Text())
-			}
-
-			// Something is wrong!
-			err := c.scanner.Err()
-			if err != nil && err == bufio.ErrTooLong {
+			// Read the commands one by one, the chunks of BDAT are read
+			// directly from the same reader
+			line, err := c.readLine()
+			if err == errLineTooLong {
 				c.reply(500, "Line too long")
 
-				// Proceed to the next line and create a new scanner
-				c.reader.ReadString('\n')
-				c.scanner = bufio.NewScanner(c.reader)
-
 				// Reset the context
 				c.reset()
 				continue
 			} else if err != nil {
-				log.Print(err)
+				if err != io.EOF {
+					log.Print(err)
+				}
+				break
 			}
 
-			break
+			c.handle(line)
 		}
 	}
 
@@ -78,6 +85,40 @@ func (c *Connection) serve() {
 	ow()
 }
 
+// readLine reads a single line without its line ending. Lines longer than
+// maxLineLength are skipped.
+func (c *Connection) readLine() (string, error) {
+	var line []byte
+	for {
+		chunk, err := c.reader.ReadSlice('\n')
+		if line != nil || err == bufio.ErrBufferFull {
+			line = append(line, chunk...)
+		} else {
+			line = chunk
+		}
+
+		if len(line) > maxLineLength {
+			// Skip the rest of the line
+			for err == bufio.ErrBufferFull {
+				_, err = c.reader.ReadSlice('\n')
+			}
+			if err != nil {
+				return "", err
+			}
+			return "", errLineTooLong
+		}
+
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+
+		return strings.TrimRight(string(line), "\r\n"), nil
+	}
+}
+
 func (c *Connection) welcome() {
 	// 220 Wilkommen!
 	c.reply(220, c.Server.WelcomeMessage)
@@ -89,9 +130,12 @@ func (c *Connection) reset() {
 }
 
 func (c *Connection) reply(code int, message string) {
-	// Write the string and flush the interface
+	// Write the string and flush the interface. Replies to pipelined
+	// commands are sent together once all of them are handled.
 	c.writer.WriteString(strconv.Itoa(code) + " " + message + "\r\n")
-	c.flush()
+	if c.reader.Buffered() == 0 {
+		c.flush()
+	}
 }
 
 func (c *Connection) flush() {
@@ -106,6 +150,13 @@ func (c *Connection) reject() {
 }
 
 func (c *Connection) Error(err error) {
+	if c.capturing {
+		if c.rejection == nil {
+			c.rejection = err
+		}
+		return
+	}
+
 	if se, ok := err.(Error); ok {
 		c.reply(se.Code, se.Message)
 	} else {
@@ -138,14 +189,20 @@ func (c *Connection) handle(line string) {
 		c.handleHELO(cmd)
 	case "EHLO":
 		c.handleEHLO(cmd)
+	case "LHLO":
+		c.handleLHLO(cmd)
 	case "MAIL":
 		c.handleMAIL(cmd)
 	case "RCPT":
 		c.handleRCPT(cmd)
 	case "STARTTLS":
 		c.handleSTARTTLS(cmd)
+	case "AUTH":
+		c.handleAUTH(cmd)
 	case "DATA":
 		c.handleDATA(cmd)
+	case "BDAT":
+		c.handleBDAT(cmd)
 	case "RSET":
 		c.handleRSET(cmd)
 	case "NOOP":
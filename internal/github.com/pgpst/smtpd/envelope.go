@@ -12,6 +12,30 @@ type Envelope struct {
 	Sender     string
 	Recipients []string
 	Data       []byte
+
+	Size     int    // size declared with the SIZE parameter
+	Body     string // 7BIT or 8BITMIME
+	SMTPUTF8 bool   // whether the addresses and headers may contain UTF-8
+
+	// Delivery status notification parameters (RFC 3461)
+	Return       string          // RET, FULL or HDRS
+	EnvelopeID   string          // ENVID, decoded from xtext
+	RecipientDSN []*RecipientDSN // parameters of every recipient
+
+	// Environment holds the handlers' state of the transaction. Unlike the
+	// connection's one, it's dropped along with the envelope by RSET and
+	// after the delivery, and every MAIL starts with an empty one.
+	Environment map[string]interface{}
+
+	chunking bool    // whether the data is transferred using BDAT
+	rejected []error // delivery errors of the recipients
+}
+
+// RecipientDSN holds the delivery status notification parameters of a
+// recipient.
+type RecipientDSN struct {
+	Notify   []string // NEVER, or any of SUCCESS, FAILURE and DELAY
+	Original string   // ORCPT, the address type and the decoded address
 }
 
 var tlsVersions = map[uint16]string{
@@ -21,6 +45,50 @@ var tlsVersions = map[uint16]string{
 	tls.VersionTLS12: "TLS1.2",
 }
 
+// Reject marks the delivery to the recipient with the index as failed. LMTP
+// clients get the error for that recipient only, SMTP clients get the first
+// error for the whole message.
+func (e *Envelope) Reject(index int, err error) {
+	if index < 0 || index >= len(e.Recipients) {
+		return
+	}
+	if e.rejected == nil {
+		e.rejected = make([]error, len(e.Recipients))
+	}
+	e.rejected[index] = err
+}
+
+// Rejected returns the delivery error of the recipient with the index.
+func (e *Envelope) Rejected(index int) error {
+	if index >= len(e.rejected) {
+		return nil
+	}
+	return e.rejected[index]
+}
+
+func (e *Envelope) firstRejection() error {
+	for _, err := range e.rejected {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isASCII checks whether the addresses of the envelope need SMTPUTF8.
+func (e *Envelope) isASCII() bool {
+	if !isASCII(e.Sender) {
+		return false
+	}
+	for _, recipient := range e.Recipients {
+		if !isASCII(recipient) {
+			return false
+		}
+	}
+
+	return true
+}
+
 func (e *Envelope) AddReceivedLine(c *Connection) {
 	var buf bytes.Buffer
 
@@ -31,7 +99,16 @@ func (e *Envelope) AddReceivedLine(c *Connection) {
 	buf.WriteString("] by ")
 	buf.WriteString(c.Server.Hostname)
 	buf.WriteString(" with ")
-	buf.WriteString(c.Protocol.String())
+	if e.SMTPUTF8 && !e.isASCII() {
+		// RFC 6531 protocol types of internationalized transactions
+		if c.Protocol == LMTP {
+			buf.WriteString("UTF8LMTP")
+		} else {
+			buf.WriteString("UTF8SMTP")
+		}
+	} else {
+		buf.WriteString(c.Protocol.String())
+	}
 	buf.WriteRune(';')
 
 	if c.TLS != nil {
@@ -0,0 +1,72 @@
+package smtpd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// param is a single ESMTP parameter of MAIL or RCPT.
+type param struct {
+	Key   string
+	Value string
+}
+
+// parseParams splits the ESMTP parameters into uppercase keywords and their
+// values.
+func parseParams(fields []string) ([]param, error) {
+	params := make([]param, 0, len(fields))
+	for _, field := range fields {
+		parts := strings.SplitN(field, "=", 2)
+		if parts[0] == "" {
+			return nil, fmt.Errorf("Invalid parameter %s.", field)
+		}
+
+		p := param{Key: strings.ToUpper(parts[0])}
+		if len(parts) == 2 {
+			p.Value = parts[1]
+		}
+		params = append(params, p)
+	}
+
+	return params, nil
+}
+
+// decodeXtext decodes the xtext encoding of RFC 3461, where the special
+// characters are replaced by "+" followed by their hex code.
+func decodeXtext(input string) (string, error) {
+	output := make([]byte, 0, len(input))
+	for i := 0; i < len(input); i++ {
+		char := input[i]
+		if char < '!' || char > '~' || char == '=' {
+			return "", fmt.Errorf("Invalid xtext %s.", input)
+		}
+
+		if char == '+' {
+			if i+2 >= len(input) {
+				return "", fmt.Errorf("Invalid xtext %s.", input)
+			}
+			code, err := strconv.ParseUint(input[i+1:i+3], 16, 8)
+			if err != nil || input[i+1:i+3] != strings.ToUpper(input[i+1:i+3]) {
+				return "", fmt.Errorf("Invalid xtext %s.", input)
+			}
+			char = byte(code)
+			i += 2
+		}
+
+		output = append(output, char)
+	}
+
+	return string(output), nil
+}
+
+// isASCII checks whether the string can be used without SMTPUTF8.
+func isASCII(input string) bool {
+	for i := 0; i < len(input); i++ {
+		if input[i] > 127 {
+			return false
+		}
+	}
+
+	return true
+}
@@ -13,6 +13,11 @@ import (
 )
 
 func (c *Connection) handleHELO(cmd *command) {
+	if c.Server.LMTP {
+		c.reply(500, "5.5.1 Please use LHLO.")
+		return
+	}
+
 	if len(cmd.Fields) < 2 {
 		c.reply(502, "Missing parameter")
 		return
@@ -33,6 +38,25 @@ func (c *Connection) handleHELO(cmd *command) {
 }
 
 func (c *Connection) handleEHLO(cmd *command) {
+	if c.Server.LMTP {
+		c.reply(500, "5.5.1 Please use LHLO.")
+		return
+	}
+
+	c.greet(cmd, ESMTP)
+}
+
+func (c *Connection) handleLHLO(cmd *command) {
+	if !c.Server.LMTP {
+		c.reply(502, "Unsupported command.")
+		return
+	}
+
+	c.greet(cmd, LMTP)
+}
+
+// greet handles EHLO and LHLO, which both list the extensions.
+func (c *Connection) greet(cmd *command, protocol Protocol) {
 	if len(cmd.Fields) < 2 {
 		c.reply(502, "Missing parameter")
 		return
@@ -44,30 +68,26 @@ func (c *Connection) handleEHLO(cmd *command) {
 	}
 
 	c.HeloName = cmd.Fields[1]
-	c.Protocol = ESMTP
+	c.Protocol = protocol
+
+	// Prepare the list of extensions available on this connection
+	extensions := append([]string{}, c.Server.extensions...)
+	if c.authAvailable() {
+		extensions = append(extensions, "AUTH PLAIN LOGIN")
+	}
+	if c.Server.TLSConfig != nil && c.TLS == nil {
+		extensions = append(extensions, "STARTTLS")
+	}
 
 	// First line is the hostname
 	c.writer.WriteString("250-" + c.Server.Hostname + "\r\n")
 
-	// Can we send STARTTLS?
-	if c.Server.TLSConfig != nil && c.TLS == nil {
-		// Send all extensions in server's extensions list
-		for _, extension := range c.Server.extensions {
-			c.writer.WriteString("250-" + extension + "\r\n")
-		}
-
-		// And send STARTTLS without a dash
-		if c.Server.TLSConfig != nil && c.TLS == nil {
-			c.reply(250, "STARTTLS")
-		}
-	} else {
-		// Send all extensions except the last one
-		for _, extension := range c.Server.extensions[:len(c.Server.extensions)-1] {
-			c.writer.WriteString("250-" + extension + "\r\n")
-		}
-		// Send the last one seperately, without a dash
-		c.reply(250, c.Server.extensions[len(c.Server.extensions)-1])
+	// Send all extensions except the last one
+	for _, extension := range extensions[:len(extensions)-1] {
+		c.writer.WriteString("250-" + extension + "\r\n")
 	}
+	// Send the last one seperately, without a dash
+	c.reply(250, extensions[len(extensions)-1])
 
 	return
 }
@@ -83,6 +103,11 @@ func (c *Connection) handleMAIL(cmd *command) {
 		return
 	}
 
+	if c.User == "" && c.Server.AuthRequired {
+		c.Error(ErrAuthRequired)
+		return
+	}
+
 	if len(cmd.Fields) < 2 {
 		c.reply(502, "Missing parameter.")
 		return
@@ -100,20 +125,94 @@ func (c *Connection) handleMAIL(cmd *command) {
 		return
 	}
 
-	// Parse the address
-	address, err := parseAddress(params[1])
+	if !c.Server.take(c.Addr, "messages", c.Server.RateLimits.Messages, 1, time.Minute) {
+		c.Error(errTooManyMessages)
+		return
+	}
+
+	// Parse the address, bounces are sent with a null reverse-path
+	var address string
+	if strings.TrimSpace(params[1]) != "<>" {
+		var err error
+		address, err = parseAddress(params[1])
+		if err != nil {
+			c.reply(502, err.Error())
+			return
+		}
+	}
+
+	// Parse the ESMTP parameters
+	extra, err := parseParams(cmd.Fields[2:])
 	if err != nil {
-		c.reply(502, err.Error())
+		c.reply(501, "5.5.4 "+err.Error())
 		return
 	}
 
-	// Execute the sender checking chain
-	oh := func(_ *Connection) {
-		c.Envelope = &Envelope{
-			Sender:     address,
-			Recipients: []string{},
+	envelope := &Envelope{
+		Sender:     address,
+		Recipients: []string{},
+		Body:       "7BIT",
+	}
+	for _, param := range extra {
+		switch param.Key {
+		case "SIZE":
+			size, err := strconv.Atoi(param.Value)
+			if err != nil || size < 0 {
+				c.reply(501, "5.5.4 Invalid SIZE parameter.")
+				return
+			}
+			if size > c.Server.MaxMessageSize {
+				c.reply(552, "5.3.4 Message size exceeds fixed maximum message size of "+strconv.Itoa(c.Server.MaxMessageSize)+" bytes.")
+				return
+			}
+			envelope.Size = size
+		case "BODY":
+			body := strings.ToUpper(param.Value)
+			if body != "7BIT" && body != "8BITMIME" {
+				c.reply(501, "5.5.4 Invalid BODY parameter.")
+				return
+			}
+			envelope.Body = body
+		case "SMTPUTF8":
+			if param.Value != "" {
+				c.reply(501, "5.5.4 Invalid SMTPUTF8 parameter.")
+				return
+			}
+			envelope.SMTPUTF8 = true
+		case "RET":
+			ret := strings.ToUpper(param.Value)
+			if ret != "FULL" && ret != "HDRS" {
+				c.reply(501, "5.5.4 Invalid RET parameter.")
+				return
+			}
+			envelope.Return = ret
+		case "ENVID":
+			id, err := decodeXtext(param.Value)
+			if err != nil || id == "" {
+				c.reply(501, "5.5.4 Invalid ENVID parameter.")
+				return
+			}
+			envelope.EnvelopeID = id
+		case "AUTH":
+			// The identity is set by the AUTH command itself
+		default:
+			c.reply(555, "5.5.4 Unsupported parameter "+param.Key+".")
+			return
 		}
+	}
 
+	if !envelope.SMTPUTF8 && !isASCII(address) {
+		c.reply(553, "5.6.7 Non-ASCII addresses require SMTPUTF8.")
+		return
+	}
+
+	// Create the envelope, so that the handlers can read the sender
+	c.Envelope = envelope
+
+	// Execute the sender checking chain
+	accepted := false
+	oh := func(_ *Connection) {
+		accepted = true
 		c.reply(250, "Go ahead.")
 	}
 
@@ -123,6 +222,11 @@ func (c *Connection) handleMAIL(cmd *command) {
 
 	oh(c)
 
+	// Drop the envelope if any of the handlers rejected it
+	if !accepted {
+		c.reset()
+	}
+
 	return
 }
 
@@ -156,11 +260,61 @@ func (c *Connection) handleRCPT(cmd *command) {
 		return
 	}
 
+	if !c.Envelope.SMTPUTF8 && !isASCII(address) {
+		c.reply(553, "5.6.7 Non-ASCII addresses require SMTPUTF8.")
+		return
+	}
+
+	// Parse the DSN parameters
+	extra, err := parseParams(cmd.Fields[2:])
+	if err != nil {
+		c.reply(501, "5.5.4 "+err.Error())
+		return
+	}
+
+	dsn := &RecipientDSN{}
+	for _, param := range extra {
+		switch param.Key {
+		case "NOTIFY":
+			dsn.Notify = strings.Split(strings.ToUpper(param.Value), ",")
+			for _, value := range dsn.Notify {
+				if (value != "NEVER" && value != "SUCCESS" && value != "FAILURE" && value != "DELAY") ||
+					(value == "NEVER" && len(dsn.Notify) > 1) {
+					c.reply(501, "5.5.4 Invalid NOTIFY parameter.")
+					return
+				}
+			}
+		case "ORCPT":
+			parts := strings.SplitN(param.Value, ";", 2)
+			if len(parts) != 2 || parts[0] == "" {
+				c.reply(501, "5.5.4 Invalid ORCPT parameter.")
+				return
+			}
+			original, err := decodeXtext(parts[1])
+			if err != nil || original == "" {
+				c.reply(501, "5.5.4 Invalid ORCPT parameter.")
+				return
+			}
+			dsn.Original = parts[0] + ";" + original
+		default:
+			c.reply(555, "5.5.4 Unsupported parameter "+param.Key+".")
+			return
+		}
+	}
+
+	if !c.Server.take(c.Addr, "recipients", c.Server.RateLimits.Recipients, 1, time.Hour) {
+		c.Error(errTooManyRecipients)
+		return
+	}
+
 	// Add it to the recipients list
 	c.Envelope.Recipients = append(c.Envelope.Recipients, address)
+	c.Envelope.RecipientDSN = append(c.Envelope.RecipientDSN, dsn)
 
 	// Execute the recipient checking chain
+	accepted := false
 	oh := func(_ *Connection) {
+		accepted = true
 		c.reply(250, "Go ahead.")
 	}
 
@@ -170,6 +324,12 @@ func (c *Connection) handleRCPT(cmd *command) {
 
 	oh(c)
 
+	// Remove the recipient if any of the handlers rejected it
+	if !accepted && c.Envelope != nil {
+		c.Envelope.Recipients = c.Envelope.Recipients[:len(c.Envelope.Recipients)-1]
+		c.Envelope.RecipientDSN = c.Envelope.RecipientDSN[:len(c.Envelope.RecipientDSN)-1]
+	}
+
 	return
 }
 
@@ -186,6 +346,7 @@ func (c *Connection) handleSTARTTLS(cmd *command) {
 
 	tlsConn := tls.Server(c.conn, c.Server.TLSConfig)
 	c.reply(220, "Go ahead")
+	c.flush()
 
 	// Perform a handshake
 	if err := tlsConn.Handshake(); err != nil {
@@ -203,7 +364,6 @@ func (c *Connection) handleSTARTTLS(cmd *command) {
 	c.conn = tlsConn
 	c.reader = bufio.NewReader(c.conn)
 	c.writer = bufio.NewWriter(c.conn)
-	c.scanner = bufio.NewScanner(c.reader)
 
 	state := tlsConn.ConnectionState()
 	c.TLS = &state
@@ -220,6 +380,11 @@ func (c *Connection) handleDATA(cmd *command) {
 		return
 	}
 
+	if c.Envelope.chunking {
+		c.reply(503, "5.5.1 BDAT transfer in progress.")
+		return
+	}
+
 	c.reply(354, "Go ahead. End your data with <CR><LF>.<CR><LF>")
 	c.conn.SetDeadline(time.Now().Add(c.Server.DataTimeout))
 
@@ -231,18 +396,7 @@ func (c *Connection) handleDATA(cmd *command) {
 	if err == io.EOF {
 		// Message was smaller than MaxMessageSize - deliver the message
 		c.Envelope.Data = data.Bytes()
-
-		// Execute the delivery chain
-		oh := func(_ *Connection) {
-			c.reply(250, "Thank you.")
-			c.reset()
-		}
-
-		for _, ha := range c.Server.DeliveryChain {
-			oh = ha.HandleDelivery(oh)
-		}
-
-		oh(c)
+		c.deliver()
 	}
 
 	if err != nil {
@@ -257,6 +411,118 @@ func (c *Connection) handleDATA(cmd *command) {
 	return
 }
 
+func (c *Connection) handleBDAT(cmd *command) {
+	if len(cmd.Fields) < 2 || len(cmd.Fields) > 3 {
+		c.reply(501, "5.5.4 Invalid BDAT parameters.")
+		return
+	}
+
+	size, err := strconv.ParseInt(cmd.Fields[1], 10, 64)
+	if err != nil || size < 0 {
+		c.reply(501, "5.5.4 Invalid chunk size.")
+		return
+	}
+
+	last := false
+	if len(cmd.Fields) == 3 {
+		if !strings.EqualFold(cmd.Fields[2], "LAST") {
+			c.reply(501, "5.5.4 Invalid BDAT parameters.")
+			return
+		}
+		last = true
+	}
+
+	// The chunk follows the command immediately, so it has to be read even
+	// if it's going to be rejected
+	c.conn.SetDeadline(time.Now().Add(c.Server.DataTimeout))
+
+	if c.Envelope == nil || len(c.Envelope.Recipients) == 0 {
+		if _, err := io.CopyN(ioutil.Discard, c.reader, size); err != nil {
+			return
+		}
+		c.reply(503, "5.5.1 Missing RCPT TO command.")
+		return
+	}
+
+	if int64(len(c.Envelope.Data))+size > int64(c.Server.MaxMessageSize) {
+		if _, err := io.CopyN(ioutil.Discard, c.reader, size); err != nil {
+			return
+		}
+		c.reply(552, "5.3.4 Message exceeded max message size of "+strconv.Itoa(c.Server.MaxMessageSize)+" bytes.")
+		c.reset()
+		return
+	}
+
+	chunk := make([]byte, size)
+	if _, err := io.ReadFull(c.reader, chunk); err != nil {
+		// Network error, ignore
+		return
+	}
+	c.Envelope.Data = append(c.Envelope.Data, chunk...)
+	c.Envelope.chunking = true
+
+	if !last {
+		c.reply(250, "2.0.0 "+strconv.FormatInt(size, 10)+" octets received.")
+		return
+	}
+
+	c.deliver()
+}
+
+// deliver runs the delivery chain on the received message. LMTP clients
+// get a reply for every recipient, SMTP clients only the first rejection.
+func (c *Connection) deliver() {
+	delivered := false
+	oh := func(_ *Connection) {
+		delivered = true
+		c.capturing = false
+
+		if c.Server.LMTP {
+			for i, recipient := range c.Envelope.Recipients {
+				if err := c.Envelope.Rejected(i); err != nil {
+					c.Error(err)
+				} else {
+					c.reply(250, "2.1.5 <"+recipient+"> Delivered.")
+				}
+			}
+		} else if err := c.Envelope.firstRejection(); err != nil {
+			c.Error(err)
+		} else {
+			c.reply(250, "Thank you.")
+		}
+
+		c.reset()
+	}
+
+	for _, ha := range c.Server.DeliveryChain {
+		oh = ha.HandleDelivery(oh)
+	}
+
+	recipients := len(c.Envelope.Recipients)
+	c.capturing, c.rejection = true, nil
+	oh(c)
+	c.capturing = false
+
+	if delivered {
+		return
+	}
+
+	// A rejection by the chain applies to every recipient and ends the
+	// transaction, so that the next one starts with an empty envelope.
+	// Handlers that didn't reply at all still get the message rejected.
+	err := c.rejection
+	if err == nil {
+		err = Error{Code: 451, Message: "4.3.0 Message was not delivered."}
+	}
+	if !c.Server.LMTP {
+		recipients = 1
+	}
+	for i := 0; i < recipients; i++ {
+		c.Error(err)
+	}
+	c.reset()
+}
+
 func (c *Connection) handleRSET(cmd *command) {
 	c.reset()
 	c.reply(250, "Go ahead.")
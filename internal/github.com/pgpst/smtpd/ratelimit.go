@@ -0,0 +1,220 @@
+package smtpd
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// RateLimit is the limit of a single client address and of its whole
+// network, /24 for IPv4 and /64 for IPv6. Zero disables a limit.
+type RateLimit struct {
+	IP      int
+	Network int
+}
+
+// RateLimits restrict how much the clients can use the server.
+type RateLimits struct {
+	Connections RateLimit // concurrent connections
+	Messages    RateLimit // messages per minute
+	Recipients  RateLimit // recipients per hour
+}
+
+// RateStore keeps the token buckets of the rate limits.
+type RateStore interface {
+	// Take removes n tokens from the bucket of the key. Buckets hold up to
+	// capacity tokens and refill completely over the period. It returns
+	// false if the bucket doesn't have enough tokens. Negative n returns
+	// the tokens to the bucket.
+	Take(key string, n int, capacity int, period time.Duration) (bool, error)
+}
+
+var (
+	errTooManyConnections = Error{Code: 421, Message: "4.7.0 Too many connections from your network. Try again later."}
+	errTooManyMessages    = Error{Code: 451, Message: "4.7.1 Too many messages from your network. Try again later."}
+	errTooManyRecipients  = Error{Code: 451, Message: "4.7.1 Too many recipients from your network. Try again later."}
+)
+
+// rateKeys returns the keys of the client's address and network.
+func rateKeys(addr net.Addr) (string, string) {
+	var ip net.IP
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		ip = tcp.IP
+	} else if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		ip = net.ParseIP(host)
+	}
+	if ip == nil {
+		return "", ""
+	}
+
+	var network net.IP
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		network = ip4.Mask(net.CIDRMask(24, 32))
+	} else {
+		network = ip.Mask(net.CIDRMask(64, 128))
+	}
+
+	return ip.String(), network.String()
+}
+
+// take checks the limit using the buckets of the client. Failures of the
+// store don't reject anyone. Tokens are only spent if every bucket has them,
+// the ones taken before a full bucket are returned.
+func (s *Server) take(addr net.Addr, kind string, limit RateLimit, n int, period time.Duration) bool {
+	ip, network := rateKeys(addr)
+	if ip == "" {
+		return true
+	}
+
+	buckets := []struct {
+		key      string
+		capacity int
+	}{
+		{kind + ":ip:" + ip, limit.IP},
+		{kind + ":net:" + network, limit.Network},
+	}
+	for i, bucket := range buckets {
+		if bucket.capacity <= 0 {
+			continue
+		}
+
+		ok, err := s.RateStore.Take(bucket.key, n, bucket.capacity, period)
+		if err != nil {
+			log.Print(err)
+			buckets[i].capacity = 0
+			continue
+		}
+		if !ok {
+			for _, taken := range buckets[:i] {
+				if taken.capacity <= 0 {
+					continue
+				}
+				if _, err := s.RateStore.Take(taken.key, -n, taken.capacity, period); err != nil {
+					log.Print(err)
+				}
+			}
+			return false
+		}
+	}
+
+	return true
+}
+
+// connectionCounter tracks the concurrent connections of the clients.
+type connectionCounter struct {
+	sync.Mutex
+	counts map[string]int
+}
+
+func (c *connectionCounter) acquire(addr net.Addr, limit RateLimit) bool {
+	ip, network := rateKeys(addr)
+	if ip == "" || (limit.IP <= 0 && limit.Network <= 0) {
+		return true
+	}
+	ip, network = "ip:"+ip, "net:"+network
+
+	c.Lock()
+	defer c.Unlock()
+
+	if (limit.IP > 0 && c.counts[ip] >= limit.IP) ||
+		(limit.Network > 0 && c.counts[network] >= limit.Network) {
+		return false
+	}
+
+	c.counts[ip]++
+	c.counts[network]++
+	return true
+}
+
+func (c *connectionCounter) release(addr net.Addr, limit RateLimit) {
+	ip, network := rateKeys(addr)
+	if ip == "" || (limit.IP <= 0 && limit.Network <= 0) {
+		return
+	}
+	ip, network = "ip:"+ip, "net:"+network
+
+	c.Lock()
+	defer c.Unlock()
+
+	for _, key := range []string{ip, network} {
+		if c.counts[key]--; c.counts[key] <= 0 {
+			delete(c.counts, key)
+		}
+	}
+}
+
+type bucket struct {
+	tokens   float64
+	updated  time.Time
+	capacity int
+	period   time.Duration
+}
+
+// level returns the amount of tokens in the bucket at the time.
+func (b *bucket) level(now time.Time) float64 {
+	tokens := b.tokens + now.Sub(b.updated).Seconds()*float64(b.capacity)/b.period.Seconds()
+	if tokens > float64(b.capacity) {
+		tokens = float64(b.capacity)
+	}
+	return tokens
+}
+
+// MemoryRateStore keeps the buckets in the memory of a single server.
+type MemoryRateStore struct {
+	sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+	now     func() time.Time
+}
+
+// NewMemoryRateStore creates an empty in-memory store.
+func NewMemoryRateStore() *MemoryRateStore {
+	return &MemoryRateStore{
+		buckets: map[string]*bucket{},
+		swept:   time.Now(),
+		now:     time.Now,
+	}
+}
+
+// Take implements RateStore.
+func (m *MemoryRateStore) Take(key string, n int, capacity int, period time.Duration) (bool, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	now := m.now()
+
+	// Full buckets are the same as the missing ones
+	if now.Sub(m.swept) > time.Minute {
+		for key, b := range m.buckets {
+			if b.level(now) >= float64(b.capacity) {
+				delete(m.buckets, key)
+			}
+		}
+		m.swept = now
+	}
+
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &bucket{
+			tokens: float64(capacity),
+		}
+		m.buckets[key] = b
+	} else {
+		b.tokens = b.level(now)
+	}
+	b.updated = now
+	b.capacity = capacity
+	b.period = period
+
+	if b.tokens < float64(n) {
+		return false, nil
+	}
+
+	b.tokens -= float64(n)
+	if b.tokens > float64(capacity) {
+		b.tokens = float64(capacity)
+	}
+	return true, nil
+}
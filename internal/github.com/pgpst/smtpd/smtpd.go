@@ -22,6 +22,11 @@ type Server struct {
 	MaxMessageSize int
 	MaxRecipients  int
 
+	// RateLimits restrict the clients by their addresses and networks,
+	// keeping the state in RateStore, in memory by default.
+	RateLimits RateLimits
+	RateStore  RateStore
+
 	WrapperChain   []Wrapper
 	SenderChain    []Sender
 	RecipientChain []Recipient
@@ -30,7 +35,17 @@ type Server struct {
 	TLSConfig *tls.Config
 	ForceTLS  bool
 
-	extensions []string
+	// LMTP switches the server to LMTP (RFC 2033), which greets with LHLO
+	// and replies to the message data once for every recipient.
+	LMTP bool
+
+	// Authenticator enables the AUTH extension after STARTTLS. With
+	// AuthRequired, MAIL is only accepted from authenticated clients.
+	Authenticator Authenticator
+	AuthRequired  bool
+
+	extensions  []string
+	connections *connectionCounter
 }
 
 func (s *Server) configureDefaults() error {
@@ -39,7 +54,11 @@ func (s *Server) configureDefaults() error {
 	}
 
 	if s.WelcomeMessage == "" {
-		s.WelcomeMessage = fmt.Sprintf("%s ESMTP ready.", s.Hostname)
+		if s.LMTP {
+			s.WelcomeMessage = fmt.Sprintf("%s LMTP ready.", s.Hostname)
+		} else {
+			s.WelcomeMessage = fmt.Sprintf("%s ESMTP ready.", s.Hostname)
+		}
 	}
 
 	if s.ReadTimeout == 0 {
@@ -82,14 +101,30 @@ func (s *Server) configureDefaults() error {
 		s.DeliveryChain = []Delivery{}
 	}
 
+	if s.RateStore == nil {
+		s.RateStore = NewMemoryRateStore()
+	}
+
+	if s.connections == nil {
+		s.connections = &connectionCounter{
+			counts: map[string]int{},
+		}
+	}
+
 	if s.ForceTLS && s.TLSConfig == nil {
 		return errors.New("Cannot use ForceTLS with no TLSConfig")
 	}
 
+	if s.AuthRequired && (s.Authenticator == nil || s.TLSConfig == nil) {
+		return errors.New("Cannot use AuthRequired with no Authenticator or TLSConfig")
+	}
+
 	s.extensions = []string{
 		"SIZE " + strconv.Itoa(s.MaxMessageSize),
 		"8BITMIME",
+		"CHUNKING",
 		"PIPELINING",
+		"SMTPUTF8",
 	}
 
 	return nil
@@ -132,35 +167,42 @@ func (s *Server) Serve(l net.Listener) error {
 		// Prepare new bufio interfaces
 		reader := bufio.NewReader(conn)
 		writer := bufio.NewWriter(conn)
-		scanner := bufio.NewScanner(reader)
 
 		// Prepare a new Connection
 		sc := &Connection{
-			Server:  s,
-			Addr:    conn.RemoteAddr(),
-			conn:    conn,
-			reader:  reader,
-			writer:  writer,
-			scanner: scanner,
+			Server: s,
+			Addr:   conn.RemoteAddr(),
+			conn:   conn,
+			reader: reader,
+			writer: writer,
 		}
 
-		// If there's no limiter, just serve
-		if limiter == nil {
-			go sc.serve()
-		} else {
-			go func() {
-				// Try to push into buffered limiter
-				select {
-				case limiter <- struct{}{}:
-					// Serve
-					sc.serve()
-					// Unlock the connection
-					<-limiter
-				default:
-					// Reject the connection
-					sc.reject()
-				}
-			}()
-		}
+		go func() {
+			// Limit the connections of a single client
+			if !s.connections.acquire(sc.Addr, s.RateLimits.Connections) {
+				sc.Error(errTooManyConnections)
+				sc.close()
+				return
+			}
+			defer s.connections.release(sc.Addr, s.RateLimits.Connections)
+
+			// If there's no limiter, just serve
+			if limiter == nil {
+				sc.serve()
+				return
+			}
+
+			// Try to push into buffered limiter
+			select {
+			case limiter <- struct{}{}:
+				// Serve
+				sc.serve()
+				// Unlock the connection
+				<-limiter
+			default:
+				// Reject the connection
+				sc.reject()
+			}
+		}()
 	}
 }
@@ -38,6 +38,7 @@ var (
 	ErrTempAuthFailure      = Error{Code: StatusTempAuthFailure, Message: StatusString(StatusTempAuthFailure)}
 	ErrAuthInvalid          = Error{Code: StatusAuthInvalid, Message: StatusString(StatusAuthInvalid)}
 	ErrAuthRequired         = Error{Code: StatusAuthRequired, Message: StatusString(StatusAuthRequired)}
+	ErrEncryptionRequired   = Error{Code: StatusEncryptionRequired, Message: StatusString(StatusEncryptionRequired)}
 	ErrServerError          = Error{Code: StatusServerError, Message: StatusString(StatusServerError)}
 	ErrExceedStorage        = Error{Code: StatusExceedStorage, Message: StatusString(StatusExceedStorage)}
 )
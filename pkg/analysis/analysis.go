@@ -0,0 +1,345 @@
+// Package analysis describes the MIME structure of the emails. The trees are
+// stored in the encrypted manifests, so that the clients can list the parts
+// and attachments without decrypting the whole body.
+package analysis
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+
+	"github.com/pgpst/pgpst/pkg/models"
+)
+
+// MaxDepth is how deep the parts are nested before they're described as
+// leaves, so that crafted emails can't exhaust the stack.
+const MaxDepth = 32
+
+// Analyze fills the node with the description of the MIME entity in the
+// input and its parts. Positions are offset by n.BasePosition.
+func Analyze(n *models.EmailNode, input []byte) error {
+	return analyze(n, input, "text/plain", 0)
+}
+
+func analyze(n *models.EmailNode, input []byte, defaultType string, depth int) error {
+	// The header ends with the first empty line
+	headerEnd, bodyStart := splitHeader(input)
+
+	tp := textproto.NewReader(bufio.NewReader(bytes.NewReader(input[:bodyStart])))
+	headers, err := tp.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return err
+	}
+	n.Headers = mail.Header(headers)
+
+	n.HeaderPosition = [2]int{n.BasePosition, n.BasePosition + headerEnd}
+	n.BodyPosition = [2]int{n.BasePosition + headerEnd, n.BasePosition + len(input)}
+
+	// Invalid content types are treated as the default one (RFC 2045)
+	media, params, err := mime.ParseMediaType(headers.Get("Content-Type"))
+	if err != nil && (err != mime.ErrInvalidMediaParameter || media == "") {
+		media = defaultType
+	}
+	if params == nil {
+		params = map[string]string{}
+	}
+	n.ContentType = media
+	n.Charset = strings.ToLower(params["charset"])
+
+	n.TransferEncoding = strings.ToLower(strings.TrimSpace(headers.Get("Content-Transfer-Encoding")))
+	if n.TransferEncoding == "" {
+		n.TransferEncoding = "7bit"
+	}
+
+	disposition, dparams, _ := mime.ParseMediaType(headers.Get("Content-Disposition"))
+	n.Disposition = disposition
+	if name := dparams["filename"]; name != "" {
+		n.Filename = filename(name)
+	} else if name := params["name"]; name != "" {
+		n.Filename = filename(name)
+	}
+
+	body := input[bodyStart:]
+	base := n.BasePosition + bodyStart
+
+	// Multipart bodies are split into the parts
+	if strings.HasPrefix(media, "multipart/") && params["boundary"] != "" && depth < MaxDepth {
+		childType := "text/plain"
+		if media == "multipart/digest" {
+			childType = "message/rfc822"
+		}
+
+		n.Children = []*models.EmailNode{}
+		for _, part := range splitParts(body, params["boundary"]) {
+			child := &models.EmailNode{
+				BasePosition: base + part[0],
+			}
+			if err := analyze(child, body[part[0]:part[1]], childType, depth+1); err != nil {
+				return err
+			}
+			n.Children = append(n.Children, child)
+		}
+
+		return nil
+	}
+
+	// Attached emails are described too, unless they're encoded
+	if media == "message/rfc822" && isIdentity(n.TransferEncoding) && depth < MaxDepth {
+		child := &models.EmailNode{
+			BasePosition: base,
+		}
+		if err := analyze(child, body, "text/plain", depth+1); err != nil {
+			return err
+		}
+		n.Children = []*models.EmailNode{child}
+	}
+
+	content := decode(body, n.TransferEncoding)
+	hash := sha256.Sum256(content)
+	n.Size = len(content)
+	n.Hash = hex.EncodeToString(hash[:])
+
+	return nil
+}
+
+// Files returns the hashes of the attachments in the tree.
+func Files(n *models.EmailNode) []string {
+	files := []string{}
+	seen := map[string]struct{}{}
+
+	var walk func(n *models.EmailNode)
+	walk = func(n *models.EmailNode) {
+		if n.Hash != "" && (n.Filename != "" || n.Disposition == "attachment") {
+			if _, ok := seen[n.Hash]; !ok {
+				seen[n.Hash] = struct{}{}
+				files = append(files, n.Hash)
+			}
+		}
+		for _, child := range n.Children {
+			walk(child)
+		}
+	}
+	walk(n)
+
+	return files
+}
+
+// IsEncrypted checks whether any part of the email is encrypted.
+func IsEncrypted(n *models.EmailNode) bool {
+	if n.ContentType == "multipart/encrypted" || n.ContentType == "application/pgp-encrypted" {
+		return true
+	}
+
+	if strings.HasPrefix(n.ContentType, "multipart/") {
+		for _, child := range n.Children {
+			if IsEncrypted(child) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// ObscuredSubject replaces the outer subject of the encrypted emails with
+// protected headers.
+const ObscuredSubject = "..."
+
+// ProtectedFields are the header fields copied into the cryptographic
+// payload of an email with protected headers (Memory Hole).
+var ProtectedFields = []string{
+	"Subject",
+	"From",
+	"To",
+	"Cc",
+	"Reply-To",
+	"Date",
+	"Message-Id",
+	"References",
+	"In-Reply-To",
+}
+
+// ProtectedHeaders returns the protected header fields of the email, found in
+// the part marked with the protected-headers parameter. Signed emails carry
+// them in the signed part, encrypted ones can only be read by the clients.
+func ProtectedHeaders(n *models.EmailNode) mail.Header {
+	part := n
+	if n.ContentType == "multipart/signed" && len(n.Children) > 0 {
+		part = n.Children[0]
+	}
+
+	_, params, err := mime.ParseMediaType(part.Headers.Get("Content-Type"))
+	if err != nil || params["protected-headers"] == "" {
+		return nil
+	}
+
+	headers := mail.Header{}
+	for _, field := range ProtectedFields {
+		if values, ok := part.Headers[field]; ok {
+			headers[field] = values
+		}
+	}
+	if len(headers) == 0 {
+		return nil
+	}
+
+	return headers
+}
+
+// Headers returns the header of the email, with the protected fields
+// replacing the outer ones.
+func Headers(n *models.EmailNode) mail.Header {
+	protected := ProtectedHeaders(n)
+	if protected == nil {
+		return n.Headers
+	}
+
+	headers := mail.Header{}
+	for key, values := range n.Headers {
+		headers[key] = values
+	}
+	for key, values := range protected {
+		headers[key] = values
+	}
+
+	return headers
+}
+
+// splitHeader returns where the empty line after the header starts and ends.
+// Inputs without it are all header.
+func splitHeader(input []byte) (int, int) {
+	for i := 0; i < len(input); {
+		end := bytes.IndexByte(input[i:], '\n')
+		if end == -1 {
+			break
+		}
+
+		if len(bytes.TrimRight(input[i:i+end+1], "\r\n")) == 0 {
+			return i, i + end + 1
+		}
+		i += end + 1
+	}
+
+	return len(input), len(input)
+}
+
+// splitParts returns the positions of the parts of a multipart body. The
+// preamble and the epilogue are skipped, the newline before a delimiter
+// belongs to the delimiter. Bodies without the close delimiter end at EOF.
+func splitParts(body []byte, boundary string) [][2]int {
+	var (
+		parts = [][2]int{}
+		dash  = []byte("--" + boundary)
+		start = -1
+	)
+
+	for i := 0; i < len(body); {
+		next := len(body)
+		if end := bytes.IndexByte(body[i:], '\n'); end != -1 {
+			next = i + end + 1
+		}
+
+		if closing, ok := delimiter(body[i:next], dash); ok {
+			if start != -1 {
+				parts = append(parts, [2]int{start, trimNewline(body, start, i)})
+			}
+			if closing {
+				return parts
+			}
+			start = next
+		}
+
+		i = next
+	}
+
+	if start != -1 && start < len(body) {
+		parts = append(parts, [2]int{start, len(body)})
+	}
+
+	return parts
+}
+
+// delimiter checks whether the line is a delimiter of the boundary, which
+// may be followed by whitespace.
+func delimiter(line []byte, dash []byte) (bool, bool) {
+	if !bytes.HasPrefix(line, dash) {
+		return false, false
+	}
+
+	rest := line[len(dash):]
+	closing := bytes.HasPrefix(rest, []byte("--"))
+	if closing {
+		rest = rest[2:]
+	}
+	if len(bytes.TrimRight(rest, " \t\r\n")) != 0 {
+		return false, false
+	}
+
+	return closing, true
+}
+
+// trimNewline moves the end of a part before the newline of the delimiter.
+func trimNewline(body []byte, start int, end int) int {
+	if end > start && body[end-1] == '\n' {
+		end--
+		if end > start && body[end-1] == '\r' {
+			end--
+		}
+	}
+
+	return end
+}
+
+// filename decodes the encoded words of the name and strips its directories.
+func filename(name string) string {
+	if decoded, err := new(mime.WordDecoder).DecodeHeader(name); err == nil {
+		name = decoded
+	}
+
+	if i := strings.LastIndexAny(name, `/\`); i != -1 {
+		name = name[i+1:]
+	}
+
+	return strings.TrimSpace(name)
+}
+
+func isIdentity(encoding string) bool {
+	return encoding == "7bit" || encoding == "8bit" || encoding == "binary"
+}
+
+// decode undoes the transfer encoding of the content. Broken encodings are
+// decoded as far as possible.
+func decode(content []byte, encoding string) []byte {
+	switch encoding {
+	case "base64":
+		// Drop the line breaks, padding and any garbage
+		clean := make([]byte, 0, len(content))
+		for _, char := range content {
+			if (char >= 'A' && char <= 'Z') || (char >= 'a' && char <= 'z') ||
+				(char >= '0' && char <= '9') || char == '+' || char == '/' {
+				clean = append(clean, char)
+			}
+		}
+		if len(clean)%4 == 1 {
+			clean = clean[:len(clean)-1]
+		}
+
+		decoded := make([]byte, base64.RawStdEncoding.DecodedLen(len(clean)))
+		n, _ := base64.RawStdEncoding.Decode(decoded, clean)
+		return decoded[:n]
+	case "quoted-printable":
+		decoded, _ := ioutil.ReadAll(quotedprintable.NewReader(bytes.NewReader(content)))
+		return decoded
+	}
+
+	return content
+}
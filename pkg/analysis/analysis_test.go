@@ -0,0 +1,209 @@
+package analysis_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/pgpst/pgpst/internal/github.com/smartystreets/goconvey/convey"
+
+	"github.com/pgpst/pgpst/pkg/analysis"
+	"github.com/pgpst/pgpst/pkg/models"
+)
+
+func analyze(name string) ([]byte, *models.EmailNode) {
+	input, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	So(err, ShouldBeNil)
+
+	node := &models.EmailNode{}
+	So(analysis.Analyze(node, input), ShouldBeNil)
+
+	return input, node
+}
+
+func body(input []byte, node *models.EmailNode) string {
+	return string(input[node.BodyPosition[0]:node.BodyPosition[1]])
+}
+
+func hash(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestAnalyze(t *testing.T) {
+	Convey("An email without a content type should be plain text", t, func() {
+		input, node := analyze("plain.eml")
+
+		So(node.ContentType, ShouldEqual, "text/plain")
+		So(node.TransferEncoding, ShouldEqual, "7bit")
+		So(node.Headers.Get("Subject"), ShouldEqual, "Plain text")
+		So(node.Children, ShouldBeEmpty)
+		So(string(input[node.HeaderPosition[1]:node.HeaderPosition[1]+2]), ShouldEqual, "\r\n")
+
+		content := "Hello Bob,\r\nno Content-Type here, so this is text/plain.\r\n"
+		So(node.Size, ShouldEqual, len(content))
+		So(node.Hash, ShouldEqual, hash(content))
+		So(analysis.Files(node), ShouldBeEmpty)
+	})
+
+	Convey("The preamble and the epilogue should be skipped", t, func() {
+		input, node := analyze("preamble.eml")
+
+		So(node.ContentType, ShouldEqual, "multipart/mixed")
+		So(len(node.Children), ShouldEqual, 2)
+
+		text := node.Children[0]
+		So(text.ContentType, ShouldEqual, "text/plain")
+		So(text.Charset, ShouldEqual, "utf-8")
+		So(body(input, text), ShouldEqual, "\r\nSee the attached document.")
+
+		pdf := node.Children[1]
+		So(pdf.ContentType, ShouldEqual, "application/pdf")
+		So(pdf.TransferEncoding, ShouldEqual, "base64")
+		So(pdf.Disposition, ShouldEqual, "attachment")
+		So(pdf.Filename, ShouldEqual, "report.pdf")
+		So(pdf.Size, ShouldEqual, 4*len("%PDF-1.4 fake document\n"))
+		So(string(input[pdf.BasePosition:pdf.BasePosition+13]), ShouldEqual, "Content-Type:")
+
+		So(analysis.Files(node), ShouldResemble, []string{pdf.Hash})
+	})
+
+	Convey("Nested boundaries with trailing whitespace should be split", t, func() {
+		input, node := analyze("nested.eml")
+
+		So(len(node.Children), ShouldEqual, 2)
+
+		alternative := node.Children[0]
+		So(alternative.ContentType, ShouldEqual, "multipart/alternative")
+		So(len(alternative.Children), ShouldEqual, 2)
+
+		plain := alternative.Children[0]
+		So(plain.Charset, ShouldEqual, "iso-8859-1")
+		So(plain.TransferEncoding, ShouldEqual, "quoted-printable")
+		So(plain.Size, ShouldEqual, len("Caf\xe9 au lait"))
+		So(plain.Hash, ShouldEqual, hash("Caf\xe9 au lait"))
+		So(body(input, plain), ShouldEqual, "\nCaf=E9 au lait")
+
+		html := alternative.Children[1]
+		So(html.ContentType, ShouldEqual, "text/html")
+		So(html.Hash, ShouldEqual, hash("<p>Caf\xe9 au lait</p>"))
+
+		logo := node.Children[1]
+		So(logo.ContentType, ShouldEqual, "image/png")
+		So(logo.Disposition, ShouldEqual, "inline")
+		So(logo.Filename, ShouldEqual, "logo.png")
+		So(logo.Size, ShouldEqual, 8)
+	})
+
+	Convey("A close delimiter at EOF should end the last part", t, func() {
+		input, node := analyze("eof.eml")
+
+		So(len(node.Children), ShouldEqual, 2)
+		So(body(input, node.Children[0]), ShouldEqual, "\r\nFirst part")
+
+		second := node.Children[1]
+		So(second.ContentType, ShouldEqual, "text/plain")
+		So(second.Headers, ShouldBeEmpty)
+		So(second.Hash, ShouldEqual, hash("Second part without a header"))
+	})
+
+	Convey("A missing close delimiter should end the last part at EOF", t, func() {
+		_, node := analyze("unclosed.eml")
+
+		So(len(node.Children), ShouldEqual, 1)
+		So(node.Children[0].Hash, ShouldEqual, hash("Only part, cut off"))
+	})
+
+	Convey("Encoded filenames and invalid parameters should be handled", t, func() {
+		_, node := analyze("encoded.eml")
+
+		So(len(node.Children), ShouldEqual, 4)
+
+		text := node.Children[0]
+		So(text.Size, ShouldEqual, len("Zażółć gęślą jaźń"))
+		So(text.Hash, ShouldEqual, hash("Zażółć gęślą jaźń"))
+
+		So(node.Children[1].Filename, ShouldEqual, "żółw.txt")
+		So(node.Children[1].Hash, ShouldEqual, hash("żółw"))
+		So(node.Children[2].Filename, ShouldEqual, "notatki.txt")
+		So(node.Children[2].TransferEncoding, ShouldEqual, "8bit")
+
+		html := node.Children[3]
+		So(html.ContentType, ShouldEqual, "text/html")
+		So(html.Charset, ShouldBeEmpty)
+		So(html.TransferEncoding, ShouldEqual, "base64")
+		So(html.Hash, ShouldEqual, hash("<b>bold</b>"))
+
+		So(analysis.Files(node), ShouldResemble, []string{
+			node.Children[1].Hash,
+			node.Children[2].Hash,
+		})
+	})
+
+	Convey("Attached and digested emails should be described", t, func() {
+		_, node := analyze("forwarded.eml")
+
+		So(node.ContentType, ShouldEqual, "multipart/digest")
+		So(len(node.Children), ShouldEqual, 2)
+
+		first := node.Children[0]
+		So(first.ContentType, ShouldEqual, "message/rfc822")
+		So(len(first.Children), ShouldEqual, 1)
+		So(first.Children[0].Headers.Get("Subject"), ShouldEqual, "First")
+
+		second := node.Children[1].Children[0]
+		So(second.ContentType, ShouldEqual, "multipart/mixed")
+		So(len(second.Children), ShouldEqual, 1)
+		So(second.Children[0].Filename, ShouldEqual, "inner.txt")
+
+		So(analysis.Files(node), ShouldResemble, []string{second.Children[0].Hash})
+	})
+
+	Convey("Encrypted emails should be detected", t, func() {
+		node := &models.EmailNode{}
+		So(analysis.Analyze(node, []byte("Content-Type: multipart/mixed; boundary=x\r\n\r\n"+
+			"--x\r\nContent-Type: multipart/encrypted; boundary=y\r\n\r\n--y--\r\n--x--\r\n")), ShouldBeNil)
+		So(analysis.IsEncrypted(node), ShouldBeTrue)
+
+		_, node = analyze("nested.eml")
+		So(analysis.IsEncrypted(node), ShouldBeFalse)
+	})
+
+	Convey("Protected headers of signed emails should be extracted", t, func() {
+		_, node := analyze("protected.eml")
+
+		So(node.Headers.Get("Subject"), ShouldEqual, "...")
+
+		protected := analysis.ProtectedHeaders(node)
+		So(protected.Get("Subject"), ShouldEqual, "Quarterly numbers")
+		So(protected.Get("To"), ShouldEqual, "bob@example.net, Carol <carol@example.net>")
+		So(protected.Get("Content-Type"), ShouldBeEmpty)
+
+		headers := analysis.Headers(node)
+		So(headers.Get("Subject"), ShouldEqual, "Quarterly numbers")
+		So(headers.Get("Mime-Version"), ShouldEqual, "1.0")
+		So(node.Headers.Get("Subject"), ShouldEqual, "...")
+
+		_, node = analyze("nested.eml")
+		So(analysis.ProtectedHeaders(node), ShouldBeNil)
+		So(analysis.Headers(node), ShouldResemble, node.Headers)
+	})
+	Convey("Parts nested too deeply should be described as leaves", t, func() {
+		input := strings.Repeat("Content-Type: message/rfc822\r\n\r\n", 1000) + "Hello\r\n"
+
+		node := &models.EmailNode{}
+		So(analysis.Analyze(node, []byte(input)), ShouldBeNil)
+
+		depth := 0
+		for len(node.Children) > 0 {
+			node = node.Children[0]
+			depth++
+		}
+		So(depth, ShouldEqual, analysis.MaxDepth)
+		So(node.ContentType, ShouldEqual, "message/rfc822")
+		So(node.Size, ShouldBeGreaterThan, 0)
+	})
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/pgpst/pgpst/internal/github.com/gin-gonic/gin"
 
 	"github.com/pgpst/pgpst/pkg/utils"
+	"github.com/pgpst/pgpst/pkg/wkd"
 )
 
 func init() {
@@ -21,6 +22,7 @@ type API struct {
 	Rethink  *r.Session
 	Producer *nsq.Producer
 	Raven    *raven.Client
+	Resolver utils.Resolver
 }
 
 func NewAPI(options *Options) *API {
@@ -55,6 +57,11 @@ func NewAPI(options *Options) *API {
 		}
 	}
 
+	// Peers are stored under IDs shared with the mailer
+	if options.PeerSecret == "" {
+		log.Warn("No peer secret set, Autocrypt peers won't be available")
+	}
+
 	// Return a new API struct
 	return &API{
 		Options:  options,
@@ -62,6 +69,7 @@ func NewAPI(options *Options) *API {
 		Rethink:  session,
 		Producer: producer,
 		Raven:    rc,
+		Resolver: utils.NetResolver{},
 	}
 }
 
@@ -77,6 +85,13 @@ func (a *API) Main() {
 	// Hello route
 	router.GET("/", a.hello)
 
+	// Web Key Directory, in both the direct and the advanced layout
+	router.GET(wkd.Prefix+"*path", a.readWKD)
+
+	// HKP keyserver, for the clients that can't use the JSON API
+	router.GET("/pks/lookup", a.hkpLookup)
+	router.POST("/pks/add", a.hkpAdd)
+
 	v1 := router.Group("/v1")
 	{
 		// Public routes
@@ -93,12 +108,26 @@ func (a *API) Main() {
 			v1a.PUT("/accounts/:id", a.updateAccount)
 			//v1a.DELETE("/accounts/:id", a.deleteAccount)
 			v1a.GET("/accounts/:id/addresses", a.getAccountAddresses)
+			v1a.GET("/accounts/:id/domains", a.getAccountDomains)
 			//v1a.GET("/accounts/:id/emails")
 			v1a.GET("/accounts/:id/keys", a.getAccountKeys)
 			v1a.GET("/accounts/:id/labels", a.getAccountLabels)
+			v1a.GET("/accounts/:id/peers", a.getAccountPeers)
+			v1a.GET("/accounts/:id/peers/:address", a.readAccountPeer)
+			v1a.PUT("/accounts/:id/peers/:address", a.updateAccountPeer)
 			v1a.GET("/accounts/:id/resources", a.getAccountResources)
+			v1a.GET("/accounts/:id/rules", a.getAccountRules)
+			v1a.PUT("/accounts/:id/rules", a.updateAccountRules)
 			//v1a.GET("/accounts/:id/threads")
 			v1a.GET("/accounts/:id/tokens", a.getAccountTokens)
+			v1a.GET("/accounts/:id/vacation", a.getAccountVacation)
+			v1a.PUT("/accounts/:id/vacation", a.updateAccountVacation)
+
+			// Domains
+			v1a.POST("/domains", a.createDomain)
+			v1a.GET("/domains/:id", a.readDomain)
+			v1a.PUT("/domains/:id", a.updateDomain)
+			v1a.POST("/domains/:id/verify", a.verifyDomain)
 
 			// Addresses
 			//v1a.POST("/addresses", a.createAddress)
@@ -106,6 +135,12 @@ func (a *API) Main() {
 			//v1a.GET("/addresses/:id", a.readAddress)
 			//v1a.PUT("/addresses/:id", a.updateAddress)
 			//v1a.DELETE("/addresses/:id", a.deleteAddress)
+			v1a.GET("/addresses/:id/members", a.getAddressMembers)
+			v1a.POST("/addresses/:id/members", a.addAddressMember)
+			v1a.PUT("/addresses/:id/members/:account", a.acceptAddressMember)
+			v1a.DELETE("/addresses/:id/members/:account", a.removeAddressMember)
+			v1a.PUT("/addresses/:id/forwarding", a.updateAddressForwarding)
+			v1a.PUT("/addresses/:id/keys", a.updateAddressKeys)
 
 			// Emails
 			//v1a.POST("/emails", a.createEmail)
@@ -132,7 +167,7 @@ func (a *API) Main() {
 			//v1a.GET("/resources", a.listResources)
 			v1a.GET("/resources/:id", a.readResource)
 			//v1a.PUT("/resources/:id", a.updateResource)
-			//v1a.DELETE("/resources/:id", a.deleteResource)
+			v1a.DELETE("/resources/:id", a.deleteResource)
 
 			// Threads
 			//v1a.GET("/threads", a.listThreads)
@@ -17,3 +17,8 @@ const (
 	CodeOAuthInvalidAddress
 	CodeOAuthInvalidPassword
 )
+
+const (
+	CodeQuotaUnknown = 3000 + iota
+	CodeQuotaStorageExceeded
+)
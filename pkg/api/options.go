@@ -1,6 +1,8 @@
 package api
 
 import (
+	"strings"
+
 	"github.com/pgpst/pgpst/internal/github.com/Sirupsen/logrus"
 	"github.com/pgpst/pgpst/internal/github.com/namsral/flag"
 )
@@ -9,6 +11,7 @@ type Options struct {
 	LogLevel logrus.Level
 
 	DefaultDomain string
+	MXHosts       []string
 	HTTPAddress   string
 
 	RethinkDBAddress  string
@@ -21,6 +24,8 @@ type Options struct {
 
 	YubiCloudID  string
 	YubiCloudKey string
+
+	PeerSecret string
 }
 
 var llMapping = map[string]logrus.Level{
@@ -42,6 +47,7 @@ func NewOptions(fs *flag.FlagSet) *Options {
 		LogLevel: ll,
 
 		DefaultDomain: fs.Lookup("default_domain").Value.String(),
+		MXHosts:       strings.Split(fs.Lookup("mx_hosts").Value.String(), ","),
 		HTTPAddress:   fs.Lookup("http_address").Value.String(),
 
 		RethinkDBAddress:  fs.Lookup("rethinkdb_address").Value.String(),
@@ -54,5 +60,7 @@ func NewOptions(fs *flag.FlagSet) *Options {
 
 		YubiCloudID:  fs.Lookup("yubicloud_id").Value.String(),
 		YubiCloudKey: fs.Lookup("yubicloud_key").Value.String(),
+
+		PeerSecret: fs.Lookup("peer_secret").Value.String(),
 	}
 }
@@ -8,8 +8,11 @@ import (
 	"github.com/pgpst/pgpst/internal/github.com/dchest/uniuri"
 	"github.com/pgpst/pgpst/internal/github.com/gin-gonic/gin"
 
+	"github.com/pgpst/pgpst/pkg/autocrypt"
 	"github.com/pgpst/pgpst/pkg/models"
+	"github.com/pgpst/pgpst/pkg/quota"
 	"github.com/pgpst/pgpst/pkg/utils"
+	"github.com/pgpst/pgpst/pkg/wkd"
 )
 
 func (a *API) createAccount(c *gin.Context) {
@@ -63,8 +66,26 @@ func (a *API) createAccount(c *gin.Context) {
 			return
 		}
 
+		// Addresses can only be created on verified domains
+		domain, err := a.getDomain(a.Options.DefaultDomain)
+		if err != nil {
+			c.JSON(500, &gin.H{
+				"code":    0,
+				"message": err.Error(),
+			})
+			return
+		}
+		if !domain.IsVerified() {
+			c.JSON(422, &gin.H{
+				"code":    0,
+				"message": "Validation failed.",
+				"errors":  []string{"Registrations are disabled."},
+			})
+			return
+		}
+
 		// Check in the database whether you can register such account
-		cursor, err := r.Table("addresses").Get(nu + "@pgp.st").Ne(nil).Do(func(left r.Term) map[string]interface{} {
+		cursor, err := r.Table("addresses").Get(nu + "@" + domain.ID).Ne(nil).Do(func(left r.Term) map[string]interface{} {
 			return map[string]interface{}{
 				"username":  left,
 				"alt_email": r.Table("accounts").GetAllByIndex("alt_email", input.AltEmail).Count().Eq(1),
@@ -107,10 +128,11 @@ func (a *API) createAccount(c *gin.Context) {
 
 		// Create an account and an address
 		address := &models.Address{
-			ID:          nu + "@pgp.st",
-			StyledID:    styledID + "@pgp.st",
+			ID:          nu + "@" + domain.ID,
+			StyledID:    styledID + "@" + domain.ID,
 			DateCreated: time.Now(),
 			Owner:       "", // we set it later
+			WKDHashes:   wkd.AddressHashes(nu+"@"+domain.ID, styledID+"@"+domain.ID),
 		}
 		account := &models.Account{
 			ID:           uniuri.NewLen(uniuri.UUIDLen),
@@ -355,15 +377,29 @@ func (a *API) readAccount(c *gin.Context) {
 			return
 		}
 
+		// Get the plan and its usage
+		plan, usage, err := quota.Lookup(a.Rethink, ownAccount)
+		if err != nil {
+			c.JSON(500, &gin.H{
+				"code":  0,
+				"error": err.Error(),
+			})
+			return
+		}
+
 		ownAccount.Password = nil
 
 		// Write the response
 		c.JSON(200, struct {
 			*models.Account
 			Addresses []*models.Address `json:"addresses"`
+			Plan      *models.Plan      `json:"plan"`
+			Usage     *models.Usage     `json:"usage"`
 		}{
 			Account:   ownAccount,
 			Addresses: addresses,
+			Plan:      plan,
+			Usage:     usage,
 		})
 		return
 	}
@@ -397,6 +433,8 @@ func (a *API) readAccount(c *gin.Context) {
 	var result struct {
 		models.Account
 		Addresses []*models.Address `json:"addresses"`
+		Plan      *models.Plan      `json:"plan" gorethink:"-"`
+		Usage     *models.Usage     `json:"usage" gorethink:"-"`
 	}
 	if err := cursor.One(&result); err != nil {
 		c.JSON(500, &gin.H{
@@ -414,6 +452,15 @@ func (a *API) readAccount(c *gin.Context) {
 		return
 	}
 
+	result.Plan, result.Usage, err = quota.Lookup(a.Rethink, &result.Account)
+	if err != nil {
+		c.JSON(500, &gin.H{
+			"code":  0,
+			"error": err.Error(),
+		})
+		return
+	}
+
 	c.JSON(200, result)
 }
 
@@ -426,9 +473,10 @@ func (a *API) updateAccount(c *gin.Context) {
 
 	// Decode the input
 	var input struct {
-		MainAddress string `json:"main_address"`
-		NewPassword []byte `json:"new_password"`
-		OldPassword []byte `json:"old_password"`
+		MainAddress            string `json:"main_address"`
+		NewPassword            []byte `json:"new_password"`
+		OldPassword            []byte `json:"old_password"`
+		AutocryptPreferEncrypt string `json:"autocrypt_prefer_encrypt"`
 	}
 	if err := c.Bind(&input); err != nil {
 		c.JSON(422, &gin.H{
@@ -559,7 +607,7 @@ func (a *API) updateAccount(c *gin.Context) {
 	}
 
 	// Apply change to the main address setting
-	if newAddress.ID != "" {
+	if newAddress != nil && newAddress.ID != "" {
 		// Check address ownership
 		if newAddress.Owner != account.ID {
 			c.JSON(422, &gin.H{
@@ -572,6 +620,19 @@ func (a *API) updateAccount(c *gin.Context) {
 		account.MainAddress = newAddress.ID
 	}
 
+	// Apply change to the Autocrypt preference
+	if input.AutocryptPreferEncrypt != "" {
+		if input.AutocryptPreferEncrypt != autocrypt.Mutual && input.AutocryptPreferEncrypt != autocrypt.NoPreference {
+			c.JSON(422, &gin.H{
+				"code":    0,
+				"message": "Invalid Autocrypt preference",
+			})
+			return
+		}
+
+		account.AutocryptPreferEncrypt = input.AutocryptPreferEncrypt
+	}
+
 	// Perform the update
 	if err := r.Table("accounts").Update(account).Exec(a.Rethink); err != nil {
 		c.JSON(500, &gin.H{
@@ -1,10 +1,16 @@
 package api
 
 import (
+	"strings"
+	"time"
+
+	"github.com/pgpst/pgpst/internal/github.com/asaskevich/govalidator"
 	r "github.com/pgpst/pgpst/internal/github.com/dancannon/gorethink"
 	"github.com/pgpst/pgpst/internal/github.com/gin-gonic/gin"
+	"github.com/pgpst/pgpst/internal/golang.org/x/crypto/openpgp"
 
 	"github.com/pgpst/pgpst/pkg/models"
+	"github.com/pgpst/pgpst/pkg/utils"
 )
 
 func (a *API) getAccountAddresses(c *gin.Context) {
@@ -39,8 +45,12 @@ func (a *API) getAccountAddresses(c *gin.Context) {
 		}
 	}
 
-	// Get addresses from database
-	cursor, err := r.Table("addresses").GetAllByIndex("owner", id).Run(a.Rethink)
+	// Get addresses from database, including the groups the account is in
+	cursor, err := r.Table("addresses").GetAllByIndex("owner", id).Union(
+		r.Table("addresses").GetAllByIndex("members", id).Filter(func(address r.Term) r.Term {
+			return address.Field("owner").Ne(id)
+		}),
+	).Run(a.Rethink)
 	if err != nil {
 		c.JSON(500, &gin.H{
 			"code":  0,
@@ -62,3 +72,522 @@ func (a *API) getAccountAddresses(c *gin.Context) {
 	c.JSON(200, addresses)
 	return
 }
+
+// getAddress fetches the address and checks whether the account can access
+// it, members of groups only if members is true. It writes the error response
+// and returns nil if the request can't continue.
+func (a *API) getAddress(c *gin.Context, scope string, members bool) *models.Address {
+	// Token and account from context
+	var (
+		ownAccount = c.MustGet("account").(*models.Account)
+		token      = c.MustGet("token").(*models.Token)
+	)
+
+	// Fetch the address from database
+	cursor, err := r.Table("addresses").Get(c.Param("id")).Default(map[string]interface{}{}).Run(a.Rethink)
+	if err != nil {
+		c.JSON(500, &gin.H{
+			"code":  0,
+			"error": err.Error(),
+		})
+		return nil
+	}
+	defer cursor.Close()
+	var address models.Address
+	if err := cursor.One(&address); err != nil {
+		c.JSON(500, &gin.H{
+			"code":  0,
+			"error": err.Error(),
+		})
+		return nil
+	}
+
+	// Check the scope, members can only see each other
+	isMember := false
+	for _, member := range address.Members {
+		if member == ownAccount.ID {
+			isMember = true
+		}
+	}
+	if address.ID != "" && (address.Owner == ownAccount.ID || (members && isMember)) {
+		if !models.InScope(token.Scope, []string{scope}) {
+			c.JSON(403, &gin.H{
+				"code":  0,
+				"error": "Your token has insufficient scope",
+			})
+			return nil
+		}
+	} else {
+		if !models.InScope(token.Scope, []string{"admin"}) {
+			c.JSON(403, &gin.H{
+				"code":  0,
+				"error": "Your token has insufficient scope",
+			})
+			return nil
+		}
+	}
+
+	if address.ID == "" {
+		c.JSON(404, &gin.H{
+			"code":  0,
+			"error": "Address not found",
+		})
+		return nil
+	}
+
+	return &address
+}
+
+// getGroup fetches the address and checks whether the account can read or
+// modify its members. It writes the error response and returns nil if the
+// request can't continue.
+func (a *API) getGroup(c *gin.Context, scope string, members bool) *models.Address {
+	address := a.getAddress(c, scope, members)
+	if address == nil {
+		return nil
+	}
+	if !address.IsGroup() {
+		c.JSON(422, &gin.H{
+			"code":    CodeGeneralInvalidAction,
+			"message": "Address is not a group",
+		})
+		return nil
+	}
+
+	return address
+}
+
+func (a *API) getAddressMembers(c *gin.Context) {
+	address := a.getGroup(c, "addresses:read", true)
+	if address == nil {
+		return
+	}
+
+	// Get the members' accounts from database
+	if len(address.Members) == 0 {
+		c.JSON(200, []interface{}{})
+		return
+	}
+	cursor, err := r.Table("accounts").GetAll(r.Args(address.Members)).Pluck("id", "main_address").Run(a.Rethink)
+	if err != nil {
+		c.JSON(500, &gin.H{
+			"code":  0,
+			"error": err.Error(),
+		})
+		return
+	}
+	defer cursor.Close()
+	var members []struct {
+		ID          string `json:"id" gorethink:"id"`
+		MainAddress string `json:"main_address" gorethink:"main_address"`
+	}
+	if err := cursor.All(&members); err != nil {
+		c.JSON(500, &gin.H{
+			"code":  0,
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Write the response
+	c.JSON(200, members)
+}
+
+// getMembership fetches the group that the account owns, is a member of or
+// is invited to. It writes the error response and returns nil if the request
+// can't continue.
+func (a *API) getMembership(c *gin.Context) *models.Address {
+	// Token and account from context
+	var (
+		ownAccount = c.MustGet("account").(*models.Account)
+		token      = c.MustGet("token").(*models.Token)
+	)
+
+	if !models.InScope(token.Scope, []string{"addresses:modify"}) {
+		c.JSON(403, &gin.H{
+			"code":  0,
+			"error": "Your token has insufficient scope",
+		})
+		return nil
+	}
+
+	// Fetch the address from database
+	cursor, err := r.Table("addresses").Get(c.Param("id")).Default(map[string]interface{}{}).Run(a.Rethink)
+	if err != nil {
+		c.JSON(500, &gin.H{
+			"code":  0,
+			"error": err.Error(),
+		})
+		return nil
+	}
+	defer cursor.Close()
+	var address models.Address
+	if err := cursor.One(&address); err != nil {
+		c.JSON(500, &gin.H{
+			"code":  0,
+			"error": err.Error(),
+		})
+		return nil
+	}
+
+	// Other accounts can't learn about the group
+	if !address.IsGroup() || (address.Owner != ownAccount.ID &&
+		!containsString(address.Members, ownAccount.ID) &&
+		!containsString(address.Invited, ownAccount.ID)) {
+		c.JSON(404, &gin.H{
+			"code":  0,
+			"error": "Address not found",
+		})
+		return nil
+	}
+
+	return &address
+}
+
+// updateMembers stores the members and the invited accounts of the group.
+func (a *API) updateMembers(c *gin.Context, address *models.Address) {
+	address.DateModified = time.Now()
+	if err := r.Table("addresses").Get(address.ID).Update(map[string]interface{}{
+		"members":       address.Members,
+		"invited":       address.Invited,
+		"date_modified": address.DateModified,
+	}).Exec(a.Rethink); err != nil {
+		c.JSON(500, &gin.H{
+			"code":  0,
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(200, address)
+}
+
+func (a *API) addAddressMember(c *gin.Context) {
+	address := a.getGroup(c, "addresses:modify", false)
+	if address == nil {
+		return
+	}
+
+	// Decode the input
+	var input struct {
+		Account string `json:"account"`
+	}
+	if err := c.Bind(&input); err != nil {
+		c.JSON(422, &gin.H{
+			"code":    CodeGeneralInvalidInput,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	if containsString(address.Members, input.Account) || containsString(address.Invited, input.Account) {
+		c.JSON(200, address)
+		return
+	}
+
+	// Members receive the emails of the group, so owners can only invite
+	// the accounts, which join once they accept. Invites don't reveal
+	// whether the account exists.
+	token := c.MustGet("token").(*models.Token)
+	if !models.InScope(token.Scope, []string{"admin"}) {
+		address.Invited = append(address.Invited, input.Account)
+		a.updateMembers(c, address)
+		return
+	}
+
+	// Admins add the members right away, so check if the account exists
+	cursor, err := r.Table("accounts").Get(input.Account).Ne(nil).Run(a.Rethink)
+	if err != nil {
+		c.JSON(500, &gin.H{
+			"code":  0,
+			"error": err.Error(),
+		})
+		return
+	}
+	defer cursor.Close()
+	var exists bool
+	if err := cursor.One(&exists); err != nil {
+		c.JSON(500, &gin.H{
+			"code":  0,
+			"error": err.Error(),
+		})
+		return
+	}
+	if !exists {
+		c.JSON(422, &gin.H{
+			"code":    CodeGeneralInvalidInput,
+			"message": "Validation failed",
+			"errors":  []string{"Account does not exist."},
+		})
+		return
+	}
+
+	address.Members = append(address.Members, input.Account)
+	a.updateMembers(c, address)
+}
+
+func (a *API) acceptAddressMember(c *gin.Context) {
+	ownAccount := c.MustGet("account").(*models.Account)
+
+	// Only the invited account can accept the invite
+	account := c.Param("account")
+	if account == "me" {
+		account = ownAccount.ID
+	}
+	if account != ownAccount.ID {
+		c.JSON(403, &gin.H{
+			"code":  0,
+			"error": "Only the invited account can join the group",
+		})
+		return
+	}
+
+	address := a.getMembership(c)
+	if address == nil {
+		return
+	}
+	if containsString(address.Members, account) {
+		c.JSON(200, address)
+		return
+	}
+	if !containsString(address.Invited, account) {
+		c.JSON(422, &gin.H{
+			"code":    CodeGeneralInvalidAction,
+			"message": "Account is not invited to the group",
+		})
+		return
+	}
+
+	address.Invited = removeString(address.Invited, account)
+	address.Members = append(address.Members, account)
+	a.updateMembers(c, address)
+}
+
+func (a *API) removeAddressMember(c *gin.Context) {
+	ownAccount := c.MustGet("account").(*models.Account)
+
+	// Members can leave the groups and decline the invites themselves
+	account := c.Param("account")
+	if account == "me" {
+		account = ownAccount.ID
+	}
+	var address *models.Address
+	if account == ownAccount.ID {
+		address = a.getMembership(c)
+	} else {
+		address = a.getGroup(c, "addresses:modify", false)
+	}
+	if address == nil {
+		return
+	}
+
+	address.Members = removeString(address.Members, account)
+	address.Invited = removeString(address.Invited, account)
+	a.updateMembers(c, address)
+}
+
+// containsString checks whether the list contains the value.
+func containsString(list []string, value string) bool {
+	for _, x := range list {
+		if x == value {
+			return true
+		}
+	}
+	return false
+}
+
+// removeString returns the list without the value.
+func removeString(list []string, value string) []string {
+	result := []string{}
+	for _, x := range list {
+		if x != value {
+			result = append(result, x)
+		}
+	}
+	return result
+}
+
+func (a *API) updateAddressForwarding(c *gin.Context) {
+	address := a.getAddress(c, "addresses:modify", false)
+	if address == nil {
+		return
+	}
+
+	// Decode the input
+	var input models.Forwarding
+	if err := c.Bind(&input); err != nil {
+		c.JSON(422, &gin.H{
+			"code":    CodeGeneralInvalidInput,
+			"message": err.Error(),
+		})
+		return
+	}
+	input.Address = strings.TrimSpace(input.Address)
+
+	// Validate the rule, an empty address disables forwarding
+	errors := []string{}
+	if input.Address != "" {
+		if address.IsGroup() {
+			errors = append(errors, "Group addresses can't be forwarded.")
+		}
+		if !govalidator.IsEmail(input.Address) {
+			errors = append(errors, "Invalid forwarding address format.")
+		} else if target, _ := utils.SplitAddress(input.Address); target == address.ID {
+			errors = append(errors, "Address can't be forwarded to itself.")
+		}
+
+		if input.PublicKey != "" {
+			if _, err := openpgp.ReadArmoredKeyRing(strings.NewReader(input.PublicKey)); err != nil {
+				errors = append(errors, "Invalid public key.")
+			}
+		} else if input.Key != "" {
+			cursor, err := r.Table("keys").Get(input.Key).Default(map[string]interface{}{}).Run(a.Rethink)
+			if err != nil {
+				c.JSON(500, &gin.H{
+					"code":  0,
+					"error": err.Error(),
+				})
+				return
+			}
+			defer cursor.Close()
+			var key models.Key
+			if err := cursor.One(&key); err != nil {
+				c.JSON(500, &gin.H{
+					"code":  0,
+					"error": err.Error(),
+				})
+				return
+			}
+			if key.ID == "" || key.Owner != address.Owner {
+				errors = append(errors, "Key does not exist.")
+			}
+		}
+	}
+	if len(errors) > 0 {
+		c.JSON(422, &gin.H{
+			"code":    CodeGeneralInvalidInput,
+			"message": "Validation failed",
+			"errors":  errors,
+		})
+		return
+	}
+
+	if input.Address == "" {
+		address.Forwarding = nil
+	} else {
+		address.Forwarding = &input
+	}
+	address.DateModified = time.Now()
+	if err := r.Table("addresses").Get(address.ID).Update(map[string]interface{}{
+		"forwarding":    address.Forwarding,
+		"date_modified": address.DateModified,
+	}).Exec(a.Rethink); err != nil {
+		c.JSON(500, &gin.H{
+			"code":  0,
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(200, address)
+}
+
+// updateAddressKeys sets the keys that the emails received on the address are
+// encrypted to. An empty list restores the default key.
+func (a *API) updateAddressKeys(c *gin.Context) {
+	address := a.getAddress(c, "addresses:modify", false)
+	if address == nil {
+		return
+	}
+
+	// Decode the input
+	var input struct {
+		Keys []string `json:"keys"`
+	}
+	if err := c.Bind(&input); err != nil {
+		c.JSON(422, &gin.H{
+			"code":    CodeGeneralInvalidInput,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	// Validate the keys, only the owner's ones can be used
+	errors := []string{}
+	if address.IsGroup() && len(input.Keys) > 0 {
+		errors = append(errors, "Group addresses use the keys of their members.")
+	}
+	keys := []string{}
+	if len(input.Keys) > 0 {
+		ids := []interface{}{}
+		for _, id := range input.Keys {
+			ids = append(ids, id)
+		}
+
+		cursor, err := r.Table("keys").GetAll(ids...).Run(a.Rethink)
+		if err != nil {
+			c.JSON(500, &gin.H{
+				"code":  0,
+				"error": err.Error(),
+			})
+			return
+		}
+		defer cursor.Close()
+		var found []*models.Key
+		if err := cursor.All(&found); err != nil {
+			c.JSON(500, &gin.H{
+				"code":  0,
+				"error": err.Error(),
+			})
+			return
+		}
+
+		owned := map[string]*models.Key{}
+		for _, key := range found {
+			if key.Owner == address.Owner {
+				owned[key.ID] = key
+			}
+		}
+		seen := map[string]struct{}{}
+		for _, id := range input.Keys {
+			if _, ok := seen[id]; ok {
+				continue
+			}
+			seen[id] = struct{}{}
+
+			key, ok := owned[id]
+			if !ok {
+				errors = append(errors, "Key "+id+" does not exist.")
+				continue
+			}
+			if !key.IsValid(time.Now()) {
+				errors = append(errors, "Key "+id+" is revoked or expired.")
+				continue
+			}
+			keys = append(keys, id)
+		}
+	}
+	if len(errors) > 0 {
+		c.JSON(422, &gin.H{
+			"code":    CodeGeneralInvalidInput,
+			"message": "Validation failed",
+			"errors":  errors,
+		})
+		return
+	}
+
+	address.EncryptionKeys = keys
+	address.DateModified = time.Now()
+	if err := r.Table("addresses").Get(address.ID).Update(map[string]interface{}{
+		"encryption_keys": address.EncryptionKeys,
+		"date_modified":   address.DateModified,
+	}).Exec(a.Rethink); err != nil {
+		c.JSON(500, &gin.H{
+			"code":  0,
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(200, address)
+}
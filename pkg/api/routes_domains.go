@@ -0,0 +1,427 @@
+package api
+
+import (
+	"strings"
+	"time"
+
+	r "github.com/pgpst/pgpst/internal/github.com/dancannon/gorethink"
+	"github.com/pgpst/pgpst/internal/github.com/dchest/uniuri"
+	"github.com/pgpst/pgpst/internal/github.com/gin-gonic/gin"
+
+	"github.com/pgpst/pgpst/pkg/models"
+	"github.com/pgpst/pgpst/pkg/utils"
+)
+
+// getDomain fetches the domain from the database, returning an empty one if
+// it doesn't exist.
+func (a *API) getDomain(id string) (*models.Domain, error) {
+	cursor, err := r.Table("domains").Get(id).Default(map[string]interface{}{}).Run(a.Rethink)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+	var domain models.Domain
+	if err := cursor.One(&domain); err != nil {
+		return nil, err
+	}
+
+	return &domain, nil
+}
+
+func (a *API) createDomain(c *gin.Context) {
+	// Get token and account info from the context
+	var (
+		account = c.MustGet("account").(*models.Account)
+		token   = c.MustGet("token").(*models.Token)
+	)
+
+	// Decode the input
+	var input struct {
+		Domain string `json:"domain"`
+		Owner  string `json:"owner"`
+	}
+	if err := c.Bind(&input); err != nil {
+		c.JSON(422, &gin.H{
+			"code":    CodeGeneralInvalidInput,
+			"message": err.Error(),
+		})
+		return
+	}
+	if input.Owner == "" {
+		input.Owner = account.ID
+	}
+
+	// Check the scope
+	if input.Owner == account.ID {
+		if !models.InScope(token.Scope, []string{"domains:modify"}) {
+			c.JSON(403, &gin.H{
+				"code":  0,
+				"error": "Your token has insufficient scope",
+			})
+			return
+		}
+	} else {
+		if !models.InScope(token.Scope, []string{"admin"}) {
+			c.JSON(403, &gin.H{
+				"code":  0,
+				"error": "Your token has insufficient scope",
+			})
+			return
+		}
+	}
+
+	// Validate the domain
+	input.Domain = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(input.Domain)), ".")
+	if !utils.IsDomain(input.Domain) {
+		c.JSON(422, &gin.H{
+			"code":    CodeGeneralInvalidInput,
+			"message": "Validation failed",
+			"errors":  []string{"Invalid domain format."},
+		})
+		return
+	}
+
+	// Check whether it's taken. Unverified claims of other accounts don't
+	// prove anything, so they don't block the real owner of the domain.
+	existing, err := a.getDomain(input.Domain)
+	if err != nil {
+		c.JSON(500, &gin.H{
+			"code":  0,
+			"error": err.Error(),
+		})
+		return
+	}
+	if existing.ID != "" && (existing.IsVerified() || existing.Owner == input.Owner) {
+		c.JSON(422, &gin.H{
+			"code":    CodeGeneralInvalidInput,
+			"message": "Naming conflict",
+			"errors":  []string{"This domain is already added."},
+		})
+		return
+	}
+
+	// Insert it into the database
+	domain := &models.Domain{
+		ID:           input.Domain,
+		DateCreated:  time.Now(),
+		DateModified: time.Now(),
+		Owner:        input.Owner,
+		Status:       "unverified",
+		Challenge:    "pgpst-verification=" + uniuri.NewLen(uniuri.UUIDLen),
+	}
+	if err := r.Table("domains").Insert(domain, r.InsertOpts{
+		Conflict: "replace",
+	}).Exec(a.Rethink); err != nil {
+		c.JSON(500, &gin.H{
+			"code":  0,
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(201, domain)
+}
+
+func (a *API) readDomain(c *gin.Context) {
+	// Get token and account info from the context
+	var (
+		account = c.MustGet("account").(*models.Account)
+		token   = c.MustGet("token").(*models.Token)
+	)
+
+	// Fetch the domain from the database
+	domain, err := a.getDomain(strings.ToLower(c.Param("id")))
+	if err != nil {
+		c.JSON(500, &gin.H{
+			"code":  0,
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Check the scope
+	if domain.ID != "" && domain.Owner == account.ID {
+		if !models.InScope(token.Scope, []string{"domains:read"}) {
+			c.JSON(403, &gin.H{
+				"code":  0,
+				"error": "Your token has insufficient scope",
+			})
+			return
+		}
+	} else {
+		if !models.InScope(token.Scope, []string{"admin"}) {
+			c.JSON(403, &gin.H{
+				"code":  0,
+				"error": "Your token has insufficient scope",
+			})
+			return
+		}
+	}
+
+	if domain.ID == "" {
+		c.JSON(404, &gin.H{
+			"code":  0,
+			"error": "Domain not found",
+		})
+		return
+	}
+
+	c.JSON(200, domain)
+}
+
+func (a *API) verifyDomain(c *gin.Context) {
+	// Get token and account info from the context
+	var (
+		account = c.MustGet("account").(*models.Account)
+		token   = c.MustGet("token").(*models.Token)
+	)
+
+	// Fetch the domain from the database
+	domain, err := a.getDomain(strings.ToLower(c.Param("id")))
+	if err != nil {
+		c.JSON(500, &gin.H{
+			"code":  0,
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Check the scope
+	if domain.ID != "" && domain.Owner == account.ID {
+		if !models.InScope(token.Scope, []string{"domains:modify"}) {
+			c.JSON(403, &gin.H{
+				"code":  0,
+				"error": "Your token has insufficient scope",
+			})
+			return
+		}
+	} else {
+		if !models.InScope(token.Scope, []string{"admin"}) {
+			c.JSON(403, &gin.H{
+				"code":  0,
+				"error": "Your token has insufficient scope",
+			})
+			return
+		}
+	}
+
+	if domain.ID == "" {
+		c.JSON(404, &gin.H{
+			"code":  0,
+			"error": "Domain not found",
+		})
+		return
+	}
+
+	// Look up the challenge and the MX records. Verified domains stay
+	// verified, only their MX status gets refreshed.
+	result := utils.CheckDomain(a.Resolver, domain.ID, domain.Challenge, a.Options.MXHosts)
+	domain.MX = result.MX
+	domain.DateModified = time.Now()
+
+	errors := []string{}
+	if !domain.IsVerified() {
+		if !result.Challenge {
+			errors = append(errors, "TXT record "+domain.Challenge+" not found.")
+		}
+		if !result.MX {
+			errors = append(errors, "MX records do not point to "+strings.Join(a.Options.MXHosts, ", ")+".")
+		}
+		if len(errors) == 0 {
+			domain.Status = "verified"
+			domain.DateVerified = time.Now()
+		}
+	}
+
+	// Another account might have replaced the unverified claim meanwhile
+	if err := r.Table("domains").Get(domain.ID).Update(func(row r.Term) interface{} {
+		return r.Branch(row.Field("challenge").Eq(domain.Challenge), domain, map[string]interface{}{})
+	}).Exec(a.Rethink); err != nil {
+		c.JSON(500, &gin.H{
+			"code":  0,
+			"error": err.Error(),
+		})
+		return
+	}
+
+	if len(errors) > 0 {
+		c.JSON(422, &gin.H{
+			"code":    CodeGeneralInvalidAction,
+			"message": "Verification failed",
+			"errors":  errors,
+		})
+		return
+	}
+
+	c.JSON(200, domain)
+}
+
+func (a *API) updateDomain(c *gin.Context) {
+	// Get token and account info from the context
+	var (
+		account = c.MustGet("account").(*models.Account)
+		token   = c.MustGet("token").(*models.Token)
+	)
+
+	// Fetch the domain from the database
+	domain, err := a.getDomain(strings.ToLower(c.Param("id")))
+	if err != nil {
+		c.JSON(500, &gin.H{
+			"code":  0,
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Check the scope
+	if domain.ID != "" && domain.Owner == account.ID {
+		if !models.InScope(token.Scope, []string{"domains:modify"}) {
+			c.JSON(403, &gin.H{
+				"code":  0,
+				"error": "Your token has insufficient scope",
+			})
+			return
+		}
+	} else {
+		if !models.InScope(token.Scope, []string{"admin"}) {
+			c.JSON(403, &gin.H{
+				"code":  0,
+				"error": "Your token has insufficient scope",
+			})
+			return
+		}
+	}
+
+	if domain.ID == "" {
+		c.JSON(404, &gin.H{
+			"code":  0,
+			"error": "Domain not found",
+		})
+		return
+	}
+
+	// Decode the input
+	var input struct {
+		CatchAll string `json:"catch_all"`
+	}
+	if err := c.Bind(&input); err != nil {
+		c.JSON(422, &gin.H{
+			"code":    CodeGeneralInvalidInput,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	// The catch-all address has to be an existing address on the domain
+	if input.CatchAll != "" {
+		if strings.Index(input.CatchAll, "@") == -1 {
+			input.CatchAll += "@" + domain.ID
+		}
+		input.CatchAll, _ = utils.SplitAddress(input.CatchAll)
+
+		cursor, err := r.Table("addresses").Get(input.CatchAll).Default(map[string]interface{}{}).Run(a.Rethink)
+		if err != nil {
+			c.JSON(500, &gin.H{
+				"code":  0,
+				"error": err.Error(),
+			})
+			return
+		}
+		defer cursor.Close()
+		var address models.Address
+		if err := cursor.One(&address); err != nil {
+			c.JSON(500, &gin.H{
+				"code":  0,
+				"error": err.Error(),
+			})
+			return
+		}
+
+		errors := []string{}
+		if address.ID == "" {
+			errors = append(errors, "Catch-all address does not exist.")
+		} else if !strings.HasSuffix(address.ID, "@"+domain.ID) {
+			errors = append(errors, "Catch-all address has to be on the domain.")
+		} else if domain.Owner != "" && address.Owner != domain.Owner {
+			errors = append(errors, "Catch-all address has to be owned by the owner of the domain.")
+		}
+		if len(errors) > 0 {
+			c.JSON(422, &gin.H{
+				"code":    CodeGeneralInvalidInput,
+				"message": "Validation failed",
+				"errors":  errors,
+			})
+			return
+		}
+	}
+
+	domain.CatchAll = input.CatchAll
+	domain.DateModified = time.Now()
+	if err := r.Table("domains").Get(domain.ID).Update(map[string]interface{}{
+		"catch_all":     domain.CatchAll,
+		"date_modified": domain.DateModified,
+	}).Exec(a.Rethink); err != nil {
+		c.JSON(500, &gin.H{
+			"code":  0,
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(200, domain)
+}
+
+func (a *API) getAccountDomains(c *gin.Context) {
+	// Token and account from context
+	var (
+		ownAccount = c.MustGet("account").(*models.Account)
+		token      = c.MustGet("token").(*models.Token)
+	)
+
+	// Resolve the ID from the URL
+	id := c.Param("id")
+	if id == "me" {
+		id = ownAccount.ID
+	}
+
+	// Check the scope
+	if id == ownAccount.ID {
+		if !models.InScope(token.Scope, []string{"domains:read"}) {
+			c.JSON(403, &gin.H{
+				"code":  0,
+				"error": "Your token has insufficient scope",
+			})
+			return
+		}
+	} else {
+		if !models.InScope(token.Scope, []string{"admin"}) {
+			c.JSON(403, &gin.H{
+				"code":  0,
+				"error": "Your token has insufficient scope",
+			})
+			return
+		}
+	}
+
+	// Get domains from database
+	cursor, err := r.Table("domains").GetAllByIndex("owner", id).Run(a.Rethink)
+	if err != nil {
+		c.JSON(500, &gin.H{
+			"code":  0,
+			"error": err.Error(),
+		})
+		return
+	}
+	defer cursor.Close()
+	var domains []*models.Domain
+	if err := cursor.All(&domains); err != nil {
+		c.JSON(500, &gin.H{
+			"code":  0,
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Write the response
+	c.JSON(200, domains)
+}
@@ -0,0 +1,317 @@
+package api
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	r "github.com/pgpst/pgpst/internal/github.com/dancannon/gorethink"
+	"github.com/pgpst/pgpst/internal/github.com/gin-gonic/gin"
+	"github.com/pgpst/pgpst/internal/golang.org/x/crypto/openpgp"
+	"github.com/pgpst/pgpst/internal/golang.org/x/crypto/openpgp/armor"
+
+	"github.com/pgpst/pgpst/pkg/hkp"
+	"github.com/pgpst/pgpst/pkg/models"
+	"github.com/pgpst/pgpst/pkg/utils"
+)
+
+// findHKPKeys runs a search of the keyserver. Addresses resolve to their
+// default key, like in readKey.
+func (a *API) findHKPKeys(search *hkp.Search) ([]*models.Key, error) {
+	var query r.Term
+	switch search.Kind {
+	case hkp.Fingerprint:
+		query = r.Table("keys").GetAll(search.Value)
+	case hkp.KeyID:
+		query = r.Table("keys").GetAllByIndex("key_id_string", search.Value)
+	case hkp.ShortKeyID:
+		query = r.Table("keys").GetAllByIndex("key_id_short_string", search.Value)
+	case hkp.Email:
+		id, _ := utils.SplitAddress(search.Value)
+		query = r.Table("addresses").Get(id).Default(map[string]interface{}{}).Do(func(address r.Term) r.Term {
+			return r.Table("keys").GetAll(address.Field("public_key").Default("")).CoerceTo("array")
+		})
+	}
+
+	cursor, err := query.Run(a.Rethink)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+	var keys []*models.Key
+	if err := cursor.All(&keys); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+func (a *API) hkpLookup(c *gin.Context) {
+	// Parse the query
+	var (
+		op      = c.Query("op")
+		options = strings.Split(c.Query("options"), ",")
+		mr      = false
+	)
+	for _, option := range options {
+		if option == "mr" {
+			mr = true
+		}
+	}
+	if op != "get" && op != "index" && op != "vindex" {
+		c.JSON(501, &gin.H{
+			"code":    0,
+			"message": "Unsupported operation",
+		})
+		return
+	}
+
+	search, err := hkp.ParseSearch(c.Query("search"))
+	if err != nil {
+		c.JSON(400, &gin.H{
+			"code":    0,
+			"message": "Search for a key ID, fingerprint or email address",
+		})
+		return
+	}
+
+	// Find the keys
+	keys, err := a.findHKPKeys(search)
+	if err != nil {
+		c.JSON(500, &gin.H{
+			"code":    0,
+			"message": err.Error(),
+		})
+		return
+	}
+	if len(keys) == 0 {
+		c.JSON(404, &gin.H{
+			"code":    0,
+			"message": "No keys found",
+		})
+		return
+	}
+
+	// Indexes are built from the stored identities
+	if op == "index" || op == "vindex" {
+		var body []byte
+		if mr {
+			body, err = hkp.Index(keys, time.Now())
+		} else {
+			body, err = hkp.HumanIndex(keys, op == "vindex", time.Now())
+		}
+		if err != nil {
+			c.JSON(500, &gin.H{
+				"code":    0,
+				"message": err.Error(),
+			})
+			return
+		}
+
+		c.Data(200, "text/plain", body)
+		return
+	}
+
+	// Otherwise return all the keys in a single armored block
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+	if err != nil {
+		c.JSON(500, &gin.H{
+			"code":    0,
+			"message": err.Error(),
+		})
+		return
+	}
+	for _, key := range keys {
+		if _, err := w.Write(key.Body); err != nil {
+			c.JSON(500, &gin.H{
+				"code":    0,
+				"message": err.Error(),
+			})
+			return
+		}
+	}
+	if err := w.Close(); err != nil {
+		c.JSON(500, &gin.H{
+			"code":    0,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	contentType := "text/plain"
+	if mr {
+		contentType = "application/pgp-keys"
+	}
+	c.Data(200, contentType, buf.Bytes())
+}
+
+// checkHKPOwner resolves the account owning all the identities of the key.
+// Every identity has to be a pgpst address on a verified domain.
+func (a *API) checkHKPOwner(entity *openpgp.Entity) (string, error) {
+	// Identities can share an address
+	var (
+		ids  = []interface{}{}
+		seen = map[string]struct{}{}
+	)
+	for _, identity := range entity.Identities {
+		if identity.UserId == nil || identity.UserId.Email == "" {
+			return "", nil
+		}
+
+		id, _ := utils.SplitAddress(identity.UserId.Email)
+		if _, ok := seen[id]; !ok {
+			seen[id] = struct{}{}
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return "", nil
+	}
+
+	cursor, err := r.Table("addresses").GetAll(ids...).Map(func(address r.Term) r.Term {
+		return r.Expr(map[string]interface{}{
+			"owner":  address.Field("owner"),
+			"status": r.Table("domains").Get(address.Field("id").Split("@").Nth(-1)).Field("status").Default(""),
+		})
+	}).CoerceTo("array").Run(a.Rethink)
+	if err != nil {
+		return "", err
+	}
+	defer cursor.Close()
+	var addresses []struct {
+		Owner  string `gorethink:"owner"`
+		Status string `gorethink:"status"`
+	}
+	if err := cursor.All(&addresses); err != nil {
+		return "", err
+	}
+
+	if len(addresses) != len(ids) {
+		return "", nil
+	}
+
+	owner := ""
+	for _, address := range addresses {
+		if address.Status != "verified" || (owner != "" && address.Owner != owner) {
+			return "", nil
+		}
+		owner = address.Owner
+	}
+
+	return owner, nil
+}
+
+func (a *API) hkpAdd(c *gin.Context) {
+	// Parse the keys
+	keyring, err := openpgp.ReadArmoredKeyRing(strings.NewReader(c.PostForm("keytext")))
+	if err != nil {
+		c.JSON(422, &gin.H{
+			"code":    0,
+			"message": "Invalid key format",
+		})
+		return
+	}
+
+	// Check all the keys before storing any of them
+	keys := []*models.Key{}
+	for _, entity := range keyring {
+		owner, err := a.checkHKPOwner(entity)
+		if err != nil {
+			c.JSON(500, &gin.H{
+				"code":    0,
+				"message": err.Error(),
+			})
+			return
+		}
+		if owner == "" {
+			c.JSON(403, &gin.H{
+				"code":    0,
+				"message": "Only keys of verified pgpst addresses are accepted",
+			})
+			return
+		}
+
+		// Uploads can't take over addresses, only update the stored keys
+		id := hex.EncodeToString(entity.PrimaryKey.Fingerprint[:])
+		cursor, err := r.Table("keys").Get(id).Default(map[string]interface{}{}).Run(a.Rethink)
+		if err != nil {
+			c.JSON(500, &gin.H{
+				"code":    0,
+				"message": err.Error(),
+			})
+			return
+		}
+		defer cursor.Close()
+		var key models.Key
+		if err := cursor.One(&key); err != nil {
+			c.JSON(500, &gin.H{
+				"code":    0,
+				"message": err.Error(),
+			})
+			return
+		}
+		if key.ID == "" || key.Owner != owner {
+			c.JSON(403, &gin.H{
+				"code":    0,
+				"message": "New keys have to be added through the API",
+			})
+			return
+		}
+
+		stored, err := openpgp.ReadKeyRing(bytes.NewReader(key.Body))
+		if err != nil {
+			c.JSON(500, &gin.H{
+				"code":    0,
+				"message": err.Error(),
+			})
+			return
+		}
+		if len(stored) == 0 {
+			c.JSON(500, &gin.H{
+				"code":    0,
+				"message": "Stored key " + key.ID + " is empty",
+			})
+			return
+		}
+
+		// Anyone can upload the key, so it's merged into the stored one
+		// instead of replacing it
+		if err := hkp.Merge(stored[0], entity); err != nil {
+			c.JSON(500, &gin.H{
+				"code":    0,
+				"message": err.Error(),
+			})
+			return
+		}
+
+		key.Body, err = hkp.Serialize(stored[0])
+		if err != nil {
+			c.JSON(500, &gin.H{
+				"code":    0,
+				"message": err.Error(),
+			})
+			return
+		}
+		key.DateModified = time.Now()
+		key.Identities = keyIdentities(stored[0])
+		keys = append(keys, &key)
+	}
+
+	for _, key := range keys {
+		if err := r.Table("keys").Get(key.ID).Update(map[string]interface{}{
+			"date_modified": key.DateModified,
+			"body":          key.Body,
+			"identities":    key.Identities,
+		}).Exec(a.Rethink); err != nil {
+			c.JSON(500, &gin.H{
+				"code":    0,
+				"message": err.Error(),
+			})
+			return
+		}
+	}
+
+	c.JSON(200, keys)
+}
@@ -8,10 +8,52 @@ import (
 	r "github.com/pgpst/pgpst/internal/github.com/dancannon/gorethink"
 	"github.com/pgpst/pgpst/internal/github.com/gin-gonic/gin"
 	"github.com/pgpst/pgpst/internal/golang.org/x/crypto/openpgp"
+	"github.com/pgpst/pgpst/internal/golang.org/x/crypto/openpgp/packet"
 
 	"github.com/pgpst/pgpst/pkg/models"
 )
 
+// keySignature converts a signature of a key to its model.
+func keySignature(sig *packet.Signature) *models.Signature {
+	return &models.Signature{
+		Type:                 uint8(sig.SigType),
+		Algorithm:            uint8(sig.PubKeyAlgo),
+		Hash:                 uint(sig.Hash),
+		CreationTime:         sig.CreationTime,
+		SigLifetimeSecs:      sig.SigLifetimeSecs,
+		KeyLifetimeSecs:      sig.KeyLifetimeSecs,
+		IssuerKeyID:          sig.IssuerKeyId,
+		IsPrimaryID:          sig.IsPrimaryId,
+		RevocationReason:     sig.RevocationReason,
+		RevocationReasonText: sig.RevocationReasonText,
+	}
+}
+
+// keyIdentities converts the identities of a key to their models.
+func keyIdentities(entity *openpgp.Entity) []*models.Identity {
+	identities := []*models.Identity{}
+	for _, identity := range entity.Identities {
+		id := &models.Identity{
+			Name: identity.Name,
+		}
+
+		if identity.SelfSignature != nil {
+			id.SelfSignature = keySignature(identity.SelfSignature)
+		}
+
+		if identity.Signatures != nil {
+			id.Signatures = []*models.Signature{}
+			for _, sig := range identity.Signatures {
+				id.Signatures = append(id.Signatures, keySignature(sig))
+			}
+		}
+
+		identities = append(identities, id)
+	}
+
+	return identities
+}
+
 func (a *API) createKey(c *gin.Context) {
 	// Get token and account info from the context
 	var (
@@ -60,50 +102,6 @@ func (a *API) createKey(c *gin.Context) {
 	}
 	publicKey := keyring[0].PrimaryKey
 
-	// Parse the identities
-	identities := []*models.Identity{}
-	for _, identity := range keyring[0].Identities {
-		id := &models.Identity{
-			Name: identity.Name,
-		}
-
-		if identity.SelfSignature != nil {
-			sig := identity.SelfSignature
-			id.SelfSignature = &models.Signature{
-				Type:                 uint8(sig.SigType),
-				Algorithm:            uint8(sig.PubKeyAlgo),
-				Hash:                 uint(sig.Hash),
-				CreationTime:         sig.CreationTime,
-				SigLifetimeSecs:      sig.SigLifetimeSecs,
-				KeyLifetimeSecs:      sig.KeyLifetimeSecs,
-				IssuerKeyID:          sig.IssuerKeyId,
-				IsPrimaryID:          sig.IsPrimaryId,
-				RevocationReason:     sig.RevocationReason,
-				RevocationReasonText: sig.RevocationReasonText,
-			}
-		}
-
-		if identity.Signatures != nil {
-			id.Signatures = []*models.Signature{}
-			for _, sig := range identity.Signatures {
-				id.Signatures = append(id.Signatures, &models.Signature{
-					Type:                 uint8(sig.SigType),
-					Algorithm:            uint8(sig.PubKeyAlgo),
-					Hash:                 uint(sig.Hash),
-					CreationTime:         sig.CreationTime,
-					SigLifetimeSecs:      sig.SigLifetimeSecs,
-					KeyLifetimeSecs:      sig.KeyLifetimeSecs,
-					IssuerKeyID:          sig.IssuerKeyId,
-					IsPrimaryID:          sig.IsPrimaryId,
-					RevocationReason:     sig.RevocationReason,
-					RevocationReasonText: sig.RevocationReasonText,
-				})
-			}
-		}
-
-		identities = append(identities, id)
-	}
-
 	// Acquire key's length
 	length, err := publicKey.BitLength()
 	if err != nil {
@@ -128,7 +126,7 @@ func (a *API) createKey(c *gin.Context) {
 		KeyIDString:      publicKey.KeyIdString(),
 		KeyIDShortString: publicKey.KeyIdShortString(),
 
-		Identities: identities,
+		Identities: keyIdentities(keyring[0]),
 	}
 
 	// Insert it into database
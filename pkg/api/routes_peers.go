@@ -0,0 +1,309 @@
+package api
+
+import (
+	"time"
+
+	r "github.com/pgpst/pgpst/internal/github.com/dancannon/gorethink"
+	"github.com/pgpst/pgpst/internal/github.com/gin-gonic/gin"
+
+	"github.com/pgpst/pgpst/pkg/autocrypt"
+	"github.com/pgpst/pgpst/pkg/models"
+)
+
+// peer is a peer along with the recommendation for encrypting to it
+type peer struct {
+	*models.Peer
+	Recommendation string `json:"recommendation"`
+}
+
+// autocryptPreference returns the prefer-encrypt setting of the account.
+func (a *API) autocryptPreference(id string, ownAccount *models.Account) (string, error) {
+	if id == ownAccount.ID {
+		return ownAccount.AutocryptPreferEncrypt, nil
+	}
+
+	cursor, err := r.Table("accounts").Get(id).Field("autocrypt_prefer_encrypt").Default("").Run(a.Rethink)
+	if err != nil {
+		return "", err
+	}
+	defer cursor.Close()
+	var preference string
+	if err := cursor.One(&preference); err != nil {
+		return "", err
+	}
+
+	return preference, nil
+}
+
+func (a *API) getAccountPeers(c *gin.Context) {
+	// Token and account from context
+	var (
+		ownAccount = c.MustGet("account").(*models.Account)
+		token      = c.MustGet("token").(*models.Token)
+	)
+
+	// Resolve the ID from the URL
+	id := c.Param("id")
+	if id == "me" {
+		id = ownAccount.ID
+	}
+
+	// Check the scope
+	if id == ownAccount.ID {
+		if !models.InScope(token.Scope, []string{"peers:read"}) {
+			c.JSON(403, &gin.H{
+				"code":  0,
+				"error": "Your token has insufficient scope",
+			})
+			return
+		}
+	} else {
+		if !models.InScope(token.Scope, []string{"admin"}) {
+			c.JSON(403, &gin.H{
+				"code":  0,
+				"error": "Your token has insufficient scope",
+			})
+			return
+		}
+	}
+
+	preference, err := a.autocryptPreference(id, ownAccount)
+	if err != nil {
+		c.JSON(500, &gin.H{
+			"code":  0,
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Get the peers from database
+	cursor, err := r.Table("peers").GetAllByIndex("owner", id).Run(a.Rethink)
+	if err != nil {
+		c.JSON(500, &gin.H{
+			"code":  0,
+			"error": err.Error(),
+		})
+		return
+	}
+	defer cursor.Close()
+	var peers []*models.Peer
+	if err := cursor.All(&peers); err != nil {
+		c.JSON(500, &gin.H{
+			"code":  0,
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Add the recommendations
+	result := []*peer{}
+	for _, x := range peers {
+		result = append(result, &peer{
+			Peer:           x,
+			Recommendation: autocrypt.Recommend(x, preference),
+		})
+	}
+
+	// Write the response
+	c.JSON(200, result)
+}
+
+func (a *API) readAccountPeer(c *gin.Context) {
+	// Token and account from context
+	var (
+		ownAccount = c.MustGet("account").(*models.Account)
+		token      = c.MustGet("token").(*models.Token)
+	)
+
+	// Resolve the ID from the URL
+	id := c.Param("id")
+	if id == "me" {
+		id = ownAccount.ID
+	}
+
+	// Check the scope
+	if id == ownAccount.ID {
+		if !models.InScope(token.Scope, []string{"peers:read"}) {
+			c.JSON(403, &gin.H{
+				"code":  0,
+				"error": "Your token has insufficient scope",
+			})
+			return
+		}
+	} else {
+		if !models.InScope(token.Scope, []string{"admin"}) {
+			c.JSON(403, &gin.H{
+				"code":  0,
+				"error": "Your token has insufficient scope",
+			})
+			return
+		}
+	}
+
+	preference, err := a.autocryptPreference(id, ownAccount)
+	if err != nil {
+		c.JSON(500, &gin.H{
+			"code":  0,
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Peers can't be found without the secret used to store them
+	if a.Options.PeerSecret == "" {
+		c.JSON(501, &gin.H{
+			"code":    CodeGeneralUnimplemented,
+			"message": "Autocrypt peers are not configured.",
+		})
+		return
+	}
+
+	// Get the peer from database, unknown addresses get an empty state
+	peerID := autocrypt.PeerID([]byte(a.Options.PeerSecret), id, c.Param("address"))
+	cursor, err := r.Table("peers").Get(peerID).Default(map[string]interface{}{}).Run(a.Rethink)
+	if err != nil {
+		c.JSON(500, &gin.H{
+			"code":  0,
+			"error": err.Error(),
+		})
+		return
+	}
+	defer cursor.Close()
+	var result models.Peer
+	if err := cursor.One(&result); err != nil {
+		c.JSON(500, &gin.H{
+			"code":  0,
+			"error": err.Error(),
+		})
+		return
+	}
+	if result.ID == "" {
+		result.ID = peerID
+		result.Owner = id
+	}
+
+	// Write the response
+	c.JSON(200, &peer{
+		Peer:           &result,
+		Recommendation: autocrypt.Recommend(&result, preference),
+	})
+}
+
+func (a *API) updateAccountPeer(c *gin.Context) {
+	// Token and account from context
+	var (
+		ownAccount = c.MustGet("account").(*models.Account)
+		token      = c.MustGet("token").(*models.Token)
+	)
+
+	// Resolve the ID from the URL
+	id := c.Param("id")
+	if id == "me" {
+		id = ownAccount.ID
+	}
+
+	// Check the scope
+	if id == ownAccount.ID {
+		if !models.InScope(token.Scope, []string{"peers:modify"}) {
+			c.JSON(403, &gin.H{
+				"code":  0,
+				"error": "Your token has insufficient scope",
+			})
+			return
+		}
+	} else {
+		if !models.InScope(token.Scope, []string{"admin"}) {
+			c.JSON(403, &gin.H{
+				"code":  0,
+				"error": "Your token has insufficient scope",
+			})
+			return
+		}
+	}
+
+	// Decode the input
+	var input struct {
+		Override string `json:"override"`
+	}
+	if err := c.Bind(&input); err != nil {
+		c.JSON(422, &gin.H{
+			"code":    CodeGeneralInvalidInput,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	// An empty override brings back the computed recommendation
+	if _, ok := autocrypt.Recommendations[input.Override]; input.Override != "" && !ok {
+		c.JSON(422, &gin.H{
+			"code":    CodeGeneralInvalidInput,
+			"message": "Validation failed",
+			"errors":  []string{"Invalid override. It must be disable, discourage, available or encrypt."},
+		})
+		return
+	}
+
+	preference, err := a.autocryptPreference(id, ownAccount)
+	if err != nil {
+		c.JSON(500, &gin.H{
+			"code":  0,
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Peers can't be found without the secret used to store them
+	if a.Options.PeerSecret == "" {
+		c.JSON(501, &gin.H{
+			"code":    CodeGeneralUnimplemented,
+			"message": "Autocrypt peers are not configured.",
+		})
+		return
+	}
+
+	// Peers can be overridden before they send anything
+	var (
+		peerID = autocrypt.PeerID([]byte(a.Options.PeerSecret), id, c.Param("address"))
+		now    = time.Now()
+	)
+	cursor, err := r.Table("peers").Get(peerID).Replace(func(old r.Term) r.Term {
+		return r.Branch(
+			old.Eq(nil),
+			&models.Peer{
+				ID:           peerID,
+				DateCreated:  now,
+				DateModified: now,
+				Owner:        id,
+				Override:     input.Override,
+			},
+			old.Merge(map[string]interface{}{
+				"date_modified": now,
+				"override":      input.Override,
+			}),
+		)
+	}, r.ReplaceOpts{
+		ReturnChanges: true,
+	}).Field("changes").Nth(0).Field("new_val").Run(a.Rethink)
+	if err != nil {
+		c.JSON(500, &gin.H{
+			"code":  0,
+			"error": err.Error(),
+		})
+		return
+	}
+	defer cursor.Close()
+	var result models.Peer
+	if err := cursor.One(&result); err != nil {
+		c.JSON(500, &gin.H{
+			"code":  0,
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Write the response
+	c.JSON(200, &peer{
+		Peer:           &result,
+		Recommendation: autocrypt.Recommend(&result, preference),
+	})
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/pgpst/pgpst/internal/github.com/gin-gonic/gin"
 
 	"github.com/pgpst/pgpst/pkg/models"
+	"github.com/pgpst/pgpst/pkg/quota"
 )
 
 func (a *API) createResource(c *gin.Context) {
@@ -42,6 +43,23 @@ func (a *API) createResource(c *gin.Context) {
 		return
 	}
 
+	// Check whether it fits into the storage quota
+	plan, usage, err := quota.Lookup(a.Rethink, account)
+	if err != nil {
+		c.JSON(500, &gin.H{
+			"code":  0,
+			"error": err.Error(),
+		})
+		return
+	}
+	if !plan.CanStore(usage, int64(len(input.Body))) {
+		c.JSON(422, &gin.H{
+			"code":    CodeQuotaStorageExceeded,
+			"message": "Storage quota exceeded",
+		})
+		return
+	}
+
 	// Save it into database
 	resource := &models.Resource{
 		ID:           uniuri.NewLen(uniuri.UUIDLen),
@@ -62,6 +80,13 @@ func (a *API) createResource(c *gin.Context) {
 		})
 		return
 	}
+	if err := quota.AddStorage(a.Rethink, account.ID, int64(len(resource.Body)), 0, 1); err != nil {
+		c.JSON(500, &gin.H{
+			"code":    0,
+			"message": err.Error(),
+		})
+		return
+	}
 
 	c.JSON(201, resource)
 }
@@ -340,3 +365,78 @@ func (a *API) readResource(c *gin.Context) {
 
 	c.JSON(200, resource)
 }
+
+func (a *API) deleteResource(c *gin.Context) {
+	// Get token and account info from the context
+	var (
+		account = c.MustGet("account").(*models.Account)
+		token   = c.MustGet("token").(*models.Token)
+	)
+
+	// Fetch the resource from database
+	cursor, err := r.Table("resources").Get(c.Param("id")).Default(map[string]interface{}{}).Run(a.Rethink)
+	if err != nil {
+		c.JSON(500, &gin.H{
+			"code":  0,
+			"error": err.Error(),
+		})
+		return
+	}
+	defer cursor.Close()
+	var resource models.Resource
+	if err := cursor.One(&resource); err != nil {
+		c.JSON(500, &gin.H{
+			"code":  0,
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Check the scope
+	if resource.ID != "" && resource.Owner == account.ID {
+		if !models.InScope(token.Scope, []string{"resources:delete"}) {
+			c.JSON(403, &gin.H{
+				"code":  0,
+				"error": "Your token has insufficient scope",
+			})
+			return
+		}
+	} else {
+		if !models.InScope(token.Scope, []string{"admin"}) {
+			c.JSON(403, &gin.H{
+				"code":  0,
+				"error": "Your token has insufficient scope",
+			})
+			return
+		}
+	}
+
+	if resource.ID == "" {
+		c.JSON(404, &gin.H{
+			"code":  0,
+			"error": "Resource not found",
+		})
+		return
+	}
+
+	// Delete it and release its storage
+	result, err := r.Table("resources").Get(resource.ID).Delete().RunWrite(a.Rethink)
+	if err != nil {
+		c.JSON(500, &gin.H{
+			"code":  0,
+			"error": err.Error(),
+		})
+		return
+	}
+	if result.Deleted > 0 {
+		if err := quota.AddStorage(a.Rethink, resource.Owner, -int64(len(resource.Body)), 0, -1); err != nil {
+			c.JSON(500, &gin.H{
+				"code":  0,
+				"error": err.Error(),
+			})
+			return
+		}
+	}
+
+	c.JSON(200, resource)
+}
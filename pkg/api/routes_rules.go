@@ -0,0 +1,155 @@
+package api
+
+import (
+	"time"
+
+	r "github.com/pgpst/pgpst/internal/github.com/dancannon/gorethink"
+	"github.com/pgpst/pgpst/internal/github.com/gin-gonic/gin"
+
+	"github.com/pgpst/pgpst/pkg/models"
+	"github.com/pgpst/pgpst/pkg/sieve"
+)
+
+func (a *API) getAccountRules(c *gin.Context) {
+	// Token and account from context
+	var (
+		ownAccount = c.MustGet("account").(*models.Account)
+		token      = c.MustGet("token").(*models.Token)
+	)
+
+	// Resolve the ID from the URL
+	id := c.Param("id")
+	if id == "me" {
+		id = ownAccount.ID
+	}
+
+	// Check the scope
+	if id == ownAccount.ID {
+		if !models.InScope(token.Scope, []string{"rules:read"}) {
+			c.JSON(403, &gin.H{
+				"code":  0,
+				"error": "Your token has insufficient scope",
+			})
+			return
+		}
+	} else {
+		if !models.InScope(token.Scope, []string{"admin"}) {
+			c.JSON(403, &gin.H{
+				"code":  0,
+				"error": "Your token has insufficient scope",
+			})
+			return
+		}
+	}
+
+	// Get the rules from database, accounts without them get an empty script
+	cursor, err := r.Table("rules").Get(id).Default(map[string]interface{}{}).Run(a.Rethink)
+	if err != nil {
+		c.JSON(500, &gin.H{
+			"code":  0,
+			"error": err.Error(),
+		})
+		return
+	}
+	defer cursor.Close()
+	var rules models.Rules
+	if err := cursor.One(&rules); err != nil {
+		c.JSON(500, &gin.H{
+			"code":  0,
+			"error": err.Error(),
+		})
+		return
+	}
+	if rules.ID == "" {
+		rules.ID = id
+		rules.Owner = id
+	}
+
+	// Write the response
+	c.JSON(200, rules)
+}
+
+func (a *API) updateAccountRules(c *gin.Context) {
+	// Token and account from context
+	var (
+		ownAccount = c.MustGet("account").(*models.Account)
+		token      = c.MustGet("token").(*models.Token)
+	)
+
+	// Resolve the ID from the URL
+	id := c.Param("id")
+	if id == "me" {
+		id = ownAccount.ID
+	}
+
+	// Check the scope
+	if id == ownAccount.ID {
+		if !models.InScope(token.Scope, []string{"rules:modify"}) {
+			c.JSON(403, &gin.H{
+				"code":  0,
+				"error": "Your token has insufficient scope",
+			})
+			return
+		}
+	} else {
+		if !models.InScope(token.Scope, []string{"admin"}) {
+			c.JSON(403, &gin.H{
+				"code":  0,
+				"error": "Your token has insufficient scope",
+			})
+			return
+		}
+	}
+
+	// Decode the input
+	var input struct {
+		Script string `json:"script"`
+	}
+	if err := c.Bind(&input); err != nil {
+		c.JSON(422, &gin.H{
+			"code":    CodeGeneralInvalidInput,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	// Validate the script so that it doesn't fail during the delivery
+	if _, err := sieve.Parse(input.Script); err != nil {
+		response := &gin.H{
+			"code":    CodeGeneralInvalidInput,
+			"message": "Invalid script",
+			"errors":  []string{err.Error()},
+		}
+		if serr, ok := err.(*sieve.Error); ok {
+			(*response)["line"] = serr.Line
+		}
+		c.JSON(422, response)
+		return
+	}
+
+	// Replace the existing rules
+	rules := &models.Rules{
+		ID:           id,
+		DateCreated:  time.Now(),
+		DateModified: time.Now(),
+		Owner:        id,
+		Script:       input.Script,
+	}
+	if err := r.Table("rules").Get(id).Replace(func(old r.Term) r.Term {
+		return r.Branch(
+			old.Eq(nil),
+			rules,
+			r.Expr(rules).Merge(map[string]interface{}{
+				"date_created": old.Field("date_created"),
+			}),
+		)
+	}).Exec(a.Rethink); err != nil {
+		c.JSON(500, &gin.H{
+			"code":  0,
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(200, rules)
+}
@@ -59,9 +59,10 @@ func (a *API) getLabelThreads(c *gin.Context) {
 		}
 	}
 
-	// Get threads from the database
+	// Get threads from the database. Subjects and recipients are only listed
+	// from the encrypted manifests, which include the protected headers.
 	cursor, err = r.Table("threads").GetAllByIndex("labels", label.ID).OrderBy(r.Desc("date_modified")).Map(func(thread r.Term) r.Term {
-		return thread.Merge(map[string]interface{}{
+		return thread.Without("members").Merge(map[string]interface{}{
 			"manifest": r.Table("emails").GetAllByIndex("thread", thread.Field("id")).OrderBy("date_modified").CoerceTo("array"),
 		}).Do(func(thread r.Term) r.Term {
 			return r.Branch(
@@ -0,0 +1,188 @@
+package api
+
+import (
+	"time"
+
+	r "github.com/pgpst/pgpst/internal/github.com/dancannon/gorethink"
+	"github.com/pgpst/pgpst/internal/github.com/gin-gonic/gin"
+
+	"github.com/pgpst/pgpst/pkg/models"
+)
+
+// Limits of the vacation settings
+const (
+	defaultVacationInterval = 7
+	maxVacationInterval     = 365
+	maxVacationSubject      = 255
+	maxVacationBody         = 16 * 1024
+)
+
+func (a *API) getAccountVacation(c *gin.Context) {
+	// Token and account from context
+	var (
+		ownAccount = c.MustGet("account").(*models.Account)
+		token      = c.MustGet("token").(*models.Token)
+	)
+
+	// Resolve the ID from the URL
+	id := c.Param("id")
+	if id == "me" {
+		id = ownAccount.ID
+	}
+
+	// Check the scope
+	if id == ownAccount.ID {
+		if !models.InScope(token.Scope, []string{"vacation:read"}) {
+			c.JSON(403, &gin.H{
+				"code":  0,
+				"error": "Your token has insufficient scope",
+			})
+			return
+		}
+	} else {
+		if !models.InScope(token.Scope, []string{"admin"}) {
+			c.JSON(403, &gin.H{
+				"code":  0,
+				"error": "Your token has insufficient scope",
+			})
+			return
+		}
+	}
+
+	// Get the vacation from database, accounts without it get a disabled one
+	cursor, err := r.Table("vacations").Get(id).Default(map[string]interface{}{}).Run(a.Rethink)
+	if err != nil {
+		c.JSON(500, &gin.H{
+			"code":  0,
+			"error": err.Error(),
+		})
+		return
+	}
+	defer cursor.Close()
+	var vacation models.Vacation
+	if err := cursor.One(&vacation); err != nil {
+		c.JSON(500, &gin.H{
+			"code":  0,
+			"error": err.Error(),
+		})
+		return
+	}
+	if vacation.ID == "" {
+		vacation.ID = id
+		vacation.Owner = id
+		vacation.Interval = defaultVacationInterval
+	}
+
+	// Write the response
+	c.JSON(200, vacation)
+}
+
+func (a *API) updateAccountVacation(c *gin.Context) {
+	// Token and account from context
+	var (
+		ownAccount = c.MustGet("account").(*models.Account)
+		token      = c.MustGet("token").(*models.Token)
+	)
+
+	// Resolve the ID from the URL
+	id := c.Param("id")
+	if id == "me" {
+		id = ownAccount.ID
+	}
+
+	// Check the scope
+	if id == ownAccount.ID {
+		if !models.InScope(token.Scope, []string{"vacation:modify"}) {
+			c.JSON(403, &gin.H{
+				"code":  0,
+				"error": "Your token has insufficient scope",
+			})
+			return
+		}
+	} else {
+		if !models.InScope(token.Scope, []string{"admin"}) {
+			c.JSON(403, &gin.H{
+				"code":  0,
+				"error": "Your token has insufficient scope",
+			})
+			return
+		}
+	}
+
+	// Decode the input
+	var input struct {
+		Enabled   bool      `json:"enabled"`
+		Subject   string    `json:"subject"`
+		Body      string    `json:"body"`
+		StartDate time.Time `json:"start_date"`
+		EndDate   time.Time `json:"end_date"`
+		Interval  int       `json:"interval"`
+	}
+	if err := c.Bind(&input); err != nil {
+		c.JSON(422, &gin.H{
+			"code":    CodeGeneralInvalidInput,
+			"message": err.Error(),
+		})
+		return
+	}
+	if input.Interval == 0 {
+		input.Interval = defaultVacationInterval
+	}
+
+	// Validate the input
+	errors := []string{}
+	if input.Enabled && input.Body == "" {
+		errors = append(errors, "Body is required to enable the vacation.")
+	}
+	if len(input.Subject) > maxVacationSubject {
+		errors = append(errors, "Subject too long.")
+	}
+	if len(input.Body) > maxVacationBody {
+		errors = append(errors, "Body too long.")
+	}
+	if input.Interval < 1 || input.Interval > maxVacationInterval {
+		errors = append(errors, "Invalid interval. It must be 1-365 days long.")
+	}
+	if !input.StartDate.IsZero() && !input.EndDate.IsZero() && !input.EndDate.After(input.StartDate) {
+		errors = append(errors, "End date must be after the start date.")
+	}
+	if len(errors) > 0 {
+		c.JSON(422, &gin.H{
+			"code":    CodeGeneralInvalidInput,
+			"message": "Validation failed",
+			"errors":  errors,
+		})
+		return
+	}
+
+	// Replace the existing vacation
+	vacation := &models.Vacation{
+		ID:           id,
+		DateCreated:  time.Now(),
+		DateModified: time.Now(),
+		Owner:        id,
+		Enabled:      input.Enabled,
+		Subject:      input.Subject,
+		Body:         input.Body,
+		StartDate:    input.StartDate,
+		EndDate:      input.EndDate,
+		Interval:     input.Interval,
+	}
+	if err := r.Table("vacations").Get(id).Replace(func(old r.Term) r.Term {
+		return r.Branch(
+			old.Eq(nil),
+			vacation,
+			r.Expr(vacation).Merge(map[string]interface{}{
+				"date_created": old.Field("date_created"),
+			}),
+		)
+	}).Exec(a.Rethink); err != nil {
+		c.JSON(500, &gin.H{
+			"code":  0,
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(200, vacation)
+}
@@ -0,0 +1,151 @@
+package api
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	r "github.com/pgpst/pgpst/internal/github.com/dancannon/gorethink"
+	"github.com/pgpst/pgpst/internal/github.com/gin-gonic/gin"
+
+	"github.com/pgpst/pgpst/pkg/models"
+	"github.com/pgpst/pgpst/pkg/utils"
+	"github.com/pgpst/pgpst/pkg/wkd"
+)
+
+func (a *API) readWKD(c *gin.Context) {
+	request, err := wkd.ParsePath(c.Request.URL.Path)
+	if err != nil {
+		c.JSON(404, &gin.H{
+			"code":    0,
+			"message": "Not found",
+		})
+		return
+	}
+
+	// Web clients look up the keys of other domains, so the directory has
+	// to be readable from any origin
+	c.Header("Access-Control-Allow-Origin", "*")
+
+	// The direct layout is served on the domain itself
+	domainID := request.Domain
+	if domainID == "" {
+		domainID = c.Request.Host
+		if host, _, err := net.SplitHostPort(domainID); err == nil {
+			domainID = host
+		}
+		domainID = strings.ToLower(domainID)
+	}
+
+	// Only the verified domains have a directory
+	domain, err := a.getDomain(domainID)
+	if err != nil {
+		c.JSON(500, &gin.H{
+			"code":    0,
+			"message": err.Error(),
+		})
+		return
+	}
+	if !domain.IsVerified() {
+		c.JSON(404, &gin.H{
+			"code":    0,
+			"message": "Domain not found",
+		})
+		return
+	}
+
+	// The policy is empty, nothing but the keys is supported
+	if request.Hash == "" {
+		c.Data(200, "text/plain", []byte{})
+		return
+	}
+
+	// Clients may send the local part in the l parameter, which has to
+	// match the hash
+	if local := c.Query("l"); local != "" && wkd.Hash(local) != request.Hash {
+		c.JSON(404, &gin.H{
+			"code":    0,
+			"message": "Key not found",
+		})
+		return
+	}
+
+	// Resolve the hash using the addresses' hashed local parts
+	cursor, err := r.Table("addresses").GetAllByIndex("wkdHashDomain", []interface{}{
+		request.Hash,
+		domain.ID,
+	}).Pluck("id", "owner", "public_key").Limit(1).Run(a.Rethink)
+	if err != nil {
+		c.JSON(500, &gin.H{
+			"code":    0,
+			"message": err.Error(),
+		})
+		return
+	}
+	defer cursor.Close()
+	var addresses []*models.Address
+	if err := cursor.All(&addresses); err != nil {
+		c.JSON(500, &gin.H{
+			"code":    0,
+			"message": err.Error(),
+		})
+		return
+	}
+	if len(addresses) == 0 {
+		c.JSON(404, &gin.H{
+			"code":    0,
+			"message": "Key not found",
+		})
+		return
+	}
+	address := addresses[0]
+
+	// Serve the key that the mailer encrypts the address's emails to
+	cursor, err = r.Table("keys").GetAllByIndex("owner", address.Owner).Run(a.Rethink)
+	if err != nil {
+		c.JSON(500, &gin.H{
+			"code":    0,
+			"message": err.Error(),
+		})
+		return
+	}
+	defer cursor.Close()
+	var keys []*models.Key
+	if err := cursor.All(&keys); err != nil {
+		c.JSON(500, &gin.H{
+			"code":    0,
+			"message": err.Error(),
+		})
+		return
+	}
+	key := models.DefaultKey(address, keys, time.Now())
+	if key == nil {
+		c.JSON(404, &gin.H{
+			"code":    0,
+			"message": "Key not found",
+		})
+		return
+	}
+
+	// Export only the identities of the address
+	body, err := wkd.Export(key.Body, func(identity string) bool {
+		normalized, _ := utils.SplitAddress(identity)
+		return normalized == address.ID
+	})
+	if err == wkd.ErrNoIdentity {
+		c.JSON(404, &gin.H{
+			"code":    0,
+			"message": "Key not found",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(500, &gin.H{
+			"code":    0,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.Data(200, "application/octet-stream", body)
+}
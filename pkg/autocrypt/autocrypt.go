@@ -0,0 +1,205 @@
+// Package autocrypt implements the headers, the peer state and the
+// recommendations of Autocrypt Level 1 (https://autocrypt.org/level1.html).
+package autocrypt
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/pgpst/pgpst/pkg/models"
+)
+
+// HeaderName is the header field carrying the sender's key.
+const HeaderName = "Autocrypt"
+
+// Values of the prefer-encrypt attribute
+const (
+	Mutual       = "mutual"
+	NoPreference = "nopreference"
+)
+
+// Recommendations for encrypting an email to a peer
+const (
+	Disable    = "disable"
+	Discourage = "discourage"
+	Available  = "available"
+	Encrypt    = "encrypt"
+)
+
+// Recommendations lists the values that the clients can override the
+// recommendations with.
+var Recommendations = map[string]struct{}{
+	Disable:    {},
+	Discourage: {},
+	Available:  {},
+	Encrypt:    {},
+}
+
+// staleAfter is the time without an Autocrypt header after which the key of
+// a peer is discouraged.
+const staleAfter = 35 * 24 * time.Hour
+
+// Errors returned by Parse
+var (
+	ErrMissingAttribute   = errors.New("autocrypt: addr and keydata attributes are required")
+	ErrUnknownAttribute   = errors.New("autocrypt: unknown critical attribute")
+	ErrInvalidAttribute   = errors.New("autocrypt: invalid attribute")
+	ErrInvalidKeyData     = errors.New("autocrypt: keydata is not valid base64")
+	ErrDuplicateAttribute = errors.New("autocrypt: duplicate attribute")
+)
+
+// Header is a parsed Autocrypt header.
+type Header struct {
+	Address       string // lowercase address of the sender
+	PreferEncrypt string // mutual or nopreference
+	KeyData       []byte // binary OpenPGP key
+}
+
+// Parse reads the attributes of an Autocrypt header. Unknown attributes are
+// only allowed if they start with an underscore.
+func Parse(value string) (*Header, error) {
+	var (
+		header = &Header{PreferEncrypt: NoPreference}
+		seen   = map[string]struct{}{}
+	)
+
+	for _, attribute := range strings.Split(value, ";") {
+		attribute = strings.TrimSpace(attribute)
+		if attribute == "" {
+			continue
+		}
+
+		index := strings.Index(attribute, "=")
+		if index == -1 {
+			return nil, ErrInvalidAttribute
+		}
+		name, value := strings.ToLower(strings.TrimSpace(attribute[:index])), strings.TrimSpace(attribute[index+1:])
+		if _, ok := seen[name]; ok {
+			return nil, ErrDuplicateAttribute
+		}
+		seen[name] = struct{}{}
+
+		switch name {
+		case "addr":
+			header.Address = strings.ToLower(value)
+		case "prefer-encrypt":
+			if value == Mutual {
+				header.PreferEncrypt = Mutual
+			}
+		case "keydata":
+			// Folding leaves whitespace in the data
+			data, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(value), ""))
+			if err != nil {
+				return nil, ErrInvalidKeyData
+			}
+			header.KeyData = data
+		default:
+			if !strings.HasPrefix(name, "_") {
+				return nil, ErrUnknownAttribute
+			}
+		}
+	}
+
+	if header.Address == "" || len(header.KeyData) == 0 {
+		return nil, ErrMissingAttribute
+	}
+
+	return header, nil
+}
+
+// String formats the header value, folding the key data.
+func (h *Header) String() string {
+	parts := []string{"addr=" + h.Address}
+	if h.PreferEncrypt == Mutual {
+		parts = append(parts, "prefer-encrypt="+Mutual)
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(h.KeyData)
+	lines := []string{}
+	for len(encoded) > 76 {
+		lines = append(lines, encoded[:76])
+		encoded = encoded[76:]
+	}
+	lines = append(lines, encoded)
+	parts = append(parts, "keydata=\r\n "+strings.Join(lines, "\r\n "))
+
+	return strings.Join(parts, "; ")
+}
+
+// Find returns the Autocrypt header of the sender. Emails with several valid
+// headers for the sender are treated as if they had none.
+func Find(header mail.Header, from string) *Header {
+	from = strings.ToLower(from)
+
+	var found *Header
+	for _, value := range header[HeaderName] {
+		parsed, err := Parse(value)
+		if err != nil || parsed.Address != from {
+			continue
+		}
+		if found != nil {
+			return nil
+		}
+		found = parsed
+	}
+
+	return found
+}
+
+// PeerID returns the ID of the owner's peer with the address, so that the
+// address itself isn't stored. It's keyed with the server's secret, as plain
+// hashes of addresses could be reversed by guessing them.
+func PeerID(secret []byte, owner string, address string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(owner + "\x00" + strings.ToLower(address)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Update applies an email from the peer sent at the date to its state. The
+// header may be nil. It returns true if the key and the preference of the
+// peer were replaced with the header's ones.
+func Update(peer *models.Peer, header *Header, date time.Time, now time.Time) bool {
+	// Dates from the future are not trusted
+	if date.After(now) {
+		date = now
+	}
+
+	replaced := false
+	if header != nil && date.After(peer.AutocryptTimestamp) {
+		peer.AutocryptTimestamp = date
+		peer.PreferEncrypt = header.PreferEncrypt
+		replaced = true
+	}
+	if date.After(peer.LastSeen) {
+		peer.LastSeen = date
+	}
+
+	return replaced
+}
+
+// Recommend decides whether an email to the peer should be encrypted. Own
+// preference is the prefer-encrypt setting of the sending account. The
+// clients' overrides take precedence.
+func Recommend(peer *models.Peer, ownPreference string) string {
+	if peer.Override != "" {
+		return peer.Override
+	}
+
+	if peer.AutocryptTimestamp.IsZero() {
+		return Disable
+	}
+	if peer.LastSeen.Sub(peer.AutocryptTimestamp) > staleAfter {
+		return Discourage
+	}
+	if ownPreference == Mutual && peer.PreferEncrypt == Mutual {
+		return Encrypt
+	}
+
+	return Available
+}
@@ -0,0 +1,146 @@
+package autocrypt_test
+
+import (
+	"bufio"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/pgpst/pgpst/internal/github.com/smartystreets/goconvey/convey"
+
+	"github.com/pgpst/pgpst/pkg/autocrypt"
+	"github.com/pgpst/pgpst/pkg/models"
+)
+
+func parseHeader(header string) mail.Header {
+	msg, err := mail.ReadMessage(bufio.NewReader(strings.NewReader(header + "\r\n")))
+	if err != nil {
+		panic(err)
+	}
+
+	return msg.Header
+}
+
+func TestParse(t *testing.T) {
+	Convey("A valid header should be parsed", t, func() {
+		header, err := autocrypt.Parse("addr=Alice@Example.org; prefer-encrypt=mutual; _ignored=1; keydata=\r\n a2V5\r\n ZGF0YQ==")
+		So(err, ShouldBeNil)
+		So(header.Address, ShouldEqual, "alice@example.org")
+		So(header.PreferEncrypt, ShouldEqual, autocrypt.Mutual)
+		So(string(header.KeyData), ShouldEqual, "keydata")
+	})
+
+	Convey("Unknown preferences should mean no preference", t, func() {
+		header, err := autocrypt.Parse("addr=alice@example.org; prefer-encrypt=always; keydata=a2V5")
+		So(err, ShouldBeNil)
+		So(header.PreferEncrypt, ShouldEqual, autocrypt.NoPreference)
+	})
+
+	Convey("Invalid headers should be rejected", t, func() {
+		_, err := autocrypt.Parse("addr=alice@example.org")
+		So(err, ShouldEqual, autocrypt.ErrMissingAttribute)
+		_, err = autocrypt.Parse("addr=alice@example.org; type=2; keydata=a2V5")
+		So(err, ShouldEqual, autocrypt.ErrUnknownAttribute)
+		_, err = autocrypt.Parse("addr=alice@example.org; keydata=!!!")
+		So(err, ShouldEqual, autocrypt.ErrInvalidKeyData)
+		_, err = autocrypt.Parse("addr=alice@example.org; addr=bob@example.org; keydata=a2V5")
+		So(err, ShouldEqual, autocrypt.ErrDuplicateAttribute)
+		_, err = autocrypt.Parse("addr=alice@example.org; keydata")
+		So(err, ShouldEqual, autocrypt.ErrInvalidAttribute)
+	})
+
+	Convey("Formatted headers should be parsed back", t, func() {
+		input := &autocrypt.Header{
+			Address:       "alice@example.org",
+			PreferEncrypt: autocrypt.Mutual,
+			KeyData:       []byte(strings.Repeat("key data ", 30)),
+		}
+		value := input.String()
+		for _, line := range strings.Split(value, "\r\n") {
+			So(len(line), ShouldBeLessThanOrEqualTo, 78)
+		}
+
+		header := parseHeader("Autocrypt: " + value + "\r\n")
+		output := autocrypt.Find(header, "Alice@example.org")
+		So(output, ShouldResemble, input)
+	})
+}
+
+func TestFind(t *testing.T) {
+	Convey("Headers of other addresses should be ignored", t, func() {
+		header := parseHeader("Autocrypt: addr=bob@example.org; keydata=a2V5\r\n" +
+			"Autocrypt: addr=alice@example.org; keydata=a2V5\r\n")
+		So(autocrypt.Find(header, "alice@example.org").Address, ShouldEqual, "alice@example.org")
+		So(autocrypt.Find(header, "carol@example.org"), ShouldBeNil)
+	})
+
+	Convey("Several headers of the sender should be ignored", t, func() {
+		header := parseHeader("Autocrypt: addr=alice@example.org; keydata=a2V5\r\n" +
+			"Autocrypt: addr=alice@example.org; keydata=b3RoZXI=\r\n")
+		So(autocrypt.Find(header, "alice@example.org"), ShouldBeNil)
+	})
+}
+
+func TestPeer(t *testing.T) {
+	var (
+		now    = time.Now()
+		header = &autocrypt.Header{
+			Address:       "alice@example.org",
+			PreferEncrypt: autocrypt.Mutual,
+			KeyData:       []byte("key"),
+		}
+	)
+
+	Convey("Given a new peer", t, func() {
+		peer := &models.Peer{}
+		So(autocrypt.Recommend(peer, autocrypt.Mutual), ShouldEqual, autocrypt.Disable)
+
+		Convey("Emails without a header should only update the last seen date", func() {
+			So(autocrypt.Update(peer, nil, now.Add(-time.Hour), now), ShouldBeFalse)
+			So(peer.LastSeen, ShouldResemble, now.Add(-time.Hour))
+			So(peer.AutocryptTimestamp.IsZero(), ShouldBeTrue)
+			So(autocrypt.Recommend(peer, autocrypt.Mutual), ShouldEqual, autocrypt.Disable)
+		})
+
+		Convey("Headers should replace the key and the preference", func() {
+			So(autocrypt.Update(peer, header, now.Add(-time.Hour), now), ShouldBeTrue)
+			So(peer.PreferEncrypt, ShouldEqual, autocrypt.Mutual)
+			So(autocrypt.Recommend(peer, autocrypt.Mutual), ShouldEqual, autocrypt.Encrypt)
+			So(autocrypt.Recommend(peer, autocrypt.NoPreference), ShouldEqual, autocrypt.Available)
+
+			Convey("Older emails should not replace them", func() {
+				older := &autocrypt.Header{Address: "alice@example.org", PreferEncrypt: autocrypt.NoPreference}
+				So(autocrypt.Update(peer, older, now.Add(-time.Hour*2), now), ShouldBeFalse)
+				So(peer.PreferEncrypt, ShouldEqual, autocrypt.Mutual)
+				So(peer.LastSeen, ShouldResemble, now.Add(-time.Hour))
+			})
+
+			Convey("Keys unused for long should be discouraged", func() {
+				autocrypt.Update(peer, nil, now.Add(time.Hour*24*36), now.Add(time.Hour*24*36))
+				So(autocrypt.Recommend(peer, autocrypt.Mutual), ShouldEqual, autocrypt.Discourage)
+			})
+
+			Convey("Overrides should take precedence", func() {
+				peer.Override = autocrypt.Disable
+				So(autocrypt.Recommend(peer, autocrypt.Mutual), ShouldEqual, autocrypt.Disable)
+			})
+		})
+
+		Convey("Dates from the future should be replaced with the current time", func() {
+			autocrypt.Update(peer, header, now.Add(time.Hour), now)
+			So(peer.AutocryptTimestamp, ShouldResemble, now)
+			So(peer.LastSeen, ShouldResemble, now)
+		})
+	})
+
+	Convey("Peer IDs should not depend on the case of the address", t, func() {
+		secret := []byte("secret")
+		So(autocrypt.PeerID(secret, "bob", "Alice@example.org"), ShouldEqual, autocrypt.PeerID(secret, "bob", "alice@example.org"))
+		So(autocrypt.PeerID(secret, "bob", "alice@example.org"), ShouldNotEqual, autocrypt.PeerID(secret, "carol", "alice@example.org"))
+	})
+
+	Convey("Peer IDs should depend on the secret", t, func() {
+		So(autocrypt.PeerID([]byte("secret"), "bob", "alice@example.org"), ShouldNotEqual, autocrypt.PeerID([]byte("other"), "bob", "alice@example.org"))
+	})
+}
@@ -18,6 +18,7 @@ import (
 
 	"github.com/pgpst/pgpst/pkg/models"
 	"github.com/pgpst/pgpst/pkg/utils"
+	"github.com/pgpst/pgpst/pkg/wkd"
 )
 
 func accountsAdd(c *cli.Context) int {
@@ -107,6 +108,12 @@ func accountsAdd(c *cli.Context) int {
 	styledID := utils.NormalizeAddress(input.MainAddress)
 	input.MainAddress = utils.RemoveDots(styledID)
 
+	// It has to be on a verified domain
+	if err := checkDomain(session, input.MainAddress); err != nil {
+		writeError(c, err)
+		return 1
+	}
+
 	// Then check if it's taken.
 	cursor, err := r.Table("addresses").Get(input.MainAddress).Ne(nil).Run(session)
 	if err != nil {
@@ -176,6 +183,7 @@ func accountsAdd(c *cli.Context) int {
 		DateCreated:  time.Now(),
 		DateModified: time.Now(),
 		Owner:        account.ID,
+		WKDHashes:    wkd.AddressHashes(input.MainAddress, styledID),
 	}
 
 	var labels []*models.Label
@@ -13,7 +13,9 @@ import (
 	"github.com/pgpst/pgpst/internal/github.com/pzduniak/termtables"
 
 	"github.com/pgpst/pgpst/pkg/models"
+	"github.com/pgpst/pgpst/pkg/quota"
 	"github.com/pgpst/pgpst/pkg/utils"
+	"github.com/pgpst/pgpst/pkg/wkd"
 )
 
 func addressesAdd(c *cli.Context) int {
@@ -27,6 +29,7 @@ func addressesAdd(c *cli.Context) int {
 	var input struct {
 		ID    string `json:"id"`
 		Owner string `json:"owner"`
+		Type  string `json:"type"`
 	}
 
 	// Read JSON from stdin
@@ -58,6 +61,18 @@ func addressesAdd(c *cli.Context) int {
 		input.Owner = strings.TrimSpace(input.Owner)
 	}
 
+	// Group addresses can be also requested with a flag
+	if c.Bool("group") {
+		input.Type = "group"
+	}
+	if input.Type == "personal" {
+		input.Type = ""
+	}
+	if input.Type != "" && input.Type != "group" {
+		writeError(c, fmt.Errorf("Type has to be either personal or group. Got %s.", input.Type))
+		return 1
+	}
+
 	// First of all, the address. Append domain if it has no such suffix.
 	if strings.Index(input.ID, "@") == -1 {
 		input.ID += "@" + c.GlobalString("default_domain")
@@ -67,6 +82,12 @@ func addressesAdd(c *cli.Context) int {
 	styledID := utils.NormalizeAddress(input.ID)
 	input.ID = utils.RemoveDots(styledID)
 
+	// It has to be on a verified domain
+	if err := checkDomain(session, input.ID); err != nil {
+		writeError(c, err)
+		return 1
+	}
+
 	// Then check if it's taken.
 	cursor, err := r.Table("addresses").Get(input.ID).Ne(nil).Run(session)
 	if err != nil {
@@ -85,21 +106,43 @@ func addressesAdd(c *cli.Context) int {
 	}
 
 	// Check if account ID exists
-	cursor, err = r.Table("accounts").Get(input.Owner).Ne(nil).Run(session)
+	cursor, err = r.Table("accounts").Get(input.Owner).Default(map[string]interface{}{}).Run(session)
 	if err != nil {
 		writeError(c, err)
 	}
 	defer cursor.Close()
-	var exists bool
-	if err := cursor.One(&exists); err != nil {
+	var account models.Account
+	if err := cursor.One(&account); err != nil {
 		writeError(c, err)
 		return 1
 	}
-	if !exists {
+	if account.ID == "" {
 		writeError(c, fmt.Errorf("Account %s doesn't exist", input.ID))
 		return 1
 	}
 
+	// The plan of the account limits the amount of addresses
+	plan, _, err := quota.Lookup(session, &account)
+	if err != nil {
+		writeError(c, err)
+		return 1
+	}
+	cursor, err = r.Table("addresses").GetAllByIndex("owner", account.ID).Count().Run(session)
+	if err != nil {
+		writeError(c, err)
+		return 1
+	}
+	defer cursor.Close()
+	var count int
+	if err := cursor.One(&count); err != nil {
+		writeError(c, err)
+		return 1
+	}
+	if !plan.CanAddAddress(count) {
+		writeError(c, fmt.Errorf("Account %s has reached the limit of %d addresses", account.ID, plan.MaxAddresses))
+		return 1
+	}
+
 	// Insert the address into the database
 	address := &models.Address{
 		ID:           input.ID,
@@ -107,6 +150,8 @@ func addressesAdd(c *cli.Context) int {
 		DateCreated:  time.Now(),
 		DateModified: time.Now(),
 		Owner:        input.Owner,
+		Type:         input.Type,
+		WKDHashes:    wkd.AddressHashes(input.ID, styledID),
 	}
 
 	if !c.GlobalBool("dry") {
@@ -170,3 +215,132 @@ func addressesList(c *cli.Context) int {
 
 	return 0
 }
+
+func addressesMembers(c *cli.Context) int {
+	// Connect to RethinkDB
+	_, session, connected := connectToRethinkDB(c)
+	if !connected {
+		return 1
+	}
+
+	// Normalize the address, appending the default domain if needed
+	id := c.String("address")
+	if id == "" {
+		writeError(c, fmt.Errorf("No address specified"))
+		return 1
+	}
+	if strings.Index(id, "@") == -1 {
+		id += "@" + c.GlobalString("default_domain")
+	}
+	id = utils.RemoveDots(utils.NormalizeAddress(id))
+
+	// Fetch the address
+	cursor, err := r.Table("addresses").Get(id).Default(map[string]interface{}{}).Run(session)
+	if err != nil {
+		writeError(c, err)
+		return 1
+	}
+	defer cursor.Close()
+	var address models.Address
+	if err := cursor.One(&address); err != nil {
+		writeError(c, err)
+		return 1
+	}
+	if address.ID == "" {
+		writeError(c, fmt.Errorf("Address %s doesn't exist", id))
+		return 1
+	}
+	if !address.IsGroup() {
+		writeError(c, fmt.Errorf("Address %s is not a group", id))
+		return 1
+	}
+
+	// Apply the changes
+	members := []string{}
+	removed := map[string]struct{}{}
+	for _, member := range c.StringSlice("remove") {
+		removed[member] = struct{}{}
+	}
+	for _, member := range address.Members {
+		if _, ok := removed[member]; !ok {
+			members = append(members, member)
+		}
+	}
+	for _, member := range c.StringSlice("add") {
+		cursor, err := r.Table("accounts").Get(member).Ne(nil).Run(session)
+		if err != nil {
+			writeError(c, err)
+			return 1
+		}
+		defer cursor.Close()
+		var exists bool
+		if err := cursor.One(&exists); err != nil {
+			writeError(c, err)
+			return 1
+		}
+		if !exists {
+			writeError(c, fmt.Errorf("Account %s doesn't exist", member))
+			return 1
+		}
+
+		found := false
+		for _, existing := range members {
+			if existing == member {
+				found = true
+			}
+		}
+		if !found {
+			members = append(members, member)
+		}
+	}
+
+	if (len(c.StringSlice("add")) > 0 || len(c.StringSlice("remove")) > 0) && !c.Bool("dry") {
+		if err := r.Table("addresses").Get(address.ID).Update(map[string]interface{}{
+			"members":       members,
+			"date_modified": time.Now(),
+		}).Exec(session); err != nil {
+			writeError(c, err)
+			return 1
+		}
+	}
+
+	// Get the members' accounts
+	var accounts []struct {
+		ID          string `json:"id" gorethink:"id"`
+		MainAddress string `json:"main_address" gorethink:"main_address"`
+	}
+	if len(members) > 0 {
+		cursor, err = r.Table("accounts").GetAll(r.Args(members)).Pluck("id", "main_address").Run(session)
+		if err != nil {
+			writeError(c, err)
+			return 1
+		}
+		defer cursor.Close()
+		if err := cursor.All(&accounts); err != nil {
+			writeError(c, err)
+			return 1
+		}
+	}
+
+	// Write the output
+	if c.Bool("json") {
+		if err := json.NewEncoder(c.App.Writer).Encode(accounts); err != nil {
+			writeError(c, err)
+			return 1
+		}
+
+		fmt.Fprintf(c.App.Writer, "\n")
+	} else {
+		table := termtables.CreateTable()
+		table.AddHeaders("id", "main_address")
+		for _, account := range accounts {
+			table.AddRow(
+				account.ID,
+				account.MainAddress,
+			)
+		}
+		fmt.Fprintln(c.App.Writer, table.Render())
+	}
+
+	return 0
+}
@@ -80,6 +80,10 @@ func Run(r io.Reader, w io.Writer, args []string) (int, error) {
 							Name:  "dry",
 							Usage: "Start a dry run",
 						},
+						cli.BoolFlag{
+							Name:  "group",
+							Usage: "Create a group address",
+						},
 					},
 					Action: addressesAdd,
 				},
@@ -94,6 +98,33 @@ func Run(r io.Reader, w io.Writer, args []string) (int, error) {
 					},
 					Action: addressesList,
 				},
+				{
+					Name:  "members",
+					Usage: "lists and changes members of a group address",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "address",
+							Usage: "Group address to manage",
+						},
+						cli.StringSliceFlag{
+							Name:  "add",
+							Usage: "ID of an account to add",
+						},
+						cli.StringSliceFlag{
+							Name:  "remove",
+							Usage: "ID of an account to remove",
+						},
+						cli.BoolFlag{
+							Name:  "json",
+							Usage: "Output JSON",
+						},
+						cli.BoolFlag{
+							Name:  "dry",
+							Usage: "Start a dry run",
+						},
+					},
+					Action: addressesMembers,
+				},
 			},
 		},
 		{
@@ -160,6 +191,179 @@ func Run(r io.Reader, w io.Writer, args []string) (int, error) {
 				},
 			},
 		},
+		{
+			Name:  "dkim",
+			Usage: "Manage DKIM signing keys",
+			Subcommands: []cli.Command{
+				{
+					Name:  "generate",
+					Usage: "creates a new signing key",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "domain",
+							Usage: "Domain of the key, defaults to default_domain",
+						},
+						cli.StringFlag{
+							Name:  "selector",
+							Usage: "Selector of the key, defaults to pgpstYYYYMMDD",
+						},
+						cli.StringFlag{
+							Name:  "algorithm",
+							Value: "rsa",
+							Usage: "Key algorithm, rsa or ed25519",
+						},
+						cli.IntFlag{
+							Name:  "bits",
+							Value: 2048,
+							Usage: "Length of RSA keys",
+						},
+						cli.BoolFlag{
+							Name:  "dry",
+							Usage: "Start a dry run",
+						},
+					},
+					Action: dkimGenerate,
+				},
+				{
+					Name:  "rotate",
+					Usage: "activates the newest pending key and retires the current one",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "domain",
+							Usage: "Domain to rotate, defaults to default_domain",
+						},
+						cli.BoolFlag{
+							Name:  "dry",
+							Usage: "Start a dry run",
+						},
+					},
+					Action: dkimRotate,
+				},
+				{
+					Name:  "dns",
+					Usage: "prints the DNS TXT records to publish",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "domain",
+							Usage: "Domain of the keys, defaults to default_domain",
+						},
+						cli.StringFlag{
+							Name:  "selector",
+							Usage: "Only print the record of this selector",
+						},
+					},
+					Action: dkimDNS,
+				},
+				{
+					Name:  "list",
+					Usage: "lists signing keys",
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "json",
+							Usage: "Output JSON",
+						},
+					},
+					Action: dkimList,
+				},
+			},
+		},
+		{
+			Name:  "domains",
+			Usage: "Manages email domains",
+			Subcommands: []cli.Command{
+				{
+					Name:  "add",
+					Usage: "adds a verified domain",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "domain",
+							Usage: "Domain to add, defaults to default_domain",
+						},
+						cli.StringFlag{
+							Name:  "owner",
+							Usage: "ID of the owning account, empty for system domains",
+						},
+						cli.BoolFlag{
+							Name:  "dry",
+							Usage: "Start a dry run",
+						},
+					},
+					Action: domainsAdd,
+				},
+				{
+					Name:  "list",
+					Usage: "lists domains",
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "json",
+							Usage: "Output JSON",
+						},
+					},
+					Action: domainsList,
+				},
+			},
+		},
+		{
+			Name:  "emails",
+			Usage: "Manage stored emails",
+			Subcommands: []cli.Command{
+				{
+					Name:  "rewrap",
+					Usage: "re-encrypts an account's emails using the current body format",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "account",
+							Usage: "ID of the account",
+						},
+						cli.StringFlag{
+							Name:  "key",
+							Usage: "Path to the account's private key",
+						},
+						cli.StringFlag{
+							Name:  "passphrase",
+							Usage: "Passphrase of the private key",
+						},
+						cli.BoolFlag{
+							Name:  "dry",
+							Usage: "Start a dry run",
+						},
+					},
+					Action: emailsRewrap,
+				},
+				{
+					Name:  "rethread",
+					Usage: "groups an account's emails into threads again",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "account",
+							Usage: "ID of the account",
+						},
+						cli.StringFlag{
+							Name:  "key",
+							Usage: "Path to the account's private key",
+						},
+						cli.StringFlag{
+							Name:  "passphrase",
+							Usage: "Passphrase of the private key",
+						},
+						cli.IntFlag{
+							Name:  "window",
+							Value: 72,
+							Usage: "Hours in which emails with the same subject and participants are threaded, 0 to disable",
+						},
+						cli.StringFlag{
+							Name:  "thread_secret",
+							Usage: "Secret used to hash the subjects, the mailer's one",
+						},
+						cli.BoolFlag{
+							Name:  "dry",
+							Usage: "Start a dry run",
+						},
+					},
+					Action: emailsRethread,
+				},
+			},
+		},
 		{
 			Name:    "tokens",
 			Aliases: []string{"toks"},
@@ -2,6 +2,8 @@ package cli_test
 
 import (
 	"bytes"
+	"encoding/hex"
+	"io/ioutil"
 	"os"
 	"regexp"
 	"testing"
@@ -9,8 +11,10 @@ import (
 
 	r "github.com/pgpst/pgpst/internal/github.com/dancannon/gorethink"
 	. "github.com/pgpst/pgpst/internal/github.com/smartystreets/goconvey/convey"
+	"github.com/pgpst/pgpst/internal/golang.org/x/crypto/openpgp"
 
 	"github.com/pgpst/pgpst/pkg/cli"
+	"github.com/pgpst/pgpst/pkg/models"
 	"github.com/pgpst/pgpst/pkg/utils"
 )
 
@@ -94,6 +98,72 @@ func TestCLI(t *testing.T) {
 		So(code, ShouldEqual, 0)
 		So(err, ShouldBeNil)
 
+		// Accounts can't be created on unknown domains
+		input.Reset()
+		input.WriteString(`{
+	"main_address": "test123x@example.com",
+	"password": "test123x",
+	"subscription": "beta",
+	"alt_email": "test123x@example.org",
+	"status": "active"
+}`)
+		output.Reset()
+		code, err = cli.Run(input, output, []string{
+			"pgpst-cli",
+			"accs",
+			"add",
+			"--json",
+		})
+		So(code, ShouldEqual, 1)
+		So(err, ShouldBeNil)
+		So(output.String(), ShouldContainSubstring, "Domain example.com is not verified")
+
+		// Add the default domain
+		output.Reset()
+		code, err = cli.Run(os.Stdin, output, []string{
+			"pgpst-cli",
+			"domains",
+			"add",
+		})
+		So(code, ShouldEqual, 0)
+		So(err, ShouldBeNil)
+		So(output.String(), ShouldContainSubstring, "Added a new domain - pgp.st")
+
+		// Adding it again should fail
+		output.Reset()
+		code, err = cli.Run(os.Stdin, output, []string{
+			"pgpst-cli",
+			"domains",
+			"add",
+			"--domain",
+			"PGP.st",
+		})
+		So(code, ShouldEqual, 1)
+		So(err, ShouldBeNil)
+
+		// Invalid domains should be refused
+		output.Reset()
+		code, err = cli.Run(os.Stdin, output, []string{
+			"pgpst-cli",
+			"domains",
+			"add",
+			"--domain",
+			"not a domain",
+		})
+		So(code, ShouldEqual, 1)
+		So(err, ShouldBeNil)
+
+		// List the domains
+		output.Reset()
+		code, err = cli.Run(os.Stdin, output, []string{
+			"pgpst-cli",
+			"domains",
+			"list",
+		})
+		So(code, ShouldEqual, 0)
+		So(err, ShouldBeNil)
+		So(output.String(), ShouldContainSubstring, "pgp.st")
+
 		// Create a new account
 		input.Reset()
 		input.WriteString(`{
@@ -439,6 +509,81 @@ account
 		So(code, ShouldEqual, 0)
 		So(err, ShouldBeNil)
 
+		// Create a group address
+		input.Reset()
+		input.WriteString(`{
+	"id": "support",
+	"owner": "` + accountID + `",
+	"type": "group"
+}`)
+		output.Reset()
+		code, err = cli.Run(input, output, []string{
+			"pgpst-cli",
+			"addrs",
+			"add",
+			"--json",
+		})
+		So(code, ShouldEqual, 0)
+		So(err, ShouldBeNil)
+
+		// Add a member to it
+		output.Reset()
+		code, err = cli.Run(os.Stdin, output, []string{
+			"pgpst-cli",
+			"addrs",
+			"members",
+			"--address",
+			"support",
+			"--add",
+			accountID,
+			"--json",
+		})
+		So(code, ShouldEqual, 0)
+		So(err, ShouldBeNil)
+		So(output.String(), ShouldContainSubstring, accountID)
+
+		// Unknown accounts can't be added
+		output.Reset()
+		code, err = cli.Run(os.Stdin, output, []string{
+			"pgpst-cli",
+			"addrs",
+			"members",
+			"--address",
+			"support",
+			"--add",
+			"nonexisting",
+		})
+		So(code, ShouldEqual, 1)
+		So(err, ShouldBeNil)
+
+		// Personal addresses have no members
+		output.Reset()
+		code, err = cli.Run(os.Stdin, output, []string{
+			"pgpst-cli",
+			"addrs",
+			"members",
+			"--address",
+			"test123123",
+		})
+		So(code, ShouldEqual, 1)
+		So(err, ShouldBeNil)
+
+		// Remove the member
+		output.Reset()
+		code, err = cli.Run(os.Stdin, output, []string{
+			"pgpst-cli",
+			"addrs",
+			"members",
+			"--address",
+			"support",
+			"--remove",
+			accountID,
+			"--json",
+		})
+		So(code, ShouldEqual, 0)
+		So(err, ShouldBeNil)
+		So(output.String(), ShouldNotContainSubstring, accountID)
+
 		// Invalid input address creation
 		input.Reset()
 		input.WriteString(`{@@@@@}`)
@@ -481,6 +626,99 @@ ownerid
 		So(code, ShouldEqual, 1)
 		So(err, ShouldBeNil)
 
+		// Generate DKIM keys
+		output.Reset()
+		code, err = cli.Run(input, output, []string{
+			"pgpst-cli",
+			"dkim",
+			"generate",
+			"--selector",
+			"first",
+			"--algorithm",
+			"ed25519",
+		})
+		So(code, ShouldEqual, 0)
+		So(err, ShouldBeNil)
+		So(output.String(), ShouldContainSubstring, "with status active")
+		So(output.String(), ShouldContainSubstring, "first._domainkey.pgp.st. IN TXT \"v=DKIM1; k=ed25519; p=")
+
+		output.Reset()
+		code, err = cli.Run(input, output, []string{
+			"pgpst-cli",
+			"dkim",
+			"generate",
+			"--selector",
+			"first",
+		})
+		So(code, ShouldEqual, 1)
+		So(err, ShouldBeNil)
+
+		output.Reset()
+		code, err = cli.Run(input, output, []string{
+			"pgpst-cli",
+			"dkim",
+			"generate",
+			"--algorithm",
+			"dsa",
+		})
+		So(code, ShouldEqual, 1)
+		So(err, ShouldBeNil)
+
+		output.Reset()
+		code, err = cli.Run(input, output, []string{
+			"pgpst-cli",
+			"dkim",
+			"rotate",
+		})
+		So(code, ShouldEqual, 1)
+		So(err, ShouldBeNil)
+
+		output.Reset()
+		code, err = cli.Run(input, output, []string{
+			"pgpst-cli",
+			"dkim",
+			"generate",
+			"--selector",
+			"second",
+			"--bits",
+			"1024",
+		})
+		So(code, ShouldEqual, 0)
+		So(err, ShouldBeNil)
+		So(output.String(), ShouldContainSubstring, "with status pending")
+
+		output.Reset()
+		code, err = cli.Run(input, output, []string{
+			"pgpst-cli",
+			"dkim",
+			"rotate",
+		})
+		So(code, ShouldEqual, 0)
+		So(err, ShouldBeNil)
+		So(output.String(), ShouldContainSubstring, "Activated selector second of pgp.st, retired 1 keys")
+
+		output.Reset()
+		code, err = cli.Run(input, output, []string{
+			"pgpst-cli",
+			"dkim",
+			"dns",
+		})
+		So(code, ShouldEqual, 0)
+		So(err, ShouldBeNil)
+		So(output.String(), ShouldContainSubstring, "second._domainkey.pgp.st. IN TXT \"v=DKIM1; k=rsa; p=")
+		So(output.String(), ShouldNotContainSubstring, "first._domainkey")
+
+		output.Reset()
+		code, err = cli.Run(input, output, []string{
+			"pgpst-cli",
+			"dkim",
+			"dns",
+			"--domain",
+			"example.org",
+		})
+		So(code, ShouldEqual, 1)
+		So(err, ShouldBeNil)
+
 		// Check existence in list commands
 		output.Reset()
 		code, err = cli.Run(input, output, []string{
@@ -568,6 +806,73 @@ ownerid
 		So(err, ShouldBeNil)
 		So(output.String(), ShouldContainSubstring, tokenID)
 
+		output.Reset()
+		code, err = cli.Run(input, output, []string{
+			"pgpst-cli",
+			"dkim",
+			"list",
+		})
+		So(code, ShouldEqual, 0)
+		So(err, ShouldBeNil)
+		So(output.String(), ShouldContainSubstring, "first")
+		So(output.String(), ShouldContainSubstring, "retired")
+
+		// Re-wrap the bodies of an account
+		entity, err := openpgp.NewEntity("test", "", "test123x@pgp.st", nil)
+		So(err, ShouldBeNil)
+		keyFile, err := ioutil.TempFile("", "pgpst-cli")
+		So(err, ShouldBeNil)
+		defer os.Remove(keyFile.Name())
+		So(entity.SerializePrivate(keyFile, nil), ShouldBeNil)
+		So(keyFile.Close(), ShouldBeNil)
+
+		// Keys that aren't stored for the account can't be used
+		output.Reset()
+		code, err = cli.Run(input, output, []string{
+			"pgpst-cli",
+			"emails",
+			"rewrap",
+			"--account",
+			accountID,
+			"--key",
+			keyFile.Name(),
+		})
+		So(code, ShouldEqual, 1)
+		So(err, ShouldBeNil)
+
+		var public bytes.Buffer
+		So(entity.Serialize(&public), ShouldBeNil)
+		So(r.Table("keys").Insert(&models.Key{
+			ID:    hex.EncodeToString(entity.PrimaryKey.Fingerprint[:]),
+			Owner: accountID,
+			Body:  public.Bytes(),
+		}).Exec(session), ShouldBeNil)
+
+		output.Reset()
+		code, err = cli.Run(input, output, []string{
+			"pgpst-cli",
+			"emails",
+			"rewrap",
+			"--account",
+			accountID,
+		})
+		So(code, ShouldEqual, 1)
+		So(err, ShouldBeNil)
+
+		output.Reset()
+		code, err = cli.Run(input, output, []string{
+			"pgpst-cli",
+			"emails",
+			"rewrap",
+			"--account",
+			accountID,
+			"--key",
+			keyFile.Name(),
+		})
+		So(code, ShouldEqual, 0)
+		So(err, ShouldBeNil)
+		So(output.String(), ShouldContainSubstring, "Re-wrapped 0 of 0 emails")
+
 		/*
 		   		Convey("accs add --json and accs add should succeed", func() {
 		   			jsonInput := strings.NewReader(`{
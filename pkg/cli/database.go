@@ -104,24 +104,43 @@ func databaseMigrate(c *cli.Context) int {
 		}
 	}
 
-	// Collect all queries
-	queries := []r.Term{}
+	// Collect all queries, with the data updates run right after the
+	// queries of their migrations
+	type step struct {
+		Query     r.Term
+		Update    func(*r.Session) error
+		Migration string
+	}
+	steps := []step{}
 	for _, migration := range migrations[version+1:] {
-		queries = append(queries, migration.Migrate(opts)...)
-		queries = append(queries, r.Table("migration_status").Get("revision").Update(map[string]interface{}{
+		for _, query := range migration.Migrate(opts) {
+			steps = append(steps, step{Query: query})
+		}
+		if migration.Update != nil {
+			steps = append(steps, step{Update: migration.Update, Migration: migration.Name})
+		}
+		steps = append(steps, step{Query: r.Table("migration_status").Get("revision").Update(map[string]interface{}{
 			"value": migration.Revision,
-		}))
+		})})
 	}
 
 	// Create a new progress bar
-	bar := pb.StartNew(len(queries))
-	for i, query := range queries {
-		if c.Bool("dry") {
-			fmt.Fprintf(c.App.Writer, "Executing %s\n", query.String())
+	bar := pb.StartNew(len(steps))
+	for i, step := range steps {
+		if step.Update != nil {
+			if c.Bool("dry") {
+				fmt.Fprintf(c.App.Writer, "Updating the data of %s\n", step.Migration)
+			} else if err := step.Update(session); err != nil {
+				bar.FinishPrint("Failed to update the data of migration " + step.Migration + ":")
+				fmt.Fprintf(c.App.Writer, "\tError: %v\n", err)
+				return 1
+			}
+		} else if c.Bool("dry") {
+			fmt.Fprintf(c.App.Writer, "Executing %s\n", step.Query.String())
 		} else {
-			if err := query.Exec(session); err != nil {
+			if err := step.Query.Exec(session); err != nil {
 				bar.FinishPrint("Failed to execute migration #" + strconv.Itoa(i) + ":")
-				fmt.Fprintf(c.App.Writer, "\tQuery: %s\n", query.String())
+				fmt.Fprintf(c.App.Writer, "\tQuery: %s\n", step.Query.String())
 				fmt.Fprintf(c.App.Writer, "\tError: %v\n", err)
 				return 1
 			}
@@ -130,6 +149,6 @@ func databaseMigrate(c *cli.Context) int {
 	}
 
 	// Show a "finished" message
-	bar.FinishPrint("Migration completed. " + strconv.Itoa(len(queries)) + " queries executed.")
+	bar.FinishPrint("Migration completed. " + strconv.Itoa(len(steps)) + " queries executed.")
 	return 0
 }
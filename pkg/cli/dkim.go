@@ -0,0 +1,268 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	r "github.com/pgpst/pgpst/internal/github.com/dancannon/gorethink"
+	"github.com/pgpst/pgpst/internal/github.com/dchest/uniuri"
+	"github.com/pgpst/pgpst/internal/github.com/pzduniak/cli"
+	"github.com/pgpst/pgpst/internal/github.com/pzduniak/termtables"
+
+	"github.com/pgpst/pgpst/pkg/dkim"
+	"github.com/pgpst/pgpst/pkg/models"
+)
+
+func getDKIMKeys(session *r.Session, domain string) ([]*models.DKIMKey, error) {
+	query := r.Table("dkim_keys")
+	if domain != "" {
+		query = query.GetAllByIndex("domain", domain)
+	}
+
+	cursor, err := query.OrderBy("date_created").Run(session)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+	var keys []*models.DKIMKey
+	if err := cursor.All(&keys); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+func printDKIMRecord(c *cli.Context, key *models.DKIMKey) error {
+	signer, err := dkim.ParseKey(key.PrivateKey)
+	if err != nil {
+		return err
+	}
+
+	record, err := dkim.Record(signer)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(c.App.Writer, "%s._domainkey.%s. IN TXT %s\n", key.Selector, key.Domain, dkim.QuoteRecord(record))
+	return nil
+}
+
+func dkimGenerate(c *cli.Context) int {
+	// Connect to RethinkDB
+	_, session, connected := connectToRethinkDB(c)
+	if !connected {
+		return 1
+	}
+
+	// Validate the input
+	domain := strings.ToLower(c.String("domain"))
+	if domain == "" {
+		domain = c.GlobalString("default_domain")
+	}
+	selector := c.String("selector")
+	if selector == "" {
+		selector = "pgpst" + time.Now().Format("20060102")
+	}
+	algorithm := c.String("algorithm")
+	if algorithm != dkim.RSA && algorithm != dkim.Ed25519 {
+		writeError(c, fmt.Errorf("Algorithm has to be either rsa or ed25519. Got %s.", algorithm))
+		return 1
+	}
+
+	// Check that the selector isn't used yet
+	keys, err := getDKIMKeys(session, domain)
+	if err != nil {
+		writeError(c, err)
+		return 1
+	}
+	active := false
+	for _, key := range keys {
+		if key.Selector == selector {
+			writeError(c, fmt.Errorf("Selector %s is already used by %s", selector, domain))
+			return 1
+		}
+		if key.Status == "active" {
+			active = true
+		}
+	}
+
+	// Generate a new key
+	der, err := dkim.GenerateKey(algorithm, c.Int("bits"))
+	if err != nil {
+		writeError(c, err)
+		return 1
+	}
+
+	// The first key of a domain is activated right away, others have to be
+	// rotated in after their DNS records are published.
+	key := &models.DKIMKey{
+		ID:           uniuri.NewLen(uniuri.UUIDLen),
+		DateCreated:  time.Now(),
+		DateModified: time.Now(),
+		Domain:       domain,
+		Selector:     selector,
+		Algorithm:    algorithm,
+		PrivateKey:   der,
+		Status:       "pending",
+	}
+	if !active {
+		key.Status = "active"
+	}
+
+	if !c.Bool("dry") {
+		if err := r.Table("dkim_keys").Insert(key).Exec(session); err != nil {
+			writeError(c, err)
+			return 1
+		}
+	}
+
+	// Write a success message with the record to publish
+	fmt.Fprintf(c.App.Writer, "Created a new %s DKIM key for %s with status %s. Publish this record:\n", key.Algorithm, key.Domain, key.Status)
+	if err := printDKIMRecord(c, key); err != nil {
+		writeError(c, err)
+		return 1
+	}
+	return 0
+}
+
+func dkimRotate(c *cli.Context) int {
+	// Connect to RethinkDB
+	_, session, connected := connectToRethinkDB(c)
+	if !connected {
+		return 1
+	}
+
+	domain := strings.ToLower(c.String("domain"))
+	if domain == "" {
+		domain = c.GlobalString("default_domain")
+	}
+
+	keys, err := getDKIMKeys(session, domain)
+	if err != nil {
+		writeError(c, err)
+		return 1
+	}
+
+	// Find the newest pending key and the currently active ones
+	var (
+		next    *models.DKIMKey
+		current = []interface{}{}
+	)
+	for _, key := range keys {
+		if key.Status == "pending" {
+			next = key
+		} else if key.Status == "active" {
+			current = append(current, key.ID)
+		}
+	}
+	if next == nil {
+		writeError(c, fmt.Errorf("Domain %s has no pending keys. Generate one first.", domain))
+		return 1
+	}
+
+	if !c.Bool("dry") {
+		if err := r.Table("dkim_keys").Get(next.ID).Update(map[string]interface{}{
+			"status":        "active",
+			"date_modified": time.Now(),
+		}).Exec(session); err != nil {
+			writeError(c, err)
+			return 1
+		}
+
+		if len(current) > 0 {
+			if err := r.Table("dkim_keys").GetAll(current...).Update(map[string]interface{}{
+				"status":        "retired",
+				"date_modified": time.Now(),
+			}).Exec(session); err != nil {
+				writeError(c, err)
+				return 1
+			}
+		}
+	}
+
+	fmt.Fprintf(c.App.Writer, "Activated selector %s of %s, retired %d keys\n", next.Selector, domain, len(current))
+	return 0
+}
+
+func dkimDNS(c *cli.Context) int {
+	// Connect to RethinkDB
+	_, session, connected := connectToRethinkDB(c)
+	if !connected {
+		return 1
+	}
+
+	domain := strings.ToLower(c.String("domain"))
+	if domain == "" {
+		domain = c.GlobalString("default_domain")
+	}
+
+	keys, err := getDKIMKeys(session, domain)
+	if err != nil {
+		writeError(c, err)
+		return 1
+	}
+
+	// Print records of all keys that may be used in signatures
+	found := false
+	for _, key := range keys {
+		if key.Status == "retired" {
+			continue
+		}
+		if selector := c.String("selector"); selector != "" && key.Selector != selector {
+			continue
+		}
+
+		if err := printDKIMRecord(c, key); err != nil {
+			writeError(c, err)
+			return 1
+		}
+		found = true
+	}
+	if !found {
+		writeError(c, fmt.Errorf("No DKIM keys found for %s", domain))
+		return 1
+	}
+
+	return 0
+}
+
+func dkimList(c *cli.Context) int {
+	// Connect to RethinkDB
+	_, session, connected := connectToRethinkDB(c)
+	if !connected {
+		return 1
+	}
+
+	keys, err := getDKIMKeys(session, "")
+	if err != nil {
+		writeError(c, err)
+		return 1
+	}
+
+	// Write the output
+	if c.Bool("json") {
+		if err := json.NewEncoder(c.App.Writer).Encode(keys); err != nil {
+			writeError(c, err)
+			return 1
+		}
+
+		fmt.Fprint(c.App.Writer, "\n")
+	} else {
+		table := termtables.CreateTable()
+		table.AddHeaders("domain", "selector", "algorithm", "status", "date_created")
+		for _, key := range keys {
+			table.AddRow(
+				key.Domain,
+				key.Selector,
+				key.Algorithm,
+				key.Status,
+				key.DateCreated.Format(time.RubyDate),
+			)
+		}
+		fmt.Fprintln(c.App.Writer, table.Render())
+	}
+
+	return 0
+}
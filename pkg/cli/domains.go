@@ -0,0 +1,137 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	r "github.com/pgpst/pgpst/internal/github.com/dancannon/gorethink"
+	"github.com/pgpst/pgpst/internal/github.com/pzduniak/cli"
+	"github.com/pgpst/pgpst/internal/github.com/pzduniak/termtables"
+
+	"github.com/pgpst/pgpst/pkg/models"
+	"github.com/pgpst/pgpst/pkg/utils"
+)
+
+// checkDomain returns an error unless the domain of the address is verified.
+func checkDomain(session *r.Session, address string) error {
+	domain := address[strings.LastIndex(address, "@")+1:]
+
+	cursor, err := r.Table("domains").Get(domain).Default(map[string]interface{}{}).Run(session)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close()
+	var result models.Domain
+	if err := cursor.One(&result); err != nil {
+		return err
+	}
+	if !result.IsVerified() {
+		return fmt.Errorf("Domain %s is not verified", domain)
+	}
+
+	return nil
+}
+
+func domainsAdd(c *cli.Context) int {
+	// Connect to RethinkDB
+	_, session, connected := connectToRethinkDB(c)
+	if !connected {
+		return 1
+	}
+
+	// Validate the input
+	id := strings.TrimSuffix(strings.ToLower(c.String("domain")), ".")
+	if id == "" {
+		id = c.GlobalString("default_domain")
+	}
+	if !utils.IsDomain(id) {
+		writeError(c, fmt.Errorf("Domain %s has an incorrect format", id))
+		return 1
+	}
+
+	// Check if it's taken
+	cursor, err := r.Table("domains").Get(id).Ne(nil).Run(session)
+	if err != nil {
+		writeError(c, err)
+		return 1
+	}
+	defer cursor.Close()
+	var taken bool
+	if err := cursor.One(&taken); err != nil {
+		writeError(c, err)
+		return 1
+	}
+	if taken {
+		writeError(c, fmt.Errorf("Domain %s is already added", id))
+		return 1
+	}
+
+	// Domains added by the administrators don't need the DNS challenge
+	domain := &models.Domain{
+		ID:           id,
+		DateCreated:  time.Now(),
+		DateModified: time.Now(),
+		Owner:        c.String("owner"),
+		Status:       "verified",
+		DateVerified: time.Now(),
+	}
+
+	if !c.Bool("dry") {
+		if err := r.Table("domains").Insert(domain).Exec(session); err != nil {
+			writeError(c, err)
+			return 1
+		}
+	}
+
+	// Write a success message
+	fmt.Fprintf(c.App.Writer, "Added a new domain - %s\n", domain.ID)
+	return 0
+}
+
+func domainsList(c *cli.Context) int {
+	// Connect to RethinkDB
+	_, session, connected := connectToRethinkDB(c)
+	if !connected {
+		return 1
+	}
+
+	// Get domains from database
+	cursor, err := r.Table("domains").OrderBy("id").Run(session)
+	if err != nil {
+		writeError(c, err)
+		return 1
+	}
+	defer cursor.Close()
+	var domains []*models.Domain
+	if err := cursor.All(&domains); err != nil {
+		writeError(c, err)
+		return 1
+	}
+
+	// Write the output
+	if c.Bool("json") {
+		if err := json.NewEncoder(c.App.Writer).Encode(domains); err != nil {
+			writeError(c, err)
+			return 1
+		}
+
+		fmt.Fprint(c.App.Writer, "\n")
+	} else {
+		table := termtables.CreateTable()
+		table.AddHeaders("domain", "owner", "status", "mx", "date_created")
+		for _, domain := range domains {
+			table.AddRow(
+				domain.ID,
+				domain.Owner,
+				domain.Status,
+				domain.MX,
+				domain.DateCreated.Format(time.RubyDate),
+			)
+		}
+		fmt.Fprintln(c.App.Writer, table.Render())
+	}
+
+	return 0
+}
@@ -0,0 +1,436 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	r "github.com/pgpst/pgpst/internal/github.com/dancannon/gorethink"
+	"github.com/pgpst/pgpst/internal/github.com/dchest/uniuri"
+	"github.com/pgpst/pgpst/internal/github.com/pzduniak/cli"
+	"github.com/pgpst/pgpst/internal/golang.org/x/crypto/openpgp"
+	"github.com/pgpst/pgpst/internal/golang.org/x/crypto/openpgp/armor"
+
+	"github.com/pgpst/pgpst/pkg/crypto"
+	"github.com/pgpst/pgpst/pkg/models"
+	"github.com/pgpst/pgpst/pkg/quota"
+	"github.com/pgpst/pgpst/pkg/threading"
+	"github.com/pgpst/pgpst/pkg/utils"
+)
+
+// readPrivateKeyring loads an armored or binary keyring and decrypts its
+// private keys using the passphrase.
+func readPrivateKeyring(path string, passphrase string) (openpgp.EntityList, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var keyring openpgp.EntityList
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN")) {
+		keyring, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+	} else {
+		keyring, err = openpgp.ReadKeyRing(bytes.NewReader(data))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entity := range keyring {
+		if entity.PrivateKey != nil && entity.PrivateKey.Encrypted {
+			if err := entity.PrivateKey.Decrypt([]byte(passphrase)); err != nil {
+				return nil, err
+			}
+		}
+		for _, subkey := range entity.Subkeys {
+			if subkey.PrivateKey != nil && subkey.PrivateKey.Encrypted {
+				if err := subkey.PrivateKey.Decrypt([]byte(passphrase)); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	return keyring, nil
+}
+
+// decryptManifest opens a manifest encrypted to the keyring.
+func decryptManifest(keyring openpgp.EntityList, data []byte) (*models.Manifest, error) {
+	if bytes.HasPrefix(data, []byte("-----BEGIN")) {
+		block, err := armor.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		data, err = ioutil.ReadAll(block.Body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	md, err := openpgp.ReadMessage(bytes.NewReader(data), keyring, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := ioutil.ReadAll(md.UnverifiedBody)
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest models.Manifest
+	if err := json.Unmarshal(plaintext, &manifest); err != nil {
+		return nil, err
+	}
+	if manifest.Version == 0 {
+		manifest.Version = crypto.VersionLegacy
+	}
+
+	return &manifest, nil
+}
+
+func emailsRewrap(c *cli.Context) int {
+	// Validate the input
+	account := c.String("account")
+	if account == "" {
+		writeError(c, fmt.Errorf("Account ID is required"))
+		return 1
+	}
+	if c.String("key") == "" {
+		writeError(c, fmt.Errorf("Path to the account's private key is required"))
+		return 1
+	}
+
+	keyring, err := readPrivateKeyring(c.String("key"), c.String("passphrase"))
+	if err != nil {
+		writeError(c, err)
+		return 1
+	}
+	if len(keyring) == 0 {
+		writeError(c, fmt.Errorf("The key file contains no keys"))
+		return 1
+	}
+
+	// Connect to RethinkDB
+	_, session, connected := connectToRethinkDB(c)
+	if !connected {
+		return 1
+	}
+
+	// The stored part of the given key is used for the emails whose keys
+	// aren't valid anymore, like the mailer falls back to the default key
+	cursor, err := r.Table("keys").Get(hex.EncodeToString(keyring[0].PrimaryKey.Fingerprint[:])).Default(map[string]interface{}{}).Run(session)
+	if err != nil {
+		writeError(c, err)
+		return 1
+	}
+	defer cursor.Close()
+	var fallback models.Key
+	if err := cursor.One(&fallback); err != nil {
+		writeError(c, err)
+		return 1
+	}
+	if fallback.ID == "" || fallback.Owner != account {
+		writeError(c, fmt.Errorf("The private key is not one of the account's keys"))
+		return 1
+	}
+
+	cursor, err = r.Table("emails").GetAllByIndex("owner", account).Pluck("id").Run(session)
+	if err != nil {
+		writeError(c, err)
+		return 1
+	}
+	defer cursor.Close()
+	var ids []struct {
+		ID string `gorethink:"id"`
+	}
+	if err := cursor.All(&ids); err != nil {
+		writeError(c, err)
+		return 1
+	}
+
+	// Fetch the emails one by one, bodies might be large
+	rewrapped := 0
+	for _, id := range ids {
+		cursor, err := r.Table("emails").Get(id.ID).Run(session)
+		if err != nil {
+			writeError(c, err)
+			return 1
+		}
+		var email models.Email
+		err = cursor.One(&email)
+		cursor.Close()
+		if err != nil {
+			writeError(c, err)
+			return 1
+		}
+
+		manifest, err := decryptManifest(keyring, email.Manifest)
+		if err != nil {
+			writeError(c, fmt.Errorf("Unable to decrypt the manifest of %s: %v", email.ID, err))
+			return 1
+		}
+		if manifest.Version == crypto.CurrentVersion {
+			continue
+		}
+
+		plaintext, err := crypto.Decrypt(manifest.Version, manifest.Key, email.Body)
+		if err != nil {
+			writeError(c, fmt.Errorf("Unable to decrypt the body of %s: %v", email.ID, err))
+			return 1
+		}
+
+		// Encrypt the body and manifest again using a new key
+		key, err := crypto.GenerateKey()
+		if err != nil {
+			writeError(c, err)
+			return 1
+		}
+		body, err := crypto.Encrypt(key, plaintext)
+		if err != nil {
+			writeError(c, err)
+			return 1
+		}
+
+		manifest.Version = crypto.CurrentVersion
+		manifest.Key = key
+		manifest.Nonce = nil
+		encoded, err := json.Marshal(manifest)
+		if err != nil {
+			writeError(c, err)
+			return 1
+		}
+
+		// The manifest stays readable with all the keys it was encrypted to
+		keys, err := loadKeys(session, email.Keys)
+		if err != nil {
+			writeError(c, err)
+			return 1
+		}
+		emailKeyring, keyIDs, err := models.EncryptionKeyring(account, &fallback, keys, time.Now())
+		if err != nil {
+			writeError(c, err)
+			return 1
+		}
+		encryptedManifest, err := utils.PGPEncrypt(encoded, emailKeyring)
+		if err != nil {
+			writeError(c, err)
+			return 1
+		}
+
+		if !c.Bool("dry") {
+			if err := r.Table("emails").Get(email.ID).Update(map[string]interface{}{
+				"body":          body,
+				"manifest":      encryptedManifest,
+				"keys":          keyIDs,
+				"date_modified": time.Now(),
+			}).Exec(session); err != nil {
+				writeError(c, err)
+				return 1
+			}
+
+			size := int64(len(body)+len(encryptedManifest)) - int64(len(email.Body)+len(email.Manifest))
+			if err := quota.AddStorage(session, account, size, 0, 0); err != nil {
+				writeError(c, err)
+				return 1
+			}
+		}
+
+		rewrapped++
+	}
+
+	fmt.Fprintf(c.App.Writer, "Re-wrapped %d of %d emails of %s\n", rewrapped, len(ids), account)
+	return 0
+}
+
+// loadKeys fetches the keys with the fingerprints, skipping the deleted ones.
+func loadKeys(session *r.Session, ids []string) ([]*models.Key, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	args := []interface{}{}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	cursor, err := r.Table("keys").GetAll(args...).Run(session)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+	var keys []*models.Key
+	if err := cursor.All(&keys); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+func emailsRethread(c *cli.Context) int {
+	// Validate the input
+	account := c.String("account")
+	if account == "" {
+		writeError(c, fmt.Errorf("Account ID is required"))
+		return 1
+	}
+	if c.String("key") == "" {
+		writeError(c, fmt.Errorf("Path to the account's private key is required"))
+		return 1
+	}
+	if c.String("thread_secret") == "" && c.Int("window") > 0 {
+		writeError(c, fmt.Errorf("Thread secret is required to thread the emails by their subjects"))
+		return 1
+	}
+
+	keyring, err := readPrivateKeyring(c.String("key"), c.String("passphrase"))
+	if err != nil {
+		writeError(c, err)
+		return 1
+	}
+
+	// Connect to RethinkDB
+	_, session, connected := connectToRethinkDB(c)
+	if !connected {
+		return 1
+	}
+
+	// Headers are only stored in the encrypted manifests
+	cursor, err := r.Table("emails").GetAllByIndex("owner", account).Pluck(
+		"id", "date_created", "message_id", "thread", "status", "manifest",
+	).OrderBy("date_created").Run(session)
+	if err != nil {
+		writeError(c, err)
+		return 1
+	}
+	defer cursor.Close()
+	var emails []*models.Email
+	if err := cursor.All(&emails); err != nil {
+		writeError(c, err)
+		return 1
+	}
+
+	messages := make([]*threading.Message, len(emails))
+	for i, email := range emails {
+		manifest, err := decryptManifest(keyring, email.Manifest)
+		if err != nil {
+			writeError(c, fmt.Errorf("Unable to decrypt the manifest of %s: %v", email.ID, err))
+			return 1
+		}
+
+		messages[i] = threading.NewMessage([]byte(c.String("thread_secret")), account, manifest.Description.Headers, email.Status != "received", email.DateCreated)
+		messages[i].MessageID = email.MessageID
+	}
+
+	cursor, err = r.Table("threads").GetAllByIndex("owner", account).Run(session)
+	if err != nil {
+		writeError(c, err)
+		return 1
+	}
+	defer cursor.Close()
+	var existing []*models.Thread
+	if err := cursor.All(&existing); err != nil {
+		writeError(c, err)
+		return 1
+	}
+	threads := map[string]*models.Thread{}
+	for _, thread := range existing {
+		threads[thread.ID] = thread
+	}
+
+	// Every new thread takes over the thread of its oldest email, unless an
+	// older one already did. The state of the old threads is combined.
+	var (
+		groups = threading.Group(messages, time.Duration(c.Int("window"))*time.Hour)
+		used   = map[string]struct{}{}
+		moved  = 0
+	)
+	for _, group := range groups {
+		id := emails[group[0]].Thread
+		if _, ok := used[id]; ok || id == "" {
+			id = uniuri.NewLen(uniuri.UUIDLen)
+		}
+		used[id] = struct{}{}
+
+		thread := &models.Thread{
+			ID:           id,
+			DateCreated:  emails[group[0]].DateCreated,
+			DateModified: time.Now(),
+			Owner:        account,
+			Labels:       []string{},
+			Members:      []string{},
+			IsRead:       true,
+			SubjectHash:  messages[group[0]].SubjectHash,
+		}
+		combined := map[string]struct{}{}
+		for _, i := range group {
+			old, ok := threads[emails[i].Thread]
+			if !ok {
+				continue
+			}
+			if _, ok := combined[old.ID]; ok {
+				continue
+			}
+			combined[old.ID] = struct{}{}
+
+			if old.ID == id {
+				thread.DateCreated = old.DateCreated
+				thread.LastRead = old.LastRead
+			}
+			threading.Combine(thread, old)
+		}
+		if thread.Secure == "" {
+			thread.Secure = "none"
+		}
+
+		if c.Bool("dry") {
+			for _, i := range group {
+				if emails[i].Thread != id {
+					moved++
+				}
+			}
+			continue
+		}
+
+		if err := r.Table("threads").Insert(thread, r.InsertOpts{
+			Conflict: "replace",
+		}).Exec(session); err != nil {
+			writeError(c, err)
+			return 1
+		}
+
+		for _, i := range group {
+			if emails[i].Thread != id {
+				moved++
+			}
+			if err := r.Table("emails").Get(emails[i].ID).Update(map[string]interface{}{
+				"thread":     id,
+				"references": messages[i].References,
+			}).Exec(session); err != nil {
+				writeError(c, err)
+				return 1
+			}
+		}
+	}
+
+	// Remove the threads that were merged into the others
+	removed := 0
+	for id := range threads {
+		if _, ok := used[id]; ok {
+			continue
+		}
+		removed++
+
+		if c.Bool("dry") {
+			continue
+		}
+		if err := r.Table("threads").Get(id).Delete().Exec(session); err != nil {
+			writeError(c, err)
+			return 1
+		}
+	}
+
+	fmt.Fprintf(c.App.Writer, "Re-threaded %d emails of %s into %d threads, moved %d emails and removed %d threads\n",
+		len(emails), account, len(groups), moved, removed)
+	return 0
+}
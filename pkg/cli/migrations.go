@@ -2,6 +2,9 @@ package cli
 
 import (
 	r "github.com/pgpst/pgpst/internal/github.com/dancannon/gorethink"
+
+	"github.com/pgpst/pgpst/pkg/models"
+	"github.com/pgpst/pgpst/pkg/wkd"
 )
 
 type migration struct {
@@ -9,6 +12,10 @@ type migration struct {
 	Name     string
 	Migrate  func(*r.ConnectOpts) []r.Term
 	Revert   func(*r.ConnectOpts) []r.Term
+
+	// Update fills in data that can't be computed by RethinkDB. It's run
+	// after the queries of the migration, so the schema is up to date.
+	Update func(*r.Session) error
 }
 
 var migrations = []migration{
@@ -242,4 +249,287 @@ var migrations = []migration{
 			}
 		},
 	},
+	{
+		Revision: 5,
+		Name:     "dkim keys",
+		Migrate: func(opts *r.ConnectOpts) []r.Term {
+			return []r.Term{
+				r.DB(opts.Database).TableCreate("dkim_keys"),
+				r.Table("dkim_keys").IndexCreate("domain"),
+				r.Table("dkim_keys").IndexCreateFunc("domainStatus", func(row r.Term) []interface{} {
+					return []interface{}{
+						row.Field("domain"),
+						row.Field("status"),
+					}
+				}),
+			}
+		},
+		Revert: func(opts *r.ConnectOpts) []r.Term {
+			return []r.Term{
+				r.DB(opts.Database).TableDrop("dkim_keys"),
+			}
+		},
+	},
+	{
+		Revision: 6,
+		Name:     "greylist",
+		Migrate: func(opts *r.ConnectOpts) []r.Term {
+			return []r.Term{
+				r.DB(opts.Database).TableCreate("greylist"),
+				r.Table("greylist").IndexCreate("date_modified"),
+			}
+		},
+		Revert: func(opts *r.ConnectOpts) []r.Term {
+			return []r.Term{
+				r.DB(opts.Database).TableDrop("greylist"),
+			}
+		},
+	},
+	{
+		Revision: 7,
+		Name:     "rules",
+		Migrate: func(opts *r.ConnectOpts) []r.Term {
+			return []r.Term{
+				r.DB(opts.Database).TableCreate("rules"),
+			}
+		},
+		Revert: func(opts *r.ConnectOpts) []r.Term {
+			return []r.Term{
+				r.DB(opts.Database).TableDrop("rules"),
+			}
+		},
+	},
+	{
+		Revision: 8,
+		Name:     "vacation",
+		Migrate: func(opts *r.ConnectOpts) []r.Term {
+			return []r.Term{
+				r.DB(opts.Database).TableCreate("vacations"),
+				r.DB(opts.Database).TableCreate("vacation_replies"),
+				r.Table("vacation_replies").IndexCreate("owner"),
+				r.Table("vacation_replies").IndexCreate("expiry_date"),
+			}
+		},
+		Revert: func(opts *r.ConnectOpts) []r.Term {
+			return []r.Term{
+				r.DB(opts.Database).TableDrop("vacations"),
+				r.DB(opts.Database).TableDrop("vacation_replies"),
+			}
+		},
+	},
+	{
+		Revision: 9,
+		Name:     "domains",
+		Migrate: func(opts *r.ConnectOpts) []r.Term {
+			return []r.Term{
+				r.DB(opts.Database).TableCreate("domains"),
+				r.Table("domains").IndexCreate("owner"),
+				// Domains of the existing addresses become verified system domains
+				r.Table("addresses").Map(func(address r.Term) r.Term {
+					return address.Field("id").Split("@").Nth(-1)
+				}).Distinct().ForEach(func(domain r.Term) r.Term {
+					return r.Table("domains").Insert(map[string]interface{}{
+						"id":            domain,
+						"date_created":  r.Now(),
+						"date_modified": r.Now(),
+						"owner":         "",
+						"status":        "verified",
+						"challenge":     "",
+						"date_verified": r.Now(),
+						"mx":            true,
+					})
+				}),
+			}
+		},
+		Revert: func(opts *r.ConnectOpts) []r.Term {
+			return []r.Term{
+				r.DB(opts.Database).TableDrop("domains"),
+			}
+		},
+	},
+	{
+		Revision: 10,
+		Name:     "group_addresses",
+		Migrate: func(opts *r.ConnectOpts) []r.Term {
+			return []r.Term{
+				r.Table("addresses").IndexCreate("members", r.IndexCreateOpts{Multi: true}),
+			}
+		},
+		Revert: func(opts *r.ConnectOpts) []r.Term {
+			return []r.Term{
+				r.Table("addresses").IndexDrop("members"),
+			}
+		},
+	},
+	{
+		Revision: 11,
+		Name:     "plans",
+		Migrate: func(opts *r.ConnectOpts) []r.Term {
+			return []r.Term{
+				r.DB(opts.Database).TableCreate("plans"),
+				r.Table("plans").Insert([]interface{}{
+					map[string]interface{}{
+						"id":               "beta",
+						"date_created":     r.Now(),
+						"date_modified":    r.Now(),
+						"max_storage":      1 << 30,
+						"max_addresses":    5,
+						"max_message_size": 25 << 20,
+						"max_daily_sends":  500,
+					},
+					map[string]interface{}{
+						"id":               "admin",
+						"date_created":     r.Now(),
+						"date_modified":    r.Now(),
+						"max_storage":      0,
+						"max_addresses":    0,
+						"max_message_size": 0,
+						"max_daily_sends":  0,
+					},
+				}),
+				r.DB(opts.Database).TableCreate("usage"),
+				// Count what the existing accounts already store
+				r.Table("accounts").ForEach(func(account r.Term) r.Term {
+					emails := r.Table("emails").GetAllByIndex("owner", account.Field("id"))
+					resources := r.Table("resources").GetAllByIndex("owner", account.Field("id"))
+					return r.Table("usage").Insert(map[string]interface{}{
+						"id":            account.Field("id"),
+						"date_modified": r.Now(),
+						"storage": emails.Map(func(email r.Term) r.Term {
+							return email.Field("body").Default("").Count().Add(email.Field("manifest").Default("").Count())
+						}).Sum().Add(resources.Map(func(resource r.Term) r.Term {
+							return resource.Field("body").Default("").Count()
+						}).Sum()),
+						"emails":    emails.Count(),
+						"resources": resources.Count(),
+						"send_date": "",
+						"sends":     0,
+					})
+				}),
+			}
+		},
+		Revert: func(opts *r.ConnectOpts) []r.Term {
+			return []r.Term{
+				r.DB(opts.Database).TableDrop("plans"),
+				r.DB(opts.Database).TableDrop("usage"),
+			}
+		},
+	},
+	{
+		Revision: 12,
+		Name:     "rate_limits",
+		Migrate: func(opts *r.ConnectOpts) []r.Term {
+			return []r.Term{
+				r.DB(opts.Database).TableCreate("rate_limits"),
+			}
+		},
+		Revert: func(opts *r.ConnectOpts) []r.Term {
+			return []r.Term{
+				r.DB(opts.Database).TableDrop("rate_limits"),
+			}
+		},
+	},
+	{
+		Revision: 13,
+		Name:     "threading",
+		Migrate: func(opts *r.ConnectOpts) []r.Term {
+			return []r.Term{
+				r.Table("emails").IndexCreateFunc("referencesOwner", func(row r.Term) r.Term {
+					return row.Field("references").Default([]interface{}{}).Map(func(id r.Term) []interface{} {
+						return []interface{}{
+							id,
+							row.Field("owner"),
+						}
+					})
+				}, r.IndexCreateOpts{Multi: true}),
+				r.Table("threads").IndexCreateFunc("subjectHashOwner", func(row r.Term) []interface{} {
+					return []interface{}{
+						row.Field("subject_hash"),
+						row.Field("owner"),
+					}
+				}),
+			}
+		},
+		Revert: func(opts *r.ConnectOpts) []r.Term {
+			return []r.Term{
+				r.Table("emails").IndexDrop("referencesOwner"),
+				r.Table("threads").IndexDrop("subjectHashOwner"),
+			}
+		},
+	},
+	{
+		Revision: 14,
+		Name:     "digests",
+		Migrate: func(opts *r.ConnectOpts) []r.Term {
+			return []r.Term{
+				r.DB(opts.Database).TableCreate("digests"),
+				r.Table("digests").IndexCreate("date_created"),
+			}
+		},
+		Revert: func(opts *r.ConnectOpts) []r.Term {
+			return []r.Term{
+				r.DB(opts.Database).TableDrop("digests"),
+			}
+		},
+	},
+	{
+		Revision: 15,
+		Name:     "peers",
+		Migrate: func(opts *r.ConnectOpts) []r.Term {
+			return []r.Term{
+				r.DB(opts.Database).TableCreate("peers"),
+				r.Table("peers").IndexCreate("owner"),
+			}
+		},
+		Revert: func(opts *r.ConnectOpts) []r.Term {
+			return []r.Term{
+				r.DB(opts.Database).TableDrop("peers"),
+			}
+		},
+	},
+	{
+		Revision: 16,
+		Name:     "wkd",
+		Migrate: func(opts *r.ConnectOpts) []r.Term {
+			return []r.Term{
+				r.Table("addresses").IndexCreateFunc("wkdHashDomain", func(row r.Term) r.Term {
+					return row.Field("wkd_hashes").Default([]interface{}{}).Map(func(hash r.Term) []interface{} {
+						return []interface{}{
+							hash,
+							row.Field("id").Split("@").Nth(-1),
+						}
+					})
+				}, r.IndexCreateOpts{Multi: true}),
+			}
+		},
+		Revert: func(opts *r.ConnectOpts) []r.Term {
+			return []r.Term{
+				r.Table("addresses").IndexDrop("wkdHashDomain"),
+				r.Table("addresses").Replace(func(row r.Term) r.Term {
+					return row.Without("wkd_hashes")
+				}),
+			}
+		},
+		Update: func(session *r.Session) error {
+			// RethinkDB can't hash the local parts of the existing addresses
+			cursor, err := r.Table("addresses").Pluck("id", "styled_id").Run(session)
+			if err != nil {
+				return err
+			}
+			defer cursor.Close()
+			var addresses []*models.Address
+			if err := cursor.All(&addresses); err != nil {
+				return err
+			}
+
+			for _, address := range addresses {
+				if err := r.Table("addresses").Get(address.ID).Update(map[string]interface{}{
+					"wkd_hashes": wkd.AddressHashes(address.ID, address.StyledID),
+				}).Exec(session); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
 }
@@ -0,0 +1,83 @@
+package crypto
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+
+	"github.com/pgpst/pgpst/internal/github.com/codahale/chacha20"
+	"github.com/pgpst/pgpst/internal/golang.org/x/crypto/poly1305"
+)
+
+// The AEAD is the ChaCha20-Poly1305 construction from RFC 8439 used with the
+// original 64-bit nonce. For the first 2^32 blocks the key stream is the
+// same as the RFC's with a nonce prefixed by four zero bytes.
+
+// newCipher sets up a stream positioned at the first block of the payload
+// and derives the one-time Poly1305 key from the block before it.
+func newCipher(key []byte, nonce []byte) (*[32]byte, func(dst, src []byte), error) {
+	stream, err := chacha20.New(key, nonce)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var block [64]byte
+	stream.XORKeyStream(block[:], block[:])
+
+	var polyKey [32]byte
+	copy(polyKey[:], block[:32])
+
+	return &polyKey, stream.XORKeyStream, nil
+}
+
+func computeTag(polyKey *[32]byte, ciphertext []byte, data []byte) [TagSize]byte {
+	input := make([]byte, 0, len(data)+len(ciphertext)+48)
+	input = append(input, data...)
+	input = append(input, make([]byte, (16-len(data)%16)%16)...)
+	input = append(input, ciphertext...)
+	input = append(input, make([]byte, (16-len(ciphertext)%16)%16)...)
+
+	var lengths [16]byte
+	binary.LittleEndian.PutUint64(lengths[:8], uint64(len(data)))
+	binary.LittleEndian.PutUint64(lengths[8:], uint64(len(ciphertext)))
+	input = append(input, lengths[:]...)
+
+	var tag [TagSize]byte
+	poly1305.Sum(&tag, input, polyKey)
+	return tag
+}
+
+// seal returns the ciphertext followed by the tag.
+func seal(key []byte, nonce []byte, plaintext []byte, data []byte) ([]byte, error) {
+	polyKey, xor, err := newCipher(key, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	output := make([]byte, len(plaintext), len(plaintext)+TagSize)
+	xor(output, plaintext)
+
+	tag := computeTag(polyKey, output, data)
+	return append(output, tag[:]...), nil
+}
+
+// open verifies the tag and decrypts the ciphertext.
+func open(key []byte, nonce []byte, sealed []byte, data []byte) ([]byte, error) {
+	if len(sealed) < TagSize {
+		return nil, ErrAuthentication
+	}
+
+	polyKey, xor, err := newCipher(key, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertext := sealed[:len(sealed)-TagSize]
+	tag := computeTag(polyKey, ciphertext, data)
+	if subtle.ConstantTimeCompare(tag[:], sealed[len(ciphertext):]) != 1 {
+		return nil, ErrAuthentication
+	}
+
+	output := make([]byte, len(ciphertext))
+	xor(output, ciphertext)
+	return output, nil
+}
@@ -0,0 +1,149 @@
+// Package crypto implements the formats used to store encrypted email bodies.
+//
+// Bodies are encrypted with a random key that is kept in the manifest, which
+// in turn is encrypted to the owner's PGP key. The manifest's version tells
+// which format the body uses:
+//
+//	1 - ChaCha20 stream with a Poly1305 tag after every 1024-byte chunk, all
+//	    of them computed with the same key. Only supported for decryption.
+//	2 - ChaCha20-Poly1305 STREAM. The body starts with the version byte and
+//	    is followed by 64 KiB chunks, each sealed with a nonce made of the
+//	    chunk's index and a flag marking the last chunk. Reordering, removal
+//	    and truncation of the chunks are detected.
+package crypto
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/pgpst/pgpst/internal/github.com/codahale/chacha20"
+	"github.com/pgpst/pgpst/internal/golang.org/x/crypto/poly1305"
+)
+
+// Versions of the body format
+const (
+	VersionLegacy  = 1
+	VersionStream  = 2
+	CurrentVersion = VersionStream
+)
+
+const (
+	KeySize   = chacha20.KeySize
+	TagSize   = poly1305.TagSize
+	ChunkSize = 64 * 1024
+)
+
+var (
+	ErrInvalidKey     = errors.New("Invalid key size")
+	ErrUnknownVersion = errors.New("Unknown body format version")
+	ErrAuthentication = errors.New("Message authentication failed")
+	ErrTruncated      = errors.New("Body is truncated")
+)
+
+// GenerateKey returns a new random body key.
+func GenerateKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// Encrypt seals the plaintext using the current format. Keys must never be
+// reused for other bodies.
+func Encrypt(key []byte, plaintext []byte) ([]byte, error) {
+	if len(key) != KeySize {
+		return nil, ErrInvalidKey
+	}
+
+	header := []byte{VersionStream}
+
+	chunks := (len(plaintext) + ChunkSize - 1) / ChunkSize
+	if chunks == 0 {
+		// Empty bodies still get a final chunk
+		chunks = 1
+	}
+
+	output := make([]byte, 0, len(header)+len(plaintext)+chunks*TagSize)
+	output = append(output, header...)
+	for i := 0; i < chunks; i++ {
+		end := (i + 1) * ChunkSize
+		if end > len(plaintext) {
+			end = len(plaintext)
+		}
+
+		sealed, err := seal(key, chunkNonce(uint64(i), i == chunks-1), plaintext[i*ChunkSize:end], header)
+		if err != nil {
+			return nil, err
+		}
+		output = append(output, sealed...)
+	}
+
+	return output, nil
+}
+
+// Decrypt opens a body encrypted using the format of the passed version.
+func Decrypt(version int, key []byte, ciphertext []byte) ([]byte, error) {
+	if len(key) != KeySize {
+		return nil, ErrInvalidKey
+	}
+
+	switch version {
+	case VersionLegacy:
+		return decryptLegacy(key, ciphertext)
+	case VersionStream:
+		return decryptStream(key, ciphertext)
+	}
+
+	return nil, ErrUnknownVersion
+}
+
+func decryptStream(key []byte, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) == 0 {
+		return nil, ErrTruncated
+	}
+	if ciphertext[0] != VersionStream {
+		return nil, ErrUnknownVersion
+	}
+	header := ciphertext[:1]
+	rest := ciphertext[1:]
+
+	output := make([]byte, 0, len(rest))
+	for i := uint64(0); ; i++ {
+		if len(rest) < TagSize {
+			return nil, ErrTruncated
+		}
+
+		// Only the last chunk can be shorter than the full size
+		size := ChunkSize + TagSize
+		last := len(rest) <= size
+		if last {
+			size = len(rest)
+		}
+
+		plaintext, err := open(key, chunkNonce(i, last), rest[:size], header)
+		if err != nil {
+			return nil, err
+		}
+		output = append(output, plaintext...)
+		rest = rest[size:]
+
+		if last {
+			return output, nil
+		}
+	}
+}
+
+// chunkNonce encodes the index of the chunk in the first 7 bytes and the
+// last chunk flag in the 8th one.
+func chunkNonce(index uint64, last bool) []byte {
+	nonce := make([]byte, chacha20.NonceSize)
+	binary.BigEndian.PutUint64(nonce, index<<8)
+	if last {
+		nonce[7] = 1
+	}
+	return nonce
+}
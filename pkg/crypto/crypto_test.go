@@ -0,0 +1,145 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"testing"
+
+	"github.com/pgpst/pgpst/internal/github.com/codahale/chacha20"
+	. "github.com/pgpst/pgpst/internal/github.com/smartystreets/goconvey/convey"
+	"github.com/pgpst/pgpst/internal/golang.org/x/crypto/poly1305"
+)
+
+// Sealed with the RFC 8439 AEAD, key 00..1f and nonce 00000000 0000000000000001
+var testVector = "253d18b05479981b43155e68d67a637e759c5a2eeede9a553152d0084a82fe79" +
+	"a00d836c93dc97ba3f8a5149f81024aaff1e4d7c2d314965"
+
+// legacyEncrypt is the body encryption of the first mailer version
+func legacyEncrypt(key []byte, data []byte) []byte {
+	akey := [32]byte{}
+	copy(akey[:], key)
+
+	nonce := make([]byte, 8)
+	rand.Read(nonce)
+	stream, _ := chacha20.New(key, nonce)
+
+	ciphertext := make([]byte, len(data)+chacha20.NonceSize+(len(data)/1024+1)*16)
+	copy(ciphertext[:chacha20.NonceSize], nonce)
+
+	oi := chacha20.NonceSize
+	for i := 0; i < len(data); i += 1024 {
+		max := i + 1024
+		if max > len(data) {
+			max = len(data)
+		}
+		chunk := data[i:max]
+
+		stream.XORKeyStream(ciphertext[oi:oi+len(chunk)], chunk)
+		var out [16]byte
+		poly1305.Sum(&out, ciphertext[oi:oi+len(chunk)], &akey)
+		copy(ciphertext[oi+len(chunk):oi+len(chunk)+poly1305.TagSize], out[:])
+
+		oi += 1024 + poly1305.TagSize
+	}
+
+	return ciphertext
+}
+
+func randomBytes(n int) []byte {
+	x := make([]byte, n)
+	rand.Read(x)
+	return x
+}
+
+func TestCrypto(t *testing.T) {
+	Convey("Given a key", t, func() {
+		key, err := GenerateKey()
+		So(err, ShouldBeNil)
+		So(len(key), ShouldEqual, KeySize)
+
+		Convey("The chunk cipher should match the RFC 8439 AEAD", func() {
+			testKey := make([]byte, KeySize)
+			for i := range testKey {
+				testKey[i] = byte(i)
+			}
+
+			sealed, err := seal(testKey, chunkNonce(0, true), []byte("Ladies and Gentlemen of the class of '99"), []byte{VersionStream})
+			So(err, ShouldBeNil)
+			So(hex.EncodeToString(sealed), ShouldEqual, testVector)
+		})
+
+		Convey("Bodies of any size should survive a round trip", func() {
+			for _, size := range []int{0, 1, 1024, ChunkSize - 1, ChunkSize, ChunkSize + 1, 3*ChunkSize + 17} {
+				plaintext := randomBytes(size)
+
+				ciphertext, err := Encrypt(key, plaintext)
+				So(err, ShouldBeNil)
+				So(ciphertext[0], ShouldEqual, VersionStream)
+
+				output, err := Decrypt(VersionStream, key, ciphertext)
+				So(err, ShouldBeNil)
+				So(bytes.Equal(output, plaintext), ShouldBeTrue)
+			}
+		})
+
+		Convey("Modified bodies should be rejected", func() {
+			plaintext := randomBytes(2*ChunkSize + 100)
+			ciphertext, err := Encrypt(key, plaintext)
+			So(err, ShouldBeNil)
+
+			// Flipped bit
+			tampered := append([]byte{}, ciphertext...)
+			tampered[ChunkSize+5] ^= 1
+			_, err = Decrypt(VersionStream, key, tampered)
+			So(err, ShouldEqual, ErrAuthentication)
+
+			// Removed final chunk
+			_, err = Decrypt(VersionStream, key, ciphertext[:1+2*(ChunkSize+TagSize)])
+			So(err, ShouldEqual, ErrAuthentication)
+
+			// Truncated final chunk
+			_, err = Decrypt(VersionStream, key, ciphertext[:len(ciphertext)-1])
+			So(err, ShouldEqual, ErrAuthentication)
+			_, err = Decrypt(VersionStream, key, ciphertext[:1])
+			So(err, ShouldEqual, ErrTruncated)
+
+			// Swapped chunks
+			chunk := ChunkSize + TagSize
+			swapped := append([]byte{}, ciphertext[:1]...)
+			swapped = append(swapped, ciphertext[1+chunk:1+2*chunk]...)
+			swapped = append(swapped, ciphertext[1:1+chunk]...)
+			swapped = append(swapped, ciphertext[1+2*chunk:]...)
+			_, err = Decrypt(VersionStream, key, swapped)
+			So(err, ShouldEqual, ErrAuthentication)
+
+			// Wrong key
+			_, err = Decrypt(VersionStream, randomBytes(KeySize), ciphertext)
+			So(err, ShouldEqual, ErrAuthentication)
+		})
+
+		Convey("Legacy bodies should be decrypted", func() {
+			for _, size := range []int{0, 1, 1023, 1024, 1025, 4096, 5000} {
+				plaintext := randomBytes(size)
+
+				output, err := Decrypt(VersionLegacy, key, legacyEncrypt(key, plaintext))
+				So(err, ShouldBeNil)
+				So(bytes.Equal(output, plaintext), ShouldBeTrue)
+			}
+
+			ciphertext := legacyEncrypt(key, randomBytes(2000))
+			ciphertext[20] ^= 1
+			_, err := Decrypt(VersionLegacy, key, ciphertext)
+			So(err, ShouldEqual, ErrAuthentication)
+		})
+
+		Convey("Invalid parameters should be rejected", func() {
+			_, err := Encrypt(key[:16], nil)
+			So(err, ShouldEqual, ErrInvalidKey)
+			_, err = Decrypt(3, key, []byte{3})
+			So(err, ShouldEqual, ErrUnknownVersion)
+			_, err = Decrypt(VersionStream, key, []byte{VersionLegacy})
+			So(err, ShouldEqual, ErrUnknownVersion)
+		})
+	})
+}
@@ -0,0 +1,50 @@
+package crypto
+
+import (
+	"github.com/pgpst/pgpst/internal/github.com/codahale/chacha20"
+	"github.com/pgpst/pgpst/internal/golang.org/x/crypto/poly1305"
+)
+
+// Size of the chunks in the legacy format
+const legacyChunkSize = 1024
+
+// decryptLegacy opens bodies written by the first version of the mailer:
+// the nonce followed by the chunks, each with a tag of its ciphertext keyed
+// directly with the body key. The buffers were allocated for one more tag
+// than needed, so they might end with unused zero bytes.
+func decryptLegacy(key []byte, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < chacha20.NonceSize {
+		return nil, ErrTruncated
+	}
+
+	stream, err := chacha20.New(key, ciphertext[:chacha20.NonceSize])
+	if err != nil {
+		return nil, err
+	}
+
+	var polyKey [32]byte
+	copy(polyKey[:], key)
+
+	rest := ciphertext[chacha20.NonceSize:]
+	output := make([]byte, 0, len(rest))
+	for len(rest) > TagSize {
+		size := legacyChunkSize
+		if size > len(rest)-TagSize {
+			size = len(rest) - TagSize
+		}
+
+		var tag [TagSize]byte
+		copy(tag[:], rest[size:size+TagSize])
+		if !poly1305.Verify(&tag, rest[:size], &polyKey) {
+			return nil, ErrAuthentication
+		}
+
+		chunk := make([]byte, size)
+		stream.XORKeyStream(chunk, rest[:size])
+		output = append(output, chunk...)
+
+		rest = rest[size+TagSize:]
+	}
+
+	return output, nil
+}
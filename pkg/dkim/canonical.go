@@ -0,0 +1,143 @@
+package dkim
+
+import (
+	"bytes"
+	"strings"
+)
+
+// header is a single raw header field of a message.
+type header struct {
+	Name string // name as it appears in the message
+	Raw  string // whole field including the name and folding, without the final newline
+}
+
+// splitMessage separates the header fields from the body. Both \r\n and \n
+// line endings are accepted.
+func splitMessage(message []byte) ([]header, []byte) {
+	var (
+		headers = []header{}
+		body    []byte
+		rest    = message
+	)
+
+	for len(rest) > 0 {
+		// Find the end of the current line
+		end := bytes.IndexByte(rest, '\n')
+		var line []byte
+		if end == -1 {
+			line = rest
+			rest = nil
+		} else {
+			line = rest[:end]
+			rest = rest[end+1:]
+		}
+		line = bytes.TrimSuffix(line, []byte("\r"))
+
+		// An empty line ends the header
+		if len(line) == 0 {
+			body = rest
+			break
+		}
+
+		// Continuation lines belong to the previous field
+		if (line[0] == ' ' || line[0] == '\t') && len(headers) > 0 {
+			headers[len(headers)-1].Raw += "\r\n" + string(line)
+			continue
+		}
+
+		name := string(line)
+		if i := strings.IndexByte(name, ':'); i != -1 {
+			name = name[:i]
+		}
+		headers = append(headers, header{
+			Name: strings.TrimSpace(name),
+			Raw:  string(line),
+		})
+	}
+
+	return headers, body
+}
+
+// relaxedHeader canonicalizes a header field as in RFC 6376, section 3.4.2.
+func relaxedHeader(raw string) string {
+	i := strings.IndexByte(raw, ':')
+	if i == -1 {
+		return strings.ToLower(strings.TrimSpace(raw)) + ":\r\n"
+	}
+
+	name := strings.ToLower(strings.TrimSpace(raw[:i]))
+
+	// Unfold the value and compress the whitespace
+	value := strings.Replace(raw[i+1:], "\r\n", "", -1)
+	value = strings.Replace(value, "\n", "", -1)
+	value = strings.Join(strings.FieldsFunc(value, isWSP), " ")
+
+	return name + ":" + value + "\r\n"
+}
+
+// relaxedBody canonicalizes the body as in RFC 6376, section 3.4.4.
+func relaxedBody(body []byte) []byte {
+	lines := bytes.Split(body, []byte("\n"))
+
+	result := &bytes.Buffer{}
+	empty := 0
+	for i, line := range lines {
+		line = bytes.TrimSuffix(line, []byte("\r"))
+
+		// Last piece after the final newline
+		if i == len(lines)-1 && len(line) == 0 {
+			break
+		}
+
+		// Compress the whitespace and remove it from the end of the line
+		line = compressWSP(line)
+
+		// Empty lines are only written if something follows them
+		if len(line) == 0 {
+			empty++
+			continue
+		}
+		for ; empty > 0; empty-- {
+			result.WriteString("\r\n")
+		}
+
+		result.Write(line)
+		result.WriteString("\r\n")
+	}
+
+	return result.Bytes()
+}
+
+// compressWSP reduces all sequences of whitespace to a single space and
+// removes the whitespace at the end of the line.
+func compressWSP(line []byte) []byte {
+	result := make([]byte, 0, len(line))
+	inWSP := false
+	for _, c := range line {
+		if isWSP(rune(c)) {
+			inWSP = true
+			continue
+		}
+		if inWSP {
+			result = append(result, ' ')
+			inWSP = false
+		}
+		result = append(result, c)
+	}
+	return result
+}
+
+func isWSP(r rune) bool {
+	return r == ' ' || r == '\t'
+}
+
+// simpleBody canonicalizes the body as in RFC 6376, section 3.4.3.
+func simpleBody(body []byte) []byte {
+	body = bytes.Replace(body, []byte("\r\n"), []byte("\n"), -1)
+	body = bytes.TrimRight(body, "\n")
+	if len(body) == 0 {
+		return []byte("\r\n")
+	}
+
+	return append(bytes.Replace(body, []byte("\n"), []byte("\r\n"), -1), '\r', '\n')
+}
@@ -0,0 +1,118 @@
+// Package dkim implements signing and verification of DomainKeys Identified
+// Mail signatures, as in RFC 6376 and RFC 8463.
+package dkim
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Supported key types
+const (
+	RSA     = "rsa"
+	Ed25519 = "ed25519"
+)
+
+var (
+	ErrUnknownAlgorithm = errors.New("Unknown DKIM key algorithm")
+	ErrUnsupportedKey   = errors.New("Unsupported DKIM key type")
+)
+
+// GenerateKey creates a new private key and returns it in the PKCS #8 form.
+// Bits is only used by RSA keys.
+func GenerateKey(algorithm string, bits int) ([]byte, error) {
+	switch algorithm {
+	case RSA:
+		if bits == 0 {
+			bits = 2048
+		}
+		key, err := rsa.GenerateKey(rand.Reader, bits)
+		if err != nil {
+			return nil, err
+		}
+		return x509.MarshalPKCS8PrivateKey(key)
+	case Ed25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return x509.MarshalPKCS8PrivateKey(key)
+	}
+
+	return nil, ErrUnknownAlgorithm
+}
+
+// ParseKey reads a PKCS #8 private key created by GenerateKey.
+func ParseKey(der []byte) (crypto.Signer, error) {
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return k, nil
+	case ed25519.PrivateKey:
+		return k, nil
+	}
+
+	return nil, ErrUnsupportedKey
+}
+
+// Algorithm returns the key type of a private key.
+func Algorithm(key crypto.Signer) (string, error) {
+	switch key.(type) {
+	case *rsa.PrivateKey:
+		return RSA, nil
+	case ed25519.PrivateKey:
+		return Ed25519, nil
+	}
+
+	return "", ErrUnsupportedKey
+}
+
+// Record returns the contents of the TXT record that has to be published
+// under <selector>._domainkey.<domain> for the key.
+func Record(key crypto.Signer) (string, error) {
+	algorithm, err := Algorithm(key)
+	if err != nil {
+		return "", err
+	}
+
+	var public []byte
+	if algorithm == RSA {
+		public, err = x509.MarshalPKIXPublicKey(key.Public())
+		if err != nil {
+			return "", err
+		}
+	} else {
+		// RFC 8463 uses the raw key instead of a SubjectPublicKeyInfo
+		public = []byte(key.Public().(ed25519.PublicKey))
+	}
+
+	return fmt.Sprintf(
+		"v=DKIM1; k=%s; p=%s",
+		algorithm,
+		base64.StdEncoding.EncodeToString(public),
+	), nil
+}
+
+// QuoteRecord formats a record as the quoted strings of a zone file entry.
+// DNS strings are at most 255 bytes long, so longer records, like the ones of
+// 2048-bit RSA keys, are split into several of them.
+func QuoteRecord(record string) string {
+	var chunks []string
+	for len(record) > 255 {
+		chunks = append(chunks, `"`+record[:255]+`"`)
+		record = record[255:]
+	}
+	chunks = append(chunks, `"`+record+`"`)
+	return strings.Join(chunks, " ")
+}
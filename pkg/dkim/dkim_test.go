@@ -0,0 +1,287 @@
+package dkim
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"net"
+	"strings"
+	"testing"
+
+	. "github.com/pgpst/pgpst/internal/github.com/smartystreets/goconvey/convey"
+)
+
+// Example from RFC 6376, section 3.4.5
+var canonicalExample = "A: X\r\nB : Y\t\r\n\tZ  \r\n\r\n C \r\nD \t E\r\n\r\n\r\n"
+
+var testMessage = "From: Joe SixPack <joe@football.example.com>\r\n" +
+	"To: Suzie Q <suzie@shopping.example.net>\r\n" +
+	"Subject: Is dinner ready?\r\n" +
+	"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\r\n" +
+	"Message-ID: <20030712040037.46341.5F8J@football.example.com>\r\n" +
+	"\r\n" +
+	"Hi.\r\n" +
+	"\r\n" +
+	"We lost the game. Are you hungry yet?\r\n" +
+	"\r\n" +
+	"Joe.\r\n"
+
+// Recomputes the signed hash of a message signed by Sign
+func signedHash(signed []byte) ([]byte, []byte) {
+	headers, _ := splitMessage(signed)
+	field := headers[0].Raw
+	tags := parseTestTags(field)
+
+	hash := sha256.New()
+	used := map[int]struct{}{}
+	for _, name := range strings.Split(tags["h"], ":") {
+		for i := len(headers) - 1; i > 0; i-- {
+			if _, ok := used[i]; ok || !strings.EqualFold(headers[i].Name, name) {
+				continue
+			}
+			used[i] = struct{}{}
+			hash.Write([]byte(relaxedHeader(headers[i].Raw)))
+			break
+		}
+	}
+
+	b := field[strings.Index(field, "b=")+2:]
+	hash.Write([]byte(strings.TrimSuffix(relaxedHeader(field[:len(field)-len(b)]), "\r\n")))
+
+	signature, _ := base64.StdEncoding.DecodeString(tags["b"])
+	return hash.Sum(nil), signature
+}
+
+func parseTestTags(field string) map[string]string {
+	field = field[strings.Index(field, ":")+1:]
+	field = strings.NewReplacer("\r\n", "", "\t", "", " ", "").Replace(field)
+
+	tags := map[string]string{}
+	for _, tag := range strings.Split(field, ";") {
+		parts := strings.SplitN(tag, "=", 2)
+		if len(parts) == 2 {
+			tags[parts[0]] = parts[1]
+		}
+	}
+	return tags
+}
+
+func TestCanonicalization(t *testing.T) {
+	Convey("Given the example message from RFC 6376", t, func() {
+		headers, body := splitMessage([]byte(canonicalExample))
+
+		Convey("Relaxed header canonicalization should match the RFC", func() {
+			So(len(headers), ShouldEqual, 2)
+			So(relaxedHeader(headers[0].Raw)+relaxedHeader(headers[1].Raw), ShouldEqual, "a:X\r\nb:Y Z\r\n")
+		})
+
+		Convey("Relaxed body canonicalization should match the RFC", func() {
+			So(string(relaxedBody(body)), ShouldEqual, " C\r\nD E\r\n")
+		})
+	})
+
+	Convey("Given an empty body", t, func() {
+		Convey("Relaxed body canonicalization should return an empty string", func() {
+			So(string(relaxedBody([]byte("\r\n\r\n"))), ShouldEqual, "")
+			So(string(relaxedBody(nil)), ShouldEqual, "")
+		})
+	})
+
+	Convey("Given a body with bare newlines", t, func() {
+		Convey("Relaxed body canonicalization should use CRLF", func() {
+			So(string(relaxedBody([]byte("a  b \nc\n\n"))), ShouldEqual, "a b\r\nc\r\n")
+		})
+	})
+}
+
+func TestSign(t *testing.T) {
+	Convey("Given an RSA key", t, func() {
+		der, err := GenerateKey(RSA, 1024)
+		So(err, ShouldBeNil)
+
+		signer, err := NewSigner("football.example.com", "brisbane", der)
+		So(err, ShouldBeNil)
+
+		Convey("Record should return an RSA TXT record", func() {
+			record, err := Record(signer.Key)
+			So(err, ShouldBeNil)
+			So(record, ShouldStartWith, "v=DKIM1; k=rsa; p=")
+		})
+
+		Convey("Sign should produce a valid signature", func() {
+			signed, err := signer.Sign([]byte(testMessage))
+			So(err, ShouldBeNil)
+			So(string(signed), ShouldStartWith, "DKIM-Signature: v=1; a=rsa-sha256; c=relaxed/relaxed;")
+			So(string(signed), ShouldEndWith, testMessage)
+
+			tags := parseTestTags(strings.SplitN(string(signed), "\r\nFrom:", 2)[0])
+			So(tags["d"], ShouldEqual, "football.example.com")
+			So(tags["s"], ShouldEqual, "brisbane")
+			So(tags["h"], ShouldEqual, "from:subject:date:to:message-id")
+
+			bh := sha256.Sum256(relaxedBody([]byte("Hi.\r\n\r\nWe lost the game. Are you hungry yet?\r\n\r\nJoe.\r\n")))
+			So(tags["bh"], ShouldEqual, base64.StdEncoding.EncodeToString(bh[:]))
+
+			digest, signature := signedHash(signed)
+			err = rsa.VerifyPKCS1v15(signer.Key.Public().(*rsa.PublicKey), crypto.SHA256, digest, signature)
+			So(err, ShouldBeNil)
+		})
+
+		Convey("Sign should fail without a From header", func() {
+			_, err := signer.Sign([]byte("Subject: Hello\r\n\r\nHello world\r\n"))
+			So(err, ShouldEqual, ErrNoFrom)
+		})
+	})
+
+	Convey("Given an Ed25519 key", t, func() {
+		der, err := GenerateKey(Ed25519, 0)
+		So(err, ShouldBeNil)
+
+		signer, err := NewSigner("football.example.com", "brisbane", der)
+		So(err, ShouldBeNil)
+
+		Convey("Record should return an Ed25519 TXT record", func() {
+			record, err := Record(signer.Key)
+			So(err, ShouldBeNil)
+			So(record, ShouldStartWith, "v=DKIM1; k=ed25519; p=")
+			So(len(record), ShouldEqual, len("v=DKIM1; k=ed25519; p=")+44)
+		})
+
+		Convey("Sign should produce a valid signature", func() {
+			signed, err := signer.Sign([]byte(testMessage))
+			So(err, ShouldBeNil)
+			So(string(signed), ShouldStartWith, "DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed;")
+
+			digest, signature := signedHash(signed)
+			So(ed25519.Verify(signer.Key.Public().(ed25519.PublicKey), digest, signature), ShouldBeTrue)
+		})
+	})
+
+	Convey("Given an unknown algorithm", t, func() {
+		Convey("GenerateKey should fail", func() {
+			_, err := GenerateKey("dsa", 0)
+			So(err, ShouldEqual, ErrUnknownAlgorithm)
+		})
+	})
+}
+
+func TestQuoteRecord(t *testing.T) {
+	Convey("Given a 2048-bit RSA key", t, func() {
+		der, err := GenerateKey(RSA, 2048)
+		So(err, ShouldBeNil)
+
+		key, err := ParseKey(der)
+		So(err, ShouldBeNil)
+
+		record, err := Record(key)
+		So(err, ShouldBeNil)
+		So(len(record), ShouldBeGreaterThan, 255)
+
+		Convey("QuoteRecord should split the record into DNS strings", func() {
+			quoted := QuoteRecord(record)
+			So(quoted, ShouldStartWith, `"v=DKIM1; k=rsa; p=`)
+
+			chunks := strings.Split(quoted, " \"")
+			So(len(chunks), ShouldEqual, 2)
+			joined := ""
+			for _, chunk := range chunks {
+				chunk = strings.Trim(chunk, `"`)
+				So(len(chunk), ShouldBeLessThanOrEqualTo, 255)
+				joined += chunk
+			}
+			So(joined, ShouldEqual, record)
+		})
+	})
+
+	Convey("Short records should be a single string", t, func() {
+		So(QuoteRecord("v=DKIM1; k=ed25519; p=abc"), ShouldEqual, `"v=DKIM1; k=ed25519; p=abc"`)
+	})
+}
+
+type fakeResolver map[string][]string
+
+func (f fakeResolver) LookupTXT(name string) ([]string, error) {
+	if x, ok := f[name]; ok {
+		return x, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name}
+}
+
+func TestVerify(t *testing.T) {
+	Convey("Given messages signed with RSA and Ed25519 keys", t, func() {
+		resolver := fakeResolver{}
+		signed := map[string][]byte{}
+		for _, algorithm := range []string{RSA, Ed25519} {
+			der, err := GenerateKey(algorithm, 1024)
+			So(err, ShouldBeNil)
+			signer, err := NewSigner("football.example.com", algorithm, der)
+			So(err, ShouldBeNil)
+			record, err := Record(signer.Key)
+			So(err, ShouldBeNil)
+			resolver[algorithm+"._domainkey.football.example.com"] = []string{record}
+
+			signed[algorithm], err = signer.Sign([]byte(testMessage))
+			So(err, ShouldBeNil)
+		}
+
+		Convey("Verify should accept the valid signatures", func() {
+			for _, algorithm := range []string{RSA, Ed25519} {
+				results := Verify(signed[algorithm], resolver)
+				So(len(results), ShouldEqual, 1)
+				So(results[0].Err, ShouldBeNil)
+				So(results[0].Status, ShouldEqual, Pass)
+				So(results[0].Domain, ShouldEqual, "football.example.com")
+				So(results[0].Selector, ShouldEqual, algorithm)
+			}
+		})
+
+		Convey("Verify should ignore changes in whitespace", func() {
+			message := strings.Replace(string(signed[RSA]), "Subject: Is dinner ready?", "Subject:  Is dinner\r\n ready?", 1)
+			message = strings.Replace(message, "Hi.", "Hi.  ", 1)
+			results := Verify([]byte(message), resolver)
+			So(results[0].Status, ShouldEqual, Pass)
+		})
+
+		Convey("Verify should detect a modified body", func() {
+			message := strings.Replace(string(signed[Ed25519]), "game", "match", 1)
+			results := Verify([]byte(message), resolver)
+			So(results[0].Status, ShouldEqual, Fail)
+			So(results[0].Err, ShouldEqual, ErrBodyHash)
+		})
+
+		Convey("Verify should detect a modified header", func() {
+			message := strings.Replace(string(signed[RSA]), "Joe SixPack", "Joe Sixpack", 1)
+			results := Verify([]byte(message), resolver)
+			So(results[0].Status, ShouldEqual, Fail)
+			So(results[0].Err, ShouldEqual, ErrSignature)
+		})
+
+		Convey("Verify should fail on revoked keys", func() {
+			resolver[RSA+"._domainkey.football.example.com"] = []string{"v=DKIM1; k=rsa; p="}
+			results := Verify(signed[RSA], resolver)
+			So(results[0].Status, ShouldEqual, Fail)
+			So(results[0].Err, ShouldEqual, ErrRevoked)
+		})
+
+		Convey("Verify should return a permerror on missing keys", func() {
+			delete(resolver, Ed25519+"._domainkey.football.example.com")
+			results := Verify(signed[Ed25519], resolver)
+			So(results[0].Status, ShouldEqual, PermError)
+		})
+	})
+
+	Convey("Given an unsigned message", t, func() {
+		Convey("Verify should return no results", func() {
+			So(len(Verify([]byte(testMessage), fakeResolver{})), ShouldEqual, 0)
+		})
+	})
+
+	Convey("Given a message with simple canonicalization", t, func() {
+		Convey("Simple body canonicalization should remove trailing empty lines", func() {
+			So(string(simpleBody([]byte("a \r\nb\r\n\r\n\r\n"))), ShouldEqual, "a \r\nb\r\n")
+			So(string(simpleBody(nil)), ShouldEqual, "\r\n")
+		})
+	})
+}
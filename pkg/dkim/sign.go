@@ -0,0 +1,134 @@
+package dkim
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultHeaders are signed if the Signer has no list of its own.
+var DefaultHeaders = []string{
+	"From",
+	"Reply-To",
+	"Subject",
+	"Date",
+	"To",
+	"Cc",
+	"Message-ID",
+	"In-Reply-To",
+	"References",
+	"MIME-Version",
+	"Content-Type",
+	"Content-Transfer-Encoding",
+}
+
+var ErrNoFrom = errors.New("Message has no From header")
+
+type Signer struct {
+	Domain   string
+	Selector string
+	Key      crypto.Signer
+	Headers  []string
+}
+
+// NewSigner creates a signer from a key in the form returned by GenerateKey.
+func NewSigner(domain string, selector string, der []byte) (*Signer, error) {
+	key, err := ParseKey(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Signer{
+		Domain:   domain,
+		Selector: selector,
+		Key:      key,
+	}, nil
+}
+
+// Sign returns the message with a DKIM-Signature header prepended. Signing
+// uses the relaxed/relaxed canonicalization.
+func (s *Signer) Sign(message []byte) ([]byte, error) {
+	algorithm, err := Algorithm(s.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	headers, body := splitMessage(message)
+
+	// Hash the body
+	bh := sha256.Sum256(relaxedBody(body))
+
+	// Select the header fields to sign, starting from the bottom
+	names := s.Headers
+	if names == nil {
+		names = DefaultHeaders
+	}
+	var (
+		signed = []string{}
+		hash   = sha256.New()
+		used   = map[int]struct{}{}
+		from   = false
+	)
+	for _, name := range names {
+		for i := len(headers) - 1; i >= 0; i-- {
+			if _, ok := used[i]; ok || !strings.EqualFold(headers[i].Name, name) {
+				continue
+			}
+			used[i] = struct{}{}
+
+			if strings.EqualFold(name, "From") {
+				from = true
+			}
+
+			signed = append(signed, strings.ToLower(name))
+			hash.Write([]byte(relaxedHeader(headers[i].Raw)))
+		}
+	}
+	if !from {
+		return nil, ErrNoFrom
+	}
+
+	// Prepare the signature header with an empty b= tag
+	field := "DKIM-Signature: v=1; a=" + algorithm + "-sha256; c=relaxed/relaxed;\r\n" +
+		"\td=" + s.Domain + "; s=" + s.Selector + "; t=" + strconv.FormatInt(time.Now().Unix(), 10) + ";\r\n" +
+		"\th=" + strings.Join(signed, ":") + ";\r\n" +
+		"\tbh=" + base64.StdEncoding.EncodeToString(bh[:]) + ";\r\n" +
+		"\tb="
+	hash.Write([]byte(strings.TrimSuffix(relaxedHeader(field), "\r\n")))
+	digest := hash.Sum(nil)
+
+	// Sign the hash
+	var signature []byte
+	switch key := s.Key.(type) {
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest)
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(key, digest)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Write the folded signature and the message
+	output := &bytes.Buffer{}
+	output.WriteString(field)
+	encoded := base64.StdEncoding.EncodeToString(signature)
+	for len(encoded) > 72 {
+		output.WriteString(encoded[:72])
+		output.WriteString("\r\n\t")
+		encoded = encoded[72:]
+	}
+	output.WriteString(encoded)
+	output.WriteString("\r\n")
+	output.Write(message)
+
+	return output.Bytes(), nil
+}
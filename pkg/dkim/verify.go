@@ -0,0 +1,325 @@
+package dkim
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Verification statuses, as in RFC 8601, section 2.7.1
+const (
+	Pass      = "pass"
+	Fail      = "fail"
+	Neutral   = "neutral"
+	TempError = "temperror"
+	PermError = "permerror"
+)
+
+// Max amount of signatures that are checked in a single message
+const maxSignatures = 5
+
+// Resolver is used to fetch the public keys.
+type Resolver interface {
+	LookupTXT(name string) ([]string, error)
+}
+
+// Result is the outcome of the verification of a single signature.
+type Result struct {
+	Status   string
+	Domain   string
+	Selector string
+	Err      error
+}
+
+var (
+	ErrBodyHash  = errors.New("Body hash did not verify")
+	ErrSignature = errors.New("Signature did not verify")
+	ErrNoKey     = errors.New("Key was not found")
+	ErrRevoked   = errors.New("Key was revoked")
+	ErrExpired   = errors.New("Signature has expired")
+)
+
+// Verify checks all DKIM-Signature headers of the message. An empty slice
+// means that the message was not signed.
+func Verify(message []byte, resolver Resolver) []*Result {
+	headers, body := splitMessage(message)
+
+	results := []*Result{}
+	for i, h := range headers {
+		if !strings.EqualFold(h.Name, "DKIM-Signature") {
+			continue
+		}
+		if len(results) >= maxSignatures {
+			break
+		}
+
+		results = append(results, verifySignature(headers, i, body, resolver))
+	}
+
+	return results
+}
+
+func verifySignature(headers []header, index int, body []byte, resolver Resolver) *Result {
+	field := headers[index].Raw
+	result := &Result{}
+	fail := func(status string, err error) *Result {
+		result.Status = status
+		result.Err = err
+		return result
+	}
+
+	tags, err := parseTags(field[strings.IndexByte(field, ':')+1:])
+	if err != nil {
+		return fail(PermError, err)
+	}
+	for _, name := range []string{"v", "a", "b", "bh", "d", "h", "s"} {
+		if _, ok := tags[name]; !ok {
+			return fail(PermError, fmt.Errorf("Signature is missing the %s tag", name))
+		}
+	}
+	result.Domain = strings.ToLower(tags["d"])
+	result.Selector = tags["s"]
+
+	if tags["v"] != "1" {
+		return fail(PermError, fmt.Errorf("Unsupported signature version %s", tags["v"]))
+	}
+
+	// rsa-sha1 is no longer considered valid, as in RFC 8301
+	var algorithm string
+	switch strings.ToLower(tags["a"]) {
+	case "rsa-sha256":
+		algorithm = RSA
+	case "ed25519-sha256":
+		algorithm = Ed25519
+	default:
+		return fail(PermError, ErrUnknownAlgorithm)
+	}
+
+	// Canonicalization defaults to simple/simple
+	headerC, bodyC := "simple", "simple"
+	if c, ok := tags["c"]; ok {
+		parts := strings.SplitN(strings.ToLower(c), "/", 2)
+		headerC = parts[0]
+		if len(parts) == 2 {
+			bodyC = parts[1]
+		}
+	}
+	if (headerC != "simple" && headerC != "relaxed") || (bodyC != "simple" && bodyC != "relaxed") {
+		return fail(PermError, fmt.Errorf("Unknown canonicalization %s", tags["c"]))
+	}
+
+	// The identity has to be within the signing domain
+	if i, ok := tags["i"]; ok {
+		domain := strings.ToLower(i[strings.LastIndex(i, "@")+1:])
+		if domain != result.Domain && !strings.HasSuffix(domain, "."+result.Domain) {
+			return fail(PermError, fmt.Errorf("Identity %s is not within %s", i, result.Domain))
+		}
+	}
+
+	// From has to be signed
+	signed := strings.Split(tags["h"], ":")
+	from := false
+	for i, name := range signed {
+		signed[i] = strings.TrimSpace(name)
+		if strings.EqualFold(signed[i], "From") {
+			from = true
+		}
+	}
+	if !from {
+		return fail(PermError, ErrNoFrom)
+	}
+
+	if x, ok := tags["x"]; ok {
+		expires, err := strconv.ParseInt(x, 10, 64)
+		if err != nil {
+			return fail(PermError, err)
+		}
+		if time.Now().Unix() > expires {
+			return fail(PermError, ErrExpired)
+		}
+	}
+
+	// Compute the body hash
+	if bodyC == "relaxed" {
+		body = relaxedBody(body)
+	} else {
+		body = simpleBody(body)
+	}
+	if l, ok := tags["l"]; ok {
+		length, err := strconv.Atoi(l)
+		if err != nil || length < 0 || length > len(body) {
+			return fail(PermError, fmt.Errorf("Invalid body length %s", l))
+		}
+		body = body[:length]
+	}
+	bh := sha256.Sum256(body)
+	if base64.StdEncoding.EncodeToString(bh[:]) != tags["bh"] {
+		return fail(Fail, ErrBodyHash)
+	}
+
+	// Compute the header hash, taking the instances from the bottom
+	canonicalize := relaxedHeader
+	if headerC == "simple" {
+		canonicalize = func(raw string) string {
+			return raw + "\r\n"
+		}
+	}
+	hash := sha256.New()
+	used := map[int]struct{}{}
+	for _, name := range signed {
+		for i := len(headers) - 1; i >= 0; i-- {
+			if _, ok := used[i]; ok || !strings.EqualFold(headers[i].Name, name) {
+				continue
+			}
+			used[i] = struct{}{}
+			hash.Write([]byte(canonicalize(headers[i].Raw)))
+			break
+		}
+	}
+	hash.Write([]byte(strings.TrimSuffix(canonicalize(removeSignature(field)), "\r\n")))
+	digest := hash.Sum(nil)
+
+	signature, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return fail(PermError, err)
+	}
+
+	// Fetch the key and check the signature
+	key, err := lookupKey(resolver, result.Selector+"._domainkey."+result.Domain, algorithm)
+	if err != nil {
+		if de, ok := err.(*net.DNSError); ok && (de.Temporary() || de.Timeout()) {
+			return fail(TempError, err)
+		}
+		if err == ErrRevoked {
+			return fail(Fail, err)
+		}
+		return fail(PermError, err)
+	}
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(k, crypto.SHA256, digest, signature); err != nil {
+			return fail(Fail, ErrSignature)
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, digest, signature) {
+			return fail(Fail, ErrSignature)
+		}
+	}
+
+	result.Status = Pass
+	return result
+}
+
+// parseTags reads a tag-list, as in RFC 6376, section 3.2. Whitespace is
+// removed from the values.
+func parseTags(list string) (map[string]string, error) {
+	tags := map[string]string{}
+	for _, tag := range strings.Split(list, ";") {
+		if strings.TrimSpace(tag) == "" {
+			continue
+		}
+
+		parts := strings.SplitN(tag, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid tag %s", strings.TrimSpace(tag))
+		}
+
+		name := strings.TrimSpace(parts[0])
+		if _, ok := tags[name]; ok {
+			return nil, fmt.Errorf("Duplicate tag %s", name)
+		}
+		tags[name] = strings.Map(func(r rune) rune {
+			if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+				return -1
+			}
+			return r
+		}, parts[1])
+	}
+
+	return tags, nil
+}
+
+// removeSignature empties the value of the b= tag of a signature field.
+func removeSignature(field string) string {
+	i := strings.IndexByte(field, ':')
+	tags := strings.Split(field[i+1:], ";")
+	for j, tag := range tags {
+		eq := strings.IndexByte(tag, '=')
+		if eq != -1 && strings.TrimSpace(tag[:eq]) == "b" {
+			tags[j] = tag[:eq+1]
+		}
+	}
+
+	return field[:i+1] + strings.Join(tags, ";")
+}
+
+func lookupKey(resolver Resolver, name string, algorithm string) (crypto.PublicKey, error) {
+	records, err := resolver.LookupTXT(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, ErrNoKey
+	}
+
+	tags, err := parseTags(strings.Join(records, ""))
+	if err != nil {
+		return nil, err
+	}
+	if v, ok := tags["v"]; ok && v != "DKIM1" {
+		return nil, fmt.Errorf("Unsupported key version %s", v)
+	}
+	k, ok := tags["k"]
+	if !ok {
+		k = RSA
+	}
+	if k != algorithm {
+		return nil, fmt.Errorf("Key type %s does not match the signature", k)
+	}
+	p, ok := tags["p"]
+	if !ok {
+		return nil, ErrNoKey
+	}
+	if p == "" {
+		return nil, ErrRevoked
+	}
+	der, err := base64.StdEncoding.DecodeString(p)
+	if err != nil {
+		return nil, err
+	}
+
+	if k == Ed25519 {
+		if len(der) != ed25519.PublicKeySize {
+			return nil, ErrUnsupportedKey
+		}
+		return ed25519.PublicKey(der), nil
+	}
+
+	// RSA keys are usually in the SubjectPublicKeyInfo form, but some
+	// signers publish the bare PKCS #1 key.
+	var key *rsa.PublicKey
+	if parsed, err := x509.ParsePKIXPublicKey(der); err == nil {
+		rk, ok := parsed.(*rsa.PublicKey)
+		if !ok {
+			return nil, ErrUnsupportedKey
+		}
+		key = rk
+	} else if key, err = x509.ParsePKCS1PublicKey(der); err != nil {
+		return nil, err
+	}
+	if key.N.BitLen() < 1024 {
+		return nil, ErrUnsupportedKey
+	}
+
+	return key, nil
+}
@@ -0,0 +1,225 @@
+// Package dmarc implements the policy evaluation of Domain-based Message
+// Authentication, Reporting and Conformance, as in RFC 7489.
+package dmarc
+
+import (
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Policies requested by the domain owners
+const (
+	None       = "none"
+	Quarantine = "quarantine"
+	Reject     = "reject"
+)
+
+// Evaluation results, as in RFC 8601, section 2.7.1
+const (
+	Pass      = "pass"
+	Fail      = "fail"
+	TempError = "temperror"
+	PermError = "permerror"
+)
+
+// Resolver is used to fetch the policy records.
+type Resolver interface {
+	LookupTXT(name string) ([]string, error)
+}
+
+// Record is a parsed policy record.
+type Record struct {
+	Policy          string
+	SubdomainPolicy string
+	AlignDKIM       string // r or s
+	AlignSPF        string // r or s
+	Percent         int
+}
+
+// Identifiers are the results of the underlying checks that DMARC uses.
+type Identifiers struct {
+	From        string   // domain of the From header
+	SPFDomain   string   // domain used in the SPF check
+	SPFPass     bool     // whether SPF returned a pass
+	DKIMDomains []string // d= domains of the valid signatures
+}
+
+// Result is the outcome of the evaluation.
+type Result struct {
+	Result      string // pass, fail, none, temperror or permerror
+	Domain      string // domain of the From header
+	Policy      string // policy requested for the domain
+	Disposition string // action to take after the pct sampling
+}
+
+// ParseRecord parses the contents of a _dmarc TXT record.
+func ParseRecord(txt string) (*Record, bool) {
+	record := &Record{
+		AlignDKIM: "r",
+		AlignSPF:  "r",
+		Percent:   100,
+	}
+
+	tags := strings.Split(txt, ";")
+	if strings.TrimSpace(tags[0]) != "v=DMARC1" {
+		return nil, false
+	}
+	for _, tag := range tags[1:] {
+		parts := strings.SplitN(tag, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		value := strings.ToLower(strings.TrimSpace(parts[1]))
+		switch strings.TrimSpace(parts[0]) {
+		case "p":
+			record.Policy = value
+		case "sp":
+			record.SubdomainPolicy = value
+		case "adkim":
+			record.AlignDKIM = value
+		case "aspf":
+			record.AlignSPF = value
+		case "pct":
+			if pct, err := strconv.Atoi(value); err == nil && pct >= 0 && pct <= 100 {
+				record.Percent = pct
+			}
+		}
+	}
+
+	if !validPolicy(record.Policy) {
+		return nil, false
+	}
+	if !validPolicy(record.SubdomainPolicy) {
+		record.SubdomainPolicy = record.Policy
+	}
+
+	return record, true
+}
+
+func validPolicy(policy string) bool {
+	return policy == None || policy == Quarantine || policy == Reject
+}
+
+// Lookup fetches the policy of a domain. Returns a nil record if the domain
+// has no policy.
+func Lookup(resolver Resolver, domain string) (*Record, error) {
+	records, err := resolver.LookupTXT("_dmarc." + domain)
+	if err != nil {
+		if de, ok := err.(*net.DNSError); ok && (de.Temporary() || de.Timeout()) {
+			return nil, err
+		}
+		return nil, nil
+	}
+
+	var found *Record
+	for _, txt := range records {
+		if record, ok := ParseRecord(txt); ok {
+			// Multiple records are treated as no record at all
+			if found != nil {
+				return nil, nil
+			}
+			found = record
+		}
+	}
+
+	return found, nil
+}
+
+// OrganizationalDomain returns the registered part of a domain. This is an
+// approximation of the public suffix algorithm that takes the last two
+// labels, or three if the second-level label is a common registry one.
+func OrganizationalDomain(domain string) string {
+	labels := strings.Split(strings.TrimSuffix(strings.ToLower(domain), "."), ".")
+	if len(labels) <= 2 {
+		return strings.Join(labels, ".")
+	}
+
+	keep := 2
+	switch labels[len(labels)-2] {
+	case "co", "com", "net", "org", "gov", "edu", "ac":
+		if len(labels[len(labels)-1]) == 2 {
+			keep = 3
+		}
+	}
+
+	return strings.Join(labels[len(labels)-keep:], ".")
+}
+
+func aligned(mode string, a string, b string) bool {
+	a = strings.ToLower(a)
+	b = strings.ToLower(b)
+	if mode == "s" {
+		return a == b
+	}
+	return OrganizationalDomain(a) == OrganizationalDomain(b)
+}
+
+// Check evaluates the policy of the From domain against the results of the
+// SPF and DKIM checks.
+func Check(resolver Resolver, ids *Identifiers) *Result {
+	from := strings.ToLower(ids.From)
+	result := &Result{
+		Result:      None,
+		Domain:      from,
+		Disposition: None,
+	}
+
+	// Find the policy, falling back to the organizational domain
+	record, err := Lookup(resolver, from)
+	if err != nil {
+		result.Result = TempError
+		return result
+	}
+	subdomain := false
+	if record == nil {
+		org := OrganizationalDomain(from)
+		if org == from {
+			return result
+		}
+
+		record, err = Lookup(resolver, org)
+		if err != nil {
+			result.Result = TempError
+			return result
+		}
+		if record == nil {
+			return result
+		}
+		subdomain = true
+	}
+
+	result.Policy = record.Policy
+	if subdomain {
+		result.Policy = record.SubdomainPolicy
+	}
+
+	// Any aligned identifier is enough to pass
+	if ids.SPFPass && aligned(record.AlignSPF, ids.SPFDomain, from) {
+		result.Result = Pass
+		return result
+	}
+	for _, domain := range ids.DKIMDomains {
+		if aligned(record.AlignDKIM, domain, from) {
+			result.Result = Pass
+			return result
+		}
+	}
+
+	// Apply the policy to the requested percentage of the failing messages,
+	// the rest gets the next weaker policy, as in RFC 7489, section 6.6.4.
+	result.Result = Fail
+	result.Disposition = result.Policy
+	if record.Percent < 100 && rand.Intn(100) >= record.Percent {
+		switch result.Policy {
+		case Reject:
+			result.Disposition = Quarantine
+		case Quarantine:
+			result.Disposition = None
+		}
+	}
+
+	return result
+}
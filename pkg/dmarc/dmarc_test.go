@@ -0,0 +1,111 @@
+package dmarc_test
+
+import (
+	"net"
+	"testing"
+
+	. "github.com/pgpst/pgpst/internal/github.com/smartystreets/goconvey/convey"
+
+	"github.com/pgpst/pgpst/pkg/dmarc"
+)
+
+type fakeResolver map[string][]string
+
+func (f fakeResolver) LookupTXT(name string) ([]string, error) {
+	if x, ok := f[name]; ok {
+		return x, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name}
+}
+
+func TestCheck(t *testing.T) {
+	resolver := fakeResolver{
+		"_dmarc.example.org":   {"v=DMARC1; p=reject; sp=quarantine; rua=mailto:dmarc@example.org"},
+		"_dmarc.strict.org":    {"v=DMARC1; p=quarantine; adkim=s; aspf=s"},
+		"_dmarc.monitor.org":   {"v=DMARC1; p=none"},
+		"_dmarc.invalid.org":   {"v=DMARC1; p=drop"},
+		"_dmarc.example.co.uk": {"v=DMARC1; p=reject"},
+	}
+
+	Convey("Given a set of DMARC records", t, func() {
+		Convey("Aligned SPF should pass", func() {
+			result := dmarc.Check(resolver, &dmarc.Identifiers{
+				From:      "example.org",
+				SPFDomain: "bounces.example.org",
+				SPFPass:   true,
+			})
+			So(result.Result, ShouldEqual, dmarc.Pass)
+			So(result.Policy, ShouldEqual, dmarc.Reject)
+			So(result.Disposition, ShouldEqual, dmarc.None)
+		})
+
+		Convey("Aligned DKIM should pass", func() {
+			result := dmarc.Check(resolver, &dmarc.Identifiers{
+				From:        "example.org",
+				SPFDomain:   "example.net",
+				SPFPass:     true,
+				DKIMDomains: []string{"example.net", "mail.example.org"},
+			})
+			So(result.Result, ShouldEqual, dmarc.Pass)
+		})
+
+		Convey("Unaligned identifiers should get the policy", func() {
+			result := dmarc.Check(resolver, &dmarc.Identifiers{
+				From:        "example.org",
+				SPFDomain:   "example.net",
+				SPFPass:     true,
+				DKIMDomains: []string{"example.net"},
+			})
+			So(result.Result, ShouldEqual, dmarc.Fail)
+			So(result.Disposition, ShouldEqual, dmarc.Reject)
+		})
+
+		Convey("Subdomains should use the subdomain policy", func() {
+			result := dmarc.Check(resolver, &dmarc.Identifiers{
+				From: "news.example.org",
+			})
+			So(result.Result, ShouldEqual, dmarc.Fail)
+			So(result.Domain, ShouldEqual, "news.example.org")
+			So(result.Disposition, ShouldEqual, dmarc.Quarantine)
+		})
+
+		Convey("Strict alignment should require exact domains", func() {
+			result := dmarc.Check(resolver, &dmarc.Identifiers{
+				From:        "strict.org",
+				SPFDomain:   "mail.strict.org",
+				SPFPass:     true,
+				DKIMDomains: []string{"mail.strict.org"},
+			})
+			So(result.Result, ShouldEqual, dmarc.Fail)
+			So(result.Disposition, ShouldEqual, dmarc.Quarantine)
+		})
+
+		Convey("The none policy should only report a failure", func() {
+			result := dmarc.Check(resolver, &dmarc.Identifiers{
+				From: "monitor.org",
+			})
+			So(result.Result, ShouldEqual, dmarc.Fail)
+			So(result.Disposition, ShouldEqual, dmarc.None)
+		})
+
+		Convey("Domains without valid records should return none", func() {
+			for _, domain := range []string{"invalid.org", "unknown.org"} {
+				result := dmarc.Check(resolver, &dmarc.Identifiers{
+					From: domain,
+				})
+				So(result.Result, ShouldEqual, dmarc.None)
+				So(result.Disposition, ShouldEqual, dmarc.None)
+			}
+		})
+
+		Convey("Organizational domains of registry suffixes should be found", func() {
+			So(dmarc.OrganizationalDomain("mail.example.co.uk"), ShouldEqual, "example.co.uk")
+			So(dmarc.OrganizationalDomain("a.b.example.org"), ShouldEqual, "example.org")
+
+			result := dmarc.Check(resolver, &dmarc.Identifiers{
+				From: "mail.example.co.uk",
+			})
+			So(result.Disposition, ShouldEqual, dmarc.Reject)
+		})
+	})
+}
@@ -0,0 +1,222 @@
+// Package forwarding prepares copies of received emails for the delivery to
+// external mailboxes, encrypting them with PGP/MIME (RFC 3156) when the key of
+// the target is known.
+package forwarding
+
+import (
+	"bytes"
+	"errors"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"strings"
+
+	"github.com/pgpst/pgpst/internal/github.com/dchest/uniuri"
+	"github.com/pgpst/pgpst/internal/golang.org/x/crypto/openpgp"
+
+	"github.com/pgpst/pgpst/pkg/analysis"
+	"github.com/pgpst/pgpst/pkg/utils"
+)
+
+// HopHeader is prepended to every forwarded email, listing the address that
+// forwarded it.
+const HopHeader = "X-Pgpst-Forwarded-For"
+
+// MaxHops is the amount of forwards an email can go through.
+const MaxHops = 8
+
+// Errors returned by Check
+var (
+	ErrLoop        = errors.New("forwarding: email has already been forwarded by this address")
+	ErrTooManyHops = errors.New("forwarding: email has been forwarded too many times")
+)
+
+// Check returns an error if forwarding the email from the address would
+// create a loop.
+func Check(header mail.Header, address string) error {
+	hops := header[textproto.CanonicalMIMEHeaderKey(HopHeader)]
+	for _, hop := range hops {
+		hop, _ = utils.SplitAddress(strings.Trim(strings.TrimSpace(hop), "<>"))
+		if hop == address {
+			return ErrLoop
+		}
+	}
+	if len(hops) >= MaxHops {
+		return ErrTooManyHops
+	}
+
+	return nil
+}
+
+// contentHeaders are moved into the encrypted part of an email.
+var contentHeaders = map[string]struct{}{
+	"Content-Type":              struct{}{},
+	"Content-Transfer-Encoding": struct{}{},
+	"Content-Disposition":       struct{}{},
+	"Content-Id":                struct{}{},
+	"Content-Description":       struct{}{},
+	"Mime-Version":              struct{}{},
+}
+
+// ObscuredSubject replaces the subject of the encrypted emails, which is only
+// readable from their protected headers.
+const ObscuredSubject = analysis.ObscuredSubject
+
+// Compose prepends the hop header of the address to the email. If the
+// keyring isn't empty, the email is encrypted, see Encrypt.
+func Compose(data []byte, address string, keyring openpgp.EntityList) ([]byte, error) {
+	if len(keyring) > 0 {
+		var err error
+		data, err = Encrypt(data, keyring)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	buf.WriteString(HopHeader + ": <" + address + ">\r\n")
+	buf.Write(data)
+	return buf.Bytes(), nil
+}
+
+// Encrypt replaces the content of the email with its PGP/MIME encrypted
+// version, keeping the rest of the headers intact. The encrypted part carries
+// the protected headers (Memory Hole), and the outer subject is obscured.
+func Encrypt(data []byte, keyring openpgp.EntityList) ([]byte, error) {
+	buf := &bytes.Buffer{}
+
+	// Separate the header from the body
+	header, body := data, []byte{}
+	if index := bytes.Index(data, []byte("\r\n\r\n")); index != -1 {
+		header, body = data[:index+2], data[index+4:]
+	} else if index := bytes.Index(data, []byte("\n\n")); index != -1 {
+		header, body = data[:index+1], data[index+2:]
+	}
+
+	// Split the fields between the outer and the encrypted part
+	var (
+		contentType = "text/plain; charset=us-ascii"
+		content     = &bytes.Buffer{}
+		protected   = &bytes.Buffer{}
+	)
+	for _, field := range splitFields(header) {
+		name, value := field, []byte{}
+		if index := bytes.IndexByte(field, ':'); index != -1 {
+			name, value = field[:index], field[index+1:]
+		}
+		key := textproto.CanonicalMIMEHeaderKey(string(bytes.TrimSpace(name)))
+
+		if _, ok := contentHeaders[key]; ok {
+			if key == "Content-Type" {
+				contentType = unfold(value)
+			} else if key != "Mime-Version" {
+				content.Write(field)
+			}
+			continue
+		}
+
+		if _, ok := protectedFields[key]; ok {
+			protected.Write(field)
+			if key == "Subject" {
+				buf.WriteString("Subject: " + ObscuredSubject + "\r\n")
+				continue
+			}
+		}
+		buf.Write(field)
+	}
+
+	// Mark the part, unless its content type can't be rewritten
+	inner := &bytes.Buffer{}
+	if media, params, err := mime.ParseMediaType(contentType); err == nil {
+		params["protected-headers"] = "v1"
+		inner.WriteString("Content-Type: " + mime.FormatMediaType(media, params) + "\r\n")
+	} else {
+		inner.WriteString("Content-Type: " + contentType + "\r\n")
+	}
+	inner.Write(content.Bytes())
+	inner.Write(protected.Bytes())
+	inner.WriteString("\r\n")
+	inner.Write(body)
+
+	ciphertext, err := utils.PGPEncrypt(inner.Bytes(), keyring)
+	if err != nil {
+		return nil, err
+	}
+	armored, err := utils.PGPArmor(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+
+	boundary := uniuri.NewLen(uniuri.UUIDLen)
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: " + mime.FormatMediaType("multipart/encrypted", map[string]string{
+		"protocol": "application/pgp-encrypted",
+		"boundary": boundary,
+	}) + "\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString("This is an OpenPGP/MIME encrypted message (RFC 3156).\r\n")
+	buf.WriteString("--" + boundary + "\r\n")
+	buf.WriteString("Content-Type: application/pgp-encrypted\r\n")
+	buf.WriteString("Content-Description: PGP/MIME version identification\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString("Version: 1\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString("--" + boundary + "\r\n")
+	buf.WriteString("Content-Type: application/octet-stream; name=\"encrypted.asc\"\r\n")
+	buf.WriteString("Content-Description: OpenPGP encrypted message\r\n")
+	buf.WriteString("Content-Disposition: inline; filename=\"encrypted.asc\"\r\n")
+	buf.WriteString("\r\n")
+	buf.Write(bytes.Replace(bytes.Replace(armored, []byte("\r\n"), []byte("\n"), -1), []byte("\n"), []byte("\r\n"), -1))
+	buf.WriteString("\r\n--" + boundary + "--\r\n")
+
+	return buf.Bytes(), nil
+}
+
+// protectedFields are copied into the encrypted part of an email.
+var protectedFields = map[string]struct{}{}
+
+func init() {
+	for _, field := range analysis.ProtectedFields {
+		protectedFields[field] = struct{}{}
+	}
+}
+
+// unfold joins the lines of a folded header value.
+func unfold(value []byte) string {
+	value = bytes.Replace(value, []byte("\r\n"), []byte(""), -1)
+	value = bytes.Replace(value, []byte("\n"), []byte(""), -1)
+	return string(bytes.TrimSpace(value))
+}
+
+// splitFields splits the header into fields, keeping the folded lines and
+// the line endings of every field.
+func splitFields(header []byte) [][]byte {
+	var fields [][]byte
+	for len(header) > 0 {
+		end := bytes.IndexByte(header, '\n')
+		if end == -1 {
+			end = len(header) - 1
+		}
+		line := header[:end+1]
+		header = header[end+1:]
+
+		if len(fields) > 0 && (line[0] == ' ' || line[0] == '\t') {
+			last := fields[len(fields)-1]
+			fields[len(fields)-1] = append(last[:len(last):len(last)], line...)
+			continue
+		}
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		fields = append(fields, line)
+	}
+
+	// The header might end without a line break if there's no body
+	if len(fields) > 0 {
+		if last := fields[len(fields)-1]; last[len(last)-1] != '\n' {
+			fields[len(fields)-1] = append(last[:len(last):len(last)], '\r', '\n')
+		}
+	}
+
+	return fields
+}
@@ -0,0 +1,165 @@
+package forwarding_test
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+
+	. "github.com/pgpst/pgpst/internal/github.com/smartystreets/goconvey/convey"
+	"github.com/pgpst/pgpst/internal/golang.org/x/crypto/openpgp"
+	"github.com/pgpst/pgpst/internal/golang.org/x/crypto/openpgp/armor"
+
+	"github.com/pgpst/pgpst/pkg/forwarding"
+)
+
+func parseHeader(header string) mail.Header {
+	msg, err := mail.ReadMessage(bufio.NewReader(strings.NewReader(header + "\r\n")))
+	if err != nil {
+		panic(err)
+	}
+
+	return msg.Header
+}
+
+func TestCheck(t *testing.T) {
+	Convey("An email without hop headers should be forwarded", t, func() {
+		So(forwarding.Check(parseHeader("To: suzie@pgp.st\r\n"), "suzie@pgp.st"), ShouldBeNil)
+	})
+
+	Convey("An email forwarded by another address should be forwarded", t, func() {
+		header := parseHeader("X-Pgpst-Forwarded-For: <joe@pgp.st>\r\nTo: suzie@pgp.st\r\n")
+		So(forwarding.Check(header, "suzie@pgp.st"), ShouldBeNil)
+	})
+
+	Convey("An email forwarded by the same address should be detected as a loop", t, func() {
+		header := parseHeader("X-Pgpst-Forwarded-For: <Suzie.Q@pgp.st>\r\nTo: suzie@pgp.st\r\n")
+		So(forwarding.Check(header, "suzieq@pgp.st"), ShouldEqual, forwarding.ErrLoop)
+	})
+
+	Convey("An email forwarded too many times should not be forwarded", t, func() {
+		header := strings.Repeat("X-Pgpst-Forwarded-For: <joe@example.org>\r\n", forwarding.MaxHops)
+		So(forwarding.Check(parseHeader(header), "suzie@pgp.st"), ShouldEqual, forwarding.ErrTooManyHops)
+	})
+}
+
+const email = "From: Joe <joe@example.org>\r\n" +
+	"To: suzie@pgp.st\r\n" +
+	"Subject: Football\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: text/plain;\r\n" +
+	"\tcharset=utf-8\r\n" +
+	"\r\n" +
+	"Are you coming?\r\n"
+
+func TestCompose(t *testing.T) {
+	Convey("Without keys the email should only get the hop header", t, func() {
+		output, err := forwarding.Compose([]byte(email), "suzie@pgp.st", nil)
+		So(err, ShouldBeNil)
+		So(string(output), ShouldEqual, "X-Pgpst-Forwarded-For: <suzie@pgp.st>\r\n"+email)
+	})
+
+	Convey("With a key the email should be encrypted using PGP/MIME", t, func() {
+		entity, err := openpgp.NewEntity("Suzie", "", "suzie@example.com", nil)
+		So(err, ShouldBeNil)
+		for _, identity := range entity.Identities {
+			identity.SelfSignature.PreferredHash = []uint8{8} // SHA256
+		}
+
+		output, err := forwarding.Compose([]byte(email), "suzie@pgp.st", openpgp.EntityList{entity})
+		So(err, ShouldBeNil)
+
+		msg, err := mail.ReadMessage(bytes.NewReader(output))
+		So(err, ShouldBeNil)
+		So(msg.Header.Get("X-Pgpst-Forwarded-For"), ShouldEqual, "<suzie@pgp.st>")
+		So(msg.Header.Get("Subject"), ShouldEqual, forwarding.ObscuredSubject)
+		So(msg.Header.Get("From"), ShouldEqual, "Joe <joe@example.org>")
+		So(msg.Header["Mime-Version"], ShouldResemble, []string{"1.0"})
+
+		mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+		So(err, ShouldBeNil)
+		So(mediaType, ShouldEqual, "multipart/encrypted")
+		So(params["protocol"], ShouldEqual, "application/pgp-encrypted")
+
+		reader := multipart.NewReader(msg.Body, params["boundary"])
+		part, err := reader.NextPart()
+		So(err, ShouldBeNil)
+		So(part.Header.Get("Content-Type"), ShouldEqual, "application/pgp-encrypted")
+
+		part, err = reader.NextPart()
+		So(err, ShouldBeNil)
+		block, err := armor.Decode(part)
+		So(err, ShouldBeNil)
+		details, err := openpgp.ReadMessage(block.Body, openpgp.EntityList{entity}, nil, nil)
+		So(err, ShouldBeNil)
+		plaintext, err := ioutil.ReadAll(details.UnverifiedBody)
+		So(err, ShouldBeNil)
+		So(string(plaintext), ShouldEqual, "Content-Type: text/plain; charset=utf-8; protected-headers=v1\r\n"+
+			"From: Joe <joe@example.org>\r\n"+
+			"To: suzie@pgp.st\r\n"+
+			"Subject: Football\r\n"+
+			"\r\n"+
+			"Are you coming?\r\n")
+
+		_, err = reader.NextPart()
+		So(err, ShouldEqual, io.EOF)
+	})
+
+	Convey("Encrypted emails sent by the accounts shouldn't get the hop header", t, func() {
+		entity, err := openpgp.NewEntity("Suzie", "", "suzie@example.com", nil)
+		So(err, ShouldBeNil)
+		for _, identity := range entity.Identities {
+			identity.SelfSignature.PreferredHash = []uint8{8} // SHA256
+		}
+
+		output, err := forwarding.Encrypt([]byte(email), openpgp.EntityList{entity})
+		So(err, ShouldBeNil)
+
+		msg, err := mail.ReadMessage(bytes.NewReader(output))
+		So(err, ShouldBeNil)
+		So(msg.Header.Get("X-Pgpst-Forwarded-For"), ShouldBeEmpty)
+		So(msg.Header.Get("Subject"), ShouldEqual, forwarding.ObscuredSubject)
+		So(msg.Header.Get("Content-Type"), ShouldStartWith, "multipart/encrypted;")
+	})
+
+	Convey("Emails without a content type should get the default one", t, func() {
+		entity, err := openpgp.NewEntity("Suzie", "", "suzie@example.com", nil)
+		So(err, ShouldBeNil)
+		for _, identity := range entity.Identities {
+			identity.SelfSignature.PreferredHash = []uint8{8} // SHA256
+		}
+
+		output, err := forwarding.Compose([]byte("Subject: Hi\r\nMessage-ID: <hi@example.org>\r\nX-Mailer: test\r\n\r\nHello\r\n"), "suzie@pgp.st", openpgp.EntityList{entity})
+		So(err, ShouldBeNil)
+
+		msg, err := mail.ReadMessage(bytes.NewReader(output))
+		So(err, ShouldBeNil)
+		So(msg.Header.Get("Subject"), ShouldEqual, forwarding.ObscuredSubject)
+		So(msg.Header.Get("Message-ID"), ShouldEqual, "<hi@example.org>")
+		So(msg.Header.Get("X-Mailer"), ShouldEqual, "test")
+
+		_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+		So(err, ShouldBeNil)
+		reader := multipart.NewReader(msg.Body, params["boundary"])
+		_, err = reader.NextPart()
+		So(err, ShouldBeNil)
+		part, err := reader.NextPart()
+		So(err, ShouldBeNil)
+		block, err := armor.Decode(part)
+		So(err, ShouldBeNil)
+		details, err := openpgp.ReadMessage(block.Body, openpgp.EntityList{entity}, nil, nil)
+		So(err, ShouldBeNil)
+		plaintext, err := ioutil.ReadAll(details.UnverifiedBody)
+		So(err, ShouldBeNil)
+		So(string(plaintext), ShouldEqual, "Content-Type: text/plain; charset=us-ascii; protected-headers=v1\r\n"+
+			"Subject: Hi\r\n"+
+			"Message-ID: <hi@example.org>\r\n"+
+			"\r\n"+
+			"Hello\r\n")
+	})
+}
@@ -0,0 +1,384 @@
+// Package hkp implements the parts of the HTTP Keyserver Protocol
+// (draft-shaw-openpgp-hkp) that don't need the database: parsing the searches,
+// formatting the key indexes and merging the uploaded keys.
+package hkp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pgpst/pgpst/internal/golang.org/x/crypto/openpgp"
+	"github.com/pgpst/pgpst/internal/golang.org/x/crypto/openpgp/packet"
+
+	"github.com/pgpst/pgpst/pkg/models"
+)
+
+// Kinds of searches
+const (
+	KeyID       = "key_id"
+	ShortKeyID  = "key_id_short"
+	Fingerprint = "fingerprint"
+	Email       = "email"
+)
+
+// ErrInvalidSearch is returned for searches that aren't key IDs, fingerprints
+// or email addresses. Searching the names isn't supported.
+var ErrInvalidSearch = errors.New("hkp: search is not a key ID, fingerprint or email address")
+
+// Search is a parsed search parameter.
+type Search struct {
+	Kind  string
+	Value string // uppercase key ID, lowercase fingerprint or the address
+}
+
+// ParseSearch reads the search parameter of a lookup.
+func ParseSearch(search string) (*Search, error) {
+	search = strings.TrimSpace(search)
+
+	if strings.HasPrefix(search, "0x") || strings.HasPrefix(search, "0X") {
+		value := search[2:]
+		if !isHex(value) {
+			return nil, ErrInvalidSearch
+		}
+
+		switch len(value) {
+		case 8:
+			return &Search{Kind: ShortKeyID, Value: strings.ToUpper(value)}, nil
+		case 16:
+			return &Search{Kind: KeyID, Value: strings.ToUpper(value)}, nil
+		case 40:
+			return &Search{Kind: Fingerprint, Value: strings.ToLower(value)}, nil
+		}
+
+		return nil, ErrInvalidSearch
+	}
+
+	if strings.Contains(search, "@") {
+		if address, err := mail.ParseAddress(search); err == nil {
+			return &Search{Kind: Email, Value: address.Address}, nil
+		}
+	}
+
+	return nil, ErrInvalidSearch
+}
+
+func isHex(value string) bool {
+	for _, c := range value {
+		if !(c >= '0' && c <= '9') && !(c >= 'a' && c <= 'f') && !(c >= 'A' && c <= 'F') {
+			return false
+		}
+	}
+	return value != ""
+}
+
+// Letters of the algorithms in the human readable index
+var algorithms = map[uint8]string{
+	1:  "R",
+	2:  "r",
+	3:  "s",
+	16: "g",
+	17: "D",
+	18: "e",
+	19: "E",
+}
+
+// escape encodes the characters that can't appear in the fields of the
+// machine readable index.
+func escape(value string) string {
+	var buf bytes.Buffer
+	for _, c := range []byte(value) {
+		if c == ':' || c == '%' || c < 0x20 || c > 0x7e {
+			fmt.Fprintf(&buf, "%%%02X", c)
+		} else {
+			buf.WriteByte(c)
+		}
+	}
+	return buf.String()
+}
+
+// timestamp formats a time of the machine readable index.
+func timestamp(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return strconv.FormatInt(t.Unix(), 10)
+}
+
+// entry is a key with the details that aren't stored in its model
+type entry struct {
+	*models.Key
+	Created    time.Time
+	Expiration time.Time
+	Revoked    bool
+}
+
+// describe reads the creation time and the revocations of the key from its
+// body, and the expiration from its newest self-signature.
+func describe(key *models.Key) (*entry, error) {
+	entities, err := openpgp.ReadKeyRing(bytes.NewReader(key.Body))
+	if err != nil {
+		return nil, err
+	}
+
+	result := &entry{
+		Key:     key,
+		Created: entities[0].PrimaryKey.CreationTime,
+		Revoked: len(entities[0].Revocations) > 0,
+	}
+
+	var newest *models.Signature
+	for _, identity := range key.Identities {
+		sig := identity.SelfSignature
+		if sig != nil && (newest == nil || sig.CreationTime.After(newest.CreationTime)) {
+			newest = sig
+		}
+	}
+	if newest != nil && newest.KeyLifetimeSecs != nil && *newest.KeyLifetimeSecs != 0 {
+		result.Expiration = result.Created.Add(time.Duration(*newest.KeyLifetimeSecs) * time.Second)
+	}
+
+	return result, nil
+}
+
+func (e *entry) flags(now time.Time) string {
+	flags := ""
+	if e.Revoked {
+		flags += "r"
+	}
+	if !e.Expiration.IsZero() && now.After(e.Expiration) {
+		flags += "e"
+	}
+	return flags
+}
+
+// identityExpiration returns when the self-signature of the identity expires.
+func identityExpiration(sig *models.Signature) time.Time {
+	if sig.SigLifetimeSecs == nil || *sig.SigLifetimeSecs == 0 {
+		return time.Time{}
+	}
+	return sig.CreationTime.Add(time.Duration(*sig.SigLifetimeSecs) * time.Second)
+}
+
+func identityFlags(sig *models.Signature, now time.Time) string {
+	flags := ""
+	if sig.RevocationReason != nil {
+		flags += "r"
+	}
+	if expiration := identityExpiration(sig); !expiration.IsZero() && now.After(expiration) {
+		flags += "e"
+	}
+	return flags
+}
+
+// Index lists the keys in the machine readable format used by the clients.
+func Index(keys []*models.Key, now time.Time) ([]byte, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "info:1:%d\n", len(keys))
+
+	for _, key := range keys {
+		e, err := describe(key)
+		if err != nil {
+			return nil, err
+		}
+
+		fmt.Fprintf(&buf, "pub:%s:%d:%d:%s:%s:%s\n",
+			strings.ToUpper(key.ID), key.Algorithm, key.Length,
+			timestamp(e.Created), timestamp(e.Expiration), e.flags(now),
+		)
+
+		for _, identity := range key.Identities {
+			if identity.SelfSignature == nil {
+				continue
+			}
+			fmt.Fprintf(&buf, "uid:%s:%s:%s:%s\n",
+				escape(identity.Name), timestamp(identity.SelfSignature.CreationTime),
+				timestamp(identityExpiration(identity.SelfSignature)), identityFlags(identity.SelfSignature, now),
+			)
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// HumanIndex lists the keys for people reading them in a browser. The
+// verbose index includes the signatures of the identities.
+func HumanIndex(keys []*models.Key, verbose bool, now time.Time) ([]byte, error) {
+	var buf bytes.Buffer
+
+	for i, key := range keys {
+		e, err := describe(key)
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 {
+			buf.WriteString("\n")
+		}
+
+		fmt.Fprintf(&buf, "pub  %d%s/%s %s", key.Length, algorithms[key.Algorithm], key.KeyIDString, e.Created.UTC().Format("2006-01-02"))
+		if flags := e.flags(now); strings.Contains(flags, "r") {
+			buf.WriteString(" [revoked]")
+		} else if strings.Contains(flags, "e") {
+			buf.WriteString(" [expired: " + e.Expiration.UTC().Format("2006-01-02") + "]")
+		} else if !e.Expiration.IsZero() {
+			buf.WriteString(" [expires: " + e.Expiration.UTC().Format("2006-01-02") + "]")
+		}
+		buf.WriteString("\n")
+		fmt.Fprintf(&buf, "     Key fingerprint = %s\n", strings.ToUpper(key.ID))
+
+		for _, identity := range key.Identities {
+			buf.WriteString("uid  " + identity.Name + "\n")
+			if !verbose {
+				continue
+			}
+
+			sigs := identity.Signatures
+			if identity.SelfSignature != nil {
+				sigs = append([]*models.Signature{identity.SelfSignature}, sigs...)
+			}
+			for _, sig := range sigs {
+				issuer := "????????????????"
+				if sig.IssuerKeyID != nil {
+					issuer = fmt.Sprintf("%016X", *sig.IssuerKeyID)
+				}
+				label := "sig "
+				if sig.Type == 0x30 {
+					label = "rev "
+				}
+				fmt.Fprintf(&buf, "%s %s %s\n", label, issuer, sig.CreationTime.UTC().Format("2006-01-02"))
+			}
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// ErrOtherKey is returned by Merge for keys with another primary key.
+var ErrOtherKey = errors.New("hkp: uploaded key has another primary key")
+
+// Merge adds the parts of an uploaded key to the stored one. Both have to be
+// read with openpgp.ReadKeyRing, which verifies the self-signatures, the
+// subkey bindings and the revocations of the key. Signatures of other keys
+// are dropped and older self-signatures never replace newer ones, so that an
+// upload can only add identities, subkeys and revocations made by the owner.
+func Merge(stored *openpgp.Entity, uploaded *openpgp.Entity) error {
+	if stored.PrimaryKey.Fingerprint != uploaded.PrimaryKey.Fingerprint {
+		return ErrOtherKey
+	}
+
+	revoked := map[int64]struct{}{}
+	for _, revocation := range stored.Revocations {
+		revoked[revocation.CreationTime.Unix()] = struct{}{}
+	}
+	for _, revocation := range uploaded.Revocations {
+		if _, ok := revoked[revocation.CreationTime.Unix()]; !ok {
+			revoked[revocation.CreationTime.Unix()] = struct{}{}
+			stored.Revocations = append(stored.Revocations, revocation)
+		}
+	}
+
+	for _, identity := range stored.Identities {
+		identity.Signatures = selfRevocations(stored.PrimaryKey, identity, nil)
+	}
+	for name, identity := range uploaded.Identities {
+		current, ok := stored.Identities[name]
+		if !ok {
+			identity.Signatures = selfRevocations(stored.PrimaryKey, identity, nil)
+			stored.Identities[name] = identity
+			continue
+		}
+
+		if identity.SelfSignature.CreationTime.After(current.SelfSignature.CreationTime) {
+			current.SelfSignature = identity.SelfSignature
+		}
+		current.Signatures = selfRevocations(stored.PrimaryKey, identity, current.Signatures)
+	}
+
+	for _, subkey := range uploaded.Subkeys {
+		found := false
+		for i := range stored.Subkeys {
+			current := &stored.Subkeys[i]
+			if current.PublicKey.KeyId != subkey.PublicKey.KeyId {
+				continue
+			}
+			found = true
+			if subkey.Sig.CreationTime.After(current.Sig.CreationTime) {
+				current.Sig = subkey.Sig
+			}
+		}
+		if !found {
+			stored.Subkeys = append(stored.Subkeys, subkey)
+		}
+	}
+
+	return nil
+}
+
+// selfRevocations appends the revocations of the identity made by the key to
+// the ones kept so far. Other signatures land among them when parsing, but
+// only these are verified and kept.
+func selfRevocations(key *packet.PublicKey, identity *openpgp.Identity, kept []*packet.Signature) []*packet.Signature {
+	seen := map[int64]struct{}{}
+	for _, sig := range kept {
+		seen[sig.CreationTime.Unix()] = struct{}{}
+	}
+
+	for _, sig := range identity.Signatures {
+		if sig.SigType != 0x30 || sig.IssuerKeyId == nil || *sig.IssuerKeyId != key.KeyId {
+			continue
+		}
+		if _, ok := seen[sig.CreationTime.Unix()]; ok {
+			continue
+		}
+		if key.VerifyUserIdSignature(identity.UserId.Id, key, sig) != nil {
+			continue
+		}
+		seen[sig.CreationTime.Unix()] = struct{}{}
+		kept = append(kept, sig)
+	}
+
+	return kept
+}
+
+// Serialize writes the public parts of the entity, including the revocations
+// that openpgp.Entity's Serialize leaves out.
+func Serialize(entity *openpgp.Entity) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := entity.PrimaryKey.Serialize(&buf); err != nil {
+		return nil, err
+	}
+	for _, revocation := range entity.Revocations {
+		if err := revocation.Serialize(&buf); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, identity := range entity.Identities {
+		if err := identity.UserId.Serialize(&buf); err != nil {
+			return nil, err
+		}
+		if err := identity.SelfSignature.Serialize(&buf); err != nil {
+			return nil, err
+		}
+		for _, sig := range identity.Signatures {
+			if err := sig.Serialize(&buf); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, subkey := range entity.Subkeys {
+		if err := subkey.PublicKey.Serialize(&buf); err != nil {
+			return nil, err
+		}
+		if err := subkey.Sig.Serialize(&buf); err != nil {
+			return nil, err
+		}
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,240 @@
+package hkp_test
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/pgpst/pgpst/internal/github.com/smartystreets/goconvey/convey"
+	"github.com/pgpst/pgpst/internal/golang.org/x/crypto/openpgp"
+	"github.com/pgpst/pgpst/internal/golang.org/x/crypto/openpgp/packet"
+
+	"github.com/pgpst/pgpst/pkg/hkp"
+	"github.com/pgpst/pgpst/pkg/models"
+)
+
+func TestParseSearch(t *testing.T) {
+	cases := []struct {
+		Search string
+		Kind   string
+		Value  string
+	}{
+		{"0xdeadbeef", hkp.ShortKeyID, "DEADBEEF"},
+		{"0x0123456789ABCDEF", hkp.KeyID, "0123456789ABCDEF"},
+		{"0X0123456789abcdef0123456789ABCDEF01234567", hkp.Fingerprint, "0123456789abcdef0123456789abcdef01234567"},
+		{"bob@pgp.st", hkp.Email, "bob@pgp.st"},
+		{"Bob <bob@pgp.st>", hkp.Email, "bob@pgp.st"},
+	}
+
+	Convey("Given searches of the clients", t, func() {
+		for _, c := range cases {
+			Convey(c.Search+" should be a "+c.Kind+" search", func() {
+				search, err := hkp.ParseSearch(c.Search)
+				So(err, ShouldBeNil)
+				So(search.Kind, ShouldEqual, c.Kind)
+				So(search.Value, ShouldEqual, c.Value)
+			})
+		}
+
+		Convey("Names and malformed key IDs should be rejected", func() {
+			for _, search := range []string{"Bob", "0xdeadbee", "0xnothexxx", ""} {
+				_, err := hkp.ParseSearch(search)
+				So(err, ShouldEqual, hkp.ErrInvalidSearch)
+			}
+		})
+	})
+}
+
+func TestIndex(t *testing.T) {
+	entity, err := openpgp.NewEntity("Bob", "", "bob@pgp.st", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := entity.SerializePrivate(ioutil.Discard, nil); err != nil {
+		t.Fatal(err)
+	}
+	var body bytes.Buffer
+	if err := entity.Serialize(&body); err != nil {
+		t.Fatal(err)
+	}
+
+	Convey("Given a stored key", t, func() {
+		var (
+			now      = time.Now()
+			created  = entity.PrimaryKey.CreationTime
+			lifetime = uint32(3600)
+			issuer   = uint64(0x1234)
+		)
+		key := &models.Key{
+			ID:          hex.EncodeToString(entity.PrimaryKey.Fingerprint[:]),
+			Algorithm:   1,
+			Length:      2048,
+			Body:        body.Bytes(),
+			KeyIDString: entity.PrimaryKey.KeyIdString(),
+			Identities: []*models.Identity{{
+				Name: "Bob <bob@pgp.st>",
+				SelfSignature: &models.Signature{
+					Type:         0x13,
+					CreationTime: created,
+				},
+				Signatures: []*models.Signature{{
+					Type:         0x10,
+					CreationTime: created,
+					IssuerKeyID:  &issuer,
+				}},
+			}},
+		}
+
+		Convey("The machine readable index should list the key and its identities", func() {
+			index, err := hkp.Index([]*models.Key{key}, now)
+			So(err, ShouldBeNil)
+			So(string(index), ShouldEqual, fmt.Sprintf(
+				"info:1:1\npub:%s:1:2048:%d::\nuid:Bob <bob@pgp.st>:%d::\n",
+				strings.ToUpper(key.ID), created.Unix(), created.Unix(),
+			))
+		})
+
+		Convey("Expired keys should be flagged", func() {
+			key.Identities[0].SelfSignature.KeyLifetimeSecs = &lifetime
+			index, err := hkp.Index([]*models.Key{key}, now.Add(2*time.Hour))
+			So(err, ShouldBeNil)
+			So(string(index), ShouldContainSubstring, fmt.Sprintf(":%d:e\n", created.Add(time.Hour).Unix()))
+		})
+
+		Convey("Colons in the identities should be escaped", func() {
+			key.Identities[0].Name = "Bob: The Builder <bob@pgp.st>"
+			index, err := hkp.Index([]*models.Key{key}, now)
+			So(err, ShouldBeNil)
+			So(string(index), ShouldContainSubstring, "uid:Bob%3A The Builder <bob@pgp.st>:")
+		})
+
+		Convey("Only the verbose human index should include the signatures", func() {
+			index, err := hkp.HumanIndex([]*models.Key{key}, false, now)
+			So(err, ShouldBeNil)
+			So(string(index), ShouldContainSubstring, "pub  2048R/"+key.KeyIDString)
+			So(string(index), ShouldContainSubstring, "uid  Bob <bob@pgp.st>\n")
+			So(string(index), ShouldNotContainSubstring, "0000000000001234")
+
+			index, err = hkp.HumanIndex([]*models.Key{key}, true, now)
+			So(err, ShouldBeNil)
+			So(string(index), ShouldContainSubstring, "sig  0000000000001234")
+		})
+	})
+}
+
+func TestMerge(t *testing.T) {
+	var (
+		now     = time.Now()
+		created = now.Add(-time.Hour * 48)
+		config  = &packet.Config{Time: func() time.Time { return created }}
+	)
+
+	alice, err := openpgp.NewEntity("Alice", "", "alice@pgp.st", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.SerializePrivate(ioutil.Discard, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reads back the public part, like the stored and uploaded keys
+	public := func(entity *openpgp.Entity) *openpgp.Entity {
+		So(entity.SerializePrivate(ioutil.Discard, nil), ShouldBeNil)
+		body, err := hkp.Serialize(entity)
+		So(err, ShouldBeNil)
+		entities, err := openpgp.ReadKeyRing(bytes.NewReader(body))
+		So(err, ShouldBeNil)
+		return entities[0]
+	}
+
+	// Adds a revocation of the identity, signed by the signer
+	revoke := func(entity *openpgp.Entity, identity *openpgp.Identity, signer *openpgp.Entity) {
+		issuer := entity.PrimaryKey.KeyId
+		sig := &packet.Signature{
+			SigType:      0x30,
+			PubKeyAlgo:   signer.PrivateKey.PubKeyAlgo,
+			Hash:         crypto.SHA256,
+			CreationTime: now,
+			IssuerKeyId:  &issuer,
+		}
+		So(sig.SignUserId(identity.UserId.Id, entity.PrimaryKey, signer.PrivateKey, nil), ShouldBeNil)
+		identity.Signatures = append(identity.Signatures, sig)
+	}
+
+	Convey("Given a stored key", t, func() {
+		bob, err := openpgp.NewEntity("Bob", "", "bob@pgp.st", config)
+		So(err, ShouldBeNil)
+		identity := bob.Identities["Bob <bob@pgp.st>"]
+		stored := public(bob)
+
+		Convey("Merging the same key should change nothing", func() {
+			before, err := hkp.Serialize(stored)
+			So(err, ShouldBeNil)
+			So(hkp.Merge(stored, public(bob)), ShouldBeNil)
+			after, err := hkp.Serialize(stored)
+			So(err, ShouldBeNil)
+			So(after, ShouldResemble, before)
+		})
+
+		Convey("Signatures of other keys should be dropped", func() {
+			So(bob.SignIdentity("Bob <bob@pgp.st>", alice, nil), ShouldBeNil)
+			uploaded := public(bob)
+			So(len(uploaded.Identities["Bob <bob@pgp.st>"].Signatures), ShouldEqual, 1)
+			So(hkp.Merge(stored, uploaded), ShouldBeNil)
+			So(len(stored.Identities["Bob <bob@pgp.st>"].Signatures), ShouldEqual, 0)
+		})
+
+		Convey("Revocations of the owner should be added", func() {
+			revoke(bob, identity, bob)
+			So(hkp.Merge(stored, public(bob)), ShouldBeNil)
+			So(len(stored.Identities["Bob <bob@pgp.st>"].Signatures), ShouldEqual, 1)
+
+			// Uploading them again shouldn't duplicate them
+			So(hkp.Merge(stored, public(bob)), ShouldBeNil)
+			So(len(stored.Identities["Bob <bob@pgp.st>"].Signatures), ShouldEqual, 1)
+		})
+
+		Convey("Forged revocations should be dropped", func() {
+			revoke(bob, identity, alice)
+			So(hkp.Merge(stored, public(bob)), ShouldBeNil)
+			So(len(stored.Identities["Bob <bob@pgp.st>"].Signatures), ShouldEqual, 0)
+		})
+
+		Convey("Newer self-signatures should replace the stored ones", func() {
+			identity.SelfSignature.CreationTime = now
+			bob.Subkeys[0].Sig.CreationTime = now
+			So(hkp.Merge(stored, public(bob)), ShouldBeNil)
+			So(stored.Identities["Bob <bob@pgp.st>"].SelfSignature.CreationTime.Unix(), ShouldEqual, now.Unix())
+			So(stored.Subkeys[0].Sig.CreationTime.Unix(), ShouldEqual, now.Unix())
+		})
+
+		Convey("Older self-signatures shouldn't replace the stored ones", func() {
+			lifetime := uint32(3600)
+			identity.SelfSignature.CreationTime = now
+			identity.SelfSignature.KeyLifetimeSecs = &lifetime
+			bob.Subkeys[0].Sig.CreationTime = now
+			bob.Subkeys[0].Sig.KeyLifetimeSecs = &lifetime
+			newer := public(bob)
+
+			So(hkp.Merge(newer, stored), ShouldBeNil)
+			So(newer.Identities["Bob <bob@pgp.st>"].SelfSignature.KeyLifetimeSecs, ShouldNotBeNil)
+			So(newer.Subkeys[0].Sig.KeyLifetimeSecs, ShouldNotBeNil)
+		})
+
+		Convey("Keys without the stored subkeys should keep them", func() {
+			uploaded := public(bob)
+			uploaded.Subkeys = nil
+			So(hkp.Merge(stored, uploaded), ShouldBeNil)
+			So(len(stored.Subkeys), ShouldEqual, 1)
+		})
+
+		Convey("Other keys should be rejected", func() {
+			So(hkp.Merge(stored, public(alice)), ShouldEqual, hkp.ErrOtherKey)
+		})
+	})
+}
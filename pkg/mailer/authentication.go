@@ -0,0 +1,195 @@
+package mailer
+
+import (
+	"bytes"
+	"net/mail"
+	"strings"
+
+	"github.com/pgpst/pgpst/internal/github.com/pgpst/smtpd"
+
+	"github.com/pgpst/pgpst/pkg/dkim"
+	"github.com/pgpst/pgpst/pkg/dmarc"
+	"github.com/pgpst/pgpst/pkg/models"
+	"github.com/pgpst/pgpst/pkg/spf"
+)
+
+// authenticate runs the SPF, DKIM and DMARC checks on the current envelope.
+func (m *Mailer) authenticate(conn *smtpd.Connection) (*models.Authentication, *dmarc.Result) {
+	auth := &models.Authentication{
+		DKIM: []*models.DKIMResult{},
+	}
+
+	// SPF uses the connecting IP and the MAIL FROM
+	ip := remoteIP(conn)
+	spfPass := false
+	if ip != nil {
+		result, domain := spf.Check(m.Resolver, ip, conn.HeloName, conn.Envelope.Sender)
+		auth.SPF = string(result)
+		auth.SPFDomain = domain
+		spfPass = result == spf.Pass
+	} else {
+		auth.SPF = string(spf.None)
+	}
+
+	// Check all the signatures
+	dkimDomains := []string{}
+	for _, result := range dkim.Verify(conn.Envelope.Data, m.Resolver) {
+		auth.DKIM = append(auth.DKIM, &models.DKIMResult{
+			Result:   result.Status,
+			Domain:   result.Domain,
+			Selector: result.Selector,
+		})
+		if result.Status == dkim.Pass {
+			dkimDomains = append(dkimDomains, result.Domain)
+		}
+	}
+
+	// DMARC is based on the domain of the From header. It's skipped without
+	// the IP, as the policies would be enforced against the SPF check that
+	// never ran - LMTP clients are expected to have applied them already.
+	policy := &dmarc.Result{
+		Result:      dmarc.None,
+		Disposition: dmarc.None,
+	}
+	if msg, err := mail.ReadMessage(bytes.NewReader(conn.Envelope.Data)); err == nil && ip != nil {
+		if from, err := mail.ParseAddress(msg.Header.Get("From")); err == nil {
+			policy = dmarc.Check(m.Resolver, &dmarc.Identifiers{
+				From:        from.Address[strings.LastIndex(from.Address, "@")+1:],
+				SPFDomain:   auth.SPFDomain,
+				SPFPass:     spfPass,
+				DKIMDomains: dkimDomains,
+			})
+		}
+	}
+	auth.DMARC = policy.Result
+	auth.DMARCDomain = policy.Domain
+	auth.DMARCPolicy = policy.Policy
+
+	return auth, policy
+}
+
+// authenticationResults formats the results as an Authentication-Results
+// header, as in RFC 8601.
+func authenticationResults(hostname string, auth *models.Authentication) []byte {
+	buf := &bytes.Buffer{}
+	buf.WriteString("Authentication-Results: ")
+	buf.WriteString(hostname)
+	buf.WriteString(";\r\n\tspf=")
+	buf.WriteString(auth.SPF)
+	if auth.SPFDomain != "" {
+		buf.WriteString(" smtp.mailfrom=")
+		buf.WriteString(auth.SPFDomain)
+	}
+
+	if len(auth.DKIM) == 0 {
+		buf.WriteString(";\r\n\tdkim=none")
+	}
+	for _, result := range auth.DKIM {
+		buf.WriteString(";\r\n\tdkim=")
+		buf.WriteString(result.Result)
+		if result.Domain != "" {
+			buf.WriteString(" header.d=")
+			buf.WriteString(result.Domain)
+		}
+		if result.Selector != "" {
+			buf.WriteString(" header.s=")
+			buf.WriteString(result.Selector)
+		}
+	}
+
+	buf.WriteString(";\r\n\tdmarc=")
+	buf.WriteString(auth.DMARC)
+	if auth.DMARCPolicy != "" {
+		buf.WriteString(" (p=")
+		buf.WriteString(auth.DMARCPolicy)
+		buf.WriteString(")")
+	}
+	if auth.DMARCDomain != "" {
+		buf.WriteString(" header.from=")
+		buf.WriteString(auth.DMARCDomain)
+	}
+	buf.WriteString("\r\n")
+
+	return buf.Bytes()
+}
+
+// authservID returns the authserv-id of an Authentication-Results value,
+// skipping the comments around it.
+func authservID(value string) string {
+	var (
+		buf   bytes.Buffer
+		depth = 0
+	)
+	for _, c := range value {
+		switch {
+		case c == '(':
+			depth++
+		case c == ')' && depth > 0:
+			depth--
+		case depth > 0:
+		case c == ';':
+			return strings.TrimSpace(buf.String())
+		default:
+			buf.WriteRune(c)
+		}
+	}
+	return strings.TrimSpace(buf.String())
+}
+
+// removeAuthenticationResults drops the Authentication-Results fields that
+// claim to come from the host, so that senders can't forge our results
+// (RFC 8601, section 5).
+func removeAuthenticationResults(hostname string, data []byte) []byte {
+	return removeFields(data, func(name string, value string) bool {
+		return strings.EqualFold(name, "Authentication-Results") &&
+			strings.EqualFold(authservID(value), hostname)
+	})
+}
+
+// removeFields drops the header fields for which drop returns true, keeping
+// the folding of the others intact.
+func removeFields(data []byte, drop func(name string, value string) bool) []byte {
+	// The header ends with the line break of its last field. The DATA
+	// command converts the line endings to LF, so both kinds are handled.
+	end := len(data)
+	if index := bytes.Index(data, []byte("\r\n\r\n")); index != -1 {
+		end = index + 2
+	} else if index := bytes.Index(data, []byte("\n\n")); index != -1 {
+		end = index + 1
+	}
+
+	var (
+		result = make([]byte, 0, len(data))
+		header = data[:end]
+		field  []byte
+	)
+	keep := func() {
+		if field == nil {
+			return
+		}
+		if colon := bytes.IndexByte(field, ':'); colon != -1 &&
+			drop(strings.TrimSpace(string(field[:colon])), string(field[colon+1:])) {
+			return
+		}
+		result = append(result, field...)
+	}
+
+	for len(header) > 0 {
+		line := header
+		if index := bytes.IndexByte(header, '\n'); index != -1 {
+			line = header[:index+1]
+		}
+		header = header[len(line):]
+
+		// Folded lines continue the previous field
+		if field != nil && (line[0] == ' ' || line[0] == '\t') {
+			field = append(field, line...)
+			continue
+		}
+		keep()
+		field = append([]byte{}, line...)
+	}
+	keep()
+
+	return append(result, data[end:]...)
+}
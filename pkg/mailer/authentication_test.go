@@ -0,0 +1,153 @@
+package mailer
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/pgpst/pgpst/internal/github.com/pgpst/smtpd"
+	. "github.com/pgpst/pgpst/internal/github.com/smartystreets/goconvey/convey"
+
+	"github.com/pgpst/pgpst/pkg/dmarc"
+	"github.com/pgpst/pgpst/pkg/utils"
+)
+
+func TestRemoveAuthenticationResults(t *testing.T) {
+	Convey("Given an email with forged and foreign results", t, func() {
+		email := "Authentication-Results: pgp.st; dkim=pass;\r\n\tdmarc=pass\r\n" +
+			"From: alice@example.com\r\n" +
+			"Authentication-Results: (forged) PGP.ST (comment);\r\n dmarc=pass\r\n" +
+			"Authentication-Results: mx.example.com; spf=pass\r\n" +
+			"Subject: Hi\r\n" +
+			"\r\n" +
+			"Authentication-Results: pgp.st; in the body\r\n"
+
+		Convey("Only the results claiming to be ours should be removed", func() {
+			So(string(removeAuthenticationResults("pgp.st", []byte(email))), ShouldEqual,
+				"From: alice@example.com\r\n"+
+					"Authentication-Results: mx.example.com; spf=pass\r\n"+
+					"Subject: Hi\r\n"+
+					"\r\n"+
+					"Authentication-Results: pgp.st; in the body\r\n",
+			)
+		})
+
+		Convey("Emails without the results should be left alone", func() {
+			email := "From: alice@example.com\r\n\r\nHello\r\n"
+			So(string(removeAuthenticationResults("pgp.st", []byte(email))), ShouldEqual, email)
+		})
+	})
+
+	Convey("Given an email with LF line endings, as read by DATA", t, func() {
+		Convey("Forged results after the first field should be removed", func() {
+			email := "From: alice@example.com\n" +
+				"Authentication-Results: pgp.st; dkim=pass;\n\tdmarc=pass\n" +
+				"Subject: Hi\n" +
+				"\n" +
+				"Hello\n"
+			So(string(removeAuthenticationResults("pgp.st", []byte(email))), ShouldEqual,
+				"From: alice@example.com\n"+
+					"Subject: Hi\n"+
+					"\n"+
+					"Hello\n",
+			)
+		})
+
+		Convey("Forged results in the first field should keep the rest of the email", func() {
+			email := "Authentication-Results: pgp.st; dmarc=pass\n" +
+				"From: alice@example.com\n" +
+				"\n" +
+				"Hello\n"
+			So(string(removeAuthenticationResults("pgp.st", []byte(email))), ShouldEqual,
+				"From: alice@example.com\n"+
+					"\n"+
+					"Hello\n",
+			)
+		})
+	})
+}
+
+func TestRemoveFields(t *testing.T) {
+	Convey("Given an email with a folded Bcc field at the end of the header", t, func() {
+		email := "From: alice@example.com\r\n" +
+			"To: bob@example.org\r\n" +
+			"Bcc: carol@example.org,\r\n\tdave@example.org\r\n" +
+			"\r\n" +
+			"Bcc: in the body\r\n"
+
+		Convey("The field should be removed without changing the body", func() {
+			So(string(removeFields([]byte(email), func(name string, value string) bool {
+				return strings.EqualFold(name, "Bcc")
+			})), ShouldEqual,
+				"From: alice@example.com\r\n"+
+					"To: bob@example.org\r\n"+
+					"\r\n"+
+					"Bcc: in the body\r\n",
+			)
+		})
+	})
+
+	Convey("Given an email with LF line endings, as read by DATA", t, func() {
+		email := "From: alice@example.com\n" +
+			"Bcc: carol@example.org,\n\tdave@example.org\n" +
+			"To: bob@example.org\n" +
+			"Bcc: erin@example.org\n" +
+			"\n" +
+			"Bcc: in the body\n"
+
+		Convey("Every Bcc field of the header should be removed", func() {
+			So(string(removeFields([]byte(email), func(name string, value string) bool {
+				return strings.EqualFold(name, "Bcc")
+			})), ShouldEqual,
+				"From: alice@example.com\n"+
+					"To: bob@example.org\n"+
+					"\n"+
+					"Bcc: in the body\n",
+			)
+		})
+	})
+}
+
+type txtResolver struct {
+	utils.NetResolver
+	TXT map[string][]string
+}
+
+func (t txtResolver) LookupTXT(name string) ([]string, error) {
+	if x, ok := t.TXT[name]; ok {
+		return x, nil
+	}
+	return nil, errors.New("no such host")
+}
+
+func TestAuthenticate(t *testing.T) {
+	Convey("Given an email from a domain rejecting the failures", t, func() {
+		m := &Mailer{
+			Resolver: txtResolver{TXT: map[string][]string{
+				"example.com":        {"v=spf1 -all"},
+				"_dmarc.example.com": {"v=DMARC1; p=reject"},
+			}},
+		}
+		conn := &smtpd.Connection{
+			Server: &smtpd.Server{},
+			Addr:   &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 25},
+			Envelope: &smtpd.Envelope{
+				Sender: "alice@example.com",
+				Data:   []byte("From: alice@example.com\r\nSubject: Hi\r\n\r\nHello\r\n"),
+			},
+		}
+
+		Convey("SMTP clients should be held to the policy", func() {
+			_, policy := m.authenticate(conn)
+			So(policy.Disposition, ShouldEqual, dmarc.Reject)
+		})
+
+		Convey("LMTP clients have no IP to check, so the policy should be skipped", func() {
+			conn.Server.LMTP = true
+			auth, policy := m.authenticate(conn)
+			So(auth.DMARC, ShouldEqual, dmarc.None)
+			So(policy.Disposition, ShouldEqual, dmarc.None)
+		})
+	})
+}
@@ -0,0 +1,114 @@
+package mailer
+
+import (
+	"encoding/json"
+	"mime"
+	"net/mail"
+	"strings"
+	"time"
+
+	r "github.com/pgpst/pgpst/internal/github.com/dancannon/gorethink"
+
+	"github.com/pgpst/pgpst/pkg/autocrypt"
+	"github.com/pgpst/pgpst/pkg/models"
+	"github.com/pgpst/pgpst/pkg/utils"
+	"github.com/pgpst/pgpst/pkg/wkd"
+)
+
+// addAutocrypt prepends the sender's Autocrypt header to a submitted email.
+// The header carries a minimal key, with only the sender's identity and an
+// encryption subkey. Emails from unparseable senders and keys that can't be
+// used anymore are left as they are.
+func addAutocrypt(data []byte, header mail.Header, account *models.Account, key *models.Key, now time.Time) []byte {
+	from, err := mail.ParseAddress(header.Get("From"))
+	if err != nil || !key.IsValid(now) {
+		return data
+	}
+
+	keyData, err := wkd.ExportEncryption(key.Body, func(address string) bool {
+		return strings.EqualFold(address, from.Address)
+	}, now)
+	if err != nil {
+		return data
+	}
+
+	preference := autocrypt.NoPreference
+	if account.AutocryptPreferEncrypt == autocrypt.Mutual {
+		preference = autocrypt.Mutual
+	}
+
+	value := (&autocrypt.Header{
+		Address:       from.Address,
+		PreferEncrypt: preference,
+		KeyData:       keyData,
+	}).String()
+
+	return append([]byte(autocrypt.HeaderName+": "+value+"\r\n"), data...)
+}
+
+// updatePeer applies the Autocrypt header of a received email to the state
+// of its sender. Reports are ignored, as they're usually sent automatically.
+func (m *Mailer) updatePeer(recipient *recipient, desc *description) error {
+	headers := desc.Node.Headers
+	if mediaType, _, err := mime.ParseMediaType(headers.Get("Content-Type")); err == nil && mediaType == "multipart/report" {
+		return nil
+	}
+
+	from, err := mail.ParseAddress(headers.Get("From"))
+	if err != nil {
+		return nil
+	}
+
+	now := time.Now()
+	date, err := headers.Date()
+	if err != nil {
+		date = now
+	}
+
+	id := autocrypt.PeerID([]byte(m.Options.PeerSecret), recipient.Account.ID, from.Address)
+	cursor, err := r.Table("peers").Get(id).Default(map[string]interface{}{}).Run(m.Rethink)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close()
+	var peer models.Peer
+	if err := cursor.One(&peer); err != nil {
+		return err
+	}
+	if peer.ID == "" {
+		peer = models.Peer{
+			ID:          id,
+			DateCreated: now,
+			Owner:       recipient.Account.ID,
+		}
+	}
+
+	lastSeen := peer.LastSeen
+	header := autocrypt.Find(headers, from.Address)
+	if autocrypt.Update(&peer, header, date, now) {
+		keyring, _, err := models.EncryptionKeyring(recipient.Account.ID, recipient.Key, recipient.Keys, now)
+		if err != nil {
+			return err
+		}
+
+		encoded, err := json.Marshal(&models.PeerKey{
+			Address: header.Address,
+			KeyData: header.KeyData,
+		})
+		if err != nil {
+			return err
+		}
+
+		peer.Key, err = utils.PGPEncrypt(encoded, keyring)
+		if err != nil {
+			return err
+		}
+	} else if !peer.LastSeen.After(lastSeen) {
+		return nil
+	}
+	peer.DateModified = now
+
+	return r.Table("peers").Insert(&peer, r.InsertOpts{
+		Conflict: "replace",
+	}).Exec(m.Rethink)
+}
@@ -0,0 +1,80 @@
+package mailer
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/mail"
+	"testing"
+	"time"
+
+	. "github.com/pgpst/pgpst/internal/github.com/smartystreets/goconvey/convey"
+	"github.com/pgpst/pgpst/internal/golang.org/x/crypto/openpgp"
+
+	"github.com/pgpst/pgpst/pkg/autocrypt"
+	"github.com/pgpst/pgpst/pkg/models"
+)
+
+func TestAddAutocrypt(t *testing.T) {
+	entity, err := openpgp.NewEntity("bob", "", "bob@pgp.st", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := entity.SerializePrivate(ioutil.Discard, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	Convey("Given a submitted email and the sender's key", t, func() {
+		var (
+			now     = time.Now()
+			account = &models.Account{ID: "bob"}
+			key     = storedKey("bob", entity)
+			data    = []byte("From: Bob <Bob@pgp.st>\r\nTo: alice@example.com\r\nSubject: Hi\r\n\r\nHello\r\n")
+		)
+		msg, err := mail.ReadMessage(bytes.NewReader(data))
+		So(err, ShouldBeNil)
+
+		Convey("The header should carry the sender's address and a minimal key", func() {
+			signed, err := mail.ReadMessage(bytes.NewReader(addAutocrypt(data, msg.Header, account, key, now)))
+			So(err, ShouldBeNil)
+
+			header := autocrypt.Find(signed.Header, "bob@pgp.st")
+			So(header, ShouldNotBeNil)
+			So(header.PreferEncrypt, ShouldEqual, autocrypt.NoPreference)
+
+			entities, err := openpgp.ReadKeyRing(bytes.NewReader(header.KeyData))
+			So(err, ShouldBeNil)
+			So(entities[0].PrimaryKey.KeyId, ShouldEqual, key.KeyID)
+			So(len(entities[0].Identities), ShouldEqual, 1)
+			So(len(entities[0].Subkeys), ShouldEqual, 1)
+			So(entities[0].Subkeys[0].PublicKey.KeyId, ShouldEqual, entity.Subkeys[0].PublicKey.KeyId)
+		})
+
+		Convey("Keys without the sender's identity shouldn't be advertised", func() {
+			other := []byte("From: Bob <bob@example.org>\r\nTo: alice@example.com\r\nSubject: Hi\r\n\r\nHello\r\n")
+			msg, err := mail.ReadMessage(bytes.NewReader(other))
+			So(err, ShouldBeNil)
+			So(addAutocrypt(other, msg.Header, account, key, now), ShouldResemble, other)
+		})
+
+		Convey("The account's preference should be included", func() {
+			account.AutocryptPreferEncrypt = autocrypt.Mutual
+			signed, err := mail.ReadMessage(bytes.NewReader(addAutocrypt(data, msg.Header, account, key, now)))
+			So(err, ShouldBeNil)
+			So(autocrypt.Find(signed.Header, "bob@pgp.st").PreferEncrypt, ShouldEqual, autocrypt.Mutual)
+		})
+
+		Convey("Expired keys shouldn't be advertised", func() {
+			lifetime := uint32(60)
+			sig := entity.Identities["bob <bob@pgp.st>"].SelfSignature
+			sig.KeyLifetimeSecs = &lifetime
+			So(entity.SerializePrivate(ioutil.Discard, nil), ShouldBeNil)
+			defer func() {
+				sig.KeyLifetimeSecs = nil
+				So(entity.SerializePrivate(ioutil.Discard, nil), ShouldBeNil)
+			}()
+
+			key := storedKey("bob", entity)
+			So(addAutocrypt(data, msg.Header, account, key, now.Add(time.Hour)), ShouldResemble, data)
+		})
+	})
+}
@@ -0,0 +1,80 @@
+package mailer
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	"github.com/pgpst/pgpst/internal/github.com/dchest/uniuri"
+
+	"github.com/pgpst/pgpst/pkg/models"
+)
+
+// sendBounce queues a delivery status notification telling the sender that
+// the spooled email won't be delivered to the recipient. Bounces are sent
+// with a null sender, so that they don't bounce back.
+func (m *Mailer) sendBounce(entry *SpoolEntry, recipient *SpoolRecipient, data []byte) error {
+	body, err := json.Marshal(&models.OutgoingEmail{
+		To:   []string{entry.Sender},
+		Body: composeBounce(m.Options.Hostname, entry, recipient, data),
+	})
+	if err != nil {
+		return err
+	}
+
+	return m.Producer.Publish("send_email", body)
+}
+
+// composeBounce renders a RFC 3464 report of the failed delivery. Only the
+// headers of the original email are returned.
+func composeBounce(hostname string, entry *SpoolEntry, recipient *SpoolRecipient, data []byte) []byte {
+	boundary := uniuri.NewLen(uniuri.UUIDLen)
+
+	header := data
+	if i := bytes.Index(data, []byte("\r\n\r\n")); i != -1 {
+		header = data[:i+2]
+	} else if i := bytes.Index(data, []byte("\n\n")); i != -1 {
+		header = data[:i+1]
+	}
+
+	buf := &bytes.Buffer{}
+	buf.WriteString("From: Mail Delivery System <MAILER-DAEMON@" + hostname + ">\r\n")
+	buf.WriteString("To: <" + entry.Sender + ">\r\n")
+	buf.WriteString("Subject: Undelivered Mail Returned to Sender\r\n")
+	buf.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	buf.WriteString("Message-ID: <" + uniuri.NewLen(uniuri.UUIDLen) + "@" + hostname + ">\r\n")
+	buf.WriteString("Auto-Submitted: auto-replied\r\n")
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: multipart/report; report-type=delivery-status; boundary=\"" + boundary + "\"\r\n")
+	buf.WriteString("\r\n")
+
+	// Human readable explanation
+	buf.WriteString("--" + boundary + "\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString("Your email could not be delivered to <" + recipient.Address + ">.\r\n")
+	buf.WriteString("The delivery failed permanently, it won't be retried.\r\n")
+	buf.WriteString("\r\n")
+
+	// Machine readable status
+	buf.WriteString("--" + boundary + "\r\n")
+	buf.WriteString("Content-Type: message/delivery-status\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString("Reporting-MTA: dns; " + hostname + "\r\n")
+	buf.WriteString("Arrival-Date: " + entry.DateCreated.Format(time.RFC1123Z) + "\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString("Final-Recipient: rfc822; " + recipient.Address + "\r\n")
+	buf.WriteString("Action: failed\r\n")
+	buf.WriteString("Status: 5.0.0\r\n")
+	buf.WriteString("\r\n")
+
+	// Headers of the original email
+	buf.WriteString("--" + boundary + "\r\n")
+	buf.WriteString("Content-Type: text/rfc822-headers\r\n")
+	buf.WriteString("\r\n")
+	buf.Write(header)
+	buf.WriteString("\r\n")
+	buf.WriteString("--" + boundary + "--\r\n")
+
+	return buf.Bytes()
+}
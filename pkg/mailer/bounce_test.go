@@ -0,0 +1,43 @@
+package mailer
+
+import (
+	"bytes"
+	"net/mail"
+	"testing"
+	"time"
+
+	. "github.com/pgpst/pgpst/internal/github.com/smartystreets/goconvey/convey"
+)
+
+func TestComposeBounce(t *testing.T) {
+	Convey("Given a dropped recipient of a spooled email", t, func() {
+		entry := &SpoolEntry{
+			ID:          "first",
+			DateCreated: time.Now(),
+			Sender:      "alice@example.org",
+		}
+		recipient := &SpoolRecipient{
+			Address: "gone@pgp.st",
+		}
+		data := []byte("From: alice@example.org\r\nSubject: Hi\r\n\r\nSecret body\r\n")
+
+		bounce := composeBounce("mx.pgp.st", entry, recipient, data)
+		msg, err := mail.ReadMessage(bytes.NewReader(bounce))
+		So(err, ShouldBeNil)
+
+		Convey("It should be a delivery status report sent to the sender", func() {
+			So(msg.Header.Get("To"), ShouldEqual, "<alice@example.org>")
+			So(msg.Header.Get("Auto-Submitted"), ShouldEqual, "auto-replied")
+			So(msg.Header.Get("Content-Type"), ShouldStartWith, "multipart/report; report-type=delivery-status;")
+		})
+
+		Convey("It should report the failed recipient", func() {
+			So(string(bounce), ShouldContainSubstring, "Final-Recipient: rfc822; gone@pgp.st\r\nAction: failed\r\n")
+		})
+
+		Convey("It should return only the headers of the original email", func() {
+			So(string(bounce), ShouldContainSubstring, "Subject: Hi\r\n")
+			So(string(bounce), ShouldNotContainSubstring, "Secret body")
+		})
+	})
+}
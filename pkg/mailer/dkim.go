@@ -0,0 +1,109 @@
+package mailer
+
+import (
+	"bytes"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/pgpst/pgpst/internal/github.com/Sirupsen/logrus"
+	r "github.com/pgpst/pgpst/internal/github.com/dancannon/gorethink"
+
+	"github.com/pgpst/pgpst/pkg/dkim"
+	"github.com/pgpst/pgpst/pkg/models"
+)
+
+// Cached signers expire, so that rotated keys get picked up.
+const dkimCacheTTL = time.Minute * 10
+
+type cachedSigner struct {
+	Signer  *dkim.Signer // nil if the domain has no active key
+	Expires time.Time
+}
+
+// dkimSigner returns the signer of the domain's active key, or nil if there
+// is none.
+func (m *Mailer) dkimSigner(domain string) (*dkim.Signer, error) {
+	if cached, ok := m.DKIMCache.Get(domain); ok {
+		if cs := cached.(*cachedSigner); cs.Expires.After(time.Now()) {
+			return cs.Signer, nil
+		}
+	}
+
+	cursor, err := r.Table("dkim_keys").GetAllByIndex("domainStatus", []interface{}{
+		domain,
+		"active",
+	}).OrderBy(r.Desc("date_created")).Run(m.Rethink)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+	var keys []*models.DKIMKey
+	if err := cursor.All(&keys); err != nil {
+		return nil, err
+	}
+
+	var signer *dkim.Signer
+	if len(keys) > 0 {
+		signer, err = dkim.NewSigner(keys[0].Domain, keys[0].Selector, keys[0].PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	m.DKIMCache.Add(domain, &cachedSigner{
+		Signer:  signer,
+		Expires: time.Now().Add(dkimCacheTTL),
+	})
+
+	return signer, nil
+}
+
+// signOutgoing returns the body of the outgoing email, signed if it was
+// composed by an account. Relayed emails keep the From header of their
+// author, so signing them would vouch for whatever they claim.
+func (m *Mailer) signOutgoing(email *models.OutgoingEmail) []byte {
+	if !email.Sign {
+		return email.Body
+	}
+	return m.signEmail(email.Body)
+}
+
+// signEmail adds a DKIM signature of the From header's domain. The body is
+// returned unchanged if the domain has no key.
+func (m *Mailer) signEmail(body []byte) []byte {
+	msg, err := mail.ReadMessage(bytes.NewReader(body))
+	if err != nil {
+		m.Log.WithField("err", err).Warn("Unable to parse an outgoing email")
+		return body
+	}
+	from, err := mail.ParseAddress(msg.Header.Get("From"))
+	if err != nil {
+		m.Log.WithField("err", err).Warn("Unable to parse the From header of an outgoing email")
+		return body
+	}
+	domain := strings.ToLower(from.Address[strings.LastIndex(from.Address, "@")+1:])
+
+	signer, err := m.dkimSigner(domain)
+	if err != nil {
+		m.Log.WithFields(logrus.Fields{
+			"domain": domain,
+			"err":    err,
+		}).Error("Unable to load the DKIM key")
+		return body
+	}
+	if signer == nil {
+		return body
+	}
+
+	signed, err := signer.Sign(body)
+	if err != nil {
+		m.Log.WithFields(logrus.Fields{
+			"domain": domain,
+			"err":    err,
+		}).Error("Unable to sign an email")
+		return body
+	}
+
+	return signed
+}
@@ -0,0 +1,46 @@
+package mailer
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/pgpst/pgpst/internal/github.com/Sirupsen/logrus"
+	. "github.com/pgpst/pgpst/internal/github.com/smartystreets/goconvey/convey"
+
+	"github.com/pgpst/pgpst/pkg/dkim"
+	"github.com/pgpst/pgpst/pkg/models"
+	"github.com/pgpst/pgpst/pkg/utils"
+)
+
+func TestSignOutgoing(t *testing.T) {
+	der, err := dkim.GenerateKey(dkim.Ed25519, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := dkim.NewSigner("pgp.st", "mail", der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Convey("Given a mailer with a DKIM key of the domain", t, func() {
+		m := &Mailer{
+			Log:       logrus.New(),
+			DKIMCache: utils.NewLRU(1),
+		}
+		m.DKIMCache.Add("pgp.st", &cachedSigner{
+			Signer:  signer,
+			Expires: time.Now().Add(time.Hour),
+		})
+		body := []byte("From: boss@pgp.st\r\nTo: alice@example.org\r\nSubject: Hi\r\n\r\nHello\r\n")
+
+		Convey("Emails composed by the accounts should be signed", func() {
+			signed := m.signOutgoing(&models.OutgoingEmail{Body: body, Sign: true})
+			So(bytes.HasPrefix(signed, []byte("DKIM-Signature: ")), ShouldBeTrue)
+		})
+
+		Convey("Relayed emails shouldn't be signed", func() {
+			So(m.signOutgoing(&models.OutgoingEmail{Body: body}), ShouldResemble, body)
+		})
+	})
+}
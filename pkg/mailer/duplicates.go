@@ -0,0 +1,145 @@
+package mailer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/mail"
+	"time"
+
+	"github.com/pgpst/pgpst/internal/github.com/Sirupsen/logrus"
+	r "github.com/pgpst/pgpst/internal/github.com/dancannon/gorethink"
+	"github.com/pgpst/pgpst/internal/github.com/pgpst/smtpd"
+
+	"github.com/pgpst/pgpst/pkg/models"
+	"github.com/pgpst/pgpst/pkg/threading"
+)
+
+// DuplicateStore remembers the emails delivered to the accounts.
+type DuplicateStore interface {
+	// GetDigest returns nil if the owner didn't receive the email yet
+	GetDigest(id string) (*models.Digest, error)
+	PutDigest(digest *models.Digest) error
+}
+
+type rethinkDuplicates struct {
+	session *r.Session
+}
+
+func (d *rethinkDuplicates) GetDigest(id string) (*models.Digest, error) {
+	cursor, err := r.Table("digests").Get(id).Default(map[string]interface{}{}).Run(d.session)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+	var digest models.Digest
+	if err := cursor.One(&digest); err != nil {
+		return nil, err
+	}
+	if digest.ID == "" {
+		return nil, nil
+	}
+
+	return &digest, nil
+}
+
+func (d *rethinkDuplicates) PutDigest(digest *models.Digest) error {
+	return r.Table("digests").Insert(digest, r.InsertOpts{
+		Conflict: "replace",
+	}).Exec(d.session)
+}
+
+// digestEmail hashes the Message-ID and the body of the email. Emails
+// without a Message-ID can't be told apart from legitimate resends, so they
+// have no digest.
+func digestEmail(data []byte) string {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return ""
+	}
+	ids := threading.ParseIDs(msg.Header.Get("Message-ID"))
+	if len(ids) == 0 {
+		return ""
+	}
+	body, err := ioutil.ReadAll(msg.Body)
+	if err != nil {
+		return ""
+	}
+
+	bodyHash := sha256.Sum256(bytes.TrimSpace(body))
+	hash := sha256.Sum256([]byte(ids[0] + "\x00" + hex.EncodeToString(bodyHash[:])))
+	return hex.EncodeToString(hash[:])
+}
+
+func digestID(owner string, digest string) string {
+	hash := sha256.Sum256([]byte(owner + "\x00" + digest))
+	return hex.EncodeToString(hash[:])
+}
+
+// HandleDuplicates drops the recipients that already received the email
+// within the duplicate window, usually because the sender retried it after
+// a timeout. The sender still gets a successful reply.
+func (m *Mailer) HandleDuplicates(next func(conn *smtpd.Connection)) func(conn *smtpd.Connection) {
+	return func(conn *smtpd.Connection) {
+		// Only the digest of the current email may be remembered
+		delete(conn.Envelope.Environment, "digest")
+
+		dropRejected(conn, len(conn.Envelope.Recipients))
+		recipients, _ := conn.Envelope.Environment["recipients"].([]recipient)
+		if m.Options.DuplicateWindow <= 0 || len(recipients) == 0 {
+			next(conn)
+			return
+		}
+
+		// The digest is taken before any headers are added to the email
+		digest := digestEmail(conn.Envelope.Data)
+		if digest == "" {
+			next(conn)
+			return
+		}
+		conn.Envelope.Environment["digest"] = digest
+
+		since := time.Now().Add(-time.Duration(m.Options.DuplicateWindow) * time.Hour)
+		remaining := []recipient{}
+		for _, recipient := range recipients {
+			existing, err := m.Duplicates.GetDigest(digestID(recipient.Account.ID, digest))
+			if err != nil {
+				// Storing a copy twice is better than losing it
+				m.Log.WithField("err", err).Error("Unable to fetch an email digest")
+			} else if existing != nil && existing.DateCreated.After(since) {
+				m.Log.WithFields(logrus.Fields{
+					"owner":  recipient.Account.ID,
+					"digest": digest,
+				}).Info("Suppressed a duplicate delivery")
+				continue
+			}
+
+			remaining = append(remaining, recipient)
+		}
+		conn.Envelope.Environment["recipients"] = remaining
+
+		next(conn)
+	}
+}
+
+// rememberDigest records the delivery of the accepted email to the
+// recipients, so that its retries are suppressed.
+func (m *Mailer) rememberDigest(conn *smtpd.Connection, recipients []recipient) {
+	digest, ok := conn.Envelope.Environment["digest"].(string)
+	if !ok || m.Duplicates == nil {
+		return
+	}
+
+	now := time.Now()
+	for _, recipient := range recipients {
+		if err := m.Duplicates.PutDigest(&models.Digest{
+			ID:          digestID(recipient.Account.ID, digest),
+			DateCreated: now,
+			Owner:       recipient.Account.ID,
+			Digest:      digest,
+		}); err != nil {
+			m.Log.WithField("err", err).Error("Unable to store an email digest")
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package mailer
+
+import (
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pgpst/pgpst/internal/github.com/Sirupsen/logrus"
+	"github.com/pgpst/pgpst/internal/github.com/pgpst/smtpd"
+	. "github.com/pgpst/pgpst/internal/github.com/smartystreets/goconvey/convey"
+
+	"github.com/pgpst/pgpst/pkg/models"
+)
+
+type memoryDuplicates struct {
+	sync.Mutex
+	Digests map[string]*models.Digest
+}
+
+func (d *memoryDuplicates) GetDigest(id string) (*models.Digest, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	if digest, ok := d.Digests[id]; ok {
+		x := *digest
+		return &x, nil
+	}
+	return nil, nil
+}
+
+func (d *memoryDuplicates) PutDigest(digest *models.Digest) error {
+	d.Lock()
+	defer d.Unlock()
+
+	x := *digest
+	d.Digests[digest.ID] = &x
+	return nil
+}
+
+const duplicateEmail = "From: alice@example.com\r\n" +
+	"To: bob@pgp.st\r\n" +
+	"Subject: Retried\r\n" +
+	"Message-ID: <retried@example.com>\r\n" +
+	"\r\n" +
+	"Hello Bob\r\n"
+
+func TestDuplicates(t *testing.T) {
+	Convey("Given a mailer that suppresses duplicates", t, func() {
+		log := logrus.New()
+		log.Level = logrus.PanicLevel
+
+		duplicates := &memoryDuplicates{
+			Digests: map[string]*models.Digest{},
+		}
+		m := &Mailer{
+			Options: &Options{
+				Hostname:        "pgp.st",
+				DuplicateWindow: 24,
+			},
+			Log:        log,
+			Duplicates: duplicates,
+		}
+
+		// Stands in for the spool, counting the stored copies per owner
+		var (
+			lock   sync.Mutex
+			stored = map[string]int{}
+		)
+		count := func(owner string) int {
+			lock.Lock()
+			defer lock.Unlock()
+			return stored[owner]
+		}
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer listener.Close()
+		go (&smtpd.Server{
+			RecipientChain: []smtpd.Recipient{
+				smtpd.RecipientFunc(func(next func(conn *smtpd.Connection)) func(conn *smtpd.Connection) {
+					return func(conn *smtpd.Connection) {
+						if conn.Environment == nil {
+							conn.Environment = map[string]interface{}{}
+						}
+						if conn.Envelope.Environment == nil {
+							conn.Envelope.Environment = map[string]interface{}{}
+						}
+						recipients, _ := conn.Envelope.Environment["recipients"].([]recipient)
+
+						address := conn.Envelope.Recipients[len(conn.Envelope.Recipients)-1]
+						conn.Envelope.Environment["recipients"] = append(recipients, recipient{
+							Address: &models.Address{ID: address},
+							Account: &models.Account{ID: address[:strings.Index(address, "@")]},
+							Index:   len(conn.Envelope.Recipients) - 1,
+						})
+						next(conn)
+					}
+				}),
+			},
+			DeliveryChain: []smtpd.Delivery{
+				smtpd.DeliveryFunc(func(next func(conn *smtpd.Connection)) func(conn *smtpd.Connection) {
+					return func(conn *smtpd.Connection) {
+						recipients := conn.Envelope.Environment["recipients"].([]recipient)
+
+						lock.Lock()
+						for _, recipient := range recipients {
+							stored[recipient.Account.ID]++
+						}
+						lock.Unlock()
+
+						m.rememberDigest(conn, recipients)
+						next(conn)
+					}
+				}),
+				smtpd.DeliveryFunc(m.HandleDuplicates),
+			},
+		}).Serve(listener)
+
+		send := func(email string, to ...string) error {
+			return smtp.SendMail(listener.Addr().String(), nil, "alice@example.com", to, []byte(email))
+		}
+
+		Convey("A retried email should be accepted without being stored again", func() {
+			So(send(duplicateEmail, "bob@pgp.st"), ShouldBeNil)
+			So(send(duplicateEmail, "bob@pgp.st"), ShouldBeNil)
+			So(count("bob"), ShouldEqual, 1)
+			So(len(duplicates.Digests), ShouldEqual, 1)
+		})
+
+		Convey("Retries after a timeout in DATA should be suppressed", func() {
+			// The client gives up before reading the reply to the data
+			c, err := textproto.Dial("tcp", listener.Addr().String())
+			So(err, ShouldBeNil)
+			for _, line := range []string{"EHLO mail.example.com", "MAIL FROM:<alice@example.com>", "RCPT TO:<bob@pgp.st>", "DATA"} {
+				id, err := c.Cmd("%s", line)
+				So(err, ShouldBeNil)
+				c.StartResponse(id)
+				_, _, err = c.ReadResponse(-1)
+				c.EndResponse(id)
+				So(err, ShouldBeNil)
+			}
+			w := c.DotWriter()
+			_, err = w.Write([]byte(duplicateEmail))
+			So(err, ShouldBeNil)
+			So(w.Close(), ShouldBeNil)
+			c.Close()
+
+			for i := 0; i < 100 && count("bob") == 0; i++ {
+				time.Sleep(10 * time.Millisecond)
+			}
+			So(count("bob"), ShouldEqual, 1)
+
+			So(send(duplicateEmail, "bob@pgp.st"), ShouldBeNil)
+			So(count("bob"), ShouldEqual, 1)
+		})
+
+		Convey("Only the owners that didn't receive the email should get it", func() {
+			So(send(duplicateEmail, "bob@pgp.st"), ShouldBeNil)
+			So(send(duplicateEmail, "bob@pgp.st", "carol@pgp.st"), ShouldBeNil)
+			So(count("bob"), ShouldEqual, 1)
+			So(count("carol"), ShouldEqual, 1)
+		})
+
+		Convey("Emails with a different body should be stored", func() {
+			So(send(duplicateEmail, "bob@pgp.st"), ShouldBeNil)
+			So(send(duplicateEmail+"P.S. Edited\r\n", "bob@pgp.st"), ShouldBeNil)
+			So(count("bob"), ShouldEqual, 2)
+		})
+
+		Convey("Emails without a Message-ID should always be stored", func() {
+			email := strings.Replace(duplicateEmail, "Message-ID: <retried@example.com>\r\n", "", 1)
+			So(send(email, "bob@pgp.st"), ShouldBeNil)
+			So(send(email, "bob@pgp.st"), ShouldBeNil)
+			So(count("bob"), ShouldEqual, 2)
+			So(duplicates.Digests, ShouldBeEmpty)
+		})
+
+		Convey("Digests shouldn't carry over to the next email of the connection", func() {
+			c, err := smtp.Dial(listener.Addr().String())
+			So(err, ShouldBeNil)
+			deliver := func(email string, to string) {
+				So(c.Mail("alice@example.com"), ShouldBeNil)
+				So(c.Rcpt(to), ShouldBeNil)
+				w, err := c.Data()
+				So(err, ShouldBeNil)
+				_, err = w.Write([]byte(email))
+				So(err, ShouldBeNil)
+				So(w.Close(), ShouldBeNil)
+			}
+			deliver(duplicateEmail, "bob@pgp.st")
+			deliver(strings.Replace(duplicateEmail, "Message-ID: <retried@example.com>\r\n", "", 1), "carol@pgp.st")
+			So(c.Quit(), ShouldBeNil)
+			So(len(duplicates.Digests), ShouldEqual, 1)
+
+			So(send(duplicateEmail, "carol@pgp.st"), ShouldBeNil)
+			So(count("carol"), ShouldEqual, 2)
+		})
+
+		Convey("Copies delivered before the window should be stored again", func() {
+			So(send(duplicateEmail, "bob@pgp.st"), ShouldBeNil)
+			for _, digest := range duplicates.Digests {
+				digest.DateCreated = digest.DateCreated.Add(-25 * time.Hour)
+			}
+			So(send(duplicateEmail, "bob@pgp.st"), ShouldBeNil)
+			So(count("bob"), ShouldEqual, 2)
+		})
+
+		Convey("A zero window should disable the suppression", func() {
+			m.Options.DuplicateWindow = 0
+			So(send(duplicateEmail, "bob@pgp.st"), ShouldBeNil)
+			So(send(duplicateEmail, "bob@pgp.st"), ShouldBeNil)
+			So(count("bob"), ShouldEqual, 2)
+		})
+	})
+}
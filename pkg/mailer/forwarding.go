@@ -0,0 +1,130 @@
+package mailer
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	"github.com/pgpst/pgpst/internal/github.com/Sirupsen/logrus"
+	r "github.com/pgpst/pgpst/internal/github.com/dancannon/gorethink"
+	"github.com/pgpst/pgpst/internal/github.com/pgpst/smtpd"
+	"github.com/pgpst/pgpst/internal/golang.org/x/crypto/openpgp"
+
+	"github.com/pgpst/pgpst/pkg/forwarding"
+	"github.com/pgpst/pgpst/pkg/models"
+	"github.com/pgpst/pgpst/pkg/srs"
+)
+
+// shouldForward checks whether the email should be forwarded to the external
+// mailbox configured for the address. Spam and looping emails stay here.
+func (m *Mailer) shouldForward(entry *SpoolEntry, recipient *recipient, desc *description) bool {
+	rule := recipient.Address.Forwarding
+	if rule == nil || rule.Address == "" || recipient.Address.IsGroup() || entry.Spam {
+		return false
+	}
+
+	if err := forwarding.Check(desc.Node.Headers, recipient.Address.ID); err != nil {
+		m.Log.WithFields(logrus.Fields{
+			"ctx_id":  entry.ID,
+			"address": recipient.Address.ID,
+			"reason":  err.Error(),
+		}).Warn("Not forwarding an email")
+		return false
+	}
+
+	return true
+}
+
+// forwardEmail queues a copy of the email for the forwarding target of the
+// address, encrypted if its key is known.
+func (m *Mailer) forwardEmail(entry *SpoolEntry, recipient *recipient, data []byte) error {
+	rule := recipient.Address.Forwarding
+
+	keyring, err := m.forwardingKeyring(rule)
+	if err != nil {
+		return err
+	}
+
+	body, err := forwarding.Compose(data, recipient.Address.ID, keyring)
+	if err != nil {
+		return err
+	}
+
+	// Rewrite the sender, so that the SPF checks of the target pass
+	sender, err := m.SRS.Forward(entry.Sender)
+	if err != nil {
+		m.Log.WithFields(logrus.Fields{
+			"ctx_id": entry.ID,
+			"sender": entry.Sender,
+		}).Warn("Forwarding an email with an invalid sender as a bounce")
+		sender = ""
+	}
+
+	message, err := json.Marshal(&models.OutgoingEmail{
+		From: sender,
+		To:   []string{rule.Address},
+		Body: body,
+	})
+	if err != nil {
+		return err
+	}
+
+	return m.Producer.Publish("send_email", message)
+}
+
+// forwardingKeyring returns the key of the forwarding target, preferring the
+// one attached to the rule. The keyring is empty if there's no known key.
+func (m *Mailer) forwardingKeyring(rule *models.Forwarding) (openpgp.EntityList, error) {
+	if rule.PublicKey != "" {
+		return openpgp.ReadArmoredKeyRing(strings.NewReader(rule.PublicKey))
+	}
+
+	if rule.Key == "" {
+		return nil, nil
+	}
+
+	cursor, err := r.Table("keys").Get(rule.Key).Default(map[string]interface{}{}).Run(m.Rethink)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+	var key models.Key
+	if err := cursor.One(&key); err != nil {
+		return nil, err
+	}
+	if key.ID == "" {
+		return nil, nil
+	}
+
+	return openpgp.ReadKeyRing(bytes.NewReader(key.Body))
+}
+
+// reverseSRS decodes the address if it's a rewritten sender of an email
+// forwarded by us. The second result is false for the other addresses.
+func (m *Mailer) reverseSRS(address string) (string, bool, error) {
+	at := strings.LastIndex(address, "@")
+	if !srs.IsSRS(address) || at == -1 || !strings.EqualFold(address[at+1:], m.SRS.Domain) {
+		return "", false, nil
+	}
+
+	original, err := m.SRS.Reverse(address)
+	if err != nil {
+		return "", true, smtpd.Error{Code: 550, Message: "5.1.1 Invalid forwarding address"}
+	}
+
+	return original, true, nil
+}
+
+// relayBounces passes the bounces sent to the rewritten senders back to the
+// original senders. They keep the null sender, so they can't bounce again.
+func (m *Mailer) relayBounces(to []string, data []byte) error {
+	body, err := json.Marshal(&models.OutgoingEmail{
+		To:   to,
+		Body: data,
+	})
+	if err != nil {
+		return err
+	}
+
+	return m.Producer.Publish("send_email", body)
+}
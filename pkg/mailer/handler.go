@@ -2,10 +2,8 @@ package mailer
 
 import (
 	"bytes"
-	"crypto/rand"
 	"encoding/json"
 	"errors"
-	"io"
 	"net/mail"
 	"path/filepath"
 	"runtime"
@@ -13,18 +11,23 @@ import (
 	"time"
 
 	"github.com/pgpst/pgpst/internal/github.com/Sirupsen/logrus"
-	"github.com/pgpst/pgpst/internal/github.com/codahale/chacha20"
 	r "github.com/pgpst/pgpst/internal/github.com/dancannon/gorethink"
 	"github.com/pgpst/pgpst/internal/github.com/dchest/uniuri"
 	"github.com/pgpst/pgpst/internal/github.com/lavab/go-spamc"
 	"github.com/pgpst/pgpst/internal/github.com/pgpst/smtpd"
 	"github.com/pgpst/pgpst/internal/golang.org/x/crypto/openpgp"
-	"github.com/pgpst/pgpst/internal/golang.org/x/crypto/poly1305"
 
+	"github.com/pgpst/pgpst/pkg/analysis"
+	"github.com/pgpst/pgpst/pkg/crypto"
+	"github.com/pgpst/pgpst/pkg/dmarc"
 	"github.com/pgpst/pgpst/pkg/models"
+	"github.com/pgpst/pgpst/pkg/quota"
+	"github.com/pgpst/pgpst/pkg/threading"
 	"github.com/pgpst/pgpst/pkg/utils"
 )
 
+var errMailboxFull = smtpd.Error{Code: 452, Message: "4.2.2 Mailbox full"}
+
 func (m *Mailer) Wrap(x func()) func() {
 	return func() {
 		if m.Raven != nil {
@@ -39,22 +42,51 @@ type recipient struct {
 	Address *models.Address `gorethink:"address"`
 	Account *models.Account `gorethink:"account"`
 	Key     *models.Key     `gorethink:"key"`
+	Keys    []*models.Key   `gorethink:"keys"` // keys chosen by the owner of a personal address
 	Labels  struct {
 		Inbox string `gorethink:"inbox"`
 		Spam  string `gorethink:"spam"`
 	} `gorethink:"labels"`
+	Tag   string       `gorethink:"-"`
+	Plan  *models.Plan `gorethink:"-"`
+	Index int          `gorethink:"-"` // position in the envelope's recipients
+}
+
+// dropRejected forgets the recipients and bounces of the transaction that
+// were added for the envelope's addresses starting at index n. Handlers
+// running after HandleRecipient, like the greylisting, can still reject an
+// address, which smtpd then removes from the envelope.
+func dropRejected(conn *smtpd.Connection, n int) {
+	if recipients, ok := conn.Envelope.Environment["recipients"].([]recipient); ok {
+		kept := []recipient{}
+		for _, recipient := range recipients {
+			if recipient.Index < n {
+				kept = append(kept, recipient)
+			}
+		}
+		conn.Envelope.Environment["recipients"] = kept
+	}
+
+	if bounces, ok := conn.Envelope.Environment["bounces"].(map[int]string); ok {
+		for index := range bounces {
+			if index >= n {
+				delete(bounces, index)
+			}
+		}
+	}
 }
 
 func (m *Mailer) HandleRecipient(next func(conn *smtpd.Connection)) func(conn *smtpd.Connection) {
 	return func(conn *smtpd.Connection) {
-		// Prepare the context
+		// Prepare the context, it only lasts for the current transaction
 		if conn.Environment == nil {
 			conn.Environment = map[string]interface{}{}
 		}
-		if _, ok := conn.Environment["recipients"]; !ok {
-			conn.Environment["recipients"] = []recipient{}
+		if conn.Envelope.Environment == nil {
+			conn.Envelope.Environment = map[string]interface{}{}
 		}
-		recipients := conn.Environment["recipients"].([]recipient)
+		dropRejected(conn, len(conn.Envelope.Recipients)-1)
+		recipients, _ := conn.Envelope.Environment["recipients"].([]recipient)
 
 		// Get the most recently added recipient and parse it
 		addr, err := mail.ParseAddress(
@@ -65,99 +97,251 @@ func (m *Mailer) HandleRecipient(next func(conn *smtpd.Connection)) func(conn *s
 			return
 		}
 
-		// Normalize the address
-		addr.Address = utils.RemoveDots(utils.NormalizeAddress(addr.Address))
-
-		// Fetch the address and account from database
-		cursor, err := r.Table("addresses").Get(addr.Address).Default(map[string]interface{}{}).Do(func(address r.Term) map[string]interface{} {
-			return map[string]interface{}{
-				"address": address,
-				"account": r.Branch(
-					address.HasFields("id"),
-					r.Table("accounts").Get(address.Field("owner")),
-					nil,
-				),
-				"key": r.Branch(
-					address.HasFields("public_key").And(address.Field("public_key").Ne("")),
-					r.Table("keys").Get(address.Field("public_key")).Without("identities"),
-					r.Branch(
-						address.HasFields("id"),
-						r.Table("keys").GetAllByIndex("owner", address.Field("owner")).OrderBy("date_created").CoerceTo("array").Do(func(keys r.Term) r.Term {
-							return r.Branch(
-								keys.Count().Gt(0),
-								keys.Nth(-1).Without("identities"),
-								nil,
-							)
-						}),
-						nil,
-					),
-				),
+		// Bounces of the forwarded emails go back to the original senders.
+		// Anything else sent to them would turn the mailer into a relay.
+		if original, ok, err := m.reverseSRS(addr.Address); ok {
+			if err != nil {
+				conn.Error(err)
+				return
 			}
-		}).Do(func(data r.Term) r.Term {
-			return data.Merge(map[string]interface{}{
-				"labels": r.Branch(
-					data.Field("account").HasFields("id"),
-					r.Table("labels").GetAllByIndex("nameOwnerSystem", []interface{}{
-						"Inbox",
-						data.Field("account").Field("id"),
-						true,
-					}, []interface{}{
-						"Spam",
-						data.Field("account").Field("id"),
-						true,
-					}).CoerceTo("array").Do(func(result r.Term) r.Term {
-						return r.Branch(
-							result.Count().Eq(2),
-							map[string]interface{}{
-								"inbox": result.Nth(0).Field("id"),
-								"spam":  result.Nth(1).Field("id"),
-							},
-							nil,
-						)
-					}),
-					nil,
-				),
-			})
-		}).Run(m.Rethink)
+			if conn.Envelope.Sender != "" {
+				conn.Error(smtpd.Error{Code: 550, Message: "5.7.1 Only bounces are accepted for forwarding addresses"})
+				return
+			}
+
+			bounces, ok := conn.Envelope.Environment["bounces"].(map[int]string)
+			if !ok {
+				bounces = map[int]string{}
+				conn.Envelope.Environment["bounces"] = bounces
+			}
+			bounces[len(conn.Envelope.Recipients)-1] = original
+
+			next(conn)
+			return
+		}
+
+		// Normalize the address, separating the sub-address
+		address, tag := utils.SplitAddress(addr.Address)
+
+		// Only accept emails for the verified domains
+		name := address[strings.LastIndex(address, "@")+1:]
+		domain, err := m.lookupDomain(name)
 		if err != nil {
 			m.Error(conn, err)
 			return
 		}
-		defer cursor.Close()
-		var result recipient
-		if err := cursor.One(&result); err != nil {
+		if !domain.IsVerified() {
+			conn.Error(smtpd.Error{Code: 550, Message: "5.1.2 Domain " + name + " is not handled by this server"})
+			return
+		}
+
+		// Fetch the address and accounts from database
+		results, err := m.lookupRecipients(address)
+		if err != nil {
 			m.Error(conn, err)
 			return
 		}
 
-		// Check if anything got matched
-		if result.Address == nil || result.Address.ID == "" || result.Account == nil || result.Account.ID == "" {
+		// Unknown addresses go to the catch-all address of the domain
+		if len(results) == 0 && domain.CatchAll != "" {
+			results, err = m.lookupRecipients(domain.CatchAll)
+			if err != nil {
+				m.Error(conn, err)
+				return
+			}
+		}
+		if len(results) == 0 {
 			conn.Error(errors.New("No such address"))
 			return
 		}
-		if result.Key == nil || result.Labels.Inbox == "" || result.Labels.Spam == "" {
-			conn.Error(errors.New("Account is not configured"))
+
+		// Group addresses are delivered to every configured member
+		var accepted []recipient
+		for _, result := range results {
+			err := checkRecipient(result)
+			if err == nil {
+				err = m.checkQuota(result)
+			}
+			if err != nil {
+				if len(results) == 1 {
+					conn.Error(err)
+					return
+				}
+
+				m.Log.WithFields(logrus.Fields{
+					"address": address,
+					"err":     err,
+				}).Warn("Skipping a member of a group address")
+				continue
+			}
+
+			result.Tag = tag
+			result.Index = len(conn.Envelope.Recipients) - 1
+			accepted = append(accepted, *result)
+		}
+		if len(accepted) == 0 {
+			conn.Error(errors.New("Group has no configured members"))
 			return
 		}
 
-		// Append the result to the recipients
-		conn.Environment["recipients"] = append(recipients, result)
+		// Append the results to the recipients
+		conn.Envelope.Environment["recipients"] = append(recipients, accepted...)
 
 		// Run the next handler
 		next(conn)
 	}
 }
 
-type envelope struct {
-	ID string
+// lookupDomain fetches the domain, returning an empty one if it doesn't
+// exist.
+func (m *Mailer) lookupDomain(id string) (*models.Domain, error) {
+	cursor, err := r.Table("domains").Get(id).Default(map[string]interface{}{}).Run(m.Rethink)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+	var domain models.Domain
+	if err := cursor.One(&domain); err != nil {
+		return nil, err
+	}
+
+	return &domain, nil
+}
+
+// lookupRecipients fetches the address with its accounts, the keys to
+// encrypt to and the system labels. Personal addresses resolve to their
+// owner, group addresses to each of their members. Unknown addresses return
+// no recipients.
+func (m *Mailer) lookupRecipients(id string) ([]*recipient, error) {
+	cursor, err := r.Table("addresses").Get(id).Default(map[string]interface{}{}).Do(func(address r.Term) r.Term {
+		return r.Branch(
+			address.HasFields("id"),
+			r.Branch(
+				address.Field("type").Default("personal").Eq("group"),
+				address.Field("members").Default([]interface{}{}).Map(func(member r.Term) r.Term {
+					return recipientQuery(address, member, false)
+				}),
+				[]interface{}{recipientQuery(address, address.Field("owner"), true)},
+			),
+			[]interface{}{},
+		)
+	}).Run(m.Rethink)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+	var results []*recipient
+	if err := cursor.All(&results); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// recipientQuery resolves the account, keys and labels of the address's
+// recipient. Members of groups always get the newest key of their account.
+func recipientQuery(address r.Term, account r.Term, personal bool) r.Term {
+	newestKey := r.Table("keys").GetAllByIndex("owner", account).OrderBy("date_created").CoerceTo("array").Do(func(keys r.Term) r.Term {
+		return r.Branch(
+			keys.Count().Gt(0),
+			keys.Nth(-1).Without("identities"),
+			nil,
+		)
+	})
+
+	key := newestKey
+	keys := r.Expr([]interface{}{})
+	if personal {
+		key = r.Branch(
+			address.HasFields("public_key").And(address.Field("public_key").Ne("")),
+			r.Table("keys").Get(address.Field("public_key")).Without("identities"),
+			newestKey,
+		)
+
+		// Identities are needed to skip the revoked and expired keys
+		keys = address.Field("encryption_keys").Default([]interface{}{}).Map(func(id r.Term) r.Term {
+			return r.Table("keys").Get(id)
+		}).Filter(func(key r.Term) r.Term {
+			return key.Ne(nil)
+		})
+	}
+
+	return r.Expr(map[string]interface{}{
+		"address": address,
+		"account": r.Table("accounts").Get(account),
+		"key":     key,
+		"keys":    keys,
+	}).Do(func(data r.Term) r.Term {
+		return data.Merge(map[string]interface{}{
+			"labels": r.Branch(
+				data.Field("account").Ne(nil),
+				r.Table("labels").GetAllByIndex("nameOwnerSystem", []interface{}{
+					"Inbox",
+					data.Field("account").Field("id"),
+					true,
+				}, []interface{}{
+					"Spam",
+					data.Field("account").Field("id"),
+					true,
+				}).CoerceTo("array").Do(func(result r.Term) r.Term {
+					return r.Branch(
+						result.Count().Eq(2),
+						map[string]interface{}{
+							"inbox": result.Nth(0).Field("id"),
+							"spam":  result.Nth(1).Field("id"),
+						},
+						nil,
+					)
+				}),
+				nil,
+			),
+		})
+	})
+}
+
+// lookupRecipient fetches the recipient of the address that belongs to the
+// account, or the first one if the account is empty.
+func (m *Mailer) lookupRecipient(id string, account string) (*recipient, error) {
+	results, err := m.lookupRecipients(id)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, result := range results {
+		if account == "" || (result.Account != nil && result.Account.ID == account) {
+			return result, nil
+		}
+	}
+
+	return &recipient{}, nil
+}
+
+// checkQuota loads the plan of the recipient's account and returns an error
+// if its mailbox is full.
+func (m *Mailer) checkQuota(result *recipient) error {
+	plan, usage, err := quota.Lookup(m.Rethink, result.Account)
+	if err != nil {
+		return err
+	}
+	if !plan.CanStore(usage, 1) {
+		return errMailboxFull
+	}
+
+	result.Plan = plan
+	return nil
+}
 
-	From string
-	To   []string
-	CC   []string
+// checkRecipient returns an error if the address can't receive emails.
+func checkRecipient(result *recipient) error {
+	// Check if anything got matched
+	if result.Address == nil || result.Address.ID == "" || result.Account == nil || result.Account.ID == "" {
+		return errors.New("No such address")
+	}
+	if result.Key == nil || result.Labels.Inbox == "" || result.Labels.Spam == "" {
+		return errors.New("Account is not configured")
+	}
 
-	Subject    string
-	MemoryHole []byte
-	Body       []byte
+	return nil
 }
 
 func (m *Mailer) HandleDelivery(next func(conn *smtpd.Connection)) func(conn *smtpd.Connection) {
@@ -168,6 +352,28 @@ func (m *Mailer) HandleDelivery(next func(conn *smtpd.Connection)) func(conn *sm
 			ctxID  = uniuri.NewLen(uniuri.UUIDLen)
 		)
 
+		// Verify the sender and record the results in the message, replacing
+		// the results that pretend to be ours
+		auth, policy := m.authenticate(conn)
+		conn.Envelope.Data = append(
+			authenticationResults(m.Options.Hostname, auth),
+			removeAuthenticationResults(m.Options.Hostname, conn.Envelope.Data)...,
+		)
+		if policy.Disposition == dmarc.Reject {
+			m.Log.WithFields(logrus.Fields{
+				"ctx_id": ctxID,
+				"domain": policy.Domain,
+			}).Info("Email rejected by the DMARC policy")
+			conn.Error(smtpd.Error{
+				Code:    550,
+				Message: "5.7.1 Email rejected per DMARC policy of " + policy.Domain,
+			})
+			return
+		}
+		if policy.Disposition == dmarc.Quarantine {
+			isSpam = true
+		}
+
 		// Check for spam
 		spamReply, err := m.Spam.Report(string(conn.Envelope.Data))
 		if err != nil {
@@ -185,310 +391,409 @@ func (m *Mailer) HandleDelivery(next func(conn *smtpd.Connection)) func(conn *sm
 		// Trim the spaces from the input
 		conn.Envelope.Data = bytes.TrimSpace(conn.Envelope.Data)
 
-		// First run the analysis algorithm to generate an email description
-		node := &models.EmailNode{}
-		if err := analyzeEmail(node, conn.Envelope.Data); err != nil {
+		// Make sure that the email can be stored before accepting it
+		if _, err := describeEmail(conn.Envelope.Data); err != nil {
 			m.Error(conn, err)
 			return
 		}
 
-		// Calculate message ID
-		messageID := node.Headers.Get("Message-ID")
-		x1i := strings.Index(messageID, "<")
-		if x1i != -1 {
-			x2i := strings.Index(messageID[x1i+1:], ">")
-			if x2i != -1 {
-				messageID = messageID[x1i+1 : x1i+x2i+1]
+		// Relay the bounces of the forwarded emails
+		dropRejected(conn, len(conn.Envelope.Recipients))
+		bounces := []string{}
+		if originals, ok := conn.Envelope.Environment["bounces"].(map[int]string); ok {
+			for index := range conn.Envelope.Recipients {
+				if original, ok := originals[index]; ok {
+					bounces = append(bounces, original)
+				}
 			}
 		}
-		if messageID == "" {
-			messageID = uniuri.NewLen(uniuri.UUIDLen) + "@invalid-incoming.pgp.st"
+		if len(bounces) > 0 {
+			if err := m.relayBounces(bounces, conn.Envelope.Data); err != nil {
+				m.Error(conn, err)
+				return
+			}
+
+			m.Log.WithFields(logrus.Fields{
+				"ctx_id":     ctxID,
+				"recipients": len(bounces),
+			}).Info("Relayed a bounce of a forwarded email")
 		}
 
-		// Generate the members field
-		fromHeader, err := mail.ParseAddress(node.Headers.Get("From"))
-		if err != nil {
-			m.Error(conn, err)
+		recipients, _ := conn.Envelope.Environment["recipients"].([]recipient)
+		if len(recipients) == 0 {
+			next(conn)
 			return
 		}
-		members := []string{fromHeader.Address}
 
-		toHeader, err := node.Headers.AddressList("From")
-		if err != nil {
-			m.Error(conn, err)
+		// The email has to fit into the limits of every recipient. LMTP
+		// rejects only the recipients that it doesn't fit.
+		recipients = m.checkSize(conn, recipients)
+		if recipients == nil {
 			return
 		}
-		for _, to := range toHeader {
-			members = append(members, to.Address)
+		if len(recipients) == 0 {
+			next(conn)
+			return
 		}
 
-		if x := node.Headers.Get("CC"); x != "" {
-			ccHeader, err := node.Headers.AddressList("CC")
-			if err != nil {
-				m.Error(conn, err)
-				return
-			}
-			for _, cc := range ccHeader {
-				members = append(members, cc.Address)
-			}
+		// Write it to the spool, it gets stored in the background
+		entry := &SpoolEntry{
+			ID:             ctxID,
+			DateCreated:    time.Now(),
+			Sender:         conn.Envelope.Sender,
+			Spam:           isSpam,
+			Authentication: auth,
 		}
-
-		// Get the recipients list from the scope
-		recipients := conn.Environment["recipients"].([]recipient)
 		for _, recipient := range recipients {
-			// Parse the found key
-			keyring, err := openpgp.ReadKeyRing(bytes.NewReader(recipient.Key.Body))
-			if err != nil {
-				m.Error(conn, err)
-				return
-			}
+			entry.Recipients = append(entry.Recipients, &SpoolRecipient{
+				Address:  recipient.Address.ID,
+				Account:  recipient.Account.ID,
+				Tag:      recipient.Tag,
+				EmailID:  uniuri.NewLen(uniuri.UUIDLen),
+				ThreadID: uniuri.NewLen(uniuri.UUIDLen),
+			})
+		}
+		if err := m.Spool.Add(entry, conn.Envelope.Data); err != nil {
+			m.Error(conn, err)
+			return
+		}
+		m.rememberDigest(conn, recipients)
 
-			// Prepare a new email object
-			email := &models.Email{
-				ID:           uniuri.NewLen(uniuri.UUIDLen),
-				DateCreated:  time.Now(),
-				DateModified: time.Now(),
-				Owner:        recipient.Account.ID,
-				MessageID:    messageID,
-				Status:       "received",
-			}
+		next(conn)
+	}
+}
 
-			// Generate a new key
-			key := make([]byte, 32)
-			if _, err := io.ReadFull(rand.Reader, key); err != nil {
-				m.Error(conn, err)
-				return
-			}
-			akey := [32]byte{}
-			copy(akey[:], key)
+// checkSize removes the recipients whose plans don't allow the size of the
+// email. SMTP rejects the whole email and returns nil, LMTP rejects the
+// envelope recipients left without any accounts.
+func (m *Mailer) checkSize(conn *smtpd.Connection, recipients []recipient) []recipient {
+	var (
+		fitting  []recipient
+		rejected = map[int]error{}
+	)
+	for _, recipient := range recipients {
+		if recipient.Plan == nil || recipient.Plan.CanReceive(len(conn.Envelope.Data)) {
+			fitting = append(fitting, recipient)
+			continue
+		}
 
-			// Generate a new nonce
-			nonce := make([]byte, 8)
-			if _, err = rand.Read(nonce); err != nil {
-				m.Error(conn, err)
-				return
-			}
+		err := smtpd.Error{
+			Code:    552,
+			Message: "5.3.4 Message exceeds the size limit of " + recipient.Address.ID,
+		}
+		if !conn.Server.LMTP {
+			conn.Error(err)
+			return nil
+		}
+		rejected[recipient.Index] = err
+	}
 
-			// Set up a new stream
-			stream, err := chacha20.New(key, nonce)
-			if err != nil {
-				m.Error(conn, err)
-				return
+	// Group addresses are delivered to the members that have space for it
+	for index, err := range rejected {
+		delivered := false
+		for _, recipient := range fitting {
+			if recipient.Index == index {
+				delivered = true
+				break
 			}
+		}
+		if !delivered {
+			conn.Envelope.Reject(index, err)
+		}
+	}
 
-			// Prepare output
-			ciphertext := make(
-				[]byte,
-				len(conn.Envelope.Data)+
-					chacha20.NonceSize+
-					(len(conn.Envelope.Data)/1024+1)*16,
-			)
-
-			// First write the nonce
-			copy(ciphertext[:chacha20.NonceSize], nonce)
-
-			// Then write the authenticated encrypted stream
-			oi := chacha20.NonceSize
-			for i := 0; i < len(conn.Envelope.Data); i += 1024 {
-				// Get the chunk
-				max := i + 1024
-				if max > len(conn.Envelope.Data) {
-					max = len(conn.Envelope.Data)
-				}
-				chunk := conn.Envelope.Data[i:max]
+	return append([]recipient{}, fitting...)
+}
 
-				// Encrypt the block
-				stream.XORKeyStream(ciphertext[oi:oi+len(chunk)], chunk)
+type description struct {
+	Node      *models.EmailNode
+	Headers   mail.Header // header with the protected fields, never stored in plaintext
+	MessageID string
+	Members   []string
+}
 
-				// Authenticate it
-				var out [16]byte
-				poly1305.Sum(&out, ciphertext[oi:oi+len(chunk)], &akey)
+// describeEmail analyzes the email and extracts the fields used in storage.
+// The fields stored in plaintext are read from the outer header, as the
+// protected one is only stored encrypted.
+func describeEmail(data []byte) (*description, error) {
+	// First run the analysis algorithm to generate an email description
+	node := &models.EmailNode{}
+	if err := analysis.Analyze(node, data); err != nil {
+		return nil, err
+	}
+	headers := node.Headers
+
+	// Calculate message ID
+	messageID := headers.Get("Message-ID")
+	x1i := strings.Index(messageID, "<")
+	if x1i != -1 {
+		x2i := strings.Index(messageID[x1i+1:], ">")
+		if x2i != -1 {
+			messageID = messageID[x1i+1 : x1i+x2i+1]
+		}
+	}
+	if messageID == "" {
+		messageID = uniuri.NewLen(uniuri.UUIDLen) + "@invalid-incoming.pgp.st"
+	}
 
-				// Write it into the result
-				copy(ciphertext[oi+len(chunk):oi+len(chunk)+poly1305.TagSize], out[:])
+	// Generate the members field
+	fromHeader, err := mail.ParseAddress(headers.Get("From"))
+	if err != nil {
+		return nil, err
+	}
+	members := []string{fromHeader.Address}
 
-				// Increase the counter
-				oi += 1024 + poly1305.TagSize
-			}
+	if x := headers.Get("To"); x != "" {
+		toHeader, err := headers.AddressList("To")
+		if err != nil {
+			return nil, err
+		}
+		for _, to := range toHeader {
+			members = append(members, to.Address)
+		}
+	}
 
-			// Save it to the body
-			email.Body = ciphertext
+	if x := headers.Get("CC"); x != "" {
+		ccHeader, err := headers.AddressList("CC")
+		if err != nil {
+			return nil, err
+		}
+		for _, cc := range ccHeader {
+			members = append(members, cc.Address)
+		}
+	}
 
-			// Create a manifest and encrypt it
-			manifest, err := json.Marshal(models.Manifest{
-				Key:         key,
-				Nonce:       nonce,
-				Description: node,
-			})
-			if err != nil {
-				m.Error(conn, err)
-				return
-			}
-			encryptedManifest, err := utils.PGPEncrypt(manifest, keyring)
-			if err != nil {
-				m.Error(conn, err)
-				return
-			}
-			email.Manifest = encryptedManifest
+	return &description{
+		Node:      node,
+		Headers:   analysis.Headers(node),
+		MessageID: messageID,
+		Members:   members,
+	}, nil
+}
 
-			// Match the thread
-			var thread *models.Thread
+// deliverSpooled stores a spooled email for one of its recipients. It's
+// safe to call it again after a failure, the IDs are fixed in the entry and
+// the copies sent out are recorded in it.
+func (m *Mailer) deliverSpooled(entry *SpoolEntry, spooled *SpoolRecipient, data []byte) error {
+	desc, err := describeEmail(data)
+	if err != nil {
+		return PermanentError{err}
+	}
 
-			// Get the References header
-			var references string
-			if x := node.Headers.Get("In-Reply-To"); x != "" {
-				references = x
-			} else if x := node.Headers.Get("References"); x != "" {
-				references = x
-			}
+	// The address might have changed since the email was accepted
+	recipient, err := m.lookupRecipient(spooled.Address, spooled.Account)
+	if err != nil {
+		return err
+	}
+	if err := checkRecipient(recipient); err != nil {
+		return PermanentError{err}
+	}
 
-			// Match by Message-ID
-			if references != "" {
-				// As specified in http://www.jwz.org/doc/threading.html, first thing <> is the msg id
-				// We support both <message-id> and message-id format.
-				x1i := strings.Index(references, "<")
-				if x1i != -1 {
-					x2i := strings.Index(references[x1i+1:], ">")
-					if x2i != -1 {
-						references = references[x1i+1 : x1i+x2i+1]
-					}
-				}
+	// Decide where the email goes using the account's rules
+	labels, redirects, err := m.applyRules(entry, spooled, recipient, desc, data)
+	if err != nil {
+		return err
+	}
 
-				// Look up the message ID in the database
-				cursor, err := r.Table("emails").GetAllByIndex("messageIDOwner", []interface{}{
-					references,
-					recipient.Account.ID,
-				}).CoerceTo("array").Do(func(emails r.Term) r.Term {
-					return r.Branch(
-						emails.Count().Eq(1),
-						r.Table("threads").Get(emails.Nth(0).Field("thread")).Default(map[string]interface{}{}),
-						map[string]interface{}{},
-					)
-				}).Run(m.Rethink)
-				if err != nil {
-					m.Error(conn, err)
-					return
-				}
-				defer cursor.Close()
-				if err := cursor.One(&thread); err != nil {
-					m.Error(conn, err)
-					return
-				}
+	// Forward-only addresses keep the emails that can't be forwarded
+	forward := m.shouldForward(entry, recipient, desc)
+	if forward && !recipient.Address.Forwarding.Keep {
+		labels = nil
+	}
 
-				// Check if we've found it, clear it if it's invalid
-				if thread.ID == "" {
-					thread = nil
-				}
-			}
+	if len(labels) > 0 && !spooled.Stored {
+		if err := m.storeEmail(entry, spooled, recipient, desc, labels, data); err != nil {
+			return err
+		}
+	}
 
-			// We can't match it by subject, so proceed to create a new thread
-			if thread == nil {
-				var secure string
-				if findEncrypted(node) {
-					secure = "all"
-				} else {
-					secure = "none"
-				}
+	// The usage is updated separately, so that a failed update is retried
+	// without storing the email again
+	if spooled.Stored && !spooled.Counted {
+		if err := quota.AddStorage(m.Rethink, recipient.Account.ID, spooled.Size, 1, 0); err != nil {
+			return err
+		}
+		spooled.Counted = true
+	}
 
-				labels := []string{recipient.Labels.Inbox}
-				if isSpam {
-					labels = append(labels, recipient.Labels.Spam)
-				}
+	if forward && !spooled.Forwarded {
+		if err := m.forwardEmail(entry, recipient, data); err != nil {
+			return err
+		}
+		spooled.Forwarded = true
+	}
 
-				thread = &models.Thread{
-					ID:           uniuri.NewLen(uniuri.UUIDLen),
-					DateCreated:  time.Now(),
-					DateModified: time.Now(),
-					Owner:        recipient.Account.ID,
-					Labels:       labels,
-					Members:      members,
-					Secure:       secure,
-				}
+	for _, address := range redirects {
+		if spooled.redirected(address) {
+			continue
+		}
+		if err := m.redirectEmail(entry, recipient, desc, address, data); err != nil {
+			return err
+		}
+		spooled.Redirected = append(spooled.Redirected, address)
+	}
 
-				if err := r.Table("threads").Insert(thread).Exec(m.Rethink); err != nil {
-					m.Error(conn, err)
-					return
-				}
-			} else {
-				// Modify the existing thread
-				foundInbox := false
-				foundSpam := false
-				for _, label := range thread.Labels {
-					if label == recipient.Labels.Inbox {
-						foundInbox = true
-					}
-
-					if isSpam {
-						if label == recipient.Labels.Spam {
-							foundSpam = true
-						}
-
-						if foundInbox && foundSpam {
-							break
-						}
-					} else {
-						if foundInbox {
-							break
-						}
-					}
-				}
+	// A failed reply isn't worth storing the email again. Members of groups
+	// don't reply on behalf of the group.
+	if len(labels) > 0 && !entry.Spam && !recipient.Address.IsGroup() && !spooled.Replied {
+		if err := m.sendVacationReply(entry, spooled, recipient, desc); err != nil {
+			m.Log.WithFields(logrus.Fields{
+				"ctx_id":  entry.ID,
+				"account": recipient.Account.ID,
+				"err":     err,
+			}).Warn("Unable to send a vacation reply")
+		}
+		spooled.Replied = true
+	}
 
-				// Append to thread.Labels
-				if !foundInbox {
-					thread.Labels = append(thread.Labels, recipient.Labels.Inbox)
-				}
-				if !foundSpam && isSpam {
-					thread.Labels = append(thread.Labels, recipient.Labels.Spam)
-				}
+	// Keys of spam senders aren't worth remembering
+	if len(labels) > 0 && !entry.Spam {
+		if err := m.updatePeer(recipient, desc); err != nil {
+			m.Log.WithFields(logrus.Fields{
+				"ctx_id":  entry.ID,
+				"account": recipient.Account.ID,
+				"err":     err,
+			}).Warn("Unable to update the Autocrypt peer")
+		}
+	}
 
-				// Members update
-				membersHash := map[string]struct{}{}
-				for _, member := range thread.Members {
-					membersHash[member] = struct{}{}
-				}
-				for _, member := range members {
-					if _, ok := membersHash[member]; !ok {
-						membersHash[member] = struct{}{}
-					}
-				}
-				thread.Members = []string{}
-				for member := range membersHash {
-					thread.Members = append(thread.Members, member)
-				}
+	m.Log.WithFields(logrus.Fields{
+		"ctx_id":    entry.ID,
+		"address":   recipient.Address.ID,
+		"account":   recipient.Account.MainAddress,
+		"labels":    len(labels),
+		"redirects": len(redirects),
+		"forwarded": forward,
+	}).Info("Email received")
+
+	return nil
+}
 
-				update := map[string]interface{}{
-					"date_modified": time.Now(),
-					"is_read":       false,
-					"labels":        thread.Labels,
-					"members":       thread.Members,
-				}
+// storeEmail encrypts the email and inserts it into a matching thread with
+// the labels.
+func (m *Mailer) storeEmail(entry *SpoolEntry, spooled *SpoolRecipient, recipient *recipient, desc *description, labels []string, data []byte) error {
+	// Parse the keys of the recipient
+	keyring, keyIDs, err := models.EncryptionKeyring(recipient.Account.ID, recipient.Key, recipient.Keys, time.Now())
+	if err != nil {
+		return PermanentError{err}
+	}
 
-				secure := findEncrypted(node)
-				if (thread.Secure == "all" && !secure) ||
-					(thread.Secure == "none" && secure) {
-					thread.Secure = "some"
-				}
+	// Prepare a new email object
+	email := &models.Email{
+		ID:           spooled.EmailID,
+		DateCreated:  time.Now(),
+		DateModified: time.Now(),
+		Owner:        recipient.Account.ID,
+		MessageID:    desc.MessageID,
+		Status:       "received",
+		Tag:          spooled.Tag,
+		Files:        analysis.Files(desc.Node),
+		Keys:         keyIDs,
+
+		Authentication: entry.Authentication,
+	}
 
-				if err := r.Table("threads").Get(thread.ID).Update(update).Exec(m.Rethink); err != nil {
-					m.Error(conn, err)
-					return
-				}
-			}
+	// Encrypt the body and its description
+	email.Body, email.Manifest, err = encryptEmail(keyring, data, desc.Node)
+	if err != nil {
+		return err
+	}
 
-			email.Thread = thread.ID
-			if err := r.Table("emails").Insert(email).Exec(m.Rethink); err != nil {
-				m.Error(conn, err)
-				return
-			}
+	// Match the thread using the references, the subject and members
+	msg := threading.NewMessage([]byte(m.Options.ThreadSecret), recipient.Account.ID, desc.Node.Headers, false, time.Now())
+	msg.MessageID = desc.MessageID
+	email.References = msg.References
 
-			m.Log.WithFields(logrus.Fields{
-				"address": recipient.Address.ID,
-				"account": recipient.Account.MainAddress,
-			}).Info("Email received")
+	thread, err := threading.Match(m.Rethink, recipient.Account.ID, msg, time.Duration(m.Options.ThreadWindow)*time.Hour)
+	if err != nil {
+		return err
+	}
+
+	secure := "none"
+	if analysis.IsEncrypted(desc.Node) {
+		secure = "all"
+	}
+
+	if thread == nil {
+		thread = &models.Thread{
+			ID:           spooled.ThreadID,
+			DateCreated:  time.Now(),
+			DateModified: time.Now(),
+			Owner:        recipient.Account.ID,
+			Labels:       labels,
+			Members:      desc.Members,
+			Secure:       secure,
+			SubjectHash:  msg.SubjectHash,
 		}
 
-		next(conn)
+		if err := r.Table("threads").Insert(thread, r.InsertOpts{
+			Conflict: "replace",
+		}).Exec(m.Rethink); err != nil {
+			return err
+		}
+	} else {
+		// Modify the existing thread
+		threading.Combine(thread, &models.Thread{
+			Labels:  labels,
+			Members: desc.Members,
+			Secure:  secure,
+		})
+
+		if err := r.Table("threads").Get(thread.ID).Update(map[string]interface{}{
+			"date_modified": time.Now(),
+			"is_read":       false,
+			"labels":        thread.Labels,
+			"members":       thread.Members,
+			"secure":        thread.Secure,
+		}).Exec(m.Rethink); err != nil {
+			return err
+		}
+	}
+
+	email.Thread = thread.ID
+	if err := r.Table("emails").Insert(email, r.InsertOpts{
+		Conflict: "replace",
+	}).Exec(m.Rethink); err != nil {
+		return err
+	}
+
+	spooled.Stored = true
+	spooled.Size = int64(len(email.Body) + len(email.Manifest))
+	return nil
+}
+
+// encryptEmail encrypts the body with a new key and returns it along with a
+// manifest encrypted to the keyring.
+func encryptEmail(keyring openpgp.EntityList, data []byte, node *models.EmailNode) ([]byte, []byte, error) {
+	// Generate a new key
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		return nil, nil, err
 	}
+
+	// Encrypt the body
+	ciphertext, err := crypto.Encrypt(key, data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Create a manifest and encrypt it
+	manifest, err := json.Marshal(models.Manifest{
+		Version:     crypto.CurrentVersion,
+		Key:         key,
+		Description: node,
+
+		ProtectedHeaders: analysis.ProtectedHeaders(node),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	encryptedManifest, err := utils.PGPEncrypt(manifest, keyring)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return ciphertext, encryptedManifest, nil
 }
 
 func (m *Mailer) Error(conn *smtpd.Connection, err error) {
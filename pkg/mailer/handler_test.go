@@ -0,0 +1,56 @@
+package mailer
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/pgpst/pgpst/internal/github.com/pgpst/smtpd"
+	. "github.com/pgpst/pgpst/internal/github.com/smartystreets/goconvey/convey"
+)
+
+func TestDropRejected(t *testing.T) {
+	Convey("Given a transaction whose last address was greylisted", t, func() {
+		conn := &smtpd.Connection{
+			Envelope: &smtpd.Envelope{
+				Recipients: []string{"bob@pgp.st", "srs0=bounce@pgp.st"},
+				Environment: map[string]interface{}{
+					"recipients": []recipient{{Index: 0}, {Index: 2}, {Index: 2}},
+					"bounces":    map[int]string{1: "alice@example.com", 2: "carol@example.com"},
+				},
+			},
+		}
+
+		Convey("Only the entries of the accepted addresses should be kept", func() {
+			dropRejected(conn, len(conn.Envelope.Recipients))
+			So(conn.Envelope.Environment["recipients"], ShouldResemble, []recipient{{Index: 0}})
+			So(conn.Envelope.Environment["bounces"], ShouldResemble, map[int]string{1: "alice@example.com"})
+		})
+
+		Convey("Transactions without any entries should be left alone", func() {
+			conn.Envelope.Environment = nil
+			dropRejected(conn, 0)
+			So(conn.Envelope.Environment, ShouldBeNil)
+		})
+	})
+}
+
+func TestDescribeEmail(t *testing.T) {
+	data, err := ioutil.ReadFile("../analysis/testdata/protected.eml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Convey("Given an email with protected headers", t, func() {
+		desc, err := describeEmail(data)
+		So(err, ShouldBeNil)
+
+		Convey("The protected fields should only be in the header used by the rules", func() {
+			So(desc.Headers.Get("Subject"), ShouldEqual, "Quarterly numbers")
+			So(desc.Node.Headers.Get("Subject"), ShouldEqual, "...")
+		})
+
+		Convey("Members should be read from the outer header", func() {
+			So(desc.Members, ShouldResemble, []string{"alice@example.org", "bob@example.net"})
+		})
+	})
+}
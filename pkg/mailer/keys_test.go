@@ -0,0 +1,132 @@
+package mailer
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/hex"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	. "github.com/pgpst/pgpst/internal/github.com/smartystreets/goconvey/convey"
+	"github.com/pgpst/pgpst/internal/golang.org/x/crypto/openpgp"
+	"github.com/pgpst/pgpst/internal/golang.org/x/crypto/openpgp/packet"
+
+	"github.com/pgpst/pgpst/pkg/models"
+)
+
+// Stores the public part of the entity like the API does
+func storedKey(owner string, entity *openpgp.Entity) *models.Key {
+	var body bytes.Buffer
+	So(entity.Serialize(&body), ShouldBeNil)
+
+	return &models.Key{
+		ID:    hex.EncodeToString(entity.PrimaryKey.Fingerprint[:]),
+		Owner: owner,
+		Body:  body.Bytes(),
+		KeyID: entity.PrimaryKey.KeyId,
+		Identities: []*models.Identity{{
+			SelfSignature: &models.Signature{
+				Type:         0x13,
+				CreationTime: entity.PrimaryKey.CreationTime,
+			},
+		}},
+	}
+}
+
+func TestEncryptionKeyring(t *testing.T) {
+	entities := []*openpgp.Entity{}
+	for _, name := range []string{"default", "laptop", "phone", "alice"} {
+		entity, err := openpgp.NewEntity(name, "", name+"@pgp.st", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, identity := range entity.Identities {
+			identity.SelfSignature.PreferredHash = []uint8{8} // SHA256
+		}
+		// Signs the identities and subkeys, so that they can be serialized
+		if err := entity.SerializePrivate(ioutil.Discard, nil); err != nil {
+			t.Fatal(err)
+		}
+		entities = append(entities, entity)
+	}
+
+	Convey("Given the default key and the keys chosen for an address", t, func() {
+		var (
+			now      = time.Now()
+			fallback = storedKey("bob", entities[0])
+			laptop   = storedKey("bob", entities[1])
+			phone    = storedKey("bob", entities[2])
+		)
+
+		Convey("All the chosen keys should be used", func() {
+			keyring, ids, err := models.EncryptionKeyring("bob", fallback, []*models.Key{laptop, phone}, now)
+			So(err, ShouldBeNil)
+			So(ids, ShouldResemble, []string{laptop.ID, phone.ID})
+			So(len(keyring), ShouldEqual, 2)
+			So(keyring[1].PrimaryKey.KeyId, ShouldEqual, phone.KeyID)
+		})
+
+		Convey("Revoked and expired keys should be skipped", func() {
+			identity := entities[2].Identities["phone <phone@pgp.st>"]
+			revocation := &packet.Signature{
+				SigType:      0x30,
+				PubKeyAlgo:   entities[2].PrivateKey.PubKeyAlgo,
+				Hash:         crypto.SHA256,
+				CreationTime: now,
+				IssuerKeyId:  &entities[2].PrimaryKey.KeyId,
+			}
+			So(revocation.SignUserId(identity.UserId.Id, entities[2].PrimaryKey, entities[2].PrivateKey, nil), ShouldBeNil)
+			identity.Signatures = []*packet.Signature{revocation}
+			defer func() { identity.Signatures = nil }()
+
+			_, ids, err := models.EncryptionKeyring("bob", fallback, []*models.Key{laptop, storedKey("bob", entities[2])}, now)
+			So(err, ShouldBeNil)
+			So(ids, ShouldResemble, []string{laptop.ID})
+
+			lifetime := uint32(60)
+			sig := entities[1].Identities["laptop <laptop@pgp.st>"].SelfSignature
+			sig.KeyLifetimeSecs = &lifetime
+			So(entities[1].SerializePrivate(ioutil.Discard, nil), ShouldBeNil)
+			defer func() {
+				sig.KeyLifetimeSecs = nil
+				So(entities[1].SerializePrivate(ioutil.Discard, nil), ShouldBeNil)
+			}()
+
+			_, ids, err = models.EncryptionKeyring("bob", fallback, []*models.Key{storedKey("bob", entities[1]), phone}, now.Add(time.Hour))
+			So(err, ShouldBeNil)
+			So(ids, ShouldResemble, []string{phone.ID})
+		})
+
+		Convey("Keys of other accounts should be skipped", func() {
+			_, ids, err := models.EncryptionKeyring("alice", storedKey("alice", entities[3]), []*models.Key{laptop}, now)
+			So(err, ShouldBeNil)
+			So(len(ids), ShouldEqual, 1)
+			So(ids[0], ShouldNotEqual, laptop.ID)
+		})
+
+		Convey("Without chosen keys the default one should be used", func() {
+			keyring, ids, err := models.EncryptionKeyring("bob", fallback, nil, now)
+			So(err, ShouldBeNil)
+			So(ids, ShouldResemble, []string{fallback.ID})
+			So(keyring[0].PrimaryKey.KeyId, ShouldEqual, fallback.KeyID)
+		})
+
+		Convey("The manifest should be readable with every chosen key", func() {
+			keyring, _, err := models.EncryptionKeyring("bob", fallback, []*models.Key{laptop, phone}, now)
+			So(err, ShouldBeNil)
+
+			node := &models.EmailNode{}
+			_, manifest, err := encryptEmail(keyring, []byte("Subject: Hi\r\n\r\nHello"), node)
+			So(err, ShouldBeNil)
+
+			for _, entity := range entities[1:3] {
+				details, err := openpgp.ReadMessage(bytes.NewReader(manifest), openpgp.EntityList{entity}, nil, nil)
+				So(err, ShouldBeNil)
+				So(details.IsEncrypted, ShouldBeTrue)
+			}
+			_, err = openpgp.ReadMessage(bytes.NewReader(manifest), openpgp.EntityList{entities[0]}, nil, nil)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
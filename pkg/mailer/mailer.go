@@ -3,9 +3,11 @@ package mailer
 import (
 	"crypto/tls"
 	"io/ioutil"
+	"net"
+	"os"
+	"strings"
 	"time"
 
-	//"github.com/hashicorp/golang-lru"
 	"github.com/pgpst/pgpst/internal/github.com/lavab/go-spamc"
 	"github.com/pgpst/pgpst/internal/github.com/Sirupsen/logrus"
 	"github.com/pgpst/pgpst/internal/github.com/bitly/go-nsq"
@@ -13,6 +15,7 @@ import (
 	"github.com/pgpst/pgpst/internal/github.com/getsentry/raven-go"
 	"github.com/pgpst/pgpst/internal/github.com/pgpst/smtpd"
 
+	"github.com/pgpst/pgpst/pkg/srs"
 	"github.com/pgpst/pgpst/pkg/utils"
 )
 
@@ -26,6 +29,15 @@ type Mailer struct {
 	Raven     *raven.Client
 	Spam      *spamc.Client
 	TLSConfig *tls.Config
+
+	Resolver   utils.Resolver
+	Dial       func(network, address string) (net.Conn, error)
+	DKIMCache  *utils.LRU
+	Greylist   GreylistStore
+	Duplicates DuplicateStore
+	Spool      *Spool
+	SRS        *srs.SRS
+	RateStore  smtpd.RateStore
 }
 
 func NewMailer(options *Options) *Mailer {
@@ -55,15 +67,69 @@ func NewMailer(options *Options) *Mailer {
 		Log:      log,
 		Rethink:  session,
 		Producer: producer,
+		Resolver: utils.NetResolver{},
+		Dial: (&net.Dialer{
+			Timeout: time.Minute,
+		}).Dial,
+		DKIMCache: utils.NewLRU(options.DKIMLRUSize),
+		Greylist: &rethinkGreylist{
+			session: session,
+		},
+		Duplicates: &rethinkDuplicates{
+			session: session,
+		},
+	}
+
+	// Open the spool of incoming emails
+	spool, err := NewSpool(options.SpoolDir, log, mailer.deliverSpooled)
+	if err != nil {
+		log.WithField("err", err).Fatal("Unable to open the spool directory")
+	}
+	spool.Bounce = mailer.sendBounce
+	mailer.Spool = spool
+
+	// Rate limits are kept in memory unless they're shared
+	if options.RateShared {
+		mailer.RateStore = &rethinkRateStore{
+			session: session,
+		}
+	} else {
+		mailer.RateStore = smtpd.NewMemoryRateStore()
+	}
+
+	// Rewritten senders of forwarded and redirected emails have to be
+	// signed. A random secret would make the bounces unroutable after a
+	// restart or on other instances.
+	if options.SRSSecret == "" {
+		log.Fatal("No SRS secret set, it's required to forward emails")
+	}
+	mailer.SRS = &srs.SRS{
+		Secret: []byte(options.SRSSecret),
+		Domain: options.SRSDomain,
+	}
+
+	// Peers are stored under IDs shared with the API, which would be
+	// predictable without a secret
+	if options.PeerSecret == "" {
+		log.Fatal("No peer secret set, it's required to store the Autocrypt peers")
+	}
+
+	// Subjects are hashed with the secret, so it's needed unless the
+	// threading by subjects is disabled
+	if options.ThreadSecret == "" && options.ThreadWindow > 0 {
+		log.Fatal("No thread secret set, it's required unless thread_window is 0")
 	}
 
 	// And a new NSQ consumer
-	consumer, err := nsq.NewConsumer("send_email", "receive", nsq.NewConfig())
+	config := nsq.NewConfig()
+	config.MaxInFlight = options.SenderConcurrency
+	config.MaxAttempts = sendAttempts
+	consumer, err := nsq.NewConsumer("send_email", "receive", config)
 	if err != nil {
 		log.WithField("err", err).Fatal("Unable to create a new NSQ consumer")
 	}
 	consumer.SetLogger(nsqlog, nsq.LogLevelWarning)
-	//consumer.AddConcurrentHandlers(mailer, options.SenderConcurrency)
+	consumer.AddConcurrentHandlers(mailer, options.SenderConcurrency)
 	mailer.Consumer = consumer
 
 	// Connect to spamd
@@ -106,6 +172,16 @@ func NewMailer(options *Options) *Mailer {
 }
 
 func (m *Mailer) Main() {
+	// Start consuming the outbound queue
+	if err := m.Consumer.ConnectToNSQD(m.Options.NSQdAddress); err != nil {
+		m.Log.WithField("err", err).Fatal("Unable to connect the consumer to NSQd")
+	}
+
+	// Store the emails left over in the spool and the incoming ones
+	if err := m.Spool.Start(); err != nil {
+		m.Log.WithField("err", err).Fatal("Unable to read the spool directory")
+	}
+
 	// Create a handler
 	smtp := &smtpd.Server{
 		Hostname:       m.Options.Hostname,
@@ -119,25 +195,136 @@ func (m *Mailer) Main() {
 		MaxMessageSize: m.Options.MaxMessageSize,
 		MaxRecipients:  m.Options.MaxRecipients,
 
+		RateLimits: m.rateLimits(),
+		RateStore:  m.RateStore,
+
 		WrapperChain: []smtpd.Wrapper{
 			m,
 		},
+		SenderChain: []smtpd.Sender{
+			m,
+		},
+		// Handlers are called starting from the last one, so unknown
+		// recipients are rejected before they're greylisted.
 		RecipientChain: []smtpd.Recipient{
+			smtpd.RecipientFunc(m.HandleGreylist),
 			m,
 		},
+		// Duplicates are dropped before the email is modified.
 		DeliveryChain: []smtpd.Delivery{
 			m,
+			smtpd.DeliveryFunc(m.HandleDuplicates),
 		},
 
 		TLSConfig: m.TLSConfig,
 	}
 
+	// Start the submission server if it's possible to authenticate
+	if m.Options.SubmissionAddress != "" && m.TLSConfig != nil {
+		submission := &smtpd.Server{
+			Hostname:       m.Options.Hostname,
+			WelcomeMessage: m.Options.WelcomeMessage,
+
+			ReadTimeout:  time.Second * time.Duration(m.Options.ReadTimeout),
+			WriteTimeout: time.Second * time.Duration(m.Options.WriteTimeout),
+			DataTimeout:  time.Second * time.Duration(m.Options.DataTimeout),
+
+			MaxConnections: m.Options.MaxConnections,
+			MaxMessageSize: m.Options.MaxMessageSize,
+			MaxRecipients:  m.Options.MaxRecipients,
+
+			RateLimits: m.rateLimits(),
+			RateStore:  m.RateStore,
+
+			WrapperChain: []smtpd.Wrapper{
+				m,
+			},
+			SenderChain: []smtpd.Sender{
+				smtpd.SenderFunc(m.HandleSubmissionSender),
+			},
+			DeliveryChain: []smtpd.Delivery{
+				smtpd.DeliveryFunc(m.HandleSubmission),
+			},
+
+			TLSConfig:     m.TLSConfig,
+			Authenticator: m,
+			AuthRequired:  true,
+		}
+
+		go func() {
+			if err := submission.ListenAndServe(m.Options.SubmissionAddress); err != nil {
+				m.Log.WithField("err", err).Fatal("Unable to listen and serve the submission server")
+			}
+		}()
+	} else if m.Options.SubmissionAddress != "" {
+		m.Log.Warn("Submission server requires a TLS certificate, not starting it")
+	}
+
+	// Start the LMTP server for the MTAs in front of the mailer. The client
+	// isn't the sender, so the connection policies don't apply to it.
+	if m.Options.LMTPAddress != "" {
+		lmtp := &smtpd.Server{
+			Hostname: m.Options.Hostname,
+
+			ReadTimeout:  time.Second * time.Duration(m.Options.ReadTimeout),
+			WriteTimeout: time.Second * time.Duration(m.Options.WriteTimeout),
+			DataTimeout:  time.Second * time.Duration(m.Options.DataTimeout),
+
+			MaxConnections: m.Options.MaxConnections,
+			MaxMessageSize: m.Options.MaxMessageSize,
+			MaxRecipients:  m.Options.MaxRecipients,
+
+			WrapperChain: []smtpd.Wrapper{
+				m,
+			},
+			RecipientChain: []smtpd.Recipient{
+				m,
+			},
+			DeliveryChain: []smtpd.Delivery{
+				m,
+				smtpd.DeliveryFunc(m.HandleDuplicates),
+			},
+
+			LMTP: true,
+		}
+
+		listener, err := listen(m.Options.LMTPAddress)
+		if err != nil {
+			m.Log.WithField("err", err).Fatal("Unable to listen on the LMTP address")
+		}
+
+		go func() {
+			if err := lmtp.Serve(listener); err != nil {
+				m.Log.WithField("err", err).Fatal("Unable to serve the LMTP server")
+			}
+		}()
+	}
+
 	// Listen
 	if err := smtp.ListenAndServe(m.Options.SMTPAddress); err != nil {
 		m.Log.WithField("err", err).Fatal("Unable to listen and serve the SMTP server")
 	}
 }
 
+// listen opens a TCP listener, or a unix socket if the address starts with
+// "unix:". Sockets left over from the previous runs are removed.
+func listen(address string) (net.Listener, error) {
+	if !strings.HasPrefix(address, "unix:") {
+		return net.Listen("tcp", address)
+	}
+
+	path := strings.TrimPrefix(address, "unix:")
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return net.Listen("unix", path)
+}
+
 func (m *Mailer) Exit() {
+	// Stop accepting new outbound emails and wait for the workers
+	m.Consumer.Stop()
+	<-m.Consumer.StopChan
 
+	m.Producer.Stop()
 }
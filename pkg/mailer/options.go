@@ -2,6 +2,7 @@ package mailer
 
 import (
 	"strconv"
+	"strings"
 
 	"github.com/pgpst/pgpst/internal/github.com/Sirupsen/logrus"
 	r "github.com/pgpst/pgpst/internal/github.com/dancannon/gorethink"
@@ -29,7 +30,31 @@ type Options struct {
 	MaxMessageSize    int
 	MaxRecipients     int
 	SMTPAddress       string
+	SubmissionAddress string
+	LMTPAddress       string
 	SMTPDAddress      string
+	DKIMLRUSize       int
+	PolicyHELO        bool
+	PolicyRDNS        bool
+	PolicyDNSBL       bool
+	DNSBLZones        []string
+	PolicyGreylist    bool
+	GreylistDelay     int
+	SpoolDir          string
+	ThreadWindow      int
+	ThreadSecret      string
+	DuplicateWindow   int
+	SRSSecret         string
+	SRSDomain         string
+	PeerSecret        string
+
+	RateConnectionsIP      int
+	RateConnectionsNetwork int
+	RateMessagesIP         int
+	RateMessagesNetwork    int
+	RateRecipientsIP       int
+	RateRecipientsNetwork  int
+	RateShared             bool
 }
 
 var llMapping = map[string]logrus.Level{
@@ -60,6 +85,18 @@ func NewOptions(fs *flag.FlagSet) (*Options, error) {
 		return nil, err
 	}
 
+	dnsblZones := []string{}
+	for _, zone := range strings.Split(fs.Lookup("dnsbl_zones").Value.String(), ",") {
+		if zone = strings.TrimSpace(zone); zone != "" {
+			dnsblZones = append(dnsblZones, zone)
+		}
+	}
+
+	srsDomain := fs.Lookup("srs_domain").Value.String()
+	if srsDomain == "" {
+		srsDomain = fs.Lookup("hostname").Value.String()
+	}
+
 	return &Options{
 		LogLevel:          ll,
 		RethinkOpts:       opts,
@@ -78,6 +115,30 @@ func NewOptions(fs *flag.FlagSet) (*Options, error) {
 		MaxConnections:    matoi(strconv.Atoi(fs.Lookup("max_connections").Value.String())),
 		MaxMessageSize:    matoi(strconv.Atoi(fs.Lookup("max_message_size").Value.String())),
 		SMTPAddress:       fs.Lookup("smtp_address").Value.String(),
+		SubmissionAddress: fs.Lookup("submission_address").Value.String(),
+		LMTPAddress:       fs.Lookup("lmtp_address").Value.String(),
 		SMTPDAddress:      fs.Lookup("smtpd_address").Value.String(),
+		DKIMLRUSize:       matoi(strconv.Atoi(fs.Lookup("dkim_lru_size").Value.String())),
+		PolicyHELO:        fs.Lookup("policy_helo").Value.(flag.Getter).Get().(bool),
+		PolicyRDNS:        fs.Lookup("policy_rdns").Value.(flag.Getter).Get().(bool),
+		PolicyDNSBL:       fs.Lookup("policy_dnsbl").Value.(flag.Getter).Get().(bool),
+		DNSBLZones:        dnsblZones,
+		PolicyGreylist:    fs.Lookup("policy_greylist").Value.(flag.Getter).Get().(bool),
+		GreylistDelay:     matoi(strconv.Atoi(fs.Lookup("greylist_delay").Value.String())),
+		SpoolDir:          fs.Lookup("spool_dir").Value.String(),
+		ThreadWindow:      matoi(strconv.Atoi(fs.Lookup("thread_window").Value.String())),
+		ThreadSecret:      fs.Lookup("thread_secret").Value.String(),
+		DuplicateWindow:   matoi(strconv.Atoi(fs.Lookup("duplicate_window").Value.String())),
+		SRSSecret:         fs.Lookup("srs_secret").Value.String(),
+		SRSDomain:         srsDomain,
+		PeerSecret:        fs.Lookup("peer_secret").Value.String(),
+
+		RateConnectionsIP:      matoi(strconv.Atoi(fs.Lookup("rate_connections_ip").Value.String())),
+		RateConnectionsNetwork: matoi(strconv.Atoi(fs.Lookup("rate_connections_network").Value.String())),
+		RateMessagesIP:         matoi(strconv.Atoi(fs.Lookup("rate_messages_ip").Value.String())),
+		RateMessagesNetwork:    matoi(strconv.Atoi(fs.Lookup("rate_messages_network").Value.String())),
+		RateRecipientsIP:       matoi(strconv.Atoi(fs.Lookup("rate_recipients_ip").Value.String())),
+		RateRecipientsNetwork:  matoi(strconv.Atoi(fs.Lookup("rate_recipients_network").Value.String())),
+		RateShared:             fs.Lookup("rate_shared").Value.(flag.Getter).Get().(bool),
 	}, nil
 }
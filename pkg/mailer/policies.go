@@ -0,0 +1,282 @@
+package mailer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pgpst/pgpst/internal/github.com/Sirupsen/logrus"
+	r "github.com/pgpst/pgpst/internal/github.com/dancannon/gorethink"
+	"github.com/pgpst/pgpst/internal/github.com/pgpst/smtpd"
+
+	"github.com/pgpst/pgpst/pkg/models"
+)
+
+// Greylisting windows, similar to the postgrey defaults
+const (
+	greylistRetryWindow = 2 * 24 * time.Hour  // unpassed triplets are forgotten after that
+	greylistPassWindow  = 35 * 24 * time.Hour // passed triplets are forgotten after that
+)
+
+// GreylistStore persists the greylisting triplets.
+type GreylistStore interface {
+	// GetTriplet returns nil if the triplet was not seen yet
+	GetTriplet(id string) (*models.Triplet, error)
+	PutTriplet(triplet *models.Triplet) error
+}
+
+type rethinkGreylist struct {
+	session *r.Session
+}
+
+func (g *rethinkGreylist) GetTriplet(id string) (*models.Triplet, error) {
+	cursor, err := r.Table("greylist").Get(id).Default(map[string]interface{}{}).Run(g.session)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+	var triplet models.Triplet
+	if err := cursor.One(&triplet); err != nil {
+		return nil, err
+	}
+	if triplet.ID == "" {
+		return nil, nil
+	}
+
+	return &triplet, nil
+}
+
+func (g *rethinkGreylist) PutTriplet(triplet *models.Triplet) error {
+	return r.Table("greylist").Insert(triplet, r.InsertOpts{
+		Conflict: "replace",
+	}).Exec(g.session)
+}
+
+// remoteIP returns the IP of the connecting client. LMTP clients are the
+// MTAs relaying the emails, so they have no IP to check.
+func remoteIP(conn *smtpd.Connection) net.IP {
+	if conn.Server.LMTP {
+		return nil
+	}
+	if addr, ok := conn.Addr.(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	if host, _, err := net.SplitHostPort(conn.Addr.String()); err == nil {
+		return net.ParseIP(host)
+	}
+	return nil
+}
+
+// HandleSender runs the enabled connection policies once the client sends
+// MAIL FROM.
+func (m *Mailer) HandleSender(next func(conn *smtpd.Connection)) func(conn *smtpd.Connection) {
+	return func(conn *smtpd.Connection) {
+		ip := remoteIP(conn)
+		if ip == nil {
+			next(conn)
+			return
+		}
+
+		checks := []func(*smtpd.Connection, net.IP) error{}
+		if m.Options.PolicyHELO {
+			checks = append(checks, m.checkHELO)
+		}
+		if m.Options.PolicyRDNS {
+			checks = append(checks, m.checkRDNS)
+		}
+		if m.Options.PolicyDNSBL {
+			checks = append(checks, m.checkDNSBL)
+		}
+
+		for _, check := range checks {
+			if err := check(conn, ip); err != nil {
+				m.Log.WithFields(logrus.Fields{
+					"ip":     ip.String(),
+					"helo":   conn.HeloName,
+					"sender": conn.Envelope.Sender,
+					"err":    err,
+				}).Info("Sender rejected by a policy")
+				conn.Error(err)
+				return
+			}
+		}
+
+		next(conn)
+	}
+}
+
+// checkHELO rejects clients that don't introduce themselves with a valid
+// hostname, or pretend to be us.
+func (m *Mailer) checkHELO(conn *smtpd.Connection, ip net.IP) error {
+	helo := strings.ToLower(strings.TrimSuffix(conn.HeloName, "."))
+
+	// Address literals have to match the connecting IP
+	if strings.HasPrefix(helo, "[") && strings.HasSuffix(helo, "]") {
+		literal := strings.TrimPrefix(helo[1:len(helo)-1], "ipv6:")
+		if parsed := net.ParseIP(literal); parsed == nil || !parsed.Equal(ip) {
+			return smtpd.Error{Code: 550, Message: "5.7.1 Helo command rejected: address literal does not match your IP"}
+		}
+		return nil
+	}
+
+	if strings.Index(helo, ".") == -1 || net.ParseIP(helo) != nil {
+		return smtpd.Error{Code: 504, Message: "5.5.2 Helo command rejected: need fully-qualified hostname"}
+	}
+
+	if helo == strings.ToLower(m.Options.Hostname) {
+		return smtpd.Error{Code: 550, Message: "5.7.1 Helo command rejected: you are not " + m.Options.Hostname}
+	}
+
+	return nil
+}
+
+// checkRDNS requires a forward-confirmed reverse DNS name of the client.
+func (m *Mailer) checkRDNS(conn *smtpd.Connection, ip net.IP) error {
+	names, err := m.Resolver.LookupAddr(ip.String())
+	if err != nil {
+		if de, ok := err.(*net.DNSError); ok && (de.Temporary() || de.Timeout()) {
+			return smtpd.Error{Code: 450, Message: "4.7.25 Client host rejected: cannot find your hostname, [" + ip.String() + "]"}
+		}
+		return smtpd.Error{Code: 550, Message: "5.7.25 Client host rejected: cannot find your hostname, [" + ip.String() + "]"}
+	}
+
+	for _, name := range names {
+		ips, err := m.Resolver.LookupIP(strings.TrimSuffix(name, "."))
+		if err != nil {
+			continue
+		}
+		for _, x := range ips {
+			if x.Equal(ip) {
+				return nil
+			}
+		}
+	}
+
+	return smtpd.Error{Code: 550, Message: "5.7.25 Client host rejected: hostname does not resolve to your address, [" + ip.String() + "]"}
+}
+
+// checkDNSBL looks up the client in the configured blocklists. Lookup errors
+// are ignored, so that a broken list doesn't stop all incoming emails.
+func (m *Mailer) checkDNSBL(conn *smtpd.Connection, ip net.IP) error {
+	reversed := reverseIP(ip)
+	for _, zone := range m.Options.DNSBLZones {
+		ips, err := m.Resolver.LookupIP(reversed + "." + zone)
+		if err != nil {
+			continue
+		}
+
+		// Listings are returned as 127.0.0.0/24 addresses. Lists like
+		// Spamhaus report query errors, e.g. of the public resolvers they
+		// block, as 127.255.255.0/24 ones, which don't list anyone.
+		for _, x := range ips {
+			x4 := x.To4()
+			if x4 == nil || x4[0] != 127 {
+				continue
+			}
+			if x4[1] == 0 && x4[2] == 0 {
+				return smtpd.Error{Code: 554, Message: "5.7.1 Service unavailable; client host [" + ip.String() + "] blocked using " + zone}
+			}
+			if x4[1] == 255 && x4[2] == 255 {
+				m.Log.WithFields(logrus.Fields{
+					"zone": zone,
+					"code": x4.String(),
+				}).Warn("DNSBL refused the query")
+			}
+		}
+	}
+
+	return nil
+}
+
+// reverseIP formats the IP as used in the DNSBL queries.
+func reverseIP(ip net.IP) string {
+	var parts []string
+	if x := ip.To4(); x != nil {
+		for i := len(x) - 1; i >= 0; i-- {
+			parts = append(parts, strconv.Itoa(int(x[i])))
+		}
+	} else {
+		x := ip.To16()
+		for i := len(x) - 1; i >= 0; i-- {
+			parts = append(parts, strconv.FormatInt(int64(x[i]&0xf), 16), strconv.FormatInt(int64(x[i]>>4), 16))
+		}
+	}
+
+	return strings.Join(parts, ".")
+}
+
+// HandleGreylist temporarily rejects the first delivery attempt of every new
+// client network, sender and recipient triplet.
+func (m *Mailer) HandleGreylist(next func(conn *smtpd.Connection)) func(conn *smtpd.Connection) {
+	return func(conn *smtpd.Connection) {
+		ip := remoteIP(conn)
+		if !m.Options.PolicyGreylist || ip == nil {
+			next(conn)
+			return
+		}
+
+		// Retries often come from a different server of the same network
+		var network net.IP
+		if x := ip.To4(); x != nil {
+			network = x.Mask(net.CIDRMask(24, 32))
+		} else {
+			network = ip.Mask(net.CIDRMask(64, 128))
+		}
+
+		var (
+			sender    = strings.ToLower(conn.Envelope.Sender)
+			recipient = strings.ToLower(conn.Envelope.Recipients[len(conn.Envelope.Recipients)-1])
+			hash      = sha256.Sum256([]byte(network.String() + "\x00" + sender + "\x00" + recipient))
+			id        = hex.EncodeToString(hash[:])
+			now       = time.Now()
+		)
+
+		triplet, err := m.Greylist.GetTriplet(id)
+		if err != nil {
+			// Don't block the emails if the store is down
+			m.Log.WithField("err", err).Error("Unable to fetch a greylist triplet")
+			next(conn)
+			return
+		}
+
+		// Forget the triplets that expired
+		if triplet != nil && ((triplet.Passed && now.Sub(triplet.DateModified) > greylistPassWindow) ||
+			(!triplet.Passed && now.Sub(triplet.DateCreated) > greylistRetryWindow)) {
+			triplet = nil
+		}
+
+		if triplet == nil {
+			triplet = &models.Triplet{
+				ID:          id,
+				DateCreated: now,
+				Network:     network.String(),
+				Sender:      sender,
+				Recipient:   recipient,
+			}
+		}
+		triplet.DateModified = now
+
+		delay := time.Duration(m.Options.GreylistDelay) * time.Second
+		if !triplet.Passed && now.Sub(triplet.DateCreated) >= delay {
+			triplet.Passed = true
+		}
+
+		if err := m.Greylist.PutTriplet(triplet); err != nil {
+			m.Log.WithField("err", err).Error("Unable to store a greylist triplet")
+		}
+
+		if !triplet.Passed {
+			wait := delay - now.Sub(triplet.DateCreated)
+			conn.Error(smtpd.Error{
+				Code:    451,
+				Message: "4.7.1 Greylisted, please try again in " + strconv.Itoa(int(wait.Seconds()+1)) + " seconds",
+			})
+			return
+		}
+
+		next(conn)
+	}
+}
@@ -0,0 +1,224 @@
+package mailer_test
+
+import (
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pgpst/pgpst/internal/github.com/pgpst/smtpd"
+	. "github.com/pgpst/pgpst/internal/github.com/smartystreets/goconvey/convey"
+
+	"github.com/pgpst/pgpst/pkg/models"
+	"github.com/pgpst/pgpst/pkg/srs"
+)
+
+type memoryGreylist struct {
+	sync.Mutex
+	Triplets map[string]*models.Triplet
+}
+
+func (g *memoryGreylist) GetTriplet(id string) (*models.Triplet, error) {
+	g.Lock()
+	defer g.Unlock()
+
+	if triplet, ok := g.Triplets[id]; ok {
+		x := *triplet
+		return &x, nil
+	}
+	return nil, nil
+}
+
+func (g *memoryGreylist) PutTriplet(triplet *models.Triplet) error {
+	g.Lock()
+	defer g.Unlock()
+
+	x := *triplet
+	g.Triplets[triplet.ID] = &x
+	return nil
+}
+
+// Returns the code of an SMTP error, 250 if there was none
+func replyCode(err error) int {
+	if err == nil {
+		return 250
+	}
+	if te, ok := err.(*textproto.Error); ok {
+		return te.Code
+	}
+	return 0
+}
+
+func TestPolicies(t *testing.T) {
+	Convey("Given a mailer with all the sender policies enabled", t, func() {
+		resolver := &fakeResolver{
+			PTR: map[string][]string{},
+			IP:  map[string][]net.IP{},
+		}
+		greylist := &memoryGreylist{
+			Triplets: map[string]*models.Triplet{},
+		}
+
+		m := newSender(resolver, "", nil)
+		m.Greylist = greylist
+		m.Options.PolicyHELO = true
+		m.Options.PolicyRDNS = true
+		m.Options.PolicyDNSBL = true
+		m.Options.DNSBLZones = []string{"bl.example.org"}
+		m.Options.PolicyGreylist = true
+		m.Options.GreylistDelay = 300
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer listener.Close()
+		go (&smtpd.Server{
+			SenderChain: []smtpd.Sender{
+				m,
+			},
+			RecipientChain: []smtpd.Recipient{
+				smtpd.RecipientFunc(m.HandleGreylist),
+			},
+		}).Serve(listener)
+
+		// Runs a transaction until the first rejection
+		send := func(helo string, to string) int {
+			c, err := smtp.Dial(listener.Addr().String())
+			So(err, ShouldBeNil)
+			defer c.Close()
+
+			if err := c.Hello(helo); err != nil {
+				return replyCode(err)
+			}
+			if err := c.Mail("sender@example.com"); err != nil {
+				return replyCode(err)
+			}
+			return replyCode(c.Rcpt(to))
+		}
+
+		// Valid reverse DNS of the test client
+		resolver.PTR["127.0.0.1"] = []string{"mail.example.com."}
+		resolver.IP["mail.example.com"] = []net.IP{net.ParseIP("127.0.0.1")}
+
+		Convey("Invalid HELO names should be rejected", func() {
+			So(send("localhost", "a@pgp.st"), ShouldEqual, 504)
+			So(send("127.0.0.1", "a@pgp.st"), ShouldEqual, 504)
+			So(send("[127.0.0.2]", "a@pgp.st"), ShouldEqual, 550)
+			So(send("pgp.st", "a@pgp.st"), ShouldEqual, 550)
+		})
+
+		Convey("Clients without a matching reverse DNS should be rejected", func() {
+			delete(resolver.PTR, "127.0.0.1")
+			So(send("mail.example.com", "a@pgp.st"), ShouldEqual, 550)
+
+			resolver.PTR["127.0.0.1"] = []string{"mail.example.net."}
+			So(send("mail.example.com", "a@pgp.st"), ShouldEqual, 550)
+		})
+
+		Convey("Clients listed in a DNSBL should be rejected", func() {
+			resolver.IP["1.0.0.127.bl.example.org"] = []net.IP{net.ParseIP("127.0.0.2")}
+			So(send("mail.example.com", "a@pgp.st"), ShouldEqual, 554)
+		})
+
+		Convey("Error codes of a DNSBL shouldn't count as listings", func() {
+			resolver.IP["1.0.0.127.bl.example.org"] = []net.IP{net.ParseIP("127.255.255.254")}
+			So(send("mail.example.com", "a@pgp.st"), ShouldEqual, 451)
+		})
+
+		Convey("New triplets should be greylisted until the delay passes", func() {
+			So(send("[127.0.0.1]", "a@pgp.st"), ShouldEqual, 451)
+			So(send("mail.example.com", "a@pgp.st"), ShouldEqual, 451)
+			So(len(greylist.Triplets), ShouldEqual, 1)
+
+			for _, triplet := range greylist.Triplets {
+				So(triplet.Network, ShouldEqual, "127.0.0.0")
+				So(triplet.Recipient, ShouldEqual, "a@pgp.st")
+				triplet.DateCreated = triplet.DateCreated.Add(-10 * time.Minute)
+			}
+
+			So(send("mail.example.com", "a@pgp.st"), ShouldEqual, 250)
+			So(send("mail.example.com", "a@pgp.st"), ShouldEqual, 250)
+			So(send("mail.example.com", "b@pgp.st"), ShouldEqual, 451)
+		})
+
+		Convey("Disabled policies should not be checked", func() {
+			m.Options.PolicyHELO = false
+			m.Options.PolicyRDNS = false
+			m.Options.PolicyGreylist = false
+			delete(resolver.PTR, "127.0.0.1")
+
+			So(send("localhost", "a@pgp.st"), ShouldEqual, 250)
+		})
+
+		Convey("LMTP clients should not be checked", func() {
+			lmtp, err := net.Listen("tcp", "127.0.0.1:0")
+			So(err, ShouldBeNil)
+			defer lmtp.Close()
+			go (&smtpd.Server{
+				SenderChain: []smtpd.Sender{
+					m,
+				},
+				RecipientChain: []smtpd.Recipient{
+					smtpd.RecipientFunc(m.HandleGreylist),
+				},
+				LMTP: true,
+			}).Serve(lmtp)
+
+			delete(resolver.PTR, "127.0.0.1")
+
+			conn, err := textproto.Dial("tcp", lmtp.Addr().String())
+			So(err, ShouldBeNil)
+			defer conn.Close()
+
+			_, _, err = conn.ReadResponse(220)
+			So(err, ShouldBeNil)
+			for _, line := range []string{"LHLO localhost", "MAIL FROM:<sender@example.com>", "RCPT TO:<a@pgp.st>"} {
+				_, err := conn.Cmd("%s", line)
+				So(err, ShouldBeNil)
+				_, _, err = conn.ReadResponse(250)
+				So(err, ShouldBeNil)
+			}
+			So(len(greylist.Triplets), ShouldEqual, 0)
+		})
+	})
+}
+
+func TestForwardingAddresses(t *testing.T) {
+	Convey("Given a mailer rewriting the senders of forwarded emails", t, func() {
+		m := newSender(&fakeResolver{}, "", nil)
+		m.SRS = &srs.SRS{
+			Secret: []byte("secret"),
+			Domain: "pgp.st",
+		}
+		address, err := m.SRS.Forward("alice@example.org")
+		So(err, ShouldBeNil)
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer listener.Close()
+		go (&smtpd.Server{
+			RecipientChain: []smtpd.Recipient{
+				m,
+			},
+		}).Serve(listener)
+
+		send := func(from string) int {
+			c, err := smtp.Dial(listener.Addr().String())
+			So(err, ShouldBeNil)
+			defer c.Close()
+
+			So(c.Hello("mail.example.com"), ShouldBeNil)
+			So(c.Mail(from), ShouldBeNil)
+			return replyCode(c.Rcpt(address))
+		}
+
+		Convey("Bounces should be accepted", func() {
+			So(send(""), ShouldEqual, 250)
+		})
+
+		Convey("Other emails shouldn't be relayed", func() {
+			So(send("spammer@example.com"), ShouldEqual, 550)
+		})
+	})
+}
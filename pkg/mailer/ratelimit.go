@@ -0,0 +1,79 @@
+package mailer
+
+import (
+	"time"
+
+	r "github.com/pgpst/pgpst/internal/github.com/dancannon/gorethink"
+	"github.com/pgpst/pgpst/internal/github.com/pgpst/smtpd"
+)
+
+// rateLimits converts the options into the limits of the SMTP servers.
+func (m *Mailer) rateLimits() smtpd.RateLimits {
+	return smtpd.RateLimits{
+		Connections: smtpd.RateLimit{
+			IP:      m.Options.RateConnectionsIP,
+			Network: m.Options.RateConnectionsNetwork,
+		},
+		Messages: smtpd.RateLimit{
+			IP:      m.Options.RateMessagesIP,
+			Network: m.Options.RateMessagesNetwork,
+		},
+		Recipients: smtpd.RateLimit{
+			IP:      m.Options.RateRecipientsIP,
+			Network: m.Options.RateRecipientsNetwork,
+		},
+	}
+}
+
+// rethinkRateStore shares the token buckets between the mailer instances.
+type rethinkRateStore struct {
+	session *r.Session
+}
+
+func (s *rethinkRateStore) Take(key string, n int, capacity int, period time.Duration) (bool, error) {
+	rate := float64(capacity) / period.Seconds()
+
+	result, err := r.Table("rate_limits").Get(key).Replace(func(old r.Term) r.Term {
+		// Refill the bucket with the tokens since the last update
+		level := r.Branch(
+			old.Eq(nil),
+			capacity,
+			old.Field("tokens").Add(r.Now().Sub(old.Field("date_modified")).Mul(rate)),
+		)
+
+		return level.Do(func(level r.Term) r.Term {
+			level = r.Branch(level.Gt(capacity), capacity, level)
+			return r.Branch(
+				level.Ge(n),
+				map[string]interface{}{
+					"id":            key,
+					"date_modified": r.Now(),
+					"tokens":        r.Branch(level.Sub(n).Gt(capacity), capacity, level.Sub(n)),
+					"taken":         true,
+				},
+				map[string]interface{}{
+					"id":            key,
+					"date_modified": r.Now(),
+					"tokens":        level,
+					"taken":         false,
+				},
+			)
+		})
+	}, r.ReplaceOpts{
+		ReturnChanges: true,
+	}).RunWrite(s.session)
+	if err != nil {
+		return false, err
+	}
+
+	if len(result.Changes) == 0 {
+		return true, nil
+	}
+	bucket, ok := result.Changes[0].NewValue.(map[string]interface{})
+	if !ok {
+		return true, nil
+	}
+	taken, _ := bucket["taken"].(bool)
+
+	return taken, nil
+}
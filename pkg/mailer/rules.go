@@ -0,0 +1,178 @@
+package mailer
+
+import (
+	"encoding/json"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/pgpst/pgpst/internal/github.com/Sirupsen/logrus"
+	r "github.com/pgpst/pgpst/internal/github.com/dancannon/gorethink"
+	"github.com/pgpst/pgpst/internal/github.com/dchest/uniuri"
+
+	"github.com/pgpst/pgpst/pkg/forwarding"
+	"github.com/pgpst/pgpst/pkg/models"
+	"github.com/pgpst/pgpst/pkg/sieve"
+)
+
+func contains(list []string, value string) bool {
+	for _, x := range list {
+		if x == value {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupRules returns the parsed rules of the account, nil if it has none.
+func (m *Mailer) lookupRules(account string) (*sieve.Script, error) {
+	cursor, err := r.Table("rules").Get(account).Default(map[string]interface{}{}).Run(m.Rethink)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+	var rules models.Rules
+	if err := cursor.One(&rules); err != nil {
+		return nil, err
+	}
+	if rules.Script == "" {
+		return nil, nil
+	}
+
+	return sieve.Parse(rules.Script)
+}
+
+// applyRules evaluates the rules of the recipient's account. It returns the
+// IDs of the labels the email should be stored in, none if it got discarded,
+// and the addresses it should be redirected to.
+func (m *Mailer) applyRules(entry *SpoolEntry, spooled *SpoolRecipient, recipient *recipient, desc *description, data []byte) ([]string, []string, error) {
+	result := &sieve.Result{
+		Keep: true,
+	}
+
+	script, err := m.lookupRules(recipient.Account.ID)
+	if err != nil {
+		if _, ok := err.(*sieve.Error); !ok {
+			return nil, nil, err
+		}
+
+		// Scripts are validated when uploaded, so keep the email if it still fails
+		m.Log.WithField("account", recipient.Account.ID).Warn("Unable to parse the rules of an account")
+	}
+	if script != nil {
+		// The verdict of spamd replaces the header set by the sender
+		header := map[string][]string{}
+		for key, values := range desc.Headers {
+			header[key] = values
+		}
+		header[textproto.CanonicalMIMEHeaderKey("X-Spam-Flag")] = []string{"NO"}
+		if entry.Spam {
+			header[textproto.CanonicalMIMEHeaderKey("X-Spam-Flag")] = []string{"YES"}
+		}
+
+		// Sub-addresses can be matched with the subaddress extension
+		address := spooled.Address
+		if spooled.Tag != "" {
+			at := strings.LastIndex(address, "@")
+			address = address[:at] + "+" + spooled.Tag + address[at:]
+		}
+
+		result = script.Evaluate(&sieve.Message{
+			Header:    header,
+			Sender:    entry.Sender,
+			Recipient: address,
+			Size:      len(data),
+		})
+	}
+
+	var labels []string
+	if result.Keep {
+		labels = append(labels, recipient.Labels.Inbox)
+	}
+	for _, name := range result.FileInto {
+		id, err := m.resolveLabel(recipient.Account.ID, name)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !contains(labels, id) {
+			labels = append(labels, id)
+		}
+	}
+	if len(labels) > 0 && entry.Spam && !contains(labels, recipient.Labels.Spam) {
+		labels = append(labels, recipient.Labels.Spam)
+	}
+
+	return labels, result.Redirect, nil
+}
+
+// resolveLabel returns the ID of the account's label with that name,
+// creating it if it doesn't exist yet.
+func (m *Mailer) resolveLabel(owner string, name string) (string, error) {
+	cursor, err := r.Table("labels").GetAllByIndex("nameOwnerSystem", []interface{}{
+		name,
+		owner,
+		true,
+	}, []interface{}{
+		name,
+		owner,
+		false,
+	}).CoerceTo("array").Run(m.Rethink)
+	if err != nil {
+		return "", err
+	}
+	defer cursor.Close()
+	var labels []*models.Label
+	if err := cursor.All(&labels); err != nil {
+		return "", err
+	}
+	if len(labels) > 0 {
+		return labels[0].ID, nil
+	}
+
+	label := &models.Label{
+		ID:           uniuri.NewLen(uniuri.UUIDLen),
+		DateCreated:  time.Now(),
+		DateModified: time.Now(),
+		Owner:        owner,
+		Name:         name,
+	}
+	if err := r.Table("labels").Insert(label).Exec(m.Rethink); err != nil {
+		return "", err
+	}
+
+	return label.ID, nil
+}
+
+// redirectEmail queues the email for the delivery to the address. Like the
+// forwarded emails, it records the hop and gets a rewritten sender, so that
+// the loops are stopped and the SPF checks of the target pass.
+func (m *Mailer) redirectEmail(entry *SpoolEntry, recipient *recipient, desc *description, to string, data []byte) error {
+	if err := forwarding.Check(desc.Node.Headers, recipient.Address.ID); err != nil {
+		m.Log.WithFields(logrus.Fields{
+			"ctx_id":  entry.ID,
+			"address": recipient.Address.ID,
+			"reason":  err.Error(),
+		}).Warn("Not redirecting an email")
+		return nil
+	}
+
+	sender, err := m.SRS.Forward(entry.Sender)
+	if err != nil {
+		m.Log.WithFields(logrus.Fields{
+			"ctx_id": entry.ID,
+			"sender": entry.Sender,
+		}).Warn("Redirecting an email with an invalid sender as a bounce")
+		sender = ""
+	}
+
+	body, err := json.Marshal(&models.OutgoingEmail{
+		From: sender,
+		To:   []string{to},
+		Body: append([]byte(forwarding.HopHeader+": <"+recipient.Address.ID+">\r\n"), data...),
+	})
+	if err != nil {
+		return err
+	}
+
+	return m.Producer.Publish("send_email", body)
+}
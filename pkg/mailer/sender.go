@@ -0,0 +1,333 @@
+package mailer
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pgpst/pgpst/internal/github.com/Sirupsen/logrus"
+	"github.com/pgpst/pgpst/internal/github.com/bitly/go-nsq"
+	r "github.com/pgpst/pgpst/internal/github.com/dancannon/gorethink"
+
+	"github.com/pgpst/pgpst/pkg/models"
+)
+
+// Amount of times a message with temporarily failing recipients is retried
+// before they are marked as failed.
+const sendAttempts = 10
+
+// HandleMessage processes messages from the send_email topic.
+func (m *Mailer) HandleMessage(msg *nsq.Message) error {
+	var email models.OutgoingEmail
+	if err := json.Unmarshal(msg.Body, &email); err != nil {
+		// Retrying won't fix it, so just drop the message
+		m.Log.WithField("err", err).Error("Unable to decode an outgoing email")
+		return nil
+	}
+
+	// Load the results of the previous attempts
+	deliveries := map[string]*models.Delivery{}
+	if email.ID != "" {
+		cursor, err := r.Table("emails").Get(email.ID).Field("deliveries").Default([]interface{}{}).Run(m.Rethink)
+		if err != nil {
+			return err
+		}
+		defer cursor.Close()
+		var previous []*models.Delivery
+		if err := cursor.All(&previous); err != nil {
+			return err
+		}
+		for _, delivery := range previous {
+			deliveries[delivery.Address] = delivery
+		}
+	}
+
+	// Only send to the recipients that weren't handled yet
+	pending := []string{}
+	for _, to := range email.To {
+		if delivery, ok := deliveries[to]; ok && delivery.Status != "sending" {
+			continue
+		}
+		pending = append(pending, to)
+	}
+
+	// Without an emails row we can't remember who already got the message,
+	// so we can't retry a partial delivery.
+	final := email.ID == "" || msg.Attempts >= sendAttempts
+
+	// Recipients with their own copies are delivered separately
+	var (
+		shared  = []string{}
+		results = []*models.Delivery{}
+	)
+	for _, to := range pending {
+		body, ok := email.Copies[to]
+		if !ok {
+			shared = append(shared, to)
+			continue
+		}
+		results = append(results, m.Deliver(email.From, []string{to}, m.signOutgoing(&models.OutgoingEmail{
+			Body: body,
+			Sign: email.Sign,
+		}))...)
+	}
+	if len(shared) > 0 {
+		results = append(results, m.Deliver(email.From, shared, m.signOutgoing(&email))...)
+	}
+
+	for _, delivery := range results {
+		if delivery.Status == "sending" && final {
+			delivery.Status = "failed"
+		}
+		deliveries[delivery.Address] = delivery
+	}
+
+	// Calculate the status of the whole email
+	status := "sent"
+	list := []*models.Delivery{}
+	for _, to := range email.To {
+		delivery := deliveries[to]
+		if delivery.Status == "sending" {
+			status = "sending"
+		} else if delivery.Status == "failed" && status == "sent" {
+			status = "failed"
+		}
+		list = append(list, delivery)
+	}
+
+	if email.ID != "" {
+		if err := r.Table("emails").Get(email.ID).Update(map[string]interface{}{
+			"date_modified": time.Now(),
+			"status":        status,
+			"deliveries":    list,
+		}).Exec(m.Rethink); err != nil {
+			return err
+		}
+	}
+
+	m.Log.WithFields(logrus.Fields{
+		"id":       email.ID,
+		"from":     email.From,
+		"attempts": msg.Attempts,
+		"status":   status,
+	}).Info("Email processed")
+
+	// Returning an error makes NSQ requeue the message with a backoff
+	if status == "sending" {
+		return errors.New("Some of the recipients failed temporarily")
+	}
+
+	return nil
+}
+
+// Deliver sends the body to the recipients using the MX servers of their
+// domains, falling back to the relay. It returns a delivery for each of the
+// recipients, with status "sending" if the failure was temporary.
+func (m *Mailer) Deliver(from string, to []string, body []byte) []*models.Delivery {
+	// Group the recipients by their domains
+	var (
+		domains = map[string][]string{}
+		order   = []string{}
+	)
+	for _, address := range to {
+		domain := strings.ToLower(address[strings.LastIndex(address, "@")+1:])
+		if _, ok := domains[domain]; !ok {
+			order = append(order, domain)
+		}
+		domains[domain] = append(domains[domain], address)
+	}
+
+	result := []*models.Delivery{}
+	for _, domain := range order {
+		result = append(result, m.deliverDomain(from, domain, domains[domain], body)...)
+	}
+
+	return result
+}
+
+type byPref []*net.MX
+
+func (b byPref) Len() int           { return len(b) }
+func (b byPref) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byPref) Less(i, j int) bool { return b[i].Pref < b[j].Pref }
+
+func (m *Mailer) deliverDomain(from string, domain string, to []string, body []byte) []*models.Delivery {
+	// Prepare the results, all of them are pending at the start
+	results := map[string]*models.Delivery{}
+	for _, address := range to {
+		results[address] = &models.Delivery{
+			Address:      address,
+			Status:       "sending",
+			Message:      "No server accepted the connection",
+			DateModified: time.Now(),
+		}
+	}
+
+	// Resolve the MX servers of the domain
+	hosts := []string{}
+	records, err := m.Resolver.LookupMX(domain)
+	if err != nil {
+		m.Log.WithFields(logrus.Fields{
+			"domain": domain,
+			"err":    err,
+		}).Warn("Unable to resolve MX records")
+	} else if len(records) == 1 && records[0].Host == "." {
+		// Null MX, as in RFC 7505
+		for _, result := range results {
+			result.Status = "failed"
+			result.Code = 556
+			result.Message = "Domain does not accept mail"
+		}
+		return deliveryList(to, results)
+	}
+	sort.Sort(byPref(records))
+	for _, record := range records {
+		hosts = append(hosts, net.JoinHostPort(strings.TrimSuffix(record.Host, "."), "25"))
+	}
+	if err == nil && len(records) == 0 {
+		// Implicit MX, as in RFC 5321, section 5.1
+		hosts = append(hosts, net.JoinHostPort(domain, "25"))
+	}
+	if m.Options.SMTPDAddress != "" {
+		hosts = append(hosts, m.Options.SMTPDAddress)
+	}
+
+	// Try the hosts in order until every recipient is handled
+	pending := to
+	for _, host := range hosts {
+		if len(pending) == 0 {
+			break
+		}
+
+		if err := m.sendTo(host, from, pending, body, results); err != nil {
+			m.Log.WithFields(logrus.Fields{
+				"host": host,
+				"err":  err,
+			}).Warn("Unable to deliver an email")
+		}
+
+		next := []string{}
+		for _, address := range pending {
+			if results[address].Status == "sending" {
+				next = append(next, address)
+			}
+		}
+		pending = next
+	}
+
+	return deliveryList(to, results)
+}
+
+func deliveryList(to []string, results map[string]*models.Delivery) []*models.Delivery {
+	list := []*models.Delivery{}
+	for _, address := range to {
+		list = append(list, results[address])
+	}
+	return list
+}
+
+func (m *Mailer) sendTo(addr string, from string, to []string, body []byte, results map[string]*models.Delivery) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+
+	// Any error before the recipients are sent applies to all of them
+	fail := func(err error) error {
+		for _, address := range to {
+			setDeliveryError(results[address], host, err)
+		}
+		return err
+	}
+
+	conn, err := m.Dial("tcp", addr)
+	if err != nil {
+		return fail(err)
+	}
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return fail(err)
+	}
+	defer client.Close()
+
+	if err := client.Hello(m.Options.Hostname); err != nil {
+		return fail(err)
+	}
+
+	// Encryption is opportunistic, as most of the MX servers use certificates
+	// that wouldn't pass the verification anyways.
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{
+			ServerName:         host,
+			InsecureSkipVerify: true,
+		}); err != nil {
+			return fail(err)
+		}
+	}
+
+	if err := client.Mail(from); err != nil {
+		return fail(err)
+	}
+
+	accepted := []string{}
+	for _, address := range to {
+		if err := client.Rcpt(address); err != nil {
+			setDeliveryError(results[address], host, err)
+			continue
+		}
+		accepted = append(accepted, address)
+	}
+	if len(accepted) == 0 {
+		client.Quit()
+		return nil
+	}
+
+	// Send the body and check the final reply
+	to = accepted
+	wc, err := client.Data()
+	if err != nil {
+		return fail(err)
+	}
+	if _, err := wc.Write(body); err != nil {
+		return fail(err)
+	}
+	if err := wc.Close(); err != nil {
+		return fail(err)
+	}
+
+	for _, address := range accepted {
+		result := results[address]
+		result.Status = "sent"
+		result.Host = host
+		result.Code = 250
+		result.Message = ""
+		result.DateModified = time.Now()
+	}
+
+	client.Quit()
+	return nil
+}
+
+func setDeliveryError(delivery *models.Delivery, host string, err error) {
+	delivery.Host = host
+	delivery.DateModified = time.Now()
+	delivery.Code = 0
+	delivery.Message = err.Error()
+
+	if te, ok := err.(*textproto.Error); ok {
+		delivery.Code = te.Code
+		delivery.Message = te.Msg
+
+		// 5xx replies are permanent
+		if te.Code >= 500 {
+			delivery.Status = "failed"
+		}
+	}
+}
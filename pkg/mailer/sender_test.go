@@ -0,0 +1,240 @@
+package mailer_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/pgpst/pgpst/internal/github.com/Sirupsen/logrus"
+	"github.com/pgpst/pgpst/internal/github.com/bitly/go-nsq"
+	"github.com/pgpst/pgpst/internal/github.com/pgpst/smtpd"
+	. "github.com/pgpst/pgpst/internal/github.com/smartystreets/goconvey/convey"
+
+	"github.com/pgpst/pgpst/pkg/mailer"
+	"github.com/pgpst/pgpst/pkg/models"
+)
+
+type fakeResolver struct {
+	MX  map[string][]*net.MX
+	TXT map[string][]string
+	IP  map[string][]net.IP
+	PTR map[string][]string
+}
+
+func (f *fakeResolver) LookupMX(name string) ([]*net.MX, error) {
+	if x, ok := f.MX[name]; ok {
+		return x, nil
+	}
+	return nil, errors.New("no such host")
+}
+
+func (f *fakeResolver) LookupTXT(name string) ([]string, error) {
+	if x, ok := f.TXT[name]; ok {
+		return x, nil
+	}
+	return nil, errors.New("no such host")
+}
+
+func (f *fakeResolver) LookupIP(host string) ([]net.IP, error) {
+	if x, ok := f.IP[host]; ok {
+		return x, nil
+	}
+	return nil, errors.New("no such host")
+}
+
+func (f *fakeResolver) LookupAddr(addr string) ([]string, error) {
+	if x, ok := f.PTR[addr]; ok {
+		return x, nil
+	}
+	return nil, errors.New("no such host")
+}
+
+type sink struct {
+	Addr      string
+	Envelopes []*smtpd.Envelope
+
+	listener net.Listener
+}
+
+// Starts a local SMTP server that rejects recipients in the reject map.
+func newSink(reject map[string]int) *sink {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+
+	s := &sink{
+		Addr:     listener.Addr().String(),
+		listener: listener,
+	}
+
+	server := &smtpd.Server{
+		RecipientChain: []smtpd.Recipient{
+			smtpd.RecipientFunc(func(next func(conn *smtpd.Connection)) func(conn *smtpd.Connection) {
+				return func(conn *smtpd.Connection) {
+					to := conn.Envelope.Recipients[len(conn.Envelope.Recipients)-1]
+					if code, ok := reject[to]; ok {
+						conn.Error(smtpd.Error{Code: code, Message: "Rejected"})
+						return
+					}
+					next(conn)
+				}
+			}),
+		},
+		DeliveryChain: []smtpd.Delivery{
+			smtpd.DeliveryFunc(func(next func(conn *smtpd.Connection)) func(conn *smtpd.Connection) {
+				return func(conn *smtpd.Connection) {
+					s.Envelopes = append(s.Envelopes, conn.Envelope)
+					next(conn)
+				}
+			}),
+		},
+	}
+	go server.Serve(listener)
+
+	return s
+}
+
+func (s *sink) Close() {
+	s.listener.Close()
+}
+
+func newSender(resolver *fakeResolver, relay string, hosts map[string]string) *mailer.Mailer {
+	log := logrus.New()
+	log.Level = logrus.PanicLevel
+
+	return &mailer.Mailer{
+		Options: &mailer.Options{
+			Hostname:     "pgp.st",
+			SMTPDAddress: relay,
+		},
+		Log:      log,
+		Resolver: resolver,
+		Dial: func(network, address string) (net.Conn, error) {
+			if target, ok := hosts[address]; ok {
+				return net.Dial(network, target)
+			}
+			return nil, errors.New("connection refused")
+		},
+	}
+}
+
+func TestDeliver(t *testing.T) {
+	Convey("Given a sender with a fake resolver and two SMTP sinks", t, func() {
+		mx := newSink(map[string]int{
+			"gone@example.org": 550,
+			"busy@example.org": 450,
+		})
+		defer mx.Close()
+
+		relay := newSink(nil)
+		defer relay.Close()
+
+		resolver := &fakeResolver{
+			MX: map[string][]*net.MX{
+				"example.org": {
+					{Host: "mx2.example.org.", Pref: 20},
+					{Host: "mx1.example.org.", Pref: 10},
+				},
+				"example.net": {},
+				"nomail.org": {
+					{Host: ".", Pref: 0},
+				},
+			},
+		}
+		sender := newSender(resolver, "relay:2525", map[string]string{
+			"mx1.example.org:25": mx.Addr,
+			"relay:2525":         relay.Addr,
+		})
+
+		body := []byte("Subject: Hello\r\n\r\nHello world\r\n")
+
+		Convey("Mail should go to the most preferred reachable MX", func() {
+			result := sender.Deliver("test@pgp.st", []string{
+				"a@example.org",
+				"b@example.org",
+			}, body)
+
+			So(len(result), ShouldEqual, 2)
+			So(result[0].Status, ShouldEqual, "sent")
+			So(result[0].Host, ShouldEqual, "mx1.example.org")
+			So(result[1].Status, ShouldEqual, "sent")
+			So(len(mx.Envelopes), ShouldEqual, 1)
+			So(mx.Envelopes[0].Sender, ShouldEqual, "test@pgp.st")
+			So(mx.Envelopes[0].Recipients, ShouldResemble, []string{"a@example.org", "b@example.org"})
+			So(len(relay.Envelopes), ShouldEqual, 0)
+		})
+
+		Convey("Permanent and temporary rejections should be reported per recipient", func() {
+			result := sender.Deliver("test@pgp.st", []string{
+				"a@example.org",
+				"gone@example.org",
+				"busy@example.org",
+			}, body)
+
+			So(len(result), ShouldEqual, 3)
+			So(result[0].Status, ShouldEqual, "sent")
+			So(result[1].Status, ShouldEqual, "failed")
+			So(result[1].Code, ShouldEqual, 550)
+
+			// The temporary failure gets retried through the relay
+			So(result[2].Status, ShouldEqual, "sent")
+			So(result[2].Host, ShouldEqual, "relay")
+			So(len(relay.Envelopes), ShouldEqual, 1)
+			So(relay.Envelopes[0].Recipients, ShouldResemble, []string{"busy@example.org"})
+		})
+
+		Convey("Unreachable domains should fall back to the relay", func() {
+			result := sender.Deliver("test@pgp.st", []string{
+				"c@example.net",
+				"d@unknown.com",
+			}, body)
+
+			So(len(result), ShouldEqual, 2)
+			So(result[0].Status, ShouldEqual, "sent")
+			So(result[1].Status, ShouldEqual, "sent")
+			So(len(relay.Envelopes), ShouldEqual, 2)
+		})
+
+		Convey("Null MX domains should fail permanently", func() {
+			result := sender.Deliver("test@pgp.st", []string{
+				"e@nomail.org",
+			}, body)
+
+			So(len(result), ShouldEqual, 1)
+			So(result[0].Status, ShouldEqual, "failed")
+			So(len(relay.Envelopes), ShouldEqual, 0)
+		})
+
+		Convey("Without any reachable server recipients should stay pending", func() {
+			sender.Options.SMTPDAddress = ""
+
+			result := sender.Deliver("test@pgp.st", []string{
+				"f@unknown.com",
+			}, body)
+
+			So(len(result), ShouldEqual, 1)
+			So(result[0].Status, ShouldEqual, "sending")
+		})
+
+		Convey("Recipients with their own copies should get them separately", func() {
+			data, err := json.Marshal(&models.OutgoingEmail{
+				From: "test@pgp.st",
+				To:   []string{"a@example.org", "b@example.org", "hidden@example.org"},
+				Body: body,
+				Copies: map[string][]byte{
+					"hidden@example.org": []byte("Subject: Hello\r\n\r\nHidden copy\r\n"),
+				},
+			})
+			So(err, ShouldBeNil)
+
+			So(sender.HandleMessage(nsq.NewMessage(nsq.MessageID{}, data)), ShouldBeNil)
+			So(len(mx.Envelopes), ShouldEqual, 2)
+			So(mx.Envelopes[0].Recipients, ShouldResemble, []string{"hidden@example.org"})
+			So(string(mx.Envelopes[0].Data), ShouldContainSubstring, "Hidden copy")
+			So(mx.Envelopes[1].Recipients, ShouldResemble, []string{"a@example.org", "b@example.org"})
+			So(string(mx.Envelopes[1].Data), ShouldContainSubstring, "Hello world")
+		})
+	})
+}
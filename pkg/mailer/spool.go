@@ -0,0 +1,312 @@
+package mailer
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pgpst/pgpst/internal/github.com/Sirupsen/logrus"
+	"github.com/pgpst/pgpst/internal/github.com/cenkalti/backoff"
+
+	"github.com/pgpst/pgpst/pkg/models"
+)
+
+// Every spooled envelope is stored as two files, the message and its
+// metadata. The metadata is written last, so entries without it were never
+// accepted and can be removed.
+const (
+	spoolDataExt = ".eml"
+	spoolMetaExt = ".json"
+)
+
+// SpoolEntry describes an accepted message that is waiting for storage.
+type SpoolEntry struct {
+	ID             string                 `json:"id"`
+	DateCreated    time.Time              `json:"date_created"`
+	Sender         string                 `json:"sender"`
+	Recipients     []*SpoolRecipient      `json:"recipients"`
+	Spam           bool                   `json:"spam"`
+	Authentication *models.Authentication `json:"authentication,omitempty"`
+}
+
+// SpoolRecipient tracks the storage of a message for a single recipient,
+// an account receiving the message on one of its addresses.
+// IDs are generated when the message is accepted, so that retries overwrite
+// partially stored copies instead of duplicating them. Copies sent to other
+// servers can't be overwritten, so they're recorded once they're queued and
+// skipped by the retries. The size of the stored copy is recorded too, so that
+// it's added to the storage usage exactly once.
+type SpoolRecipient struct {
+	Address    string   `json:"address"`
+	Account    string   `json:"account,omitempty"`
+	Tag        string   `json:"tag,omitempty"`
+	EmailID    string   `json:"email_id"`
+	ThreadID   string   `json:"thread_id"`
+	Stored     bool     `json:"stored,omitempty"`
+	Size       int64    `json:"size,omitempty"`
+	Counted    bool     `json:"counted,omitempty"`
+	Forwarded  bool     `json:"forwarded,omitempty"`
+	Redirected []string `json:"redirected,omitempty"`
+	Replied    bool     `json:"replied,omitempty"`
+	Committed  bool     `json:"committed"`
+}
+
+// redirected returns whether the message was already redirected to address.
+func (s *SpoolRecipient) redirected(address string) bool {
+	for _, x := range s.Redirected {
+		if x == address {
+			return true
+		}
+	}
+	return false
+}
+
+// PermanentError is returned by the delivery function when retrying the
+// storage of a recipient's copy would not help.
+type PermanentError struct {
+	Err error
+}
+
+func (p PermanentError) Error() string {
+	return p.Err.Error()
+}
+
+// Spool keeps the accepted messages on disk until they are stored. Bounce,
+// if set, notifies the sender of the recipients that are dropped.
+type Spool struct {
+	Dir     string
+	Log     *logrus.Logger
+	Deliver func(entry *SpoolEntry, recipient *SpoolRecipient, data []byte) error
+	Bounce  func(entry *SpoolEntry, recipient *SpoolRecipient, data []byte) error
+	BackOff func() backoff.BackOff
+
+	lock    sync.Mutex
+	running bool
+	active  map[string]struct{}
+}
+
+// NewSpool prepares the spool directory.
+func NewSpool(dir string, log *logrus.Logger, deliver func(*SpoolEntry, *SpoolRecipient, []byte) error) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	return &Spool{
+		Dir:     dir,
+		Log:     log,
+		Deliver: deliver,
+		BackOff: func() backoff.BackOff {
+			b := backoff.NewExponentialBackOff()
+			b.MaxElapsedTime = 0
+			return b
+		},
+		active: map[string]struct{}{},
+	}, nil
+}
+
+// Add durably writes the message to the spool. Once it returns the message
+// can be acknowledged to the client.
+func (s *Spool) Add(entry *SpoolEntry, data []byte) error {
+	if err := s.writeFile(entry.ID+spoolDataExt, data); err != nil {
+		return err
+	}
+	if err := s.writeMeta(entry); err != nil {
+		os.Remove(filepath.Join(s.Dir, entry.ID+spoolDataExt))
+		return err
+	}
+
+	s.lock.Lock()
+	running := s.running
+	s.lock.Unlock()
+	if running {
+		go s.process(entry.ID)
+	}
+
+	return nil
+}
+
+// Start processes the entries left over from the previous runs and every
+// entry added afterwards.
+func (s *Spool) Start() error {
+	s.lock.Lock()
+	s.running = true
+	s.lock.Unlock()
+
+	files, err := ioutil.ReadDir(s.Dir)
+	if err != nil {
+		return err
+	}
+
+	meta := map[string]struct{}{}
+	for _, file := range files {
+		if id := strings.TrimSuffix(file.Name(), spoolMetaExt); id != file.Name() {
+			meta[id] = struct{}{}
+		}
+	}
+
+	for _, file := range files {
+		name := file.Name()
+		switch {
+		case strings.HasSuffix(name, spoolDataExt):
+			// Messages without metadata were never acknowledged
+			if _, ok := meta[strings.TrimSuffix(name, spoolDataExt)]; !ok {
+				os.Remove(filepath.Join(s.Dir, name))
+			}
+		case strings.HasSuffix(name, spoolMetaExt):
+			s.Log.WithField("id", strings.TrimSuffix(name, spoolMetaExt)).Info("Draining a spooled email")
+			go s.process(strings.TrimSuffix(name, spoolMetaExt))
+		case strings.HasPrefix(name, "."):
+			// Temporary files of interrupted writes
+			os.Remove(filepath.Join(s.Dir, name))
+		}
+	}
+
+	return nil
+}
+
+// Pending returns the IDs of the entries that are not fully stored yet.
+func (s *Spool) Pending() ([]string, error) {
+	files, err := ioutil.ReadDir(s.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []string{}
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), spoolMetaExt) && !strings.HasPrefix(file.Name(), ".") {
+			ids = append(ids, strings.TrimSuffix(file.Name(), spoolMetaExt))
+		}
+	}
+
+	return ids, nil
+}
+
+func (s *Spool) process(id string) {
+	// Entries might be picked up both by Add and Start
+	s.lock.Lock()
+	if _, ok := s.active[id]; ok {
+		s.lock.Unlock()
+		return
+	}
+	s.active[id] = struct{}{}
+	s.lock.Unlock()
+	defer func() {
+		s.lock.Lock()
+		delete(s.active, id)
+		s.lock.Unlock()
+	}()
+
+	log := s.Log.WithField("id", id)
+
+	meta, err := ioutil.ReadFile(filepath.Join(s.Dir, id+spoolMetaExt))
+	if err != nil {
+		log.WithField("err", err).Error("Unable to read a spool entry")
+		return
+	}
+	var entry SpoolEntry
+	if err := json.Unmarshal(meta, &entry); err != nil {
+		log.WithField("err", err).Error("Unable to parse a spool entry")
+		return
+	}
+	data, err := ioutil.ReadFile(filepath.Join(s.Dir, id+spoolDataExt))
+	if err != nil {
+		log.WithField("err", err).Error("Unable to read a spooled email")
+		return
+	}
+
+	// Retry until every recipient is committed
+	backoff.RetryNotify(func() error {
+		for _, recipient := range entry.Recipients {
+			if recipient.Committed {
+				continue
+			}
+
+			if err := s.Deliver(&entry, recipient, data); err != nil {
+				if _, ok := err.(PermanentError); !ok {
+					// Keep the side effects that succeeded before the failure
+					if werr := s.writeMeta(&entry); werr != nil {
+						log.WithField("err", werr).Error("Unable to update a spool entry")
+					}
+					return err
+				}
+
+				log.WithFields(logrus.Fields{
+					"address": recipient.Address,
+					"err":     err,
+				}).Error("Dropping a spooled email")
+
+				// Null senders don't get notified, bounces would loop
+				if entry.Sender != "" && s.Bounce != nil {
+					if err := s.Bounce(&entry, recipient, data); err != nil {
+						return err
+					}
+				}
+			}
+
+			recipient.Committed = true
+			if err := s.writeMeta(&entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, s.BackOff(), func(err error, wait time.Duration) {
+		log.WithFields(logrus.Fields{
+			"err":  err,
+			"wait": wait.String(),
+		}).Warn("Unable to store a spooled email, retrying")
+	})
+
+	// Metadata goes first, a message without it is treated as garbage
+	if err := os.Remove(filepath.Join(s.Dir, id+spoolMetaExt)); err != nil {
+		log.WithField("err", err).Error("Unable to remove a spool entry")
+		return
+	}
+	os.Remove(filepath.Join(s.Dir, id+spoolDataExt))
+}
+
+func (s *Spool) writeMeta(entry *SpoolEntry) error {
+	meta, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	return s.writeFile(entry.ID+spoolMetaExt, meta)
+}
+
+// writeFile atomically replaces the file, syncing both the file and the
+// directory before returning.
+func (s *Spool) writeFile(name string, data []byte) error {
+	file, err := ioutil.TempFile(s.Dir, ".")
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	if err := os.Rename(file.Name(), filepath.Join(s.Dir, name)); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	dir, err := os.Open(s.Dir)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
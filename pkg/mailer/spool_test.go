@@ -0,0 +1,170 @@
+package mailer_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pgpst/pgpst/internal/github.com/Sirupsen/logrus"
+	"github.com/pgpst/pgpst/internal/github.com/cenkalti/backoff"
+	. "github.com/pgpst/pgpst/internal/github.com/smartystreets/goconvey/convey"
+
+	"github.com/pgpst/pgpst/pkg/mailer"
+)
+
+// Waits until the spool is empty, returns false on timeout
+func drained(spool *mailer.Spool) bool {
+	for i := 0; i < 200; i++ {
+		ids, err := spool.Pending()
+		if err == nil && len(ids) == 0 {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestSpool(t *testing.T) {
+	Convey("Given a spool directory", t, func() {
+		dir, err := ioutil.TempDir("", "pgpst-spool")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		log := logrus.New()
+		log.Out = ioutil.Discard
+
+		var (
+			lock      sync.Mutex
+			attempts  = map[string]int{}
+			delivered = map[string][]byte{}
+			failures  = map[string]int{}
+			forwarded = map[string]int{}
+			bounced   = map[string][]string{}
+		)
+		deliver := func(entry *mailer.SpoolEntry, recipient *mailer.SpoolRecipient, data []byte) error {
+			lock.Lock()
+			defer lock.Unlock()
+
+			attempts[recipient.Address]++
+			if recipient.Address == "gone@pgp.st" {
+				return mailer.PermanentError{Err: errors.New("No such address")}
+			}
+			if recipient.Address == "forward@pgp.st" && !recipient.Forwarded {
+				forwarded[recipient.Address]++
+				recipient.Forwarded = true
+			}
+			if failures[recipient.Address] > 0 {
+				failures[recipient.Address]--
+				return errors.New("Database is down")
+			}
+			delivered[recipient.Address] = data
+			return nil
+		}
+		open := func() *mailer.Spool {
+			spool, err := mailer.NewSpool(dir, log, deliver)
+			So(err, ShouldBeNil)
+			spool.Bounce = func(entry *mailer.SpoolEntry, recipient *mailer.SpoolRecipient, data []byte) error {
+				lock.Lock()
+				defer lock.Unlock()
+
+				bounced[entry.ID] = append(bounced[entry.ID], recipient.Address)
+				return nil
+			}
+			spool.BackOff = func() backoff.BackOff {
+				return backoff.NewConstantBackOff(time.Millisecond)
+			}
+			return spool
+		}
+
+		entry := func(id string, recipients ...string) *mailer.SpoolEntry {
+			e := &mailer.SpoolEntry{
+				ID:          id,
+				DateCreated: time.Now(),
+			}
+			for _, address := range recipients {
+				e.Recipients = append(e.Recipients, &mailer.SpoolRecipient{
+					Address: address,
+				})
+			}
+			return e
+		}
+
+		Convey("Added emails should be retried until all recipients are stored", func() {
+			spool := open()
+			So(spool.Start(), ShouldBeNil)
+
+			failures["b@pgp.st"] = 3
+			So(spool.Add(entry("first", "a@pgp.st", "b@pgp.st"), []byte("body")), ShouldBeNil)
+			So(drained(spool), ShouldBeTrue)
+
+			lock.Lock()
+			defer lock.Unlock()
+			So(string(delivered["a@pgp.st"]), ShouldEqual, "body")
+			So(string(delivered["b@pgp.st"]), ShouldEqual, "body")
+			So(attempts["a@pgp.st"], ShouldEqual, 1)
+			So(attempts["b@pgp.st"], ShouldEqual, 4)
+
+			files, err := ioutil.ReadDir(dir)
+			So(err, ShouldBeNil)
+			So(len(files), ShouldEqual, 0)
+		})
+
+		Convey("Copies sent before a failure shouldn't be sent again", func() {
+			spool := open()
+			So(spool.Start(), ShouldBeNil)
+
+			failures["forward@pgp.st"] = 2
+			So(spool.Add(entry("fourth", "forward@pgp.st"), []byte("body")), ShouldBeNil)
+			So(drained(spool), ShouldBeTrue)
+
+			lock.Lock()
+			defer lock.Unlock()
+			So(attempts["forward@pgp.st"], ShouldEqual, 3)
+			So(forwarded["forward@pgp.st"], ShouldEqual, 1)
+		})
+
+		Convey("Senders should be notified of the dropped recipients", func() {
+			spool := open()
+			So(spool.Start(), ShouldBeNil)
+
+			notified := entry("fifth", "a@pgp.st", "gone@pgp.st")
+			notified.Sender = "alice@example.org"
+			So(spool.Add(notified, []byte("body")), ShouldBeNil)
+			So(spool.Add(entry("sixth", "gone@pgp.st"), []byte("body")), ShouldBeNil)
+			So(drained(spool), ShouldBeTrue)
+
+			lock.Lock()
+			defer lock.Unlock()
+			So(bounced["fifth"], ShouldResemble, []string{"gone@pgp.st"})
+			So(bounced["sixth"], ShouldBeEmpty)
+		})
+
+		Convey("Leftover emails should be drained on start", func() {
+			So(open().Add(entry("second", "a@pgp.st", "gone@pgp.st"), []byte("leftover")), ShouldBeNil)
+
+			// Message of an envelope that was never acknowledged
+			So(ioutil.WriteFile(filepath.Join(dir, "third.eml"), []byte("garbage"), 0600), ShouldBeNil)
+
+			ids, err := open().Pending()
+			So(err, ShouldBeNil)
+			So(ids, ShouldResemble, []string{"second"})
+
+			spool := open()
+			So(spool.Start(), ShouldBeNil)
+			So(drained(spool), ShouldBeTrue)
+
+			lock.Lock()
+			defer lock.Unlock()
+			So(string(delivered["a@pgp.st"]), ShouldEqual, "leftover")
+			So(attempts["gone@pgp.st"], ShouldEqual, 1)
+
+			files, err := ioutil.ReadDir(dir)
+			So(err, ShouldBeNil)
+			So(len(files), ShouldEqual, 0)
+		})
+	})
+}
@@ -0,0 +1,505 @@
+package mailer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/pgpst/pgpst/internal/github.com/Sirupsen/logrus"
+	r "github.com/pgpst/pgpst/internal/github.com/dancannon/gorethink"
+	"github.com/pgpst/pgpst/internal/github.com/dchest/uniuri"
+	"github.com/pgpst/pgpst/internal/github.com/pgpst/smtpd"
+	"github.com/pgpst/pgpst/internal/golang.org/x/crypto/openpgp"
+
+	"github.com/pgpst/pgpst/pkg/analysis"
+	"github.com/pgpst/pgpst/pkg/autocrypt"
+	"github.com/pgpst/pgpst/pkg/forwarding"
+	"github.com/pgpst/pgpst/pkg/models"
+	"github.com/pgpst/pgpst/pkg/quota"
+	"github.com/pgpst/pgpst/pkg/threading"
+	"github.com/pgpst/pgpst/pkg/utils"
+)
+
+var (
+	errSenderNotOwned = smtpd.Error{Code: 553, Message: "5.7.1 Sender address is not owned by the user"}
+	errNotConfigured  = smtpd.Error{Code: 550, Message: "5.7.1 Account is not configured"}
+	errSendLimit      = smtpd.Error{Code: 450, Message: "4.7.1 Daily sending limit of your plan exceeded"}
+)
+
+// Authenticate verifies the credentials of submission clients. The password
+// can be either the account's password or one of its auth tokens.
+func (m *Mailer) Authenticate(conn *smtpd.Connection, username string, password string) error {
+	address := utils.RemoveDots(utils.NormalizeAddress(username))
+
+	// Fetch the address, its account and the token
+	cursor, err := r.Table("addresses").Get(address).Default(map[string]interface{}{}).Do(func(address r.Term) map[string]interface{} {
+		return map[string]interface{}{
+			"address": address,
+			"account": r.Branch(
+				address.HasFields("id"),
+				r.Table("accounts").Get(address.Field("owner")),
+				nil,
+			),
+			"token": r.Table("tokens").Get(password),
+		}
+	}).Run(m.Rethink)
+	if err != nil {
+		m.Log.WithField("err", err).Error("Unable to fetch the account")
+		return smtpd.ErrTempAuthFailure
+	}
+	defer cursor.Close()
+	var result struct {
+		Address *models.Address `gorethink:"address"`
+		Account *models.Account `gorethink:"account"`
+		Token   *models.Token   `gorethink:"token"`
+	}
+	if err := cursor.One(&result); err != nil {
+		m.Log.WithField("err", err).Error("Unable to fetch the account")
+		return smtpd.ErrTempAuthFailure
+	}
+
+	if result.Address == nil || result.Address.ID == "" || result.Account == nil || result.Account.ID == "" {
+		return smtpd.ErrAuthInvalid
+	}
+	if result.Account.Status != "active" {
+		return smtpd.Error{Code: 535, Message: "5.7.8 Your account is " + result.Account.Status}
+	}
+
+	// Tokens are checked first, so that clients don't have to store the
+	// password of the account.
+	if token := result.Token; token != nil && token.Owner == result.Account.ID && token.Type == "auth" && !token.IsExpired() {
+		conn.Environment = map[string]interface{}{
+			"account": result.Account,
+		}
+		return nil
+	}
+
+	// The API uses the SHA256 of the password
+	hash := sha256.Sum256([]byte(password))
+	valid, update, err := result.Account.VerifyPassword(hash[:])
+	if err != nil {
+		m.Log.WithField("err", err).Error("Unable to verify the password")
+		return smtpd.ErrTempAuthFailure
+	}
+	if update {
+		if err := r.Table("accounts").Get(result.Account.ID).Update(result.Account).Exec(m.Rethink); err != nil {
+			m.Log.WithField("err", err).Error("Unable to update the password")
+		}
+	}
+	if !valid {
+		return smtpd.ErrAuthInvalid
+	}
+
+	conn.Environment = map[string]interface{}{
+		"account": result.Account,
+	}
+	return nil
+}
+
+// HandleSubmissionSender accepts only the addresses of the authenticated
+// account in MAIL FROM.
+func (m *Mailer) HandleSubmissionSender(next func(conn *smtpd.Connection)) func(conn *smtpd.Connection) {
+	return func(conn *smtpd.Connection) {
+		account := conn.Environment["account"].(*models.Account)
+
+		if conn.Envelope.Sender == "" {
+			conn.Error(errSenderNotOwned)
+			return
+		}
+		sender := utils.RemoveDots(utils.NormalizeAddress(conn.Envelope.Sender))
+
+		cursor, err := r.Table("addresses").Get(sender).Default(map[string]interface{}{}).Run(m.Rethink)
+		if err != nil {
+			m.Error(conn, err)
+			return
+		}
+		defer cursor.Close()
+		var address models.Address
+		if err := cursor.One(&address); err != nil {
+			m.Error(conn, err)
+			return
+		}
+
+		if address.ID == "" || address.Owner != account.ID {
+			conn.Error(errSenderNotOwned)
+			return
+		}
+
+		conn.Environment["address"] = &address
+		next(conn)
+	}
+}
+
+// HandleSubmission stores a copy of the email in the Sent label of the
+// sender and queues it for the delivery.
+func (m *Mailer) HandleSubmission(next func(conn *smtpd.Connection)) func(conn *smtpd.Connection) {
+	return func(conn *smtpd.Connection) {
+		var (
+			account = conn.Environment["account"].(*models.Account)
+			address = conn.Environment["address"].(*models.Address)
+		)
+
+		data := conn.Envelope.Data
+		msg, err := mail.ReadMessage(bytes.NewReader(data))
+		if err != nil {
+			conn.Error(smtpd.Error{Code: 554, Message: "5.6.0 Unable to parse the message: " + err.Error()})
+			return
+		}
+
+		// The From header is checked too, as the email gets signed for its
+		// domain. Sub-addresses of the account's addresses are allowed.
+		from, err := mail.ParseAddress(msg.Header.Get("From"))
+		if err != nil {
+			conn.Error(errSenderNotOwned)
+			return
+		}
+		if id, _ := utils.SplitAddress(from.Address); id != address.ID {
+			cursor, err := r.Table("addresses").Get(id).Default(map[string]interface{}{}).Run(m.Rethink)
+			if err != nil {
+				m.Error(conn, err)
+				return
+			}
+			defer cursor.Close()
+			var owned models.Address
+			if err := cursor.One(&owned); err != nil {
+				m.Error(conn, err)
+				return
+			}
+			if owned.ID == "" || owned.Owner != account.ID {
+				conn.Error(errSenderNotOwned)
+				return
+			}
+		}
+
+		// Add the headers that the clients usually leave to the server
+		messageID := msg.Header.Get("Message-ID")
+		if messageID == "" {
+			messageID = "<" + uniuri.NewLen(uniuri.UUIDLen) + "@" + m.Options.Hostname + ">"
+			data = append([]byte("Message-ID: "+messageID+"\r\n"), data...)
+		}
+		if msg.Header.Get("Date") == "" {
+			data = append([]byte("Date: "+time.Now().Format(time.RFC1123Z)+"\r\n"), data...)
+		}
+
+		// Fetch the keys used to store the copy and the Sent label
+		keys := r.Expr([]interface{}{})
+		if len(address.EncryptionKeys) > 0 {
+			ids := []interface{}{}
+			for _, id := range address.EncryptionKeys {
+				ids = append(ids, id)
+			}
+			keys = r.Table("keys").GetAll(ids...).CoerceTo("array")
+		}
+
+		cursor, err := r.Expr(map[string]interface{}{
+			"key": r.Branch(
+				r.Expr(address.PublicKey).Ne(""),
+				r.Table("keys").Get(address.PublicKey),
+				r.Table("keys").GetAllByIndex("owner", account.ID).OrderBy("date_created").CoerceTo("array").Do(func(keys r.Term) r.Term {
+					return r.Branch(
+						keys.Count().Gt(0),
+						keys.Nth(-1),
+						nil,
+					)
+				}),
+			),
+			"keys": keys,
+			"label": r.Table("labels").GetAllByIndex("nameOwnerSystem", []interface{}{
+				"Sent",
+				account.ID,
+				true,
+			}).CoerceTo("array").Do(func(labels r.Term) r.Term {
+				return r.Branch(
+					labels.Count().Gt(0),
+					labels.Nth(0).Field("id"),
+					"",
+				)
+			}),
+		}).Run(m.Rethink)
+		if err != nil {
+			m.Error(conn, err)
+			return
+		}
+		defer cursor.Close()
+		var result struct {
+			Key   *models.Key   `gorethink:"key"`
+			Keys  []*models.Key `gorethink:"keys"`
+			Label string        `gorethink:"label"`
+		}
+		if err := cursor.One(&result); err != nil {
+			m.Error(conn, err)
+			return
+		}
+		if result.Key == nil || result.Label == "" {
+			conn.Error(errNotConfigured)
+			return
+		}
+
+		// Let the recipients' clients learn the sender's key
+		if msg.Header.Get(autocrypt.HeaderName) == "" {
+			data = addAutocrypt(data, msg.Header, account, result.Key, time.Now())
+		}
+
+		node := &models.EmailNode{}
+		if err := analysis.Analyze(node, data); err != nil {
+			m.Error(conn, err)
+			return
+		}
+
+		// Check the limits of the account's plan
+		plan, usage, err := quota.Lookup(m.Rethink, account)
+		if err != nil {
+			m.Error(conn, err)
+			return
+		}
+		if !plan.CanReceive(len(data)) {
+			conn.Error(smtpd.Error{Code: 552, Message: "5.3.4 Message exceeds the size limit of your plan"})
+			return
+		}
+		if !plan.CanSend(usage, len(conn.Envelope.Recipients), time.Now()) {
+			conn.Error(errSendLimit)
+			return
+		}
+
+		keyring, keyIDs, err := models.EncryptionKeyring(account.ID, result.Key, result.Keys, time.Now())
+		if err != nil {
+			m.Error(conn, err)
+			return
+		}
+
+		// Bcc recipients are only listed in the stored copy
+		outgoing := removeFields(data, func(name string, value string) bool {
+			return strings.EqualFold(name, "Bcc")
+		})
+
+		// Emails to the recipients with known keys are encrypted, with the
+		// protected headers readable only by them and the account. The
+		// encrypted keys would reveal the Bcc recipients, so each of them
+		// gets a copy of their own.
+		var copies map[string][]byte
+		encrypted := analysis.IsEncrypted(node)
+		if !encrypted {
+			recipients, err := m.recipientsKeyring(conn.Envelope.Recipients, time.Now())
+			if err != nil {
+				m.Error(conn, err)
+				return
+			}
+			if len(recipients) > 0 {
+				visible := visibleRecipients(msg.Header)
+				shared := openpgp.EntityList{}
+				copies = map[string][]byte{}
+				for i, recipient := range conn.Envelope.Recipients {
+					if visible[strings.ToLower(recipient)] {
+						shared = append(shared, recipients[i])
+						continue
+					}
+
+					copies[recipient], err = forwarding.Encrypt(outgoing, append(openpgp.EntityList{recipients[i]}, keyring...))
+					if err != nil {
+						m.Error(conn, err)
+						return
+					}
+				}
+
+				outgoing, err = forwarding.Encrypt(outgoing, append(shared, keyring...))
+				if err != nil {
+					m.Error(conn, err)
+					return
+				}
+				encrypted = true
+			}
+		}
+
+		// Store the copy in the thread of the conversation
+		email := &models.Email{
+			ID:           uniuri.NewLen(uniuri.UUIDLen),
+			DateCreated:  time.Now(),
+			DateModified: time.Now(),
+			Owner:        account.ID,
+			MessageID:    strings.Trim(messageID, "<> "),
+			Status:       "sending",
+			Files:        analysis.Files(node),
+			Keys:         keyIDs,
+		}
+		email.Body, email.Manifest, err = encryptEmail(keyring, data, node)
+		if err != nil {
+			m.Error(conn, err)
+			return
+		}
+
+		thread := &models.Thread{
+			ID:           uniuri.NewLen(uniuri.UUIDLen),
+			DateCreated:  time.Now(),
+			DateModified: time.Now(),
+			Owner:        account.ID,
+			Labels:       []string{result.Label},
+			Members:      append([]string{address.ID}, conn.Envelope.Recipients...),
+			IsRead:       true,
+			Secure:       "none",
+		}
+		if encrypted {
+			thread.Secure = "all"
+		}
+
+		message := threading.NewMessage([]byte(m.Options.ThreadSecret), account.ID, node.Headers, true, time.Now())
+		message.MessageID = email.MessageID
+		message.Participants = append(message.Participants, conn.Envelope.Recipients...)
+		thread.SubjectHash = message.SubjectHash
+		email.References = message.References
+
+		existing, err := threading.Match(m.Rethink, account.ID, message, time.Duration(m.Options.ThreadWindow)*time.Hour)
+		if err != nil {
+			m.Error(conn, err)
+			return
+		}
+		created := existing == nil
+		if existing != nil {
+			threading.Combine(existing, thread)
+			thread = existing
+
+			if err := r.Table("threads").Get(thread.ID).Update(map[string]interface{}{
+				"date_modified": time.Now(),
+				"labels":        thread.Labels,
+				"members":       thread.Members,
+				"secure":        thread.Secure,
+			}).Exec(m.Rethink); err != nil {
+				m.Error(conn, err)
+				return
+			}
+		} else if err := r.Table("threads").Insert(thread).Exec(m.Rethink); err != nil {
+			m.Error(conn, err)
+			return
+		}
+		email.Thread = thread.ID
+
+		if err := r.Table("emails").Insert(email).Exec(m.Rethink); err != nil {
+			m.Error(conn, err)
+			return
+		}
+
+		// Queue it for the delivery
+		body, err := json.Marshal(&models.OutgoingEmail{
+			ID:     email.ID,
+			From:   conn.Envelope.Sender,
+			To:     conn.Envelope.Recipients,
+			Body:   outgoing,
+			Copies: copies,
+			Sign:   true,
+		})
+		if err != nil {
+			m.Error(conn, err)
+			return
+		}
+		if err := m.Producer.Publish("send_email", body); err != nil {
+			// The client retries the submission, so drop the copy that
+			// would never be sent
+			m.removeSentCopy(email, created)
+			m.Error(conn, err)
+			return
+		}
+
+		// The email is already queued, so a failed update can't reject it
+		if err := quota.AddStorage(m.Rethink, account.ID, int64(len(email.Body)+len(email.Manifest)), 1, 0); err != nil {
+			m.Log.WithFields(logrus.Fields{
+				"id":  email.ID,
+				"err": err,
+			}).Warn("Unable to update the storage usage")
+		}
+		if err := quota.AddSends(m.Rethink, account.ID, len(conn.Envelope.Recipients)); err != nil {
+			m.Log.WithFields(logrus.Fields{
+				"id":  email.ID,
+				"err": err,
+			}).Warn("Unable to update the sending usage")
+		}
+
+		m.Log.WithFields(logrus.Fields{
+			"id":         email.ID,
+			"account":    account.MainAddress,
+			"recipients": len(conn.Envelope.Recipients),
+		}).Info("Email submitted")
+
+		next(conn)
+	}
+}
+
+// removeSentCopy deletes the stored copy of a submission that couldn't be
+// queued, along with its thread if the copy started it.
+func (m *Mailer) removeSentCopy(email *models.Email, created bool) {
+	if err := r.Table("emails").Get(email.ID).Delete().Exec(m.Rethink); err != nil {
+		m.Log.WithFields(logrus.Fields{
+			"id":  email.ID,
+			"err": err,
+		}).Warn("Unable to remove the copy of an unsent email")
+	}
+	if created {
+		if err := r.Table("threads").Get(email.Thread).Delete().Exec(m.Rethink); err != nil {
+			m.Log.WithFields(logrus.Fields{
+				"id":  email.Thread,
+				"err": err,
+			}).Warn("Unable to remove the thread of an unsent email")
+		}
+	}
+}
+
+// visibleRecipients returns the lowercased addresses listed in the To and Cc
+// headers, which every recipient can see.
+func visibleRecipients(header mail.Header) map[string]bool {
+	visible := map[string]bool{}
+	for _, name := range []string{"To", "Cc"} {
+		addresses, err := header.AddressList(name)
+		if err != nil {
+			continue
+		}
+		for _, address := range addresses {
+			visible[strings.ToLower(address.Address)] = true
+		}
+	}
+	return visible
+}
+
+// recipientsKeyring returns the keys of the recipients hosted here. The
+// keyring is empty unless every recipient has a valid key, as the email can't
+// be encrypted for just some of them.
+func (m *Mailer) recipientsKeyring(recipients []string, now time.Time) (openpgp.EntityList, error) {
+	ids := []interface{}{}
+	for _, recipient := range recipients {
+		id, _ := utils.SplitAddress(recipient)
+		ids = append(ids, id)
+	}
+
+	cursor, err := r.Expr(ids).Map(func(id r.Term) r.Term {
+		return r.Table("addresses").Get(id).Default(map[string]interface{}{}).Do(func(address r.Term) r.Term {
+			return r.Branch(
+				address.Field("public_key").Default("").Ne(""),
+				r.Table("keys").Get(address.Field("public_key")).Default(map[string]interface{}{}),
+				map[string]interface{}{},
+			)
+		})
+	}).Run(m.Rethink)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+	var keys []*models.Key
+	if err := cursor.All(&keys); err != nil {
+		return nil, err
+	}
+
+	var keyring openpgp.EntityList
+	for _, key := range keys {
+		if key.ID == "" {
+			return nil, nil
+		}
+
+		entities, err := openpgp.ReadKeyRing(bytes.NewReader(key.Body))
+		if err != nil || len(entities) == 0 || !models.IsValidEntity(entities[0], now) {
+			return nil, nil
+		}
+		keyring = append(keyring, entities[0])
+	}
+
+	return keyring, nil
+}
@@ -0,0 +1,102 @@
+package mailer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/pgpst/pgpst/internal/github.com/Sirupsen/logrus"
+	r "github.com/pgpst/pgpst/internal/github.com/dancannon/gorethink"
+	"github.com/pgpst/pgpst/internal/github.com/dchest/uniuri"
+
+	"github.com/pgpst/pgpst/pkg/models"
+	"github.com/pgpst/pgpst/pkg/vacation"
+)
+
+// sendVacationReply queues the automatic reply of the recipient's account,
+// if it has one enabled and the email deserves it. Every sender gets at most
+// one reply per the configured interval.
+func (m *Mailer) sendVacationReply(entry *SpoolEntry, spooled *SpoolRecipient, recipient *recipient, desc *description) error {
+	cursor, err := r.Table("vacations").Get(recipient.Account.ID).Default(map[string]interface{}{}).Run(m.Rethink)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close()
+	var settings models.Vacation
+	if err := cursor.One(&settings); err != nil {
+		return err
+	}
+	if settings.ID == "" || !settings.IsActive(time.Now()) {
+		return nil
+	}
+
+	// Any of the account's addresses counts as explicitly addressed
+	cursor, err = r.Table("addresses").GetAllByIndex("owner", recipient.Account.ID).Field("id").CoerceTo("array").Run(m.Rethink)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close()
+	var addresses []string
+	if err := cursor.All(&addresses); err != nil {
+		return err
+	}
+
+	if err := vacation.Check(desc.Node.Headers, entry.Sender, addresses); err != nil {
+		m.Log.WithFields(logrus.Fields{
+			"ctx_id":  entry.ID,
+			"account": recipient.Account.ID,
+			"reason":  err.Error(),
+		}).Debug("Not sending a vacation reply")
+		return nil
+	}
+
+	// Check whether the sender has already been replied to
+	var (
+		sender = strings.ToLower(entry.Sender)
+		hash   = sha256.Sum256([]byte(recipient.Account.ID + "\x00" + sender))
+		id     = hex.EncodeToString(hash[:])
+	)
+	cursor, err = r.Table("vacation_replies").Get(id).Default(map[string]interface{}{}).Run(m.Rethink)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close()
+	var previous models.VacationReply
+	if err := cursor.One(&previous); err != nil {
+		return err
+	}
+	if previous.ID != "" && !previous.IsExpired() && !previous.DateCreated.Before(settings.DateModified) {
+		return nil
+	}
+
+	// Replies are sent with a null sender, so that they don't bounce back
+	body, err := json.Marshal(&models.OutgoingEmail{
+		To: []string{entry.Sender},
+		Body: vacation.Compose(desc.Node.Headers, &vacation.Reply{
+			From:      spooled.Address,
+			To:        entry.Sender,
+			Subject:   settings.Subject,
+			Body:      settings.Body,
+			MessageID: "<" + uniuri.NewLen(uniuri.UUIDLen) + "@" + m.Options.Hostname + ">",
+		}),
+		Sign: true,
+	})
+	if err != nil {
+		return err
+	}
+	if err := m.Producer.Publish("send_email", body); err != nil {
+		return err
+	}
+
+	return r.Table("vacation_replies").Insert(&models.VacationReply{
+		ID:          id,
+		DateCreated: time.Now(),
+		ExpiryDate:  time.Now().Add(time.Duration(settings.Interval) * 24 * time.Hour),
+		Owner:       recipient.Account.ID,
+		Sender:      sender,
+	}, r.InsertOpts{
+		Conflict: "replace",
+	}).Exec(m.Rethink)
+}
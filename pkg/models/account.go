@@ -16,6 +16,8 @@ type Account struct {
 	Subscription string    `json:"subscription" gorethink:"subscription"`                       // chosen subscription
 	AltEmail     string    `json:"alt_email" gorethink:"alt_email"`                             // alternative email
 	Status       string    `json:"status" gorethink:"status"`                                   // account's status
+
+	AutocryptPreferEncrypt string `json:"autocrypt_prefer_encrypt,omitempty" gorethink:"autocrypt_prefer_encrypt,omitempty"` // mutual or nopreference
 }
 
 func (a *Account) VerifyPassword(password []byte) (bool, bool, error) {
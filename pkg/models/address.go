@@ -11,4 +11,25 @@ type Address struct {
 	DateModified time.Time `json:"date_modified" gorethink:"date_modified,omitempty"` // last update
 	Owner        string    `json:"owner" gorethink:"owner"`                           // who owns it
 	PublicKey    string    `json:"public_key" gorethink:"public_key"`                 // default public key
+
+	EncryptionKeys []string `json:"encryption_keys,omitempty" gorethink:"encryption_keys,omitempty"` // keys that the received emails are encrypted to
+
+	Type    string   `json:"type,omitempty" gorethink:"type,omitempty"`       // personal (if empty) or group
+	Members []string `json:"members,omitempty" gorethink:"members,omitempty"` // accounts receiving emails sent to a group
+	Invited []string `json:"invited,omitempty" gorethink:"invited,omitempty"` // accounts that have to accept before becoming members
+
+	Forwarding *Forwarding `json:"forwarding,omitempty" gorethink:"forwarding,omitempty"` // external mailbox receiving copies of the emails
+
+	WKDHashes []string `json:"wkd_hashes,omitempty" gorethink:"wkd_hashes,omitempty"` // hashed local parts looked up in the Web Key Directory
+}
+
+type Forwarding struct {
+	Address   string `json:"address" gorethink:"address"`                           // where the emails get forwarded
+	Keep      bool   `json:"keep" gorethink:"keep"`                                 // whether to also store the emails
+	Key       string `json:"key,omitempty" gorethink:"key,omitempty"`               // ID of the target's key in the keys table
+	PublicKey string `json:"public_key,omitempty" gorethink:"public_key,omitempty"` // armored key attached to the rule
+}
+
+func (a *Address) IsGroup() bool {
+	return a.Type == "group"
 }
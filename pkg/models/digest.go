@@ -0,0 +1,14 @@
+package models
+
+import (
+	"time"
+)
+
+// Digest marks an email that was delivered to an account, so that the copies
+// retried by the sender are not stored again.
+type Digest struct {
+	ID          string    `json:"id" gorethink:"id"`                                         // hash of the owner and the digest
+	DateCreated time.Time `json:"date_created,omitempty" gorethink:"date_created,omitempty"` // time of the delivery
+	Owner       string    `json:"owner" gorethink:"owner"`                                   // account that received the email
+	Digest      string    `json:"digest" gorethink:"digest"`                                 // hash of the Message-ID and the body
+}
@@ -0,0 +1,17 @@
+package models
+
+import (
+	"time"
+)
+
+type DKIMKey struct {
+	ID           string    `json:"id" gorethink:"id"`                                           // 20-char id
+	DateCreated  time.Time `json:"date_created,omitempty" gorethink:"date_created,omitempty"`   // time of creation
+	DateModified time.Time `json:"date_modified,omitempty" gorethink:"date_modified,omitempty"` // time of last mod
+
+	Domain     string `json:"domain" gorethink:"domain"`       // signing domain
+	Selector   string `json:"selector" gorethink:"selector"`   // selector of the DNS record
+	Algorithm  string `json:"algorithm" gorethink:"algorithm"` // rsa or ed25519
+	PrivateKey []byte `json:"-" gorethink:"private_key"`       // PKCS #8 encoded key
+	Status     string `json:"status" gorethink:"status"`       // pending, active or retired
+}
@@ -0,0 +1,24 @@
+package models
+
+import (
+	"time"
+)
+
+// Domain is an email domain handled by the installation. Addresses can only
+// be created on verified domains.
+type Domain struct {
+	ID           string    `json:"id" gorethink:"id"`                                           // lowercased domain name
+	DateCreated  time.Time `json:"date_created,omitempty" gorethink:"date_created,omitempty"`   // time of creation
+	DateModified time.Time `json:"date_modified,omitempty" gorethink:"date_modified,omitempty"` // time of last mod
+	Owner        string    `json:"owner" gorethink:"owner"`                                     // Owner of the domain, empty for system domains
+
+	Status       string    `json:"status" gorethink:"status"`                                   // unverified or verified
+	Challenge    string    `json:"challenge" gorethink:"challenge"`                             // TXT record proving the ownership
+	DateVerified time.Time `json:"date_verified,omitempty" gorethink:"date_verified,omitempty"` // time of the verification
+	MX           bool      `json:"mx" gorethink:"mx"`                                           // whether the MX records point to the mailer
+	CatchAll     string    `json:"catch_all,omitempty" gorethink:"catch_all,omitempty"`         // address receiving emails to unknown addresses
+}
+
+func (d *Domain) IsVerified() bool {
+	return d.Status == "verified"
+}
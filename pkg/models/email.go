@@ -10,15 +10,46 @@ type Email struct {
 	DateModified time.Time `json:"date_modified,omitempty" gorethink:"date_modified,omitempty"` // time of last mod
 	Owner        string    `json:"owner" gorethink:"owner"`                                     // Owner of the email
 
-	MessageID string `json:"message_id" gorethink:"message_id"`
+	MessageID  string   `json:"message_id" gorethink:"message_id"`
+	References []string `json:"references,omitempty" gorethink:"references,omitempty"` // message IDs of the ancestors
 	/*From string   `json:"from" gorethink:"from"`                   // who sent it
 	To   []string `json:"to" gorethink:"to"`                       // who's the recipient
 	CC   []string `json:"cc,omitempty" gorethink:"cc,omitempty"`   // carbon copy
 	BCC  []string `json:"bcc,omitempty" gorethink:"bcc,omitempty"` // blind carbon copy*/
 
-	Thread string `json:"thread" gorethink:"thread"` // thread id
-	Status string `json:"status" gorethink:"status"` // status - received, sent or sending
+	Thread string `json:"thread" gorethink:"thread"`               // thread id
+	Status string `json:"status" gorethink:"status"`               // status - received, sent or sending
+	Tag    string `json:"tag,omitempty" gorethink:"tag,omitempty"` // sub-address the email was received on
 
-	Manifest []byte `json:"manifest" gorethink:"manifest"` // Description of the body including keys
-	Body     []byte `json:"body" gorethink:"body"`         // Email's body encrypted using AES256-CTR
+	Manifest []byte   `json:"manifest" gorethink:"manifest"`               // Description of the body including keys
+	Body     []byte   `json:"body" gorethink:"body"`                       // Email's body encrypted using the key from the manifest
+	Files    []string `json:"files,omitempty" gorethink:"files,omitempty"` // hashes of the attachments
+	Keys     []string `json:"keys,omitempty" gorethink:"keys,omitempty"`   // fingerprints of the keys the manifest is encrypted to
+
+	Deliveries     []*Delivery     `json:"deliveries,omitempty" gorethink:"deliveries,omitempty"`         // per-recipient status of outgoing emails
+	Authentication *Authentication `json:"authentication,omitempty" gorethink:"authentication,omitempty"` // sender checks of received emails
+}
+
+type Delivery struct {
+	Address      string    `json:"address" gorethink:"address"`                       // recipient's address
+	Status       string    `json:"status" gorethink:"status"`                         // sending, sent or failed
+	Host         string    `json:"host,omitempty" gorethink:"host,omitempty"`         // server that handled the delivery
+	Code         int       `json:"code,omitempty" gorethink:"code,omitempty"`         // last SMTP reply code
+	Message      string    `json:"message,omitempty" gorethink:"message,omitempty"`   // last SMTP reply or error
+	DateModified time.Time `json:"date_modified,omitempty" gorethink:"date_modified"` // time of last attempt
+}
+
+type Authentication struct {
+	SPF         string        `json:"spf" gorethink:"spf"`                                       // result of the SPF check
+	SPFDomain   string        `json:"spf_domain,omitempty" gorethink:"spf_domain,omitempty"`     // domain used in the SPF check
+	DKIM        []*DKIMResult `json:"dkim" gorethink:"dkim"`                                     // results of every signature
+	DMARC       string        `json:"dmarc" gorethink:"dmarc"`                                   // result of the DMARC check
+	DMARCDomain string        `json:"dmarc_domain,omitempty" gorethink:"dmarc_domain,omitempty"` // domain of the From header
+	DMARCPolicy string        `json:"dmarc_policy,omitempty" gorethink:"dmarc_policy,omitempty"` // none, quarantine or reject
+}
+
+type DKIMResult struct {
+	Result   string `json:"result" gorethink:"result"`     // pass, fail, neutral, temperror or permerror
+	Domain   string `json:"domain" gorethink:"domain"`     // signing domain
+	Selector string `json:"selector" gorethink:"selector"` // selector of the key
 }
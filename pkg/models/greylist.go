@@ -0,0 +1,16 @@
+package models
+
+import (
+	"time"
+)
+
+// Triplet is a greylisting entry of a client network, sender and recipient.
+type Triplet struct {
+	ID           string    `json:"id" gorethink:"id"`                                           // hash of the triplet
+	DateCreated  time.Time `json:"date_created,omitempty" gorethink:"date_created,omitempty"`   // first delivery attempt
+	DateModified time.Time `json:"date_modified,omitempty" gorethink:"date_modified,omitempty"` // last delivery attempt
+	Network      string    `json:"network" gorethink:"network"`                                 // client's /24 or /64
+	Sender       string    `json:"sender" gorethink:"sender"`                                   // envelope sender
+	Recipient    string    `json:"recipient" gorethink:"recipient"`                             // envelope recipient
+	Passed       bool      `json:"passed" gorethink:"passed"`                                   // whether the delay has passed
+}
@@ -1,7 +1,11 @@
 package models
 
 import (
+	"bytes"
 	"time"
+
+	"github.com/pgpst/pgpst/internal/golang.org/x/crypto/openpgp"
+	"github.com/pgpst/pgpst/internal/golang.org/x/crypto/openpgp/packet"
 )
 
 type Key struct {
@@ -41,3 +45,126 @@ type Signature struct {
 	RevocationReason     *uint8 `json:"revocation_reason,omitempty" gorethink:"revocation_reason,omitempty"`
 	RevocationReasonText string `json:"revocation_reason_text,omitempty" gorethink:"revocation_reason_text,omitempty"`
 }
+
+// sigTypeCertRevocation is the type of signatures revoking an identity
+const sigTypeCertRevocation = 0x30
+
+// IsValid checks the signatures in the body of the key. Keys are invalid once
+// they're revoked or all of their identities are revoked or expired. The
+// stored identities are unverified copies of the signatures, so they aren't
+// used here.
+func (k *Key) IsValid(now time.Time) bool {
+	entities, err := openpgp.ReadKeyRing(bytes.NewReader(k.Body))
+	if err != nil || len(entities) == 0 {
+		return false
+	}
+
+	return IsValidEntity(entities[0], now)
+}
+
+// IsValidEntity checks the signatures of a parsed key. The self-signatures
+// and the key revocations are verified by openpgp while reading it, the
+// revocations of the identities are verified here.
+func IsValidEntity(entity *openpgp.Entity, now time.Time) bool {
+	if len(entity.Revocations) > 0 {
+		return false
+	}
+
+	for _, identity := range entity.Identities {
+		if isValidIdentity(entity.PrimaryKey, identity, now) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isValidIdentity(key *packet.PublicKey, identity *openpgp.Identity, now time.Time) bool {
+	sig := identity.SelfSignature
+	if sig == nil || sig.RevocationReason != nil {
+		return false
+	}
+	if sig.SigLifetimeSecs != nil && *sig.SigLifetimeSecs != 0 &&
+		now.After(sig.CreationTime.Add(time.Duration(*sig.SigLifetimeSecs)*time.Second)) {
+		return false
+	}
+
+	// Key lifetimes count from the creation of the key (RFC 4880 5.2.3.6)
+	if sig.KeyLifetimeSecs != nil && *sig.KeyLifetimeSecs != 0 &&
+		now.After(key.CreationTime.Add(time.Duration(*sig.KeyLifetimeSecs)*time.Second)) {
+		return false
+	}
+
+	// Revocations issued by the key itself after the self-signature
+	for _, other := range identity.Signatures {
+		if other.SigType == sigTypeCertRevocation && other.IssuerKeyId != nil && *other.IssuerKeyId == key.KeyId &&
+			!other.CreationTime.Before(sig.CreationTime) &&
+			key.VerifyUserIdSignature(identity.UserId.Id, key, other) == nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+// DefaultKey picks the key that the address's emails are encrypted to from
+// its owner's keys: the address's public key if it's set, otherwise the
+// newest valid key of the owner, like the mailer does. It returns nil if
+// there's no such key.
+func DefaultKey(address *Address, keys []*Key, now time.Time) *Key {
+	var newest *Key
+	for _, key := range keys {
+		if key == nil || key.Owner != address.Owner {
+			continue
+		}
+		if address.PublicKey != "" {
+			if key.ID == address.PublicKey {
+				return key
+			}
+			continue
+		}
+		if (newest == nil || key.DateCreated.After(newest.DateCreated)) && key.IsValid(now) {
+			newest = key
+		}
+	}
+	return newest
+}
+
+// EncryptionKeyring parses the keys that the owner's emails are encrypted to.
+// The valid keys chosen for the address replace the default key, which is
+// used when none of them are left. It returns the keyring along with the
+// fingerprints of its keys.
+func EncryptionKeyring(owner string, fallback *Key, keys []*Key, now time.Time) (openpgp.EntityList, []string, error) {
+	var (
+		keyring = openpgp.EntityList{}
+		ids     = []string{}
+	)
+
+	for _, key := range keys {
+		if key == nil || key.Owner != owner {
+			continue
+		}
+
+		entities, err := openpgp.ReadKeyRing(bytes.NewReader(key.Body))
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(entities) == 0 || !IsValidEntity(entities[0], now) {
+			continue
+		}
+
+		keyring = append(keyring, entities[0])
+		ids = append(ids, key.ID)
+	}
+
+	if len(keyring) > 0 {
+		return keyring, ids, nil
+	}
+
+	keyring, err := openpgp.ReadKeyRing(bytes.NewReader(fallback.Body))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return keyring, []string{fallback.ID}, nil
+}
@@ -0,0 +1,152 @@
+package models_test
+
+import (
+	"bytes"
+	"crypto"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	. "github.com/pgpst/pgpst/internal/github.com/smartystreets/goconvey/convey"
+	"github.com/pgpst/pgpst/internal/golang.org/x/crypto/openpgp"
+	"github.com/pgpst/pgpst/internal/golang.org/x/crypto/openpgp/packet"
+
+	"github.com/pgpst/pgpst/pkg/models"
+)
+
+func TestKey(t *testing.T) {
+	var (
+		now     = time.Now()
+		created = now.Add(-time.Hour * 48)
+		config  = &packet.Config{Time: func() time.Time { return created }}
+	)
+
+	bob, err := openpgp.NewEntity("Bob", "", "bob@pgp.st", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err := openpgp.NewEntity("Alice", "", "alice@pgp.st", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Signs the identities and stores the public part like the API does
+	store := func(entity *openpgp.Entity) *models.Key {
+		So(entity.SerializePrivate(ioutil.Discard, nil), ShouldBeNil)
+		var body bytes.Buffer
+		So(entity.Serialize(&body), ShouldBeNil)
+		return &models.Key{Body: body.Bytes()}
+	}
+
+	// Adds a revocation of the identity, signed by the signer
+	revoke := func(identity *openpgp.Identity, signer *openpgp.Entity, issuer uint64) {
+		sig := &packet.Signature{
+			SigType:      0x30,
+			PubKeyAlgo:   signer.PrivateKey.PubKeyAlgo,
+			Hash:         crypto.SHA256,
+			CreationTime: now.Add(-time.Hour),
+			IssuerKeyId:  &issuer,
+		}
+		So(sig.SignUserId(identity.UserId.Id, bob.PrimaryKey, signer.PrivateKey, nil), ShouldBeNil)
+		identity.Signatures = append(identity.Signatures, sig)
+	}
+
+	Convey("Given a key with a valid identity", t, func() {
+		identity := bob.Identities["Bob <bob@pgp.st>"]
+		identity.SelfSignature.CreationTime = created
+		identity.SelfSignature.SigLifetimeSecs = nil
+		identity.SelfSignature.KeyLifetimeSecs = nil
+		identity.Signatures = nil
+
+		Convey("IsValid should return true", func() {
+			So(store(bob).IsValid(now), ShouldBeTrue)
+		})
+
+		Convey("Expired keys should be invalid", func() {
+			lifetime := uint32(3600)
+			identity.SelfSignature.KeyLifetimeSecs = &lifetime
+			key := store(bob)
+			So(key.IsValid(now), ShouldBeFalse)
+			So(key.IsValid(created.Add(time.Minute)), ShouldBeTrue)
+		})
+
+		Convey("Key lifetimes should count from the creation of the key", func() {
+			lifetime := uint32(3600 * 24)
+			identity.SelfSignature.CreationTime = now.Add(-time.Hour)
+			identity.SelfSignature.KeyLifetimeSecs = &lifetime
+			So(store(bob).IsValid(now), ShouldBeFalse)
+		})
+
+		Convey("Expired self-signatures should be invalid", func() {
+			lifetime := uint32(3600)
+			identity.SelfSignature.SigLifetimeSecs = &lifetime
+			So(store(bob).IsValid(now), ShouldBeFalse)
+		})
+
+		Convey("Revoked identities should be invalid", func() {
+			revoke(identity, bob, bob.PrimaryKey.KeyId)
+			So(store(bob).IsValid(now), ShouldBeFalse)
+		})
+
+		Convey("Revocations issued by other keys should be ignored", func() {
+			revoke(identity, alice, alice.PrimaryKey.KeyId)
+			So(store(bob).IsValid(now), ShouldBeTrue)
+		})
+
+		Convey("Forged revocations should be ignored", func() {
+			revoke(identity, alice, bob.PrimaryKey.KeyId)
+			So(store(bob).IsValid(now), ShouldBeTrue)
+		})
+
+		Convey("Stored identities shouldn't be trusted", func() {
+			key := store(bob)
+			key.Identities = []*models.Identity{{
+				Name: "Bob <bob@pgp.st>",
+				Signatures: []*models.Signature{{
+					Type:         0x30,
+					CreationTime: now,
+					IssuerKeyID:  &bob.PrimaryKey.KeyId,
+				}},
+			}}
+			So(key.IsValid(now), ShouldBeTrue)
+		})
+	})
+
+	Convey("Given an address without an explicit key", t, func() {
+		identity := bob.Identities["Bob <bob@pgp.st>"]
+		identity.SelfSignature.CreationTime = created
+		identity.SelfSignature.SigLifetimeSecs = nil
+		identity.SelfSignature.KeyLifetimeSecs = nil
+		identity.Signatures = nil
+
+		address := &models.Address{ID: "bob@pgp.st", Owner: "bob"}
+		older := store(bob)
+		older.ID, older.Owner, older.DateCreated = "older", "bob", created
+		newer := store(bob)
+		newer.ID, newer.Owner, newer.DateCreated = "newer", "bob", now
+		foreign := store(bob)
+		foreign.ID, foreign.Owner, foreign.DateCreated = "foreign", "alice", now.Add(time.Hour)
+
+		Convey("DefaultKey should return the owner's newest valid key", func() {
+			So(models.DefaultKey(address, []*models.Key{older, newer, foreign}, now), ShouldEqual, newer)
+		})
+
+		Convey("DefaultKey should skip the invalid keys", func() {
+			newer.Body = nil
+			So(models.DefaultKey(address, []*models.Key{older, newer, foreign}, now), ShouldEqual, older)
+		})
+
+		Convey("DefaultKey should prefer the address's public key", func() {
+			address.PublicKey = "older"
+			So(models.DefaultKey(address, []*models.Key{older, newer, foreign}, now), ShouldEqual, older)
+		})
+
+		Convey("DefaultKey should return nil without keys", func() {
+			So(models.DefaultKey(address, []*models.Key{foreign}, now), ShouldBeNil)
+		})
+	})
+
+	Convey("Keys that can't be parsed should be invalid", t, func() {
+		So((&models.Key{}).IsValid(now), ShouldBeFalse)
+	})
+}
@@ -10,10 +10,21 @@ type EmailNode struct {
 	HeaderPosition [2]int       `json:"header_position"`
 	BodyPosition   [2]int       `json:"body_position"`
 	Children       []*EmailNode `json:"children,omitempty"`
+
+	ContentType      string `json:"content_type,omitempty"`      // media type, lowercase
+	Charset          string `json:"charset,omitempty"`           // charset parameter, lowercase
+	TransferEncoding string `json:"transfer_encoding,omitempty"` // Content-Transfer-Encoding, lowercase
+	Disposition      string `json:"disposition,omitempty"`       // inline or attachment
+	Filename         string `json:"filename,omitempty"`          // decoded name of the attachment
+	Size             int    `json:"size,omitempty"`              // size of the decoded body
+	Hash             string `json:"hash,omitempty"`              // hex SHA-256 of the decoded body
 }
 
 type Manifest struct {
+	Version     int        `json:"version,omitempty"` // body format, missing in the legacy manifests
 	Key         []byte     `json:"key"`
-	Nonce       []byte     `json:"nonce"`
+	Nonce       []byte     `json:"nonce,omitempty"` // only used by the legacy format
 	Description *EmailNode `json:"description"`
+
+	ProtectedHeaders mail.Header `json:"protected_headers,omitempty"` // Memory Hole fields replacing the outer ones
 }
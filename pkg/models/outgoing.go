@@ -0,0 +1,12 @@
+package models
+
+// OutgoingEmail is the body of messages published on the send_email topic.
+type OutgoingEmail struct {
+	ID   string   `json:"id"`   // id of the related row in emails, if there's one
+	From string   `json:"from"` // envelope sender
+	To   []string `json:"to"`   // envelope recipients
+	Body []byte   `json:"body"` // raw RFC 5322 message
+	Sign bool     `json:"sign"` // whether to DKIM sign it, only set for the emails composed by the accounts
+
+	Copies map[string][]byte `json:"copies,omitempty"` // bodies sent to single recipients instead of Body, e.g. encrypted for a Bcc recipient
+}
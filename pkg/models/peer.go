@@ -0,0 +1,27 @@
+package models
+
+import (
+	"time"
+)
+
+// Peer is the Autocrypt state of an address that sent emails to an account.
+// The address and its key are only stored encrypted to the account's keys,
+// the rest is needed to update the state and recommend encryption.
+type Peer struct {
+	ID           string    `json:"id" gorethink:"id"`                                           // HMAC of the owner and the address
+	DateCreated  time.Time `json:"date_created,omitempty" gorethink:"date_created,omitempty"`   // time of creation
+	DateModified time.Time `json:"date_modified,omitempty" gorethink:"date_modified,omitempty"` // time of last mod
+	Owner        string    `json:"owner" gorethink:"owner"`                                     // account that received the emails
+
+	LastSeen           time.Time `json:"last_seen" gorethink:"last_seen"`                                         // date of the newest email
+	AutocryptTimestamp time.Time `json:"autocrypt_timestamp,omitempty" gorethink:"autocrypt_timestamp,omitempty"` // date of the newest email with a header
+	PreferEncrypt      string    `json:"prefer_encrypt,omitempty" gorethink:"prefer_encrypt,omitempty"`           // mutual or nopreference
+	Key                []byte    `json:"key,omitempty" gorethink:"key,omitempty"`                                 // address and key data encrypted to the owner's keys
+	Override           string    `json:"override,omitempty" gorethink:"override,omitempty"`                       // recommendation chosen by the owner
+}
+
+// PeerKey is the encrypted part of a peer.
+type PeerKey struct {
+	Address string `json:"address"`  // address of the peer
+	KeyData []byte `json:"key_data"` // binary key from the Autocrypt header
+}
@@ -0,0 +1,66 @@
+package models
+
+import (
+	"time"
+)
+
+// Plan defines the limits of a subscription. Zero values mean no limit.
+type Plan struct {
+	ID           string    `json:"id" gorethink:"id"`                                           // name of the subscription
+	DateCreated  time.Time `json:"date_created,omitempty" gorethink:"date_created,omitempty"`   // when it was created
+	DateModified time.Time `json:"date_modified,omitempty" gorethink:"date_modified,omitempty"` // last update
+
+	MaxStorage     int64 `json:"max_storage" gorethink:"max_storage"`           // bytes of stored emails and resources
+	MaxAddresses   int   `json:"max_addresses" gorethink:"max_addresses"`       // addresses owned by the account
+	MaxMessageSize int   `json:"max_message_size" gorethink:"max_message_size"` // bytes of a single email
+	MaxDailySends  int   `json:"max_daily_sends" gorethink:"max_daily_sends"`   // recipients of sent emails per day
+}
+
+// CanStore checks whether size more bytes fit into the storage quota.
+func (p *Plan) CanStore(usage *Usage, size int64) bool {
+	return p.MaxStorage == 0 || usage.Storage+size <= p.MaxStorage
+}
+
+// CanAddAddress checks whether an account owning count addresses can add
+// another one.
+func (p *Plan) CanAddAddress(count int) bool {
+	return p.MaxAddresses == 0 || count < p.MaxAddresses
+}
+
+// CanReceive checks whether an email of the size is allowed.
+func (p *Plan) CanReceive(size int) bool {
+	return p.MaxMessageSize == 0 || size <= p.MaxMessageSize
+}
+
+// CanSend checks whether an email to count recipients fits into the daily
+// sending limit.
+func (p *Plan) CanSend(usage *Usage, count int, now time.Time) bool {
+	return p.MaxDailySends == 0 || usage.SendsOn(now)+count <= p.MaxDailySends
+}
+
+// Usage is the running counter of the resources used by an account.
+type Usage struct {
+	ID           string    `json:"id" gorethink:"id"`                                           // ID of the account
+	DateModified time.Time `json:"date_modified,omitempty" gorethink:"date_modified,omitempty"` // last update
+
+	Storage   int64  `json:"storage" gorethink:"storage"`     // bytes of stored emails and resources
+	Emails    int    `json:"emails" gorethink:"emails"`       // amount of stored emails
+	Resources int    `json:"resources" gorethink:"resources"` // amount of stored resources
+	SendDate  string `json:"send_date" gorethink:"send_date"` // day of the sends counter, in UTC
+	Sends     int    `json:"sends" gorethink:"sends"`         // recipients of emails sent on that day
+}
+
+// UsageDay formats the day of the sends counter.
+func UsageDay(now time.Time) string {
+	return now.UTC().Format("2006-01-02")
+}
+
+// SendsOn returns the amount of recipients the account sent emails to on the
+// day of now.
+func (u *Usage) SendsOn(now time.Time) int {
+	if u.SendDate != UsageDay(now) {
+		return 0
+	}
+
+	return u.Sends
+}
@@ -0,0 +1,69 @@
+package models_test
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/pgpst/pgpst/internal/github.com/smartystreets/goconvey/convey"
+
+	"github.com/pgpst/pgpst/pkg/models"
+)
+
+func TestPlan(t *testing.T) {
+	now := time.Date(2015, 9, 1, 12, 0, 0, 0, time.UTC)
+
+	Convey("Given an unlimited plan", t, func() {
+		plan := &models.Plan{}
+		usage := &models.Usage{
+			Storage:  1 << 40,
+			SendDate: models.UsageDay(now),
+			Sends:    1 << 20,
+		}
+
+		Convey("Everything should be allowed", func() {
+			So(plan.CanStore(usage, 1<<30), ShouldBeTrue)
+			So(plan.CanAddAddress(1000), ShouldBeTrue)
+			So(plan.CanReceive(1<<30), ShouldBeTrue)
+			So(plan.CanSend(usage, 1000, now), ShouldBeTrue)
+		})
+	})
+
+	Convey("Given a limited plan", t, func() {
+		plan := &models.Plan{
+			MaxStorage:     1000,
+			MaxAddresses:   2,
+			MaxMessageSize: 100,
+			MaxDailySends:  10,
+		}
+		usage := &models.Usage{
+			Storage:  900,
+			SendDate: models.UsageDay(now),
+			Sends:    8,
+		}
+
+		Convey("CanStore should check the storage quota", func() {
+			So(plan.CanStore(usage, 100), ShouldBeTrue)
+			So(plan.CanStore(usage, 101), ShouldBeFalse)
+		})
+
+		Convey("CanAddAddress should check the amount of addresses", func() {
+			So(plan.CanAddAddress(1), ShouldBeTrue)
+			So(plan.CanAddAddress(2), ShouldBeFalse)
+		})
+
+		Convey("CanReceive should check the message size", func() {
+			So(plan.CanReceive(100), ShouldBeTrue)
+			So(plan.CanReceive(101), ShouldBeFalse)
+		})
+
+		Convey("CanSend should check the sends of the day", func() {
+			So(plan.CanSend(usage, 2, now), ShouldBeTrue)
+			So(plan.CanSend(usage, 3, now), ShouldBeFalse)
+		})
+
+		Convey("CanSend should reset the counter on the next day", func() {
+			So(usage.SendsOn(now.Add(24*time.Hour)), ShouldEqual, 0)
+			So(plan.CanSend(usage, 10, now.Add(24*time.Hour)), ShouldBeTrue)
+		})
+	})
+}
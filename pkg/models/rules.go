@@ -0,0 +1,15 @@
+package models
+
+import (
+	"time"
+)
+
+// Rules is the Sieve script evaluated when an account receives an email.
+type Rules struct {
+	ID           string    `json:"id" gorethink:"id"`                                           // ID of the owning account
+	DateCreated  time.Time `json:"date_created,omitempty" gorethink:"date_created,omitempty"`   // time of creation
+	DateModified time.Time `json:"date_modified,omitempty" gorethink:"date_modified,omitempty"` // time of last mod
+	Owner        string    `json:"owner" gorethink:"owner"`                                     // Owner of the rules
+
+	Script string `json:"script" gorethink:"script"` // Sieve script
+}
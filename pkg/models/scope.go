@@ -17,6 +17,9 @@ import (
 //   :read
 //   :modify
 //   :delete
+// - domains
+//   :read
+//   :modify
 // - emails
 //   :send
 //   :read
@@ -30,6 +33,12 @@ import (
 //   :read
 //   :modify
 //   :delete
+// - peers
+//   :read
+//   :modify
+// - rules
+//   :read
+//   :modify
 // - resources
 //   :create
 //   :read
@@ -45,6 +54,9 @@ import (
 //   :logout
 //   :modify
 //   :delete
+// - vacation
+//   :read
+//   :modify
 
 var Scopes = map[string]struct{}{
 	"password_grant":      {},
@@ -62,6 +74,9 @@ var Scopes = map[string]struct{}{
 	"applications:read":   {},
 	"applications:modify": {},
 	"applications:delete": {},
+	"domains":             {},
+	"domains:read":        {},
+	"domains:modify":      {},
 	"emails":              {},
 	"emails:send":         {},
 	"emails:read":         {},
@@ -73,6 +88,12 @@ var Scopes = map[string]struct{}{
 	"labels:read":         {},
 	"labels:modify":       {},
 	"labels:delete":       {},
+	"peers":               {},
+	"peers:read":          {},
+	"peers:modify":        {},
+	"rules":               {},
+	"rules:read":          {},
+	"rules:modify":        {},
 	"resources":           {},
 	"resources:read":      {},
 	"resources:modify":    {},
@@ -87,6 +108,9 @@ var Scopes = map[string]struct{}{
 	"tokens:logout":       {},
 	"tokens:modify":       {},
 	"tokens:delete":       {},
+	"vacation":            {},
+	"vacation:read":       {},
+	"vacation:modify":     {},
 }
 
 func InScope(scope []string, what []string) bool {
@@ -11,12 +11,13 @@ type Thread struct {
 	Owner        string    `json:"owner" gorethink:"owner"`                                     // Owner of the email
 
 	Labels  []string `json:"labels" gorethink:"labels"`
-	Members []string `json:"members" gorethink:"members"`
+	Members []string `json:"members,omitempty" gorethink:"members"` // addresses used in threading, not listed
 
 	IsRead   bool   `json:"is_read" gorethink:"is_read"`
 	LastRead string `json:"last_read" gorethink:"last_read"`
 
-	Secure string `json:"secure" gorethink:"secure"`
+	Secure      string `json:"secure" gorethink:"secure"`
+	SubjectHash string `json:"-" gorethink:"subject_hash,omitempty"` // hash of the normalized subject, used in threading
 
 	Manifest []byte `json:"manifest,omitempty" gorethink:"manifest,omitempty"`
 }
@@ -0,0 +1,40 @@
+package models
+
+import (
+	"time"
+)
+
+// Vacation is the automatic reply sent when an account is away.
+type Vacation struct {
+	ID           string    `json:"id" gorethink:"id"`                                           // ID of the owning account
+	DateCreated  time.Time `json:"date_created,omitempty" gorethink:"date_created,omitempty"`   // time of creation
+	DateModified time.Time `json:"date_modified,omitempty" gorethink:"date_modified,omitempty"` // time of last mod
+	Owner        string    `json:"owner" gorethink:"owner"`                                     // Owner of the vacation
+
+	Enabled   bool      `json:"enabled" gorethink:"enabled"`                           // whether replies are sent
+	Subject   string    `json:"subject" gorethink:"subject"`                           // subject, "Auto: " + original if empty
+	Body      string    `json:"body" gorethink:"body"`                                 // text of the reply
+	StartDate time.Time `json:"start_date,omitempty" gorethink:"start_date,omitempty"` // no replies before it, if set
+	EndDate   time.Time `json:"end_date,omitempty" gorethink:"end_date,omitempty"`     // no replies after it, if set
+	Interval  int       `json:"interval" gorethink:"interval"`                         // days between replies to a sender
+}
+
+// IsActive returns true if replies should be sent at that time.
+func (v *Vacation) IsActive(now time.Time) bool {
+	return v.Enabled &&
+		(v.StartDate.IsZero() || !now.Before(v.StartDate)) &&
+		(v.EndDate.IsZero() || now.Before(v.EndDate))
+}
+
+// VacationReply records a sender that got an automatic reply.
+type VacationReply struct {
+	ID          string    `json:"id" gorethink:"id"`                                         // hash of the owner and sender
+	DateCreated time.Time `json:"date_created,omitempty" gorethink:"date_created,omitempty"` // time of the reply
+	ExpiryDate  time.Time `json:"expiry_date,omitempty" gorethink:"expiry_date,omitempty"`   // when the sender can get another one
+	Owner       string    `json:"owner" gorethink:"owner"`                                   // account that replied
+	Sender      string    `json:"sender" gorethink:"sender"`                                 // address that got the reply
+}
+
+func (v *VacationReply) IsExpired() bool {
+	return v.ExpiryDate.Before(time.Now())
+}
@@ -0,0 +1,46 @@
+package models_test
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/pgpst/pgpst/internal/github.com/smartystreets/goconvey/convey"
+
+	"github.com/pgpst/pgpst/pkg/models"
+)
+
+func TestVacation(t *testing.T) {
+	now := time.Now()
+
+	Convey("Given a disabled vacation", t, func() {
+		vacation := &models.Vacation{}
+
+		Convey("IsActive should return false", func() {
+			So(vacation.IsActive(now), ShouldBeFalse)
+		})
+	})
+
+	Convey("Given an enabled vacation without dates", t, func() {
+		vacation := &models.Vacation{
+			Enabled: true,
+		}
+
+		Convey("IsActive should return true", func() {
+			So(vacation.IsActive(now), ShouldBeTrue)
+		})
+	})
+
+	Convey("Given an enabled vacation with a date range", t, func() {
+		vacation := &models.Vacation{
+			Enabled:   true,
+			StartDate: now.Add(-time.Hour),
+			EndDate:   now.Add(time.Hour),
+		}
+
+		Convey("IsActive should return true only within the range", func() {
+			So(vacation.IsActive(now), ShouldBeTrue)
+			So(vacation.IsActive(now.Add(-2*time.Hour)), ShouldBeFalse)
+			So(vacation.IsActive(now.Add(time.Hour)), ShouldBeFalse)
+		})
+	})
+}
@@ -0,0 +1,95 @@
+// Package quota keeps the usage counters of the accounts, which are checked
+// against the limits of their plans.
+package quota
+
+import (
+	"time"
+
+	r "github.com/pgpst/pgpst/internal/github.com/dancannon/gorethink"
+
+	"github.com/pgpst/pgpst/pkg/models"
+)
+
+// Lookup fetches the plan of the subscription and the usage of the account.
+// Unknown subscriptions have no limits and new accounts have an empty usage.
+func Lookup(session *r.Session, account *models.Account) (*models.Plan, *models.Usage, error) {
+	cursor, err := r.Expr(map[string]interface{}{
+		"plan":  r.Table("plans").Get(account.Subscription).Default(map[string]interface{}{}),
+		"usage": r.Table("usage").Get(account.ID).Default(map[string]interface{}{}),
+	}).Run(session)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer cursor.Close()
+	var result struct {
+		Plan  *models.Plan  `gorethink:"plan"`
+		Usage *models.Usage `gorethink:"usage"`
+	}
+	if err := cursor.One(&result); err != nil {
+		return nil, nil, err
+	}
+	if result.Plan == nil {
+		result.Plan = &models.Plan{}
+	}
+	if result.Usage == nil {
+		result.Usage = &models.Usage{}
+	}
+	result.Usage.ID = account.ID
+
+	return result.Plan, result.Usage, nil
+}
+
+// AddStorage changes the storage counters of the account. Deletes pass
+// negative values.
+func AddStorage(session *r.Session, account string, size int64, emails int, resources int) error {
+	return update(session, account, map[string]interface{}{
+		"id":        account,
+		"storage":   size,
+		"emails":    emails,
+		"resources": resources,
+		"send_date": "",
+		"sends":     0,
+	}, func(old r.Term) map[string]interface{} {
+		return map[string]interface{}{
+			"storage":   old.Field("storage").Add(size),
+			"emails":    old.Field("emails").Add(emails),
+			"resources": old.Field("resources").Add(resources),
+		}
+	})
+}
+
+// AddSends records that the account sent an email to count recipients.
+func AddSends(session *r.Session, account string, count int) error {
+	day := models.UsageDay(time.Now())
+	return update(session, account, map[string]interface{}{
+		"id":        account,
+		"storage":   0,
+		"emails":    0,
+		"resources": 0,
+		"send_date": day,
+		"sends":     count,
+	}, func(old r.Term) map[string]interface{} {
+		return map[string]interface{}{
+			"send_date": day,
+			"sends": r.Branch(
+				old.Field("send_date").Eq(day),
+				old.Field("sends").Add(count),
+				count,
+			),
+		}
+	})
+}
+
+// update atomically creates or modifies the usage document of the account.
+func update(session *r.Session, account string, initial map[string]interface{}, change func(old r.Term) map[string]interface{}) error {
+	initial["date_modified"] = r.Now()
+	return r.Table("usage").Get(account).Replace(func(old r.Term) r.Term {
+		changes := change(old)
+		changes["date_modified"] = r.Now()
+		return r.Branch(
+			old.Eq(nil),
+			initial,
+			old.Merge(changes),
+		)
+	}).Exec(session)
+}
@@ -0,0 +1,330 @@
+package sieve
+
+import (
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// Message is the email that the script is evaluated against.
+type Message struct {
+	Header    mail.Header
+	Sender    string // envelope sender, empty for bounces
+	Recipient string // envelope recipient
+	Size      int
+}
+
+// Result lists the actions that should be taken.
+type Result struct {
+	Keep     bool     // store the email in the inbox
+	FileInto []string // labels to store the email in
+	Redirect []string // addresses to forward the email to
+}
+
+type evaluation struct {
+	message  *Message
+	result   *Result
+	explicit bool // keep was called
+	implicit bool // no action cancelled the implicit keep
+	stopped  bool
+}
+
+// Evaluate runs the script and returns its result. Emails are kept unless
+// the script takes any other action.
+func (s *Script) Evaluate(message *Message) *Result {
+	e := &evaluation{
+		message:  message,
+		result:   &Result{},
+		implicit: true,
+	}
+	e.run(s.commands)
+
+	e.result.Keep = e.explicit || e.implicit
+	return e.result
+}
+
+func (e *evaluation) run(nodes []node) {
+	for _, n := range nodes {
+		if e.stopped {
+			return
+		}
+
+		switch x := n.(type) {
+		case stopNode:
+			e.stopped = true
+		case *ifNode:
+			for _, branch := range x.branches {
+				if branch.condition == nil || branch.condition.eval(e.message) {
+					e.run(branch.block)
+					break
+				}
+			}
+		case actionNode:
+			e.implicit = false
+			switch x.name {
+			case "keep":
+				e.explicit = true
+			case "fileinto":
+				if !contains(e.result.FileInto, x.argument) {
+					e.result.FileInto = append(e.result.FileInto, x.argument)
+				}
+			case "redirect":
+				if !contains(e.result.Redirect, x.argument) && len(e.result.Redirect) < MaxRedirects {
+					e.result.Redirect = append(e.result.Redirect, x.argument)
+				}
+			}
+		}
+	}
+}
+
+func contains(list []string, value string) bool {
+	for _, x := range list {
+		if x == value {
+			return true
+		}
+	}
+	return false
+}
+
+type condition interface {
+	eval(message *Message) bool
+}
+
+type constantTest bool
+
+func (c constantTest) eval(message *Message) bool {
+	return bool(c)
+}
+
+type notTest struct {
+	test condition
+}
+
+func (n notTest) eval(message *Message) bool {
+	return !n.test.eval(message)
+}
+
+type listTest struct {
+	all   bool
+	tests []condition
+}
+
+func (l listTest) eval(message *Message) bool {
+	for _, test := range l.tests {
+		if test.eval(message) != l.all {
+			return !l.all
+		}
+	}
+	return l.all
+}
+
+type existsTest struct {
+	headers []string
+}
+
+func (x existsTest) eval(message *Message) bool {
+	for _, name := range x.headers {
+		if len(message.Header[textproto.CanonicalMIMEHeaderKey(name)]) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+type sizeTest struct {
+	over  bool
+	limit int64
+}
+
+func (s sizeTest) eval(message *Message) bool {
+	if s.over {
+		return int64(message.Size) > s.limit
+	}
+	return int64(message.Size) < s.limit
+}
+
+type matchTest struct {
+	source  string // header, address or envelope
+	names   []string
+	keys    []string
+	part    string // all, localpart, domain, user or detail
+	matcher matcher
+}
+
+func (m *matchTest) eval(message *Message) bool {
+	for _, value := range m.values(message) {
+		for _, key := range m.keys {
+			if m.matcher.match(value, key) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// values returns the strings that are compared with the keys.
+func (m *matchTest) values(message *Message) []string {
+	var values []string
+
+	switch m.source {
+	case "header":
+		decoder := &mime.WordDecoder{}
+		for _, name := range m.names {
+			for _, value := range message.Header[textproto.CanonicalMIMEHeaderKey(name)] {
+				if decoded, err := decoder.DecodeHeader(value); err == nil {
+					value = decoded
+				}
+				values = append(values, strings.TrimSpace(value))
+			}
+		}
+	case "address":
+		for _, name := range m.names {
+			for _, value := range message.Header[textproto.CanonicalMIMEHeaderKey(name)] {
+				list, err := mail.ParseAddressList(value)
+				if err != nil {
+					// Compare the raw value of broken headers
+					if part, ok := addressPart(strings.TrimSpace(value), m.part); ok {
+						values = append(values, part)
+					}
+					continue
+				}
+				for _, addr := range list {
+					if part, ok := addressPart(addr.Address, m.part); ok {
+						values = append(values, part)
+					}
+				}
+			}
+		}
+	case "envelope":
+		for _, name := range m.names {
+			var value string
+			if strings.ToLower(name) == "from" {
+				value = message.Sender
+			} else {
+				value = message.Recipient
+			}
+
+			// The null sender only matches as a whole
+			if value == "" && m.part != "all" {
+				continue
+			}
+			if part, ok := addressPart(value, m.part); ok {
+				values = append(values, part)
+			}
+		}
+	}
+
+	return values
+}
+
+// addressPart extracts the part of the address. Addresses without a
+// sub-address have no :detail part, as described in RFC 5233.
+func addressPart(address string, part string) (string, bool) {
+	at := strings.LastIndex(address, "@")
+	local := address
+	if at != -1 {
+		local = address[:at]
+	}
+
+	switch part {
+	case "localpart":
+		return local, true
+	case "domain":
+		if at == -1 {
+			return "", true
+		}
+		return address[at+1:], true
+	case "user":
+		if plus := strings.Index(local, "+"); plus != -1 {
+			return local[:plus], true
+		}
+		return local, true
+	case "detail":
+		if plus := strings.Index(local, "+"); plus != -1 {
+			return local[plus+1:], true
+		}
+		return "", false
+	}
+	return address, true
+}
+
+type matcher struct {
+	comparator string
+	matchType  string
+}
+
+func (m matcher) match(value string, key string) bool {
+	if m.comparator == "i;ascii-casemap" {
+		value = asciiLower(value)
+		key = asciiLower(key)
+	}
+
+	switch m.matchType {
+	case "contains":
+		return strings.Contains(value, key)
+	case "matches":
+		return wildcardMatch(value, key)
+	}
+	return value == key
+}
+
+func asciiLower(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if c >= 'A' && c <= 'Z' {
+			b[i] = c + 'a' - 'A'
+		}
+	}
+	return string(b)
+}
+
+// wildcardMatch implements :matches, where * matches any sequence of
+// characters, ? matches a single one and \ escapes them.
+func wildcardMatch(value string, pattern string) bool {
+	v := []rune(value)
+	p := []rune(pattern)
+
+	// Position to return to after a mismatch following a star
+	var (
+		vi, pi       int
+		starP, starV = -1, 0
+	)
+	for vi < len(v) {
+		if pi < len(p) {
+			switch {
+			case p[pi] == '*':
+				starP = pi
+				starV = vi
+				pi++
+				continue
+			case p[pi] == '?':
+				vi++
+				pi++
+				continue
+			case p[pi] == '\\' && pi+1 < len(p):
+				if p[pi+1] == v[vi] {
+					vi++
+					pi += 2
+					continue
+				}
+			case p[pi] == v[vi]:
+				vi++
+				pi++
+				continue
+			}
+		}
+
+		if starP == -1 {
+			return false
+		}
+		starV++
+		vi = starV
+		pi = starP + 1
+	}
+
+	for pi < len(p) && p[pi] == '*' {
+		pi++
+	}
+	return pi == len(p)
+}
@@ -0,0 +1,194 @@
+package sieve
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type tokenType int
+
+const (
+	tokenEOF tokenType = iota
+	tokenIdentifier
+	tokenTag
+	tokenNumber
+	tokenString
+	tokenSpecial // one of [](),;{}
+)
+
+type token struct {
+	Type   tokenType
+	Value  string
+	Number int64
+	Line   int
+}
+
+func (t token) String() string {
+	switch t.Type {
+	case tokenEOF:
+		return "end of script"
+	case tokenTag:
+		return ":" + t.Value
+	case tokenString:
+		return strconv.Quote(t.Value)
+	}
+	return t.Value
+}
+
+// Error is returned for scripts that can't be parsed.
+type Error struct {
+	Line    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Message)
+}
+
+func errorf(line int, format string, args ...interface{}) error {
+	return &Error{
+		Line:    line,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+// lex splits the script into tokens as defined in RFC 5228, section 8.1.
+func lex(script string) ([]token, error) {
+	var (
+		tokens []token
+		line   = 1
+		i      = 0
+	)
+
+	for i < len(script) {
+		c := script[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == '#':
+			for i < len(script) && script[i] != '\n' {
+				i++
+			}
+		case c == '/' && strings.HasPrefix(script[i:], "/*"):
+			end := strings.Index(script[i+2:], "*/")
+			if end == -1 {
+				return nil, errorf(line, "unterminated comment")
+			}
+			line += strings.Count(script[i:i+2+end], "\n")
+			i += end + 4
+		case strings.IndexByte("[](),;{}", c) != -1:
+			tokens = append(tokens, token{Type: tokenSpecial, Value: string(c), Line: line})
+			i++
+		case c == '"':
+			start := line
+			var value []byte
+			i++
+			for {
+				if i >= len(script) {
+					return nil, errorf(start, "unterminated string")
+				}
+				if script[i] == '"' {
+					i++
+					break
+				}
+				if script[i] == '\\' && i+1 < len(script) {
+					i++
+				}
+				if script[i] == '\n' {
+					line++
+				}
+				value = append(value, script[i])
+				i++
+			}
+			tokens = append(tokens, token{Type: tokenString, Value: string(value), Line: start})
+		case c == ':':
+			j := i + 1
+			for j < len(script) && isIdentifierChar(script[j], j == i+1) {
+				j++
+			}
+			if j == i+1 {
+				return nil, errorf(line, "invalid tag")
+			}
+			tokens = append(tokens, token{Type: tokenTag, Value: strings.ToLower(script[i+1 : j]), Line: line})
+			i = j
+		case c >= '0' && c <= '9':
+			j := i
+			for j < len(script) && script[j] >= '0' && script[j] <= '9' {
+				j++
+			}
+			number, err := strconv.ParseInt(script[i:j], 10, 64)
+			if err != nil {
+				return nil, errorf(line, "invalid number %s", script[i:j])
+			}
+			if j < len(script) {
+				switch script[j] {
+				case 'K', 'k':
+					number <<= 10
+					j++
+				case 'M', 'm':
+					number <<= 20
+					j++
+				case 'G', 'g':
+					number <<= 30
+					j++
+				}
+			}
+			tokens = append(tokens, token{Type: tokenNumber, Value: script[i:j], Number: number, Line: line})
+			i = j
+		case isIdentifierChar(c, true):
+			j := i
+			for j < len(script) && isIdentifierChar(script[j], j == i) {
+				j++
+			}
+			word := strings.ToLower(script[i:j])
+
+			// Multi-line strings end with a line containing a single dot
+			if word == "text" && j < len(script) && script[j] == ':' {
+				start := line
+				eol := strings.Index(script[j:], "\n")
+				if eol == -1 {
+					return nil, errorf(line, "unterminated string")
+				}
+				i = j + eol + 1
+				line++
+
+				var lines []string
+				for {
+					eol := strings.Index(script[i:], "\n")
+					if eol == -1 {
+						return nil, errorf(start, "unterminated string")
+					}
+					current := strings.TrimSuffix(script[i:i+eol], "\r")
+					i += eol + 1
+					line++
+					if current == "." {
+						break
+					}
+					// Dot-stuffing
+					if strings.HasPrefix(current, "..") {
+						current = current[1:]
+					}
+					lines = append(lines, current+"\r\n")
+				}
+				tokens = append(tokens, token{Type: tokenString, Value: strings.Join(lines, ""), Line: start})
+				continue
+			}
+
+			tokens = append(tokens, token{Type: tokenIdentifier, Value: word, Line: line})
+			i = j
+		default:
+			return nil, errorf(line, "unexpected character %q", c)
+		}
+	}
+
+	tokens = append(tokens, token{Type: tokenEOF, Line: line})
+	return tokens, nil
+}
+
+func isIdentifierChar(c byte, first bool) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (!first && c >= '0' && c <= '9')
+}
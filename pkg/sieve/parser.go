@@ -0,0 +1,504 @@
+package sieve
+
+import (
+	"strings"
+)
+
+// Limits that keep the evaluation of user scripts cheap
+const (
+	MaxScriptSize = 64 * 1024
+	MaxNesting    = 16
+	MaxRedirects  = 4
+)
+
+// Capabilities that can be passed to require
+var Capabilities = map[string]struct{}{
+	"fileinto":                   {},
+	"envelope":                   {},
+	"subaddress":                 {},
+	"comparator-i;octet":         {},
+	"comparator-i;ascii-casemap": {},
+}
+
+// Generic syntax tree, as described in RFC 5228, section 8.2
+
+type argument struct {
+	Type    tokenType
+	Tag     string
+	Number  int64
+	Strings []string
+	Line    int
+}
+
+type command struct {
+	Name     string
+	Line     int
+	Args     []argument
+	Tests    []*command
+	Block    []*command
+	HasBlock bool
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.Type != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) isSpecial(value string) bool {
+	t := p.peek()
+	return t.Type == tokenSpecial && t.Value == value
+}
+
+func (p *parser) expect(value string) error {
+	if t := p.next(); t.Type != tokenSpecial || t.Value != value {
+		return errorf(t.Line, "expected %s, got %s", value, t)
+	}
+	return nil
+}
+
+func (p *parser) commands(depth int) ([]*command, error) {
+	if depth > MaxNesting {
+		return nil, errorf(p.peek().Line, "blocks are nested too deeply")
+	}
+
+	var commands []*command
+	for {
+		t := p.peek()
+		if t.Type == tokenEOF || p.isSpecial("}") {
+			return commands, nil
+		}
+		if t.Type != tokenIdentifier {
+			return nil, errorf(t.Line, "expected a command, got %s", t)
+		}
+		p.next()
+
+		cmd := &command{
+			Name: t.Value,
+			Line: t.Line,
+		}
+		if err := p.arguments(cmd, depth); err != nil {
+			return nil, err
+		}
+
+		if p.isSpecial("{") {
+			p.next()
+			block, err := p.commands(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("}"); err != nil {
+				return nil, err
+			}
+			cmd.Block = block
+			cmd.HasBlock = true
+		} else if err := p.expect(";"); err != nil {
+			return nil, err
+		}
+
+		commands = append(commands, cmd)
+	}
+}
+
+// arguments parses the arguments and tests of a command or a test.
+func (p *parser) arguments(cmd *command, depth int) error {
+	for {
+		t := p.peek()
+		switch {
+		case t.Type == tokenTag:
+			p.next()
+			cmd.Args = append(cmd.Args, argument{Type: tokenTag, Tag: t.Value, Line: t.Line})
+		case t.Type == tokenNumber:
+			p.next()
+			cmd.Args = append(cmd.Args, argument{Type: tokenNumber, Number: t.Number, Line: t.Line})
+		case t.Type == tokenString:
+			p.next()
+			cmd.Args = append(cmd.Args, argument{Type: tokenString, Strings: []string{t.Value}, Line: t.Line})
+		case p.isSpecial("["):
+			p.next()
+			list := argument{Type: tokenString, Strings: []string{}, Line: t.Line}
+			for {
+				s := p.next()
+				if s.Type != tokenString {
+					return errorf(s.Line, "expected a string, got %s", s)
+				}
+				list.Strings = append(list.Strings, s.Value)
+				if p.isSpecial("]") {
+					p.next()
+					break
+				}
+				if err := p.expect(","); err != nil {
+					return err
+				}
+			}
+			cmd.Args = append(cmd.Args, list)
+		default:
+			return p.tests(cmd, depth)
+		}
+	}
+}
+
+func (p *parser) tests(cmd *command, depth int) error {
+	if depth > MaxNesting {
+		return errorf(p.peek().Line, "tests are nested too deeply")
+	}
+
+	t := p.peek()
+	if t.Type == tokenIdentifier {
+		test, err := p.test(depth)
+		if err != nil {
+			return err
+		}
+		cmd.Tests = []*command{test}
+		return nil
+	}
+
+	if p.isSpecial("(") {
+		p.next()
+		for {
+			test, err := p.test(depth)
+			if err != nil {
+				return err
+			}
+			cmd.Tests = append(cmd.Tests, test)
+			if p.isSpecial(")") {
+				p.next()
+				return nil
+			}
+			if err := p.expect(","); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (p *parser) test(depth int) (*command, error) {
+	t := p.next()
+	if t.Type != tokenIdentifier {
+		return nil, errorf(t.Line, "expected a test, got %s", t)
+	}
+
+	test := &command{
+		Name: t.Value,
+		Line: t.Line,
+	}
+	if err := p.arguments(test, depth+1); err != nil {
+		return nil, err
+	}
+	return test, nil
+}
+
+// Compiled script
+
+// Script is a parsed and validated Sieve script.
+type Script struct {
+	commands []node
+}
+
+type node interface{}
+
+type branch struct {
+	condition condition // nil for else
+	block     []node
+}
+
+type ifNode struct {
+	branches []branch
+}
+
+type actionNode struct {
+	name     string
+	argument string
+}
+
+type stopNode struct{}
+
+// Parse validates the script and prepares it for evaluation.
+func Parse(script string) (*Script, error) {
+	if len(script) > MaxScriptSize {
+		return nil, errorf(1, "script is too large")
+	}
+
+	tokens, err := lex(script)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	commands, err := p.commands(0)
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.Type != tokenEOF {
+		return nil, errorf(t.Line, "unexpected %s", t)
+	}
+
+	c := &compiler{
+		required: map[string]struct{}{},
+	}
+	nodes, err := c.block(commands, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Script{commands: nodes}, nil
+}
+
+type compiler struct {
+	required map[string]struct{}
+}
+
+func (c *compiler) block(commands []*command, top bool) ([]node, error) {
+	var (
+		nodes    []node
+		previous string
+		started  bool
+	)
+
+	for _, cmd := range commands {
+		if cmd.HasBlock && cmd.Name != "if" && cmd.Name != "elsif" && cmd.Name != "else" {
+			return nil, errorf(cmd.Line, "%s does not take a block", cmd.Name)
+		}
+		if cmd.Name != "require" {
+			started = true
+		}
+
+		switch cmd.Name {
+		case "require":
+			if !top || started {
+				return nil, errorf(cmd.Line, "require has to be placed at the start of the script")
+			}
+			capabilities, err := stringsArgument(cmd)
+			if err != nil {
+				return nil, err
+			}
+			for _, capability := range capabilities {
+				if _, ok := Capabilities[capability]; !ok {
+					return nil, errorf(cmd.Line, "unsupported capability %q", capability)
+				}
+				c.required[capability] = struct{}{}
+			}
+		case "if", "elsif", "else":
+			if !cmd.HasBlock {
+				return nil, errorf(cmd.Line, "%s requires a block", cmd.Name)
+			}
+			if cmd.Name != "if" && previous != "if" && previous != "elsif" {
+				return nil, errorf(cmd.Line, "%s without a preceding if", cmd.Name)
+			}
+
+			var cond condition
+			if cmd.Name == "else" {
+				if len(cmd.Args) > 0 || len(cmd.Tests) > 0 {
+					return nil, errorf(cmd.Line, "else does not take arguments")
+				}
+			} else {
+				if len(cmd.Args) > 0 || len(cmd.Tests) != 1 {
+					return nil, errorf(cmd.Line, "%s requires a single test", cmd.Name)
+				}
+				var err error
+				if cond, err = c.test(cmd.Tests[0]); err != nil {
+					return nil, err
+				}
+			}
+
+			block, err := c.block(cmd.Block, false)
+			if err != nil {
+				return nil, err
+			}
+
+			if cmd.Name == "if" {
+				nodes = append(nodes, &ifNode{})
+			}
+			last := nodes[len(nodes)-1].(*ifNode)
+			last.branches = append(last.branches, branch{
+				condition: cond,
+				block:     block,
+			})
+		case "stop", "keep", "discard":
+			if len(cmd.Args) > 0 || len(cmd.Tests) > 0 {
+				return nil, errorf(cmd.Line, "%s does not take arguments", cmd.Name)
+			}
+			if cmd.Name == "stop" {
+				nodes = append(nodes, stopNode{})
+			} else {
+				nodes = append(nodes, actionNode{name: cmd.Name})
+			}
+		case "fileinto", "redirect":
+			if _, ok := c.required["fileinto"]; cmd.Name == "fileinto" && !ok {
+				return nil, errorf(cmd.Line, "fileinto used without require \"fileinto\"")
+			}
+			values, err := stringsArgument(cmd)
+			if err != nil {
+				return nil, err
+			}
+			if len(values) != 1 || values[0] == "" {
+				return nil, errorf(cmd.Line, "%s requires a single non-empty string", cmd.Name)
+			}
+			if cmd.Name == "redirect" && strings.Index(values[0], "@") < 1 {
+				return nil, errorf(cmd.Line, "redirect requires an email address")
+			}
+			nodes = append(nodes, actionNode{name: cmd.Name, argument: values[0]})
+		default:
+			return nil, errorf(cmd.Line, "unknown command %s", cmd.Name)
+		}
+
+		previous = cmd.Name
+	}
+
+	return nodes, nil
+}
+
+// stringsArgument returns the only argument of a command, a string list.
+func stringsArgument(cmd *command) ([]string, error) {
+	if len(cmd.Args) != 1 || cmd.Args[0].Type != tokenString || len(cmd.Tests) > 0 {
+		return nil, errorf(cmd.Line, "%s requires a string argument", cmd.Name)
+	}
+	return cmd.Args[0].Strings, nil
+}
+
+func (c *compiler) test(cmd *command) (condition, error) {
+	switch cmd.Name {
+	case "true", "false":
+		if len(cmd.Args) > 0 || len(cmd.Tests) > 0 {
+			return nil, errorf(cmd.Line, "%s does not take arguments", cmd.Name)
+		}
+		return constantTest(cmd.Name == "true"), nil
+	case "not":
+		if len(cmd.Args) > 0 || len(cmd.Tests) != 1 {
+			return nil, errorf(cmd.Line, "not requires a single test")
+		}
+		cond, err := c.test(cmd.Tests[0])
+		if err != nil {
+			return nil, err
+		}
+		return notTest{cond}, nil
+	case "allof", "anyof":
+		if len(cmd.Args) > 0 || len(cmd.Tests) == 0 {
+			return nil, errorf(cmd.Line, "%s requires a list of tests", cmd.Name)
+		}
+		var conds []condition
+		for _, test := range cmd.Tests {
+			cond, err := c.test(test)
+			if err != nil {
+				return nil, err
+			}
+			conds = append(conds, cond)
+		}
+		return listTest{all: cmd.Name == "allof", tests: conds}, nil
+	case "exists":
+		headers, err := stringsArgument(cmd)
+		if err != nil {
+			return nil, err
+		}
+		return existsTest{headers}, nil
+	case "size":
+		if len(cmd.Args) != 2 || cmd.Args[0].Type != tokenTag || cmd.Args[1].Type != tokenNumber || len(cmd.Tests) > 0 {
+			return nil, errorf(cmd.Line, "size requires :over or :under and a number")
+		}
+		if tag := cmd.Args[0].Tag; tag != "over" && tag != "under" {
+			return nil, errorf(cmd.Line, "unknown tag :%s", tag)
+		}
+		return sizeTest{over: cmd.Args[0].Tag == "over", limit: cmd.Args[1].Number}, nil
+	case "header", "address", "envelope":
+		return c.matchTest(cmd)
+	}
+
+	return nil, errorf(cmd.Line, "unknown test %s", cmd.Name)
+}
+
+// matchTest compiles the tests that compare a list of values with keys.
+func (c *compiler) matchTest(cmd *command) (condition, error) {
+	if cmd.Name == "envelope" {
+		if _, ok := c.required["envelope"]; !ok {
+			return nil, errorf(cmd.Line, "envelope used without require \"envelope\"")
+		}
+	}
+	if len(cmd.Tests) > 0 {
+		return nil, errorf(cmd.Line, "%s does not take tests", cmd.Name)
+	}
+
+	test := &matchTest{
+		source:  cmd.Name,
+		part:    "all",
+		matcher: matcher{comparator: "i;ascii-casemap", matchType: "is"},
+	}
+
+	var (
+		lists     [][]string
+		seenMatch bool
+		seenPart  bool
+	)
+	for i := 0; i < len(cmd.Args); i++ {
+		arg := cmd.Args[i]
+		switch arg.Type {
+		case tokenTag:
+			if len(lists) > 0 {
+				return nil, errorf(arg.Line, "tags have to precede the other arguments")
+			}
+			switch arg.Tag {
+			case "is", "contains", "matches":
+				if seenMatch {
+					return nil, errorf(arg.Line, "only one match type is allowed")
+				}
+				seenMatch = true
+				test.matcher.matchType = arg.Tag
+			case "all", "localpart", "domain", "user", "detail":
+				if cmd.Name == "header" || seenPart {
+					return nil, errorf(arg.Line, "unexpected tag :%s", arg.Tag)
+				}
+				if arg.Tag == "user" || arg.Tag == "detail" {
+					if _, ok := c.required["subaddress"]; !ok {
+						return nil, errorf(arg.Line, ":%s used without require \"subaddress\"", arg.Tag)
+					}
+				}
+				seenPart = true
+				test.part = arg.Tag
+			case "comparator":
+				if i+1 >= len(cmd.Args) || cmd.Args[i+1].Type != tokenString || len(cmd.Args[i+1].Strings) != 1 {
+					return nil, errorf(arg.Line, ":comparator requires a string")
+				}
+				i++
+				comparator := cmd.Args[i].Strings[0]
+				if comparator != "i;octet" && comparator != "i;ascii-casemap" {
+					return nil, errorf(arg.Line, "unsupported comparator %q", comparator)
+				}
+				test.matcher.comparator = comparator
+			default:
+				return nil, errorf(arg.Line, "unknown tag :%s", arg.Tag)
+			}
+		case tokenString:
+			lists = append(lists, arg.Strings)
+		default:
+			return nil, errorf(arg.Line, "unexpected number")
+		}
+	}
+
+	if len(lists) != 2 {
+		return nil, errorf(cmd.Line, "%s requires a list of names and a list of keys", cmd.Name)
+	}
+	test.names = lists[0]
+	test.keys = lists[1]
+
+	if cmd.Name == "envelope" {
+		for _, name := range test.names {
+			if name = strings.ToLower(name); name != "from" && name != "to" {
+				return nil, errorf(cmd.Line, "unsupported envelope part %q", name)
+			}
+		}
+	}
+
+	return test, nil
+}
@@ -0,0 +1,162 @@
+package sieve_test
+
+import (
+	"bufio"
+	"net/mail"
+	"strings"
+	"testing"
+
+	. "github.com/pgpst/pgpst/internal/github.com/smartystreets/goconvey/convey"
+
+	"github.com/pgpst/pgpst/pkg/sieve"
+)
+
+var testMessage = "From: \"Joe SixPack\" <Joe@Football.example.com>\r\n" +
+	"To: Suzie Q <suzie@pgp.st>, list@lists.example.org\r\n" +
+	"Cc: =?UTF-8?Q?Zo=C3=AB?= <zoe@example.net>\r\n" +
+	"Subject: =?UTF-8?Q?Is_dinner_ready=3F?=\r\n" +
+	"List-Id: <football.lists.example.org>\r\n" +
+	"X-Spam-Flag: YES\r\n" +
+	"\r\n" +
+	"Hi.\r\n"
+
+func parseMessage() *sieve.Message {
+	msg, err := mail.ReadMessage(bufio.NewReader(strings.NewReader(testMessage)))
+	if err != nil {
+		panic(err)
+	}
+
+	return &sieve.Message{
+		Header:    msg.Header,
+		Sender:    "bounces+joe@football.example.com",
+		Recipient: "suzie@pgp.st",
+		Size:      len(testMessage),
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	cases := []struct {
+		Script   string
+		Keep     bool
+		FileInto []string
+		Redirect []string
+	}{
+		// Implicit and explicit keep
+		{``, true, nil, nil},
+		{`keep;`, true, nil, nil},
+		{`discard;`, false, nil, nil},
+		{`discard; keep;`, true, nil, nil},
+		{`stop; discard;`, true, nil, nil},
+
+		// Actions
+		{`require "fileinto"; fileinto "Sports";`, false, []string{"Sports"}, nil},
+		{`require ["fileinto"]; fileinto "Sports"; keep; fileinto "Sports";`, true, []string{"Sports"}, nil},
+		{`redirect "joe@example.org";`, false, nil, []string{"joe@example.org"}},
+		{`redirect "a@example.org"; redirect "b@example.org"; redirect "c@example.org"; redirect "d@example.org"; redirect "e@example.org";`,
+			false, nil, []string{"a@example.org", "b@example.org", "c@example.org", "d@example.org"}},
+
+		// Header tests
+		{`if header :contains "subject" "dinner" { discard; }`, false, nil, nil},
+		{`if header :is "Subject" "is dinner ready?" { discard; }`, false, nil, nil},
+		{`if header :is :comparator "i;octet" "Subject" "is dinner ready?" { discard; }`, true, nil, nil},
+		{`if header :matches "subject" "*dinner*?" { discard; }`, false, nil, nil},
+		{`if header :matches "subject" "dinner*" { discard; }`, true, nil, nil},
+		{`if header :matches "list-id" "<*.lists.example.org>" { discard; }`, false, nil, nil},
+		{`if header :contains "cc" "Zoë" { discard; }`, false, nil, nil},
+		{`if header :is ["X-Spam-Flag", "X-Other"] ["no", "yes"] { discard; }`, false, nil, nil},
+		{`if header :contains "x-missing" "" { discard; }`, true, nil, nil},
+
+		// Address tests
+		{`if address :is "from" "joe@football.example.com" { discard; }`, false, nil, nil},
+		{`if address :domain :is "to" "lists.example.org" { discard; }`, false, nil, nil},
+		{`if address :localpart :is "to" "suzie" { discard; }`, false, nil, nil},
+		{`if address :localpart :is "from" "football" { discard; }`, true, nil, nil},
+		{`if address :all :matches ["to", "cc"] "*@example.net" { discard; }`, false, nil, nil},
+
+		// Envelope tests
+		{`require "envelope"; if envelope :is "to" "suzie@pgp.st" { discard; }`, false, nil, nil},
+		{`require "envelope"; if envelope :matches :localpart "from" "bounces+*" { discard; }`, false, nil, nil},
+		{`require "envelope"; if envelope :domain "from" "pgp.st" { discard; }`, true, nil, nil},
+		{`require ["envelope", "subaddress"]; if envelope :detail "from" "joe" { discard; }`, false, nil, nil},
+		{`require ["envelope", "subaddress"]; if envelope :user "from" "bounces" { discard; }`, false, nil, nil},
+		{`require ["envelope", "subaddress"]; if envelope :detail :matches "to" "*" { discard; }`, true, nil, nil},
+		{`require ["envelope", "subaddress"]; if envelope :user "to" "suzie" { discard; }`, false, nil, nil},
+		{`require "subaddress"; if address :user "from" "joe" { discard; }`, false, nil, nil},
+
+		// Size tests
+		{`if size :over 100 { discard; }`, false, nil, nil},
+		{`if size :under 1K { discard; }`, false, nil, nil},
+		{`if size :over 1M { discard; }`, true, nil, nil},
+
+		// Control flow
+		{`if false { discard; } elsif true { redirect "a@example.org"; } else { keep; }`, false, nil, []string{"a@example.org"}},
+		{`if false { discard; } elsif false { redirect "a@example.org"; } else { keep; }`, true, nil, nil},
+		{`if not exists "x-spam-flag" { stop; } discard;`, false, nil, nil},
+		{`if allof (exists "from", size :over 10K) { discard; }`, true, nil, nil},
+		{`if anyof (exists "x-missing", header :is "x-spam-flag" "yes") { discard; }`, false, nil, nil},
+		{"# comment\r\n/* multi\r\nline */\r\nif header :is \"subject\" text:\r\nIs dinner ready?\r\n.\r\n{ discard; }", true, nil, nil},
+		{"require \"fileinto\";\nif header :contains \"list-id\" \"lists.example.org\" {\n\tfileinto \"Lists\";\n\tstop;\n}\nfileinto \"Other\";\n", false, []string{"Lists"}, nil},
+	}
+
+	for _, c := range cases {
+		Convey("Evaluating "+c.Script, t, func() {
+			script, err := sieve.Parse(c.Script)
+			So(err, ShouldBeNil)
+
+			result := script.Evaluate(parseMessage())
+			So(result.Keep, ShouldEqual, c.Keep)
+			So(result.FileInto, ShouldResemble, c.FileInto)
+			So(result.Redirect, ShouldResemble, c.Redirect)
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		Script string
+		Line   int
+	}{
+		{`keep`, 1},
+		{`fileinto "Sports";`, 1},
+		{`require "fileinto";` + "\n" + `fileinto ["a", "b"];`, 2},
+		{`require "vacation";`, 1},
+		{`keep; require "fileinto";`, 1},
+		{`if true { require "fileinto"; }`, 1},
+		{`if envelope :is "to" "a@pgp.st" { keep; }`, 1},
+		{`require "envelope"; if envelope :is "date" "x" { keep; }`, 1},
+		{`if header :is "subject" { keep; }`, 1},
+		{`if header :domain "from" "x" { keep; }`, 1},
+		{`if address :detail "from" "x" { keep; }`, 1},
+		{`require "subaddress"; if header :user "from" "x" { keep; }`, 1},
+		{`if header :is :contains "subject" "x" { keep; }`, 1},
+		{`if header :comparator "i;unicode-casemap" "subject" "x" { keep; }`, 1},
+		{`if size 100 { keep; }`, 1},
+		{`if size :over "100" { keep; }`, 1},
+		{`if true keep;`, 1},
+		{"\n\nelse { keep; }", 3},
+		{`if (true, false) { keep; }`, 1},
+		{`if unknown { keep; }`, 1},
+		{`vacation "gone";`, 1},
+		{`keep { discard; }`, 1},
+		{`redirect "nobody";`, 1},
+		{`redirect "";`, 1},
+		{`if header :is "subject" "x { keep; }`, 1},
+		{"/* unterminated", 1},
+		{`if true { keep; `, 1},
+		{`keep; }`, 1},
+		{`if header :is ["a", ] "x" { keep; }`, 1},
+		{`if true { ` + strings.Repeat(`if true { `, 20) + strings.Repeat(`} `, 21), 1},
+		{strings.Repeat("#", sieve.MaxScriptSize+1), 1},
+	}
+
+	for _, c := range cases {
+		Convey("Parsing "+c.Script[:len(c.Script)%80]+" should fail", t, func() {
+			_, err := sieve.Parse(c.Script)
+			So(err, ShouldNotBeNil)
+
+			serr, ok := err.(*sieve.Error)
+			So(ok, ShouldBeTrue)
+			So(serr.Line, ShouldEqual, c.Line)
+		})
+	}
+}
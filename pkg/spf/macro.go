@@ -0,0 +1,141 @@
+package spf
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// expand replaces the macros in a domain-spec, as in RFC 7208, section 7.
+func (c *checker) expand(spec string, domain string) (string, error) {
+	if strings.IndexByte(spec, '%') == -1 {
+		return strings.ToLower(strings.TrimSuffix(spec, ".")), nil
+	}
+
+	result := []byte{}
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != '%' {
+			result = append(result, spec[i])
+			continue
+		}
+
+		i++
+		if i >= len(spec) {
+			return "", fmt.Errorf("Invalid macro in %s", spec)
+		}
+
+		switch spec[i] {
+		case '%':
+			result = append(result, '%')
+		case '_':
+			result = append(result, ' ')
+		case '-':
+			result = append(result, "%20"...)
+		case '{':
+			end := strings.IndexByte(spec[i:], '}')
+			if end == -1 {
+				return "", fmt.Errorf("Unterminated macro in %s", spec)
+			}
+			value, err := c.macro(spec[i+1:i+end], domain)
+			if err != nil {
+				return "", err
+			}
+			result = append(result, value...)
+			i += end
+		default:
+			return "", fmt.Errorf("Invalid macro in %s", spec)
+		}
+	}
+
+	return strings.ToLower(strings.TrimSuffix(string(result), ".")), nil
+}
+
+// macro expands the contents of a single %{...} macro.
+func (c *checker) macro(macro string, domain string) (string, error) {
+	if len(macro) == 0 {
+		return "", fmt.Errorf("Empty macro")
+	}
+
+	var value string
+	switch macro[0] {
+	case 's', 'S':
+		value = c.sender
+	case 'l', 'L':
+		value = c.sender[:strings.LastIndex(c.sender, "@")]
+	case 'o', 'O':
+		value = c.sender[strings.LastIndex(c.sender, "@")+1:]
+	case 'd', 'D':
+		value = domain
+	case 'h', 'H':
+		value = c.helo
+	case 'i', 'I':
+		value = dottedIP(c.ip)
+	case 'v', 'V':
+		value = "in-addr"
+		if c.ip.To4() == nil {
+			value = "ip6"
+		}
+	default:
+		return "", fmt.Errorf("Unknown macro letter %c", macro[0])
+	}
+
+	// Parse the transformers
+	rest := macro[1:]
+	digits := 0
+	for digits < len(rest) && rest[digits] >= '0' && rest[digits] <= '9' {
+		digits++
+	}
+	keep := 0
+	if digits > 0 {
+		var err error
+		keep, err = strconv.Atoi(rest[:digits])
+		if err != nil || keep == 0 {
+			return "", fmt.Errorf("Invalid macro transformer in %s", macro)
+		}
+	}
+	rest = rest[digits:]
+	reverse := false
+	if len(rest) > 0 && (rest[0] == 'r' || rest[0] == 'R') {
+		reverse = true
+		rest = rest[1:]
+	}
+	delimiters := "."
+	if rest != "" {
+		if strings.Trim(rest, ".-+,/_=") != "" {
+			return "", fmt.Errorf("Invalid macro delimiters in %s", macro)
+		}
+		delimiters = rest
+	}
+
+	if keep == 0 && !reverse && delimiters == "." {
+		return value, nil
+	}
+
+	parts := strings.FieldsFunc(value, func(r rune) bool {
+		return strings.ContainsRune(delimiters, r)
+	})
+	if reverse {
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+	}
+	if keep > 0 && keep < len(parts) {
+		parts = parts[len(parts)-keep:]
+	}
+
+	return strings.Join(parts, "."), nil
+}
+
+// dottedIP formats IPv6 addresses as dot-separated nibbles.
+func dottedIP(ip net.IP) string {
+	if x := ip.To4(); x != nil {
+		return x.String()
+	}
+
+	nibbles := make([]string, 0, 32)
+	for _, b := range ip.To16() {
+		nibbles = append(nibbles, strconv.FormatInt(int64(b>>4), 16), strconv.FormatInt(int64(b&0xf), 16))
+	}
+	return strings.Join(nibbles, ".")
+}
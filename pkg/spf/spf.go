@@ -0,0 +1,398 @@
+// Package spf implements the check_host function of the Sender Policy
+// Framework, as in RFC 7208.
+package spf
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+type Result string
+
+const (
+	None      Result = "none"
+	Neutral   Result = "neutral"
+	Pass      Result = "pass"
+	Fail      Result = "fail"
+	SoftFail  Result = "softfail"
+	TempError Result = "temperror"
+	PermError Result = "permerror"
+)
+
+// Resolver is the subset of DNS lookups used by the checks.
+type Resolver interface {
+	LookupTXT(name string) ([]string, error)
+	LookupIP(host string) ([]net.IP, error)
+	LookupMX(name string) ([]*net.MX, error)
+	LookupAddr(addr string) ([]string, error)
+}
+
+// Max amount of DNS-querying terms, as in RFC 7208, section 4.6.4
+const lookupLimit = 10
+
+var errLookupLimit = errors.New("Too many DNS lookups")
+
+type checker struct {
+	resolver Resolver
+	ip       net.IP
+	sender   string
+	helo     string
+	lookups  int
+}
+
+// Check evaluates the SPF policy of the MAIL FROM domain for a connection
+// from ip. If sender is empty, the HELO name is checked instead.
+func Check(resolver Resolver, ip net.IP, helo string, sender string) (Result, string) {
+	if sender == "" {
+		sender = "postmaster@" + helo
+	}
+	if strings.Index(sender, "@") == -1 {
+		sender = "postmaster@" + sender
+	}
+	domain := strings.ToLower(sender[strings.LastIndex(sender, "@")+1:])
+
+	return CheckHost(resolver, ip, domain, sender, helo), domain
+}
+
+// CheckHost is the check_host() function from RFC 7208, section 4.
+func CheckHost(resolver Resolver, ip net.IP, domain string, sender string, helo string) Result {
+	c := &checker{
+		resolver: resolver,
+		ip:       ip,
+		sender:   sender,
+		helo:     helo,
+	}
+
+	return c.check(domain)
+}
+
+func isTemporary(err error) bool {
+	if de, ok := err.(*net.DNSError); ok {
+		return de.Temporary() || de.Timeout()
+	}
+	return false
+}
+
+func (c *checker) record(domain string) (string, Result) {
+	records, err := c.resolver.LookupTXT(domain)
+	if err != nil {
+		if isTemporary(err) {
+			return "", TempError
+		}
+		return "", None
+	}
+
+	found := []string{}
+	for _, record := range records {
+		lower := strings.ToLower(record)
+		if lower == "v=spf1" || strings.HasPrefix(lower, "v=spf1 ") {
+			found = append(found, record)
+		}
+	}
+
+	if len(found) == 0 {
+		return "", None
+	}
+	if len(found) > 1 {
+		return "", PermError
+	}
+
+	return found[0], ""
+}
+
+func (c *checker) check(domain string) Result {
+	record, result := c.record(domain)
+	if result != "" {
+		return result
+	}
+
+	var redirect string
+	for _, term := range strings.Fields(record)[1:] {
+		// Modifiers have an equals sign before any of the mechanism separators
+		if eq := strings.IndexByte(term, '='); eq != -1 && strings.IndexAny(term[:eq], ":/") == -1 {
+			name := strings.ToLower(term[:eq])
+			if name == "redirect" {
+				if redirect != "" {
+					return PermError
+				}
+				redirect = term[eq+1:]
+			}
+			// exp and unknown modifiers are ignored
+			continue
+		}
+
+		// Extract the qualifier
+		qualifier := Pass
+		switch term[0] {
+		case '+':
+			term = term[1:]
+		case '-':
+			qualifier = Fail
+			term = term[1:]
+		case '~':
+			qualifier = SoftFail
+			term = term[1:]
+		case '?':
+			qualifier = Neutral
+			term = term[1:]
+		}
+
+		matched, err := c.mechanism(domain, term)
+		if err != nil {
+			if isTemporary(err) {
+				return TempError
+			}
+			return PermError
+		}
+		if matched {
+			return qualifier
+		}
+	}
+
+	if redirect != "" {
+		if err := c.count(); err != nil {
+			return PermError
+		}
+
+		target, err := c.expand(redirect, domain)
+		if err != nil {
+			return PermError
+		}
+
+		result := c.check(target)
+		if result == None {
+			return PermError
+		}
+		return result
+	}
+
+	return Neutral
+}
+
+func (c *checker) count() error {
+	c.lookups++
+	if c.lookups > lookupLimit {
+		return errLookupLimit
+	}
+	return nil
+}
+
+// mechanism returns whether the mechanism matches. Errors abort the check
+// with either a temperror or a permerror.
+func (c *checker) mechanism(domain string, term string) (bool, error) {
+	// Split into the name and the argument
+	name := term
+	arg := ""
+	if i := strings.IndexAny(term, ":/"); i != -1 {
+		name = term[:i]
+		arg = term[i:]
+	}
+	name = strings.ToLower(name)
+
+	switch name {
+	case "all":
+		if arg != "" {
+			return false, fmt.Errorf("Invalid all mechanism: %s", term)
+		}
+		return true, nil
+	case "include":
+		if !strings.HasPrefix(arg, ":") {
+			return false, fmt.Errorf("Invalid include mechanism: %s", term)
+		}
+		if err := c.count(); err != nil {
+			return false, err
+		}
+		target, err := c.expand(arg[1:], domain)
+		if err != nil {
+			return false, err
+		}
+		switch c.check(target) {
+		case Pass:
+			return true, nil
+		case Fail, SoftFail, Neutral:
+			return false, nil
+		case TempError:
+			return false, &net.DNSError{Err: "temporary error in include", Name: target, IsTemporary: true}
+		}
+		return false, fmt.Errorf("Include of %s failed", target)
+	case "a", "mx":
+		if err := c.count(); err != nil {
+			return false, err
+		}
+		target, ip4, ip6, err := c.domainCIDR(arg, domain)
+		if err != nil {
+			return false, err
+		}
+
+		hosts := []string{target}
+		if name == "mx" {
+			records, err := c.resolver.LookupMX(target)
+			if err != nil {
+				if isTemporary(err) {
+					return false, err
+				}
+				return false, nil
+			}
+			if len(records) > lookupLimit {
+				return false, errLookupLimit
+			}
+			hosts = []string{}
+			for _, record := range records {
+				hosts = append(hosts, strings.TrimSuffix(record.Host, "."))
+			}
+		}
+
+		for _, host := range hosts {
+			ips, err := c.resolver.LookupIP(host)
+			if err != nil {
+				if isTemporary(err) {
+					return false, err
+				}
+				continue
+			}
+			for _, ip := range ips {
+				if c.inCIDR(ip, ip4, ip6) {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+	case "ip4", "ip6":
+		if !strings.HasPrefix(arg, ":") {
+			return false, fmt.Errorf("Invalid %s mechanism: %s", name, term)
+		}
+		value := arg[1:]
+		if strings.Index(value, "/") == -1 {
+			if name == "ip4" {
+				value += "/32"
+			} else {
+				value += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return false, err
+		}
+		if (name == "ip4") != (network.IP.To4() != nil) {
+			return false, fmt.Errorf("Invalid %s network: %s", name, value)
+		}
+		return network.Contains(c.ip), nil
+	case "exists":
+		if !strings.HasPrefix(arg, ":") {
+			return false, fmt.Errorf("Invalid exists mechanism: %s", term)
+		}
+		if err := c.count(); err != nil {
+			return false, err
+		}
+		target, err := c.expand(arg[1:], domain)
+		if err != nil {
+			return false, err
+		}
+		ips, err := c.resolver.LookupIP(target)
+		if err != nil {
+			if isTemporary(err) {
+				return false, err
+			}
+			return false, nil
+		}
+		for _, ip := range ips {
+			if ip.To4() != nil {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "ptr":
+		if err := c.count(); err != nil {
+			return false, err
+		}
+		target := domain
+		if strings.HasPrefix(arg, ":") {
+			var err error
+			target, err = c.expand(arg[1:], domain)
+			if err != nil {
+				return false, err
+			}
+		}
+		names, err := c.resolver.LookupAddr(c.ip.String())
+		if err != nil {
+			return false, nil
+		}
+		for i, name := range names {
+			if i >= lookupLimit {
+				break
+			}
+			name = strings.ToLower(strings.TrimSuffix(name, "."))
+			if name != target && !strings.HasSuffix(name, "."+target) {
+				continue
+			}
+			// The name has to resolve back to the IP
+			ips, err := c.resolver.LookupIP(name)
+			if err != nil {
+				continue
+			}
+			for _, ip := range ips {
+				if ip.Equal(c.ip) {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+	}
+
+	return false, fmt.Errorf("Unknown mechanism: %s", term)
+}
+
+// domainCIDR parses the [:domain][/cidr4][//cidr6] argument of a and mx.
+func (c *checker) domainCIDR(arg string, domain string) (string, int, int, error) {
+	var (
+		target = domain
+		ip4    = 32
+		ip6    = 128
+		err    error
+	)
+
+	if i := strings.Index(arg, "//"); i != -1 {
+		ip6, err = strconv.Atoi(arg[i+2:])
+		if err != nil || ip6 < 0 || ip6 > 128 {
+			return "", 0, 0, fmt.Errorf("Invalid IPv6 CIDR length: %s", arg)
+		}
+		arg = arg[:i]
+	}
+	if i := strings.LastIndex(arg, "/"); i != -1 {
+		ip4, err = strconv.Atoi(arg[i+1:])
+		if err != nil || ip4 < 0 || ip4 > 32 {
+			return "", 0, 0, fmt.Errorf("Invalid IPv4 CIDR length: %s", arg)
+		}
+		arg = arg[:i]
+	}
+	if strings.HasPrefix(arg, ":") {
+		target, err = c.expand(arg[1:], domain)
+		if err != nil {
+			return "", 0, 0, err
+		}
+	} else if arg != "" {
+		return "", 0, 0, fmt.Errorf("Invalid domain spec: %s", arg)
+	}
+
+	return target, ip4, ip6, nil
+}
+
+func (c *checker) inCIDR(ip net.IP, ip4 int, ip6 int) bool {
+	if x := c.ip.To4(); x != nil {
+		y := ip.To4()
+		if y == nil {
+			return false
+		}
+		mask := net.CIDRMask(ip4, 32)
+		return x.Mask(mask).Equal(y.Mask(mask))
+	}
+
+	if ip.To4() != nil {
+		return false
+	}
+	mask := net.CIDRMask(ip6, 128)
+	return c.ip.To16().Mask(mask).Equal(ip.To16().Mask(mask))
+}
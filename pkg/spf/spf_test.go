@@ -0,0 +1,120 @@
+package spf_test
+
+import (
+	"net"
+	"testing"
+
+	. "github.com/pgpst/pgpst/internal/github.com/smartystreets/goconvey/convey"
+
+	"github.com/pgpst/pgpst/pkg/spf"
+)
+
+type fakeResolver struct {
+	TXT map[string][]string
+	IP  map[string][]net.IP
+	MX  map[string][]*net.MX
+	PTR map[string][]string
+}
+
+func notFound(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name}
+}
+
+func (f *fakeResolver) LookupTXT(name string) ([]string, error) {
+	if name == "temp.example" {
+		return nil, &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+	}
+	if x, ok := f.TXT[name]; ok {
+		return x, nil
+	}
+	return nil, notFound(name)
+}
+
+func (f *fakeResolver) LookupIP(host string) ([]net.IP, error) {
+	if x, ok := f.IP[host]; ok {
+		return x, nil
+	}
+	return nil, notFound(host)
+}
+
+func (f *fakeResolver) LookupMX(name string) ([]*net.MX, error) {
+	if x, ok := f.MX[name]; ok {
+		return x, nil
+	}
+	return nil, notFound(name)
+}
+
+func (f *fakeResolver) LookupAddr(addr string) ([]string, error) {
+	if x, ok := f.PTR[addr]; ok {
+		return x, nil
+	}
+	return nil, notFound(addr)
+}
+
+func TestCheck(t *testing.T) {
+	resolver := &fakeResolver{
+		TXT: map[string][]string{
+			"example.org":        {"v=spf1 ip4:192.0.2.0/24 ip6:2001:db8::/32 a:mail.example.org mx include:_spf.example.org ~all"},
+			"_spf.example.org":   {"v=spf1 ip4:198.51.100.7 -all"},
+			"strict.example.org": {"some verification record", "v=spf1 -all"},
+			"double.example.org": {"v=spf1 +all", "v=spf1 -all"},
+			"broken.example.org": {"v=spf1 foo:bar"},
+			"redir.example.org":  {"v=spf1 redirect=_spf.example.org"},
+			"macro.example.org":  {"v=spf1 exists:%{ir}.%{l1r-}.allow.%{d} ?all"},
+			"loop.example.org":   {"v=spf1 include:loop.example.org"},
+			"ptr.example.org":    {"v=spf1 ptr -all"},
+		},
+		IP: map[string][]net.IP{
+			"mail.example.org":                       {net.ParseIP("203.0.113.1")},
+			"mx.example.org":                         {net.ParseIP("203.0.113.2")},
+			"10.2.0.192.bob.allow.macro.example.org": {net.ParseIP("127.0.0.2")},
+			"host.ptr.example.org":                   {net.ParseIP("203.0.113.9")},
+		},
+		MX: map[string][]*net.MX{
+			"example.org": {{Host: "mx.example.org.", Pref: 10}},
+		},
+		PTR: map[string][]string{
+			"203.0.113.9": {"host.ptr.example.org."},
+		},
+	}
+
+	cases := []struct {
+		Name   string
+		IP     string
+		Sender string
+		Result spf.Result
+	}{
+		{"ip4 networks", "192.0.2.10", "alice@example.org", spf.Pass},
+		{"ip6 networks", "2001:db8::1", "alice@example.org", spf.Pass},
+		{"a mechanisms", "203.0.113.1", "alice@example.org", spf.Pass},
+		{"mx mechanisms", "203.0.113.2", "alice@example.org", spf.Pass},
+		{"includes", "198.51.100.7", "alice@example.org", spf.Pass},
+		{"the default qualifier", "198.51.100.8", "alice@example.org", spf.SoftFail},
+		{"fail qualifiers", "192.0.2.10", "alice@strict.example.org", spf.Fail},
+		{"redirects", "198.51.100.7", "alice@redir.example.org", spf.Pass},
+		{"macros", "192.0.2.10", "bob-smith@macro.example.org", spf.Pass},
+		{"macros that don't match", "192.0.2.10", "eve@macro.example.org", spf.Neutral},
+		{"ptr mechanisms", "203.0.113.9", "alice@ptr.example.org", spf.Pass},
+		{"domains without records", "192.0.2.10", "alice@none.example.org", spf.None},
+		{"multiple records", "192.0.2.10", "alice@double.example.org", spf.PermError},
+		{"unknown mechanisms", "192.0.2.10", "alice@broken.example.org", spf.PermError},
+		{"include loops", "192.0.2.10", "alice@loop.example.org", spf.PermError},
+		{"temporary DNS errors", "192.0.2.10", "alice@temp.example", spf.TempError},
+	}
+
+	Convey("Given a set of SPF records", t, func() {
+		for _, c := range cases {
+			c := c
+			Convey("Check should handle "+c.Name, func() {
+				result, _ := spf.Check(resolver, net.ParseIP(c.IP), "mx.sender.example", c.Sender)
+				So(result, ShouldEqual, c.Result)
+			})
+		}
+
+		Convey("Check should use the HELO name for the null sender", func() {
+			result, domain := spf.Check(resolver, net.ParseIP("192.0.2.10"), "example.org", "")
+			So(result, ShouldEqual, spf.Pass)
+			So(domain, ShouldEqual, "example.org")
+		})
+	})
+}
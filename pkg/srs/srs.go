@@ -0,0 +1,177 @@
+// Package srs implements the Sender Rewriting Scheme, which lets forwarded
+// emails pass the SPF checks while keeping the bounces routable to the
+// original sender.
+package srs
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Errors returned when reversing an address
+var (
+	ErrInvalidAddress = errors.New("srs: invalid address")
+	ErrInvalidHash    = errors.New("srs: invalid hash")
+	ErrExpired        = errors.New("srs: address has expired")
+)
+
+const (
+	// DefaultMaxAge is the default amount of days a rewritten address is valid
+	DefaultMaxAge = 21
+
+	hashLength     = 4
+	timestampBase  = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567"
+	timestampRange = 1024 // two base32 characters
+)
+
+// SRS rewrites addresses with a secret into addresses on its domain.
+type SRS struct {
+	Secret []byte
+	Domain string
+	MaxAge int              // days, DefaultMaxAge if zero
+	Now    func() time.Time // time source, time.Now if nil
+}
+
+// IsSRS checks whether the address was rewritten.
+func IsSRS(address string) bool {
+	upper := strings.ToUpper(address)
+	return strings.HasPrefix(upper, "SRS0=") || strings.HasPrefix(upper, "SRS1=")
+}
+
+// Forward rewrites the envelope sender of an email forwarded by us. The null
+// sender is returned unchanged.
+func (s *SRS) Forward(address string) (string, error) {
+	if address == "" {
+		return "", nil
+	}
+
+	at := strings.LastIndex(address, "@")
+	if at < 1 || at == len(address)-1 {
+		return "", ErrInvalidAddress
+	}
+	local, domain := address[:at], address[at+1:]
+
+	upper := strings.ToUpper(local)
+	switch {
+	case strings.HasPrefix(upper, "SRS0") && len(local) > 4 && strings.ContainsAny(local[4:5], "=+-"):
+		// Another forwarder rewrote it, so only its domain has to be kept
+		rest := local[4:]
+		return "SRS1=" + s.hash(domain, rest) + "=" + domain + "=" + rest + "@" + s.Domain, nil
+	case strings.HasPrefix(upper, "SRS1") && len(local) > 4 && strings.ContainsAny(local[4:5], "=+-"):
+		// The first forwarder's domain and address stay the same
+		parts := strings.SplitN(local[5:], "=", 3)
+		if len(parts) != 3 {
+			return "", ErrInvalidAddress
+		}
+		original, rest := parts[1], parts[2]
+		return "SRS1=" + s.hash(original, rest) + "=" + original + "=" + rest + "@" + s.Domain, nil
+	}
+
+	timestamp := s.timestamp()
+	return "SRS0=" + s.hash(timestamp, domain, local) + "=" + timestamp + "=" + domain + "=" + local + "@" + s.Domain, nil
+}
+
+// Reverse decodes an address rewritten by Forward. Addresses rewritten once
+// resolve to the original sender, addresses rewritten more times to the
+// address of the first forwarder.
+func (s *SRS) Reverse(address string) (string, error) {
+	at := strings.LastIndex(address, "@")
+	if at == -1 {
+		return "", ErrInvalidAddress
+	}
+	local := address[:at]
+
+	if len(local) < 5 {
+		return "", ErrInvalidAddress
+	}
+	switch strings.ToUpper(local[:5]) {
+	case "SRS0=":
+		parts := strings.SplitN(local[5:], "=", 4)
+		if len(parts) != 4 || parts[2] == "" || parts[3] == "" {
+			return "", ErrInvalidAddress
+		}
+		hash, timestamp, domain, user := parts[0], parts[1], parts[2], parts[3]
+
+		if !s.checkHash(hash, timestamp, domain, user) {
+			return "", ErrInvalidHash
+		}
+		if err := s.checkTimestamp(timestamp); err != nil {
+			return "", err
+		}
+
+		return user + "@" + domain, nil
+	case "SRS1=":
+		parts := strings.SplitN(local[5:], "=", 3)
+		if len(parts) != 3 || parts[1] == "" || parts[2] == "" {
+			return "", ErrInvalidAddress
+		}
+		hash, domain, rest := parts[0], parts[1], parts[2]
+
+		if !s.checkHash(hash, domain, rest) {
+			return "", ErrInvalidHash
+		}
+
+		return "SRS0" + rest + "@" + domain, nil
+	}
+
+	return "", ErrInvalidAddress
+}
+
+func (s *SRS) now() time.Time {
+	if s.Now != nil {
+		return s.Now()
+	}
+	return time.Now()
+}
+
+func (s *SRS) timestamp() string {
+	days := int(s.now().Unix()/86400) % timestampRange
+	return string([]byte{timestampBase[days>>5], timestampBase[days&31]})
+}
+
+func (s *SRS) checkTimestamp(timestamp string) error {
+	if len(timestamp) != 2 {
+		return ErrInvalidAddress
+	}
+
+	value := 0
+	for _, char := range strings.ToUpper(timestamp) {
+		index := strings.IndexRune(timestampBase, char)
+		if index == -1 {
+			return ErrInvalidAddress
+		}
+		value = value<<5 | index
+	}
+
+	maxAge := s.MaxAge
+	if maxAge == 0 {
+		maxAge = DefaultMaxAge
+	}
+
+	// Timestamps wrap around every 1024 days
+	today := int(s.now().Unix()/86400) % timestampRange
+	if (today-value+timestampRange)%timestampRange > maxAge {
+		return ErrExpired
+	}
+
+	return nil
+}
+
+// hash authenticates the parts of an address. Addresses might get
+// lowercased on their way back, so the hashes are case-insensitive.
+func (s *SRS) hash(parts ...string) string {
+	mac := hmac.New(sha1.New, s.Secret)
+	for _, part := range parts {
+		mac.Write([]byte(strings.ToLower(part)))
+	}
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))[:hashLength]
+}
+
+func (s *SRS) checkHash(hash string, parts ...string) bool {
+	expected := s.hash(parts...)
+	return hmac.Equal([]byte(strings.ToLower(hash)), []byte(strings.ToLower(expected)))
+}
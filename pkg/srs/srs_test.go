@@ -0,0 +1,112 @@
+package srs_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/pgpst/pgpst/internal/github.com/smartystreets/goconvey/convey"
+
+	"github.com/pgpst/pgpst/pkg/srs"
+)
+
+func TestSRS(t *testing.T) {
+	Convey("Given a rewriter", t, func() {
+		now := time.Date(2015, 9, 1, 12, 0, 0, 0, time.UTC)
+		rewriter := &srs.SRS{
+			Secret: []byte("secret"),
+			Domain: "pgp.st",
+			Now: func() time.Time {
+				return now
+			},
+		}
+
+		Convey("The null sender should stay unchanged", func() {
+			address, err := rewriter.Forward("")
+			So(err, ShouldBeNil)
+			So(address, ShouldEqual, "")
+		})
+
+		Convey("Invalid addresses should be rejected", func() {
+			_, err := rewriter.Forward("joe")
+			So(err, ShouldEqual, srs.ErrInvalidAddress)
+			_, err = rewriter.Forward("joe@")
+			So(err, ShouldEqual, srs.ErrInvalidAddress)
+			_, err = rewriter.Reverse("joe@example.org")
+			So(err, ShouldEqual, srs.ErrInvalidAddress)
+			_, err = rewriter.Reverse("SRS0=abcd@pgp.st")
+			So(err, ShouldEqual, srs.ErrInvalidAddress)
+		})
+
+		Convey("A forwarded address should be reversible", func() {
+			address, err := rewriter.Forward("joe@example.org")
+			So(err, ShouldBeNil)
+			So(srs.IsSRS(address), ShouldBeTrue)
+			So(address, ShouldStartWith, "SRS0=")
+			So(address, ShouldEndWith, "=example.org=joe@pgp.st")
+
+			original, err := rewriter.Reverse(address)
+			So(err, ShouldBeNil)
+			So(original, ShouldEqual, "joe@example.org")
+
+			Convey("Even if it was lowercased", func() {
+				original, err := rewriter.Reverse(strings.ToLower(address))
+				So(err, ShouldBeNil)
+				So(original, ShouldEqual, "joe@example.org")
+			})
+
+			Convey("But not if it was tampered with", func() {
+				_, err := rewriter.Reverse(strings.Replace(address, "=joe@", "=zoe@", 1))
+				So(err, ShouldEqual, srs.ErrInvalidHash)
+			})
+
+			Convey("Or if it has expired", func() {
+				now = now.Add(time.Duration(srs.DefaultMaxAge+1) * 24 * time.Hour)
+				_, err := rewriter.Reverse(address)
+				So(err, ShouldEqual, srs.ErrExpired)
+			})
+
+			Convey("Or if it was signed with another secret", func() {
+				other := &srs.SRS{Secret: []byte("other"), Domain: "pgp.st"}
+				_, err := other.Reverse(address)
+				So(err, ShouldEqual, srs.ErrInvalidHash)
+			})
+		})
+
+		Convey("A rewritten address should be rewritten into SRS1", func() {
+			first := &srs.SRS{Secret: []byte("first"), Domain: "example.com"}
+			address, err := first.Forward("joe@example.org")
+			So(err, ShouldBeNil)
+
+			second, err := rewriter.Forward(address)
+			So(err, ShouldBeNil)
+			So(second, ShouldStartWith, "SRS1=")
+			So(second, ShouldContainSubstring, "=example.com==")
+
+			Convey("Which should reverse to the first forwarder", func() {
+				reversed, err := rewriter.Reverse(second)
+				So(err, ShouldBeNil)
+				So(reversed, ShouldEqual, address)
+
+				original, err := first.Reverse(reversed)
+				So(err, ShouldBeNil)
+				So(original, ShouldEqual, "joe@example.org")
+			})
+
+			Convey("And stay SRS1 when forwarded again", func() {
+				third := &srs.SRS{Secret: []byte("third"), Domain: "example.net"}
+				address, err := third.Forward(second)
+				So(err, ShouldBeNil)
+				So(address, ShouldStartWith, "SRS1=")
+				So(address, ShouldEndWith, "@example.net")
+
+				reversed, err := third.Reverse(address)
+				So(err, ShouldBeNil)
+				So(reversed, ShouldEndWith, "@example.com")
+				original, err := first.Reverse(reversed)
+				So(err, ShouldBeNil)
+				So(original, ShouldEqual, "joe@example.org")
+			})
+		})
+	})
+}
@@ -0,0 +1,158 @@
+package threading
+
+import (
+	"time"
+
+	r "github.com/pgpst/pgpst/internal/github.com/dancannon/gorethink"
+
+	"github.com/pgpst/pgpst/pkg/models"
+)
+
+// Match finds the thread of the owner's new message. Threads linked by the
+// message are merged into the oldest one. It returns nil if the message
+// starts a new thread.
+func Match(session *r.Session, owner string, msg *Message, window time.Duration) (*models.Thread, error) {
+	// Emails that the message refers to, its copies and the replies that
+	// arrived before it
+	keys := []interface{}{}
+	for _, id := range append(msg.References, msg.MessageID) {
+		if id != "" {
+			keys = append(keys, []interface{}{id, owner})
+		}
+	}
+
+	var threads []*models.Thread
+	if len(keys) > 0 {
+		related := r.Table("emails").GetAllByIndex("messageIDOwner", keys...).Field("thread")
+		if msg.MessageID != "" {
+			related = related.Union(
+				r.Table("emails").GetAllByIndex("referencesOwner", []interface{}{msg.MessageID, owner}).Field("thread"),
+			)
+		}
+
+		cursor, err := related.Distinct().Map(func(id r.Term) r.Term {
+			return r.Table("threads").Get(id)
+		}).Filter(func(thread r.Term) r.Term {
+			return thread.Ne(nil)
+		}).OrderBy("date_created").Run(session)
+		if err != nil {
+			return nil, err
+		}
+		defer cursor.Close()
+		if err := cursor.All(&threads); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(threads) > 0 {
+		if err := merge(session, threads[0], threads[1:]); err != nil {
+			return nil, err
+		}
+		return threads[0], nil
+	}
+
+	// Fall back to the latest thread with the same subject and participants
+	if window <= 0 || msg.SubjectHash == "" || len(msg.References) > 0 || len(msg.Participants) == 0 {
+		return nil, nil
+	}
+
+	participants := []interface{}{}
+	for _, participant := range msg.Participants {
+		participants = append(participants, participant)
+	}
+
+	cursor, err := r.Table("threads").GetAllByIndex("subjectHashOwner", []interface{}{
+		msg.SubjectHash,
+		owner,
+	}).Filter(func(thread r.Term) r.Term {
+		return thread.Field("date_modified").Ge(msg.Date.Add(-window)).And(
+			thread.Field("members").SetIntersection(participants).Count().Gt(0),
+		)
+	}).OrderBy(r.Desc("date_modified")).Limit(1).Run(session)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+	var matched []*models.Thread
+	if err := cursor.All(&matched); err != nil {
+		return nil, err
+	}
+	if len(matched) == 0 {
+		return nil, nil
+	}
+
+	return matched[0], nil
+}
+
+// merge moves the emails of the other threads into the target and deletes
+// them, combining their labels, members and state.
+func merge(session *r.Session, target *models.Thread, others []*models.Thread) error {
+	if len(others) == 0 {
+		return nil
+	}
+
+	ids := []interface{}{}
+	for _, other := range others {
+		ids = append(ids, other.ID)
+		Combine(target, other)
+	}
+
+	if err := r.Table("emails").GetAllByIndex("thread", ids...).Update(map[string]interface{}{
+		"thread":        target.ID,
+		"date_modified": r.Now(),
+	}).Exec(session); err != nil {
+		return err
+	}
+
+	if err := r.Table("threads").Get(target.ID).Update(map[string]interface{}{
+		"date_modified": r.Now(),
+		"labels":        target.Labels,
+		"members":       target.Members,
+		"is_read":       target.IsRead,
+		"secure":        target.Secure,
+	}).Exec(session); err != nil {
+		return err
+	}
+
+	return r.Table("threads").GetAll(ids...).Delete().Exec(session)
+}
+
+// Combine adds the labels and members of the other thread to the target.
+// The result is read only if both were read.
+func Combine(target *models.Thread, other *models.Thread) {
+	target.Labels = union(target.Labels, other.Labels)
+	target.Members = union(target.Members, other.Members)
+	target.IsRead = target.IsRead && other.IsRead
+	target.Secure = CombineSecure(target.Secure, other.Secure)
+	if target.SubjectHash == "" {
+		target.SubjectHash = other.SubjectHash
+	}
+}
+
+// CombineSecure returns the encryption state of a thread that contains
+// emails of both states.
+func CombineSecure(a string, b string) string {
+	if a == "" || a == b {
+		return b
+	}
+	if b == "" {
+		return a
+	}
+	return "some"
+}
+
+func union(a []string, b []string) []string {
+	result := append([]string{}, a...)
+	seen := map[string]struct{}{}
+	for _, item := range a {
+		seen[item] = struct{}{}
+	}
+	for _, item := range b {
+		if _, ok := seen[item]; !ok {
+			seen[item] = struct{}{}
+			result = append(result, item)
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,337 @@
+// Package threading groups the emails of an account into threads, following
+// the references between the messages as described in
+// https://www.jwz.org/doc/threading.html. Messages without references fall
+// back to their normalized subjects and participants.
+package threading
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"mime"
+	"net/mail"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pgpst/pgpst/pkg/analysis"
+)
+
+// Message holds the fields of an email used in threading.
+type Message struct {
+	MessageID    string
+	References   []string  // ancestors of the message, the parent last
+	SubjectHash  string    // hash of the normalized subject
+	Members      []string  // addresses in From, To and CC
+	Participants []string  // addresses of the other side of the conversation
+	Date         time.Time // time the email was received or sent
+}
+
+// NewMessage reads the threading fields from the owner's email header. The
+// participants of sent emails are their recipients, of the received ones the
+// sender. Subjects are hashed with the secret, see SubjectHash.
+func NewMessage(secret []byte, owner string, header mail.Header, sent bool, date time.Time) *Message {
+	msg := &Message{
+		References:  References(header),
+		SubjectHash: SubjectHash(secret, owner, header.Get("Subject")),
+		Date:        date,
+	}
+	if ids := ParseIDs(header.Get("Message-ID")); len(ids) > 0 {
+		msg.MessageID = ids[0]
+	}
+
+	from := addresses(header, "From")
+	recipients := append(addresses(header, "To"), addresses(header, "CC")...)
+	msg.Members = append(from, recipients...)
+	if sent {
+		msg.Participants = recipients
+	} else {
+		msg.Participants = from
+	}
+
+	return msg
+}
+
+func addresses(header mail.Header, key string) []string {
+	list, err := header.AddressList(key)
+	if err != nil {
+		return []string{}
+	}
+
+	result := make([]string, 0, len(list))
+	for _, address := range list {
+		result = append(result, strings.ToLower(address.Address))
+	}
+
+	return result
+}
+
+// ParseIDs extracts the message IDs in angle brackets from a header value.
+// Values without brackets are treated as a single ID.
+func ParseIDs(value string) []string {
+	ids := []string{}
+	for {
+		start := strings.Index(value, "<")
+		if start == -1 {
+			break
+		}
+		end := strings.Index(value[start+1:], ">")
+		if end == -1 {
+			break
+		}
+
+		if id := strings.TrimSpace(value[start+1 : start+1+end]); id != "" {
+			ids = append(ids, id)
+		}
+		value = value[start+end+2:]
+	}
+
+	if len(ids) == 0 {
+		if value = strings.TrimSpace(value); value != "" && !strings.ContainsAny(value, " \t<>") {
+			ids = append(ids, value)
+		}
+	}
+
+	return ids
+}
+
+// References returns the IDs of the message's ancestors, oldest first. The
+// parent from In-Reply-To is moved to the end if References misses it.
+func References(header mail.Header) []string {
+	var (
+		refs = []string{}
+		seen = map[string]struct{}{}
+	)
+
+	add := func(id string) {
+		if _, ok := seen[id]; ok {
+			return
+		}
+		seen[id] = struct{}{}
+		refs = append(refs, id)
+	}
+
+	for _, id := range ParseIDs(header.Get("References")) {
+		add(id)
+	}
+
+	// Only the first ID of In-Reply-To is reliable
+	if parents := ParseIDs(header.Get("In-Reply-To")); len(parents) > 0 {
+		add(parents[0])
+	}
+
+	return refs
+}
+
+// subjectPrefixes are the reply and forward markers of the popular clients.
+var subjectPrefixes = []string{"re", "fw", "fwd", "aw", "sv", "vs", "antw", "wg", "tr", "odp", "rif", "res", "enc"}
+
+// NormalizeSubject removes the reply and forward prefixes, mailing list tags
+// and extra whitespace, and lowercases the subject.
+func NormalizeSubject(subject string) string {
+	if decoded, err := new(mime.WordDecoder).DecodeHeader(subject); err == nil {
+		subject = decoded
+	}
+	subject = strings.ToLower(strings.Join(strings.Fields(subject), " "))
+
+	for {
+		trimmed := strings.TrimSpace(subject)
+
+		// Mailing list tags, eg. [list]
+		if strings.HasPrefix(trimmed, "[") {
+			if end := strings.Index(trimmed, "]"); end != -1 {
+				trimmed = trimmed[end+1:]
+			}
+		}
+
+		// Prefixes like "re:", "re[2]:" and "fwd:"
+		for _, prefix := range subjectPrefixes {
+			if !strings.HasPrefix(trimmed, prefix) {
+				continue
+			}
+
+			rest := trimmed[len(prefix):]
+			if strings.HasPrefix(rest, "[") {
+				if end := strings.Index(rest, "]"); end != -1 {
+					rest = rest[end+1:]
+				}
+			}
+			rest = strings.TrimLeft(rest, " ")
+			if strings.HasPrefix(rest, ":") {
+				trimmed = rest[1:]
+				break
+			}
+		}
+
+		trimmed = strings.TrimSpace(trimmed)
+		if trimmed == subject {
+			return subject
+		}
+		subject = trimmed
+	}
+}
+
+// SubjectHash hashes the owner's normalized subject, so that it can be
+// compared without being stored. It's keyed with the server's secret, as
+// plain hashes of subjects could be reversed by guessing them. Empty
+// subjects, the placeholders of the protected ones and the ones hashed
+// without a secret have no hash.
+func SubjectHash(secret []byte, owner string, subject string) string {
+	subject = NormalizeSubject(subject)
+	if len(secret) == 0 || subject == "" || subject == analysis.ObscuredSubject {
+		return ""
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(owner + "\x00" + subject))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Group splits the messages into threads, returning the indexes of the
+// messages in every thread in the order of their dates. Messages without
+// references join the latest thread with the same subject and one of their
+// participants if it was active within the window. A zero window disables
+// the fallback.
+func Group(messages []*Message, window time.Duration) [][]int {
+	// Messages and the referenced IDs are nodes of a union-find forest.
+	// Unknown references are the dummy containers of JWZ, which join the
+	// replies to the same missing message.
+	var (
+		parents = make([]int, len(messages))
+		ids     = map[string]int{}
+	)
+	for i := range parents {
+		parents[i] = i
+	}
+
+	var find func(i int) int
+	find = func(i int) int {
+		if parents[i] != i {
+			parents[i] = find(parents[i])
+		}
+		return parents[i]
+	}
+	union := func(a int, b int) {
+		a, b = find(a), find(b)
+		if a < b {
+			parents[b] = a
+		} else if b < a {
+			parents[a] = b
+		}
+	}
+	node := func(id string) int {
+		if i, ok := ids[id]; ok {
+			return i
+		}
+		parents = append(parents, len(parents))
+		ids[id] = len(parents) - 1
+		return len(parents) - 1
+	}
+
+	for i, msg := range messages {
+		if msg.MessageID == "" {
+			continue
+		}
+		if j, ok := ids[msg.MessageID]; ok {
+			// Copies of the same message share the thread
+			union(i, j)
+		} else {
+			ids[msg.MessageID] = i
+		}
+	}
+	for i, msg := range messages {
+		for _, ref := range msg.References {
+			union(i, node(ref))
+		}
+	}
+
+	order := make([]int, len(messages))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Stable(byDate{order, messages})
+
+	// Fall back to the subjects in the order of the dates
+	if window > 0 {
+		var (
+			subjects = map[string][]int{}
+			members  = map[int]map[string]struct{}{}
+		)
+		for _, i := range order {
+			root := find(i)
+			if members[root] == nil {
+				members[root] = map[string]struct{}{}
+			}
+			for _, member := range messages[i].Members {
+				members[root][member] = struct{}{}
+			}
+		}
+
+		for _, i := range order {
+			msg := messages[i]
+			if msg.SubjectHash == "" {
+				continue
+			}
+
+			// Look for the latest matching thread within the window
+			earlier := subjects[msg.SubjectHash]
+			for k := len(earlier) - 1; k >= 0 && len(msg.References) == 0; k-- {
+				j := earlier[k]
+				if msg.Date.Sub(messages[j].Date) > window {
+					break
+				}
+
+				a, b := find(j), find(i)
+				if a == b || !overlaps(members[a], msg.Participants) {
+					continue
+				}
+
+				union(a, b)
+				merged := members[a]
+				for member := range members[b] {
+					merged[member] = struct{}{}
+				}
+				members[find(a)] = merged
+				break
+			}
+
+			subjects[msg.SubjectHash] = append(earlier, i)
+		}
+	}
+
+	var (
+		threads = [][]int{}
+		index   = map[int]int{}
+	)
+	for _, i := range order {
+		root := find(i)
+		if j, ok := index[root]; ok {
+			threads[j] = append(threads[j], i)
+			continue
+		}
+		index[root] = len(threads)
+		threads = append(threads, []int{i})
+	}
+
+	return threads
+}
+
+func overlaps(members map[string]struct{}, participants []string) bool {
+	for _, participant := range participants {
+		if _, ok := members[participant]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+type byDate struct {
+	order    []int
+	messages []*Message
+}
+
+func (b byDate) Len() int      { return len(b.order) }
+func (b byDate) Swap(i, j int) { b.order[i], b.order[j] = b.order[j], b.order[i] }
+func (b byDate) Less(i, j int) bool {
+	return b.messages[b.order[i]].Date.Before(b.messages[b.order[j]].Date)
+}
@@ -0,0 +1,194 @@
+package threading_test
+
+import (
+	"bufio"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/pgpst/pgpst/internal/github.com/smartystreets/goconvey/convey"
+
+	"github.com/pgpst/pgpst/pkg/models"
+	"github.com/pgpst/pgpst/pkg/threading"
+)
+
+var secret = []byte("secret")
+
+func parseHeader(header string) mail.Header {
+	msg, err := mail.ReadMessage(bufio.NewReader(strings.NewReader(header + "\r\n")))
+	if err != nil {
+		panic(err)
+	}
+
+	return msg.Header
+}
+
+func TestReferences(t *testing.T) {
+	Convey("Message IDs should be parsed with and without brackets", t, func() {
+		So(threading.ParseIDs("<a@example.org> <b@example.org>\r\n\t<c@example.org>"), ShouldResemble, []string{
+			"a@example.org", "b@example.org", "c@example.org",
+		})
+		So(threading.ParseIDs(" a@example.org "), ShouldResemble, []string{"a@example.org"})
+		So(threading.ParseIDs("<>"), ShouldBeEmpty)
+		So(threading.ParseIDs("not an id"), ShouldBeEmpty)
+	})
+
+	Convey("The whole References list should be used, with the parent last", t, func() {
+		header := parseHeader("References: <a@x> <b@x>\r\nIn-Reply-To: <c@x> (Alice's message)\r\n")
+		So(threading.References(header), ShouldResemble, []string{"a@x", "b@x", "c@x"})
+
+		header = parseHeader("References: <a@x> <b@x> <a@x>\r\nIn-Reply-To: <b@x>\r\n")
+		So(threading.References(header), ShouldResemble, []string{"a@x", "b@x"})
+	})
+
+	Convey("Sent and received messages should have different participants", t, func() {
+		header := parseHeader("From: Alice <Alice@example.org>\r\nTo: bob@example.net\r\nCC: carol@example.com\r\n" +
+			"Message-ID: <1@example.org>\r\nSubject: Re: Lunch\r\n")
+
+		received := threading.NewMessage(secret, "alice", header, false, time.Now())
+		So(received.MessageID, ShouldEqual, "1@example.org")
+		So(received.Members, ShouldResemble, []string{"alice@example.org", "bob@example.net", "carol@example.com"})
+		So(received.Participants, ShouldResemble, []string{"alice@example.org"})
+		So(received.SubjectHash, ShouldEqual, threading.SubjectHash(secret, "alice", "lunch"))
+
+		sent := threading.NewMessage(secret, "alice", header, true, time.Now())
+		So(sent.Participants, ShouldResemble, []string{"bob@example.net", "carol@example.com"})
+	})
+}
+
+func TestNormalizeSubject(t *testing.T) {
+	Convey("Reply and forward prefixes should be removed", t, func() {
+		for _, subject := range []string{
+			"Lunch",
+			"Re: Lunch",
+			"RE: re: Lunch",
+			"Fwd: Re[2]: Lunch",
+			"AW:  Lunch ",
+			"[team] Re: [team] Lunch",
+			"=?UTF-8?Q?Re:_Lunch?=",
+		} {
+			So(threading.NormalizeSubject(subject), ShouldEqual, "lunch")
+		}
+	})
+
+	Convey("Words starting like prefixes should be kept", t, func() {
+		So(threading.NormalizeSubject("Research results"), ShouldEqual, "research results")
+		So(threading.NormalizeSubject("Re"), ShouldEqual, "re")
+	})
+
+	Convey("Empty and obscured subjects should have no hash", t, func() {
+		So(threading.SubjectHash(secret, "alice", "Re: "), ShouldBeEmpty)
+		So(threading.SubjectHash(secret, "alice", "Re: ..."), ShouldBeEmpty)
+		So(threading.SubjectHash(secret, "alice", "Re: Lunch"), ShouldEqual, threading.SubjectHash(secret, "alice", "LUNCH"))
+	})
+
+	Convey("Hashes should be keyed with the secret and the owner", t, func() {
+		So(threading.SubjectHash(nil, "alice", "Lunch"), ShouldBeEmpty)
+		So(threading.SubjectHash(secret, "alice", "Lunch"), ShouldNotEqual, threading.SubjectHash([]byte("other"), "alice", "Lunch"))
+		So(threading.SubjectHash(secret, "alice", "Lunch"), ShouldNotEqual, threading.SubjectHash(secret, "bob", "Lunch"))
+	})
+}
+
+func TestGroup(t *testing.T) {
+	base := time.Date(2015, 9, 1, 12, 0, 0, 0, time.UTC)
+	message := func(id string, hours int, refs ...string) *threading.Message {
+		return &threading.Message{
+			MessageID:    id,
+			References:   refs,
+			SubjectHash:  threading.SubjectHash(secret, "alice", "Lunch"),
+			Members:      []string{"alice@example.org", "bob@example.net"},
+			Participants: []string{"alice@example.org"},
+			Date:         base.Add(time.Duration(hours) * time.Hour),
+		}
+	}
+
+	Convey("Replies should be threaded with their ancestors", t, func() {
+		threads := threading.Group([]*threading.Message{
+			message("a", 0),
+			message("b", 1, "a"),
+			message("c", 2, "a", "b"),
+			message("d", 3),
+		}, 0)
+		So(threads, ShouldResemble, [][]int{{0, 1, 2}, {3}})
+	})
+
+	Convey("Replies received before their parents should be threaded", t, func() {
+		threads := threading.Group([]*threading.Message{
+			message("c", 0, "a", "b"),
+			message("a", 2),
+		}, 0)
+		So(threads, ShouldResemble, [][]int{{0, 1}})
+	})
+
+	Convey("Replies to the same missing message should be threaded", t, func() {
+		threads := threading.Group([]*threading.Message{
+			message("b", 0, "missing"),
+			message("c", 1, "missing"),
+		}, 0)
+		So(threads, ShouldResemble, [][]int{{0, 1}})
+	})
+
+	Convey("A message linking two threads should merge them", t, func() {
+		threads := threading.Group([]*threading.Message{
+			message("a", 0),
+			message("b", 1),
+			message("c", 2, "a", "b"),
+		}, 0)
+		So(threads, ShouldResemble, [][]int{{0, 1, 2}})
+	})
+
+	Convey("Copies of the same message should share the thread", t, func() {
+		threads := threading.Group([]*threading.Message{
+			message("a", 0),
+			message("a", 1),
+		}, 0)
+		So(threads, ShouldResemble, [][]int{{0, 1}})
+	})
+
+	Convey("Messages without references should fall back to the subject", t, func() {
+		messages := []*threading.Message{
+			message("a", 0),
+			message("b", 10),
+			message("c", 100),
+		}
+
+		So(threading.Group(messages, 24*time.Hour), ShouldResemble, [][]int{{0, 1}, {2}})
+		So(threading.Group(messages, 0), ShouldResemble, [][]int{{0}, {1}, {2}})
+
+		// Other participants start a new conversation
+		messages[1].Participants = []string{"eve@example.com"}
+		So(threading.Group(messages, 24*time.Hour), ShouldResemble, [][]int{{0}, {1}, {2}})
+	})
+
+	Convey("Sent messages should be threaded with their replies", t, func() {
+		sent := message("sent", 0)
+		sent.Participants = []string{"bob@example.net"}
+		reply := message("reply", 1, "sent")
+		reply.Participants = []string{"bob@example.net"}
+
+		So(threading.Group([]*threading.Message{reply, sent}, 0), ShouldResemble, [][]int{{1, 0}})
+	})
+}
+
+func TestCombine(t *testing.T) {
+	Convey("Combined threads should have the labels and members of both", t, func() {
+		target := &models.Thread{
+			Labels:  []string{"inbox"},
+			Members: []string{"alice@example.org"},
+			IsRead:  true,
+			Secure:  "all",
+		}
+		threading.Combine(target, &models.Thread{
+			Labels:  []string{"inbox", "sent"},
+			Members: []string{"bob@example.net"},
+			IsRead:  false,
+			Secure:  "none",
+		})
+
+		So(target.Labels, ShouldResemble, []string{"inbox", "sent"})
+		So(target.Members, ShouldResemble, []string{"alice@example.org", "bob@example.net"})
+		So(target.IsRead, ShouldBeFalse)
+		So(target.Secure, ShouldEqual, "some")
+	})
+}
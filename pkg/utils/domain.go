@@ -0,0 +1,48 @@
+package utils
+
+import (
+	"regexp"
+	"strings"
+)
+
+var rDomain = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// IsDomain checks whether the input is a valid lowercase domain name.
+func IsDomain(input string) bool {
+	return len(input) <= 253 && rDomain.MatchString(input)
+}
+
+// DomainCheck is the result of checking the DNS records of a domain.
+type DomainCheck struct {
+	Challenge bool // the TXT challenge is published
+	MX        bool // one of the MX records points to the mailer
+}
+
+// CheckDomain looks up the TXT records of the domain for the challenge and
+// matches its MX records against the hosts. Failed lookups are treated as
+// missing records.
+func CheckDomain(resolver Resolver, domain string, challenge string, hosts []string) *DomainCheck {
+	result := &DomainCheck{}
+
+	if records, err := resolver.LookupTXT(domain); err == nil {
+		for _, record := range records {
+			if strings.TrimSpace(record) == challenge {
+				result.Challenge = true
+				break
+			}
+		}
+	}
+
+	if records, err := resolver.LookupMX(domain); err == nil {
+		for _, record := range records {
+			host := strings.ToLower(strings.TrimSuffix(record.Host, "."))
+			for _, expected := range hosts {
+				if host == strings.ToLower(strings.TrimSuffix(expected, ".")) {
+					result.MX = true
+				}
+			}
+		}
+	}
+
+	return result
+}
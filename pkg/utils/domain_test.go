@@ -0,0 +1,85 @@
+package utils_test
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	. "github.com/pgpst/pgpst/internal/github.com/smartystreets/goconvey/convey"
+
+	"github.com/pgpst/pgpst/pkg/utils"
+)
+
+type fakeResolver struct {
+	MX  map[string][]*net.MX
+	TXT map[string][]string
+}
+
+func (f *fakeResolver) LookupMX(name string) ([]*net.MX, error) {
+	if x, ok := f.MX[name]; ok {
+		return x, nil
+	}
+	return nil, errors.New("no such host")
+}
+
+func (f *fakeResolver) LookupTXT(name string) ([]string, error) {
+	if x, ok := f.TXT[name]; ok {
+		return x, nil
+	}
+	return nil, errors.New("no such host")
+}
+
+func (f *fakeResolver) LookupIP(host string) ([]net.IP, error) {
+	return nil, errors.New("no such host")
+}
+
+func (f *fakeResolver) LookupAddr(addr string) ([]string, error) {
+	return nil, errors.New("no such host")
+}
+
+func TestDomain(t *testing.T) {
+	Convey("IsDomain should accept only valid domain names", t, func() {
+		So(utils.IsDomain("pgp.st"), ShouldBeTrue)
+		So(utils.IsDomain("mail.example-1.co.uk"), ShouldBeTrue)
+		So(utils.IsDomain("localhost"), ShouldBeFalse)
+		So(utils.IsDomain("-example.org"), ShouldBeFalse)
+		So(utils.IsDomain("example..org"), ShouldBeFalse)
+		So(utils.IsDomain("Example.org"), ShouldBeFalse)
+		So(utils.IsDomain("example.org."), ShouldBeFalse)
+	})
+
+	Convey("Given a resolver with records of a domain", t, func() {
+		resolver := &fakeResolver{
+			MX: map[string][]*net.MX{
+				"example.org": {
+					{Host: "mx.example.org.", Pref: 10},
+					{Host: "PGP.st.", Pref: 20},
+				},
+				"example.com": {
+					{Host: "mx.example.com.", Pref: 10},
+				},
+			},
+			TXT: map[string][]string{
+				"example.org": {"v=spf1 -all", "pgpst-verification=abc"},
+			},
+		}
+
+		Convey("CheckDomain should find the challenge and the MX", func() {
+			result := utils.CheckDomain(resolver, "example.org", "pgpst-verification=abc", []string{"pgp.st"})
+			So(result.Challenge, ShouldBeTrue)
+			So(result.MX, ShouldBeTrue)
+		})
+
+		Convey("CheckDomain should fail with a different challenge", func() {
+			result := utils.CheckDomain(resolver, "example.org", "pgpst-verification=def", []string{"pgp.st"})
+			So(result.Challenge, ShouldBeFalse)
+			So(result.MX, ShouldBeTrue)
+		})
+
+		Convey("CheckDomain should fail with MX records pointing elsewhere", func() {
+			result := utils.CheckDomain(resolver, "example.com", "pgpst-verification=abc", []string{"pgp.st"})
+			So(result.Challenge, ShouldBeFalse)
+			So(result.MX, ShouldBeFalse)
+		})
+	})
+}
@@ -0,0 +1,87 @@
+package utils
+
+import (
+	"container/list"
+	"sync"
+)
+
+// LRU is a fixed-size cache that evicts the least recently used entries.
+// It's safe for concurrent use.
+type LRU struct {
+	size    int
+	list    *list.List
+	entries map[interface{}]*list.Element
+	lock    sync.Mutex
+}
+
+type lruEntry struct {
+	key   interface{}
+	value interface{}
+}
+
+func NewLRU(size int) *LRU {
+	if size <= 0 {
+		size = 1
+	}
+
+	return &LRU{
+		size:    size,
+		list:    list.New(),
+		entries: map[interface{}]*list.Element{},
+	}
+}
+
+// Get returns the value stored under key and marks it as recently used.
+func (l *LRU) Get(key interface{}) (interface{}, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if element, ok := l.entries[key]; ok {
+		l.list.MoveToFront(element)
+		return element.Value.(*lruEntry).value, true
+	}
+
+	return nil, false
+}
+
+// Add inserts or replaces a value, evicting the oldest one if it's full.
+func (l *LRU) Add(key interface{}, value interface{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if element, ok := l.entries[key]; ok {
+		l.list.MoveToFront(element)
+		element.Value.(*lruEntry).value = value
+		return
+	}
+
+	l.entries[key] = l.list.PushFront(&lruEntry{
+		key:   key,
+		value: value,
+	})
+
+	if l.list.Len() > l.size {
+		oldest := l.list.Back()
+		l.list.Remove(oldest)
+		delete(l.entries, oldest.Value.(*lruEntry).key)
+	}
+}
+
+// Remove deletes the value stored under key.
+func (l *LRU) Remove(key interface{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if element, ok := l.entries[key]; ok {
+		l.list.Remove(element)
+		delete(l.entries, key)
+	}
+}
+
+// Len returns the amount of stored entries.
+func (l *LRU) Len() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.list.Len()
+}
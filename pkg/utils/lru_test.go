@@ -0,0 +1,57 @@
+package utils_test
+
+import (
+	"testing"
+
+	. "github.com/pgpst/pgpst/internal/github.com/smartystreets/goconvey/convey"
+
+	"github.com/pgpst/pgpst/pkg/utils"
+)
+
+func TestLRU(t *testing.T) {
+	Convey("Given a LRU cache of size 2", t, func() {
+		cache := utils.NewLRU(2)
+
+		cache.Add("a", 1)
+		cache.Add("b", 2)
+
+		Convey("Stored values should be returned", func() {
+			value, ok := cache.Get("a")
+			So(ok, ShouldBeTrue)
+			So(value, ShouldEqual, 1)
+			So(cache.Len(), ShouldEqual, 2)
+		})
+
+		Convey("Adding a third value should evict the least recently used one", func() {
+			cache.Get("a")
+			cache.Add("c", 3)
+
+			_, ok := cache.Get("b")
+			So(ok, ShouldBeFalse)
+
+			value, ok := cache.Get("a")
+			So(ok, ShouldBeTrue)
+			So(value, ShouldEqual, 1)
+
+			value, ok = cache.Get("c")
+			So(ok, ShouldBeTrue)
+			So(value, ShouldEqual, 3)
+		})
+
+		Convey("Adding an existing key should replace its value", func() {
+			cache.Add("a", 4)
+
+			value, _ := cache.Get("a")
+			So(value, ShouldEqual, 4)
+			So(cache.Len(), ShouldEqual, 2)
+		})
+
+		Convey("Removed values should not be returned", func() {
+			cache.Remove("a")
+
+			_, ok := cache.Get("a")
+			So(ok, ShouldBeFalse)
+			So(cache.Len(), ShouldEqual, 1)
+		})
+	})
+}
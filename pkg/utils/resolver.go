@@ -0,0 +1,33 @@
+package utils
+
+import (
+	"net"
+)
+
+// Resolver is the subset of DNS lookups used by the services. It's an
+// interface so that tests can run without network access.
+type Resolver interface {
+	LookupMX(name string) ([]*net.MX, error)
+	LookupTXT(name string) ([]string, error)
+	LookupIP(host string) ([]net.IP, error)
+	LookupAddr(addr string) ([]string, error)
+}
+
+// NetResolver passes all queries to the resolver of the net package.
+type NetResolver struct{}
+
+func (n NetResolver) LookupMX(name string) ([]*net.MX, error) {
+	return net.LookupMX(name)
+}
+
+func (n NetResolver) LookupTXT(name string) ([]string, error) {
+	return net.LookupTXT(name)
+}
+
+func (n NetResolver) LookupIP(host string) ([]net.IP, error) {
+	return net.LookupIP(host)
+}
+
+func (n NetResolver) LookupAddr(addr string) ([]string, error) {
+	return net.LookupAddr(addr)
+}
@@ -31,3 +31,21 @@ func NormalizeAddress(input string) string {
 
 	return NormalizeUsername(parts[0]) + "@" + strings.ToLowerSpecial(unicode.TurkishCase, parts[1])
 }
+
+// SplitAddress normalizes the address and separates its sub-address, the
+// part of the username after the first plus sign.
+func SplitAddress(input string) (string, string) {
+	at := strings.LastIndex(input, "@")
+	if at == -1 {
+		return RemoveDots(NormalizeUsername(input)), ""
+	}
+	username, domain := input[:at], input[at+1:]
+
+	// A leading plus sign doesn't start a sub-address
+	var tag string
+	if plus := strings.Index(username, "+"); plus > 0 {
+		username, tag = username[:plus], username[plus+1:]
+	}
+
+	return RemoveDots(NormalizeAddress(username + "@" + domain)), strings.ToLowerSpecial(unicode.TurkishCase, tag)
+}
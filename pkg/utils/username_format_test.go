@@ -32,4 +32,29 @@ func TestUsernameFormat(t *testing.T) {
 			So(input, ShouldEqual, "hello")
 		})
 	})
+
+	Convey("Given addresses with sub-addresses", t, func() {
+		cases := []struct {
+			Input   string
+			Address string
+			Tag     string
+		}{
+			{"alice@pgp.st", "alice@pgp.st", ""},
+			{"alice+shop@pgp.st", "alice@pgp.st", "shop"},
+			{"A.l.i.c.e+Shop@PGP.st", "alice@pgp.st", "shop"},
+			{"alice+news.letters@pgp.st", "alice@pgp.st", "news.letters"},
+			{"alice+a+b@pgp.st", "alice@pgp.st", "a+b"},
+			{"alice+@pgp.st", "alice@pgp.st", ""},
+			{"+alice@pgp.st", "alice@pgp.st", ""},
+			{"alice+shop", "aliceshop", ""},
+		}
+
+		Convey("SplitAddress should separate the tags from the normalized addresses", func() {
+			for _, c := range cases {
+				address, tag := utils.SplitAddress(c.Input)
+				So(address, ShouldEqual, c.Address)
+				So(tag, ShouldEqual, c.Tag)
+			}
+		})
+	})
 }
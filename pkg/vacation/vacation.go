@@ -0,0 +1,162 @@
+// Package vacation decides whether an email deserves an automatic reply and
+// composes the replies, following the rules of RFC 3834.
+package vacation
+
+import (
+	"bytes"
+	"errors"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/pgpst/pgpst/pkg/utils"
+)
+
+// Reasons for not replying to an email
+var (
+	ErrNullSender    = errors.New("vacation: email has no return path")
+	ErrAutomated     = errors.New("vacation: email was sent automatically")
+	ErrMailingList   = errors.New("vacation: email was sent to a mailing list")
+	ErrBulk          = errors.New("vacation: email is bulk mail")
+	ErrNotAddressed  = errors.New("vacation: email is not addressed to the recipient")
+	ErrSelfAddressed = errors.New("vacation: email was sent by the recipient")
+)
+
+// Senders that are known to be automated even if they don't say so
+var automatedPrefixes = []string{
+	"mailer-daemon@",
+	"postmaster@",
+	"owner-",
+	"listserv@",
+	"majordomo@",
+	"noreply@",
+	"no-reply@",
+}
+
+// Check returns nil if the email with the header sent from the envelope
+// sender to one of the addresses should get a reply.
+func Check(header mail.Header, sender string, addresses []string) error {
+	sender = strings.ToLower(sender)
+	if sender == "" || !strings.Contains(sender, "@") {
+		return ErrNullSender
+	}
+	for _, prefix := range automatedPrefixes {
+		if strings.HasPrefix(sender, prefix) {
+			return ErrAutomated
+		}
+	}
+	if strings.Contains(sender, "-request@") {
+		return ErrAutomated
+	}
+
+	if value := strings.ToLower(strings.TrimSpace(header.Get("Auto-Submitted"))); value != "" && value != "no" {
+		return ErrAutomated
+	}
+
+	for key := range header {
+		if strings.HasPrefix(key, "List-") {
+			return ErrMailingList
+		}
+	}
+
+	switch strings.ToLower(strings.TrimSpace(header.Get("Precedence"))) {
+	case "bulk", "junk":
+		return ErrBulk
+	case "list":
+		return ErrMailingList
+	}
+
+	normalized := map[string]struct{}{}
+	for _, address := range addresses {
+		normalized[normalize(address)] = struct{}{}
+	}
+	if _, ok := normalized[normalize(sender)]; ok {
+		return ErrSelfAddressed
+	}
+
+	// Replies are only sent if the recipient was explicitly addressed
+	for _, field := range []string{"To", "Cc"} {
+		list, err := header.AddressList(field)
+		if err != nil {
+			continue
+		}
+
+		for _, item := range list {
+			if _, ok := normalized[normalize(item.Address)]; ok {
+				return nil
+			}
+		}
+	}
+
+	return ErrNotAddressed
+}
+
+// normalize converts the address to the form used in the addresses table.
+func normalize(address string) string {
+	if !strings.Contains(address, "@") {
+		return strings.ToLower(address)
+	}
+
+	address, _ = utils.SplitAddress(address)
+	return address
+}
+
+// Reply describes an automatic response.
+type Reply struct {
+	From      string // address of the replying account
+	To        string // envelope sender of the original email
+	Subject   string // subject of the reply, derived from the original if empty
+	Body      string // text of the reply
+	MessageID string // message ID of the reply
+}
+
+// Compose renders the reply to an email with the header as a RFC 5322
+// message.
+func Compose(header mail.Header, reply *Reply) []byte {
+	subject := reply.Subject
+	if subject == "" {
+		original, err := new(mime.WordDecoder).DecodeHeader(header.Get("Subject"))
+		if err != nil {
+			original = header.Get("Subject")
+		}
+		subject = "Auto: " + original
+	}
+
+	buf := &bytes.Buffer{}
+	buf.WriteString("From: <" + reply.From + ">\r\n")
+	buf.WriteString("To: <" + reply.To + ">\r\n")
+	buf.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", subject) + "\r\n")
+	buf.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	buf.WriteString("Message-ID: " + reply.MessageID + "\r\n")
+
+	// Thread the reply with the original email
+	if messageID := strings.TrimSpace(header.Get("Message-ID")); messageID != "" {
+		buf.WriteString("In-Reply-To: " + messageID + "\r\n")
+
+		references := strings.TrimSpace(header.Get("References"))
+		if references == "" {
+			references = strings.TrimSpace(header.Get("In-Reply-To"))
+		}
+		if references != "" {
+			buf.WriteString("References: " + references + " " + messageID + "\r\n")
+		} else {
+			buf.WriteString("References: " + messageID + "\r\n")
+		}
+	}
+
+	buf.WriteString("Auto-Submitted: auto-replied\r\n")
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n")
+	buf.WriteString("\r\n")
+
+	body := strings.Replace(reply.Body, "\r\n", "\n", -1)
+	body = strings.Replace(body, "\n", "\r\n", -1)
+	writer := quotedprintable.NewWriter(buf)
+	writer.Write([]byte(body))
+	writer.Close()
+
+	return buf.Bytes()
+}
@@ -0,0 +1,108 @@
+package vacation_test
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"testing"
+
+	. "github.com/pgpst/pgpst/internal/github.com/smartystreets/goconvey/convey"
+
+	"github.com/pgpst/pgpst/pkg/vacation"
+)
+
+func parseHeader(header string) mail.Header {
+	msg, err := mail.ReadMessage(bufio.NewReader(strings.NewReader(header + "\r\n")))
+	if err != nil {
+		panic(err)
+	}
+
+	return msg.Header
+}
+
+func TestCheck(t *testing.T) {
+	addresses := []string{"suzie@pgp.st", "suzieq@pgp.st"}
+
+	cases := []struct {
+		Name   string
+		Header string
+		Sender string
+		Result error
+	}{
+		{"a direct email", "To: suzie@pgp.st\r\n", "joe@example.org", nil},
+		{"an email to a sub-address", "To: suzie+football@pgp.st\r\n", "joe@example.org", nil},
+		{"a CCed email", "To: zoe@example.org\r\nCc: \"Suzie\" <Suzie.Q@pgp.st>\r\n", "joe@example.org", nil},
+		{"an email with Auto-Submitted: no", "To: suzie@pgp.st\r\nAuto-Submitted: no\r\n", "joe@example.org", nil},
+		{"a bounce", "To: suzie@pgp.st\r\n", "", vacation.ErrNullSender},
+		{"an email from a daemon", "To: suzie@pgp.st\r\n", "MAILER-DAEMON@example.org", vacation.ErrAutomated},
+		{"an email from a list owner", "To: suzie@pgp.st\r\n", "owner-football@example.org", vacation.ErrAutomated},
+		{"an email from a list manager", "To: suzie@pgp.st\r\n", "football-request@example.org", vacation.ErrAutomated},
+		{"an automatic reply", "To: suzie@pgp.st\r\nAuto-Submitted: auto-replied\r\n", "joe@example.org", vacation.ErrAutomated},
+		{"a generated email", "To: suzie@pgp.st\r\nAuto-Submitted: auto-generated\r\n", "joe@example.org", vacation.ErrAutomated},
+		{"a list email", "To: suzie@pgp.st\r\nList-Id: <football.example.org>\r\n", "joe@example.org", vacation.ErrMailingList},
+		{"an email with Precedence: list", "To: suzie@pgp.st\r\nPrecedence: list\r\n", "joe@example.org", vacation.ErrMailingList},
+		{"a bulk email", "To: suzie@pgp.st\r\nPrecedence: bulk\r\n", "joe@example.org", vacation.ErrBulk},
+		{"a junk email", "To: suzie@pgp.st\r\nPrecedence: junk\r\n", "joe@example.org", vacation.ErrBulk},
+		{"an email sent to the account itself", "To: suzie@pgp.st\r\n", "suzieq@pgp.st", vacation.ErrSelfAddressed},
+		{"a BCCed email", "To: zoe@example.org\r\n", "joe@example.org", vacation.ErrNotAddressed},
+	}
+
+	for _, c := range cases {
+		Convey("Checking "+c.Name, t, func() {
+			err := vacation.Check(parseHeader(c.Header), c.Sender, addresses)
+			if c.Result == nil {
+				So(err, ShouldBeNil)
+			} else {
+				So(err, ShouldEqual, c.Result)
+			}
+		})
+	}
+}
+
+func TestCompose(t *testing.T) {
+	Convey("Given a reply to an email", t, func() {
+		header := parseHeader("From: joe@example.org\r\n" +
+			"To: suzie@pgp.st\r\n" +
+			"Subject: =?UTF-8?Q?Is_dinner_ready=3F?=\r\n" +
+			"Message-ID: <2@example.org>\r\n" +
+			"References: <1@example.org>\r\n")
+		reply := &vacation.Reply{
+			From:      "suzie@pgp.st",
+			To:        "joe@example.org",
+			Body:      "I'm on a vacation.\nBack on Monday - Zoë",
+			MessageID: "<3@pgp.st>",
+		}
+
+		Convey("It should be marked as an automatic reply to the original", func() {
+			msg, err := mail.ReadMessage(bytes.NewReader(vacation.Compose(header, reply)))
+			So(err, ShouldBeNil)
+
+			So(msg.Header.Get("From"), ShouldEqual, "<suzie@pgp.st>")
+			So(msg.Header.Get("To"), ShouldEqual, "<joe@example.org>")
+			So(msg.Header.Get("Subject"), ShouldEqual, "Auto: Is dinner ready?")
+			So(msg.Header.Get("Message-ID"), ShouldEqual, "<3@pgp.st>")
+			So(msg.Header.Get("In-Reply-To"), ShouldEqual, "<2@example.org>")
+			So(msg.Header.Get("References"), ShouldEqual, "<1@example.org> <2@example.org>")
+			So(msg.Header.Get("Auto-Submitted"), ShouldEqual, "auto-replied")
+
+			body, err := ioutil.ReadAll(quotedprintable.NewReader(msg.Body))
+			So(err, ShouldBeNil)
+			So(string(body), ShouldEqual, "I'm on a vacation.\r\nBack on Monday - Zoë")
+		})
+
+		Convey("A configured subject should replace the original one", func() {
+			reply.Subject = "Außer Haus"
+
+			msg, err := mail.ReadMessage(bytes.NewReader(vacation.Compose(header, reply)))
+			So(err, ShouldBeNil)
+
+			subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+			So(err, ShouldBeNil)
+			So(subject, ShouldEqual, "Außer Haus")
+		})
+	})
+}
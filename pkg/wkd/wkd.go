@@ -0,0 +1,163 @@
+// Package wkd implements the server side of the OpenPGP Web Key Directory
+// (draft-koch-openpgp-webkey-service): the hashed paths of the keys and their
+// minimal export.
+package wkd
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/pgpst/pgpst/internal/golang.org/x/crypto/openpgp"
+)
+
+// Prefix is the path that the directory is served under.
+const Prefix = "/.well-known/openpgpkey/"
+
+// Errors returned by ParsePath and Export
+var (
+	ErrInvalidPath = errors.New("wkd: path is not a key or the policy")
+	ErrNoIdentity  = errors.New("wkd: key has no identity with the address")
+)
+
+// zbase32 is the human-oriented base32 encoding used in the paths
+var zbase32 = base32.NewEncoding("ybndrfg8ejkmcpqxot1uwisza345h769")
+
+// Hash returns the hashed local part of an address used in the paths.
+func Hash(local string) string {
+	hash := sha1.Sum([]byte(strings.ToLower(local)))
+	return zbase32.EncodeToString(hash[:])
+}
+
+// AddressHashes returns the distinct hashed local parts of the forms of an
+// address, e.g. its normalized and styled IDs, which are indexed for lookups.
+func AddressHashes(addresses ...string) []string {
+	var hashes []string
+	for _, address := range addresses {
+		at := strings.LastIndex(address, "@")
+		if at == -1 {
+			continue
+		}
+		hash := Hash(address[:at])
+
+		known := false
+		for _, x := range hashes {
+			if x == hash {
+				known = true
+				break
+			}
+		}
+		if !known {
+			hashes = append(hashes, hash)
+		}
+	}
+	return hashes
+}
+
+// Request is a parsed path of the directory.
+type Request struct {
+	Domain string // set in the advanced layout, empty in the direct one
+	Hash   string // hashed local part, empty for the policy
+}
+
+// ParsePath reads a path of either layout, e.g. /.well-known/openpgpkey/hu/X
+// or /.well-known/openpgpkey/example.org/hu/X.
+func ParsePath(path string) (*Request, error) {
+	if !strings.HasPrefix(path, Prefix) {
+		return nil, ErrInvalidPath
+	}
+
+	parts := strings.Split(strings.TrimPrefix(path, Prefix), "/")
+	request := &Request{}
+	if len(parts) == 3 || (len(parts) == 2 && parts[1] == "policy") {
+		request.Domain = strings.ToLower(parts[0])
+		parts = parts[1:]
+	}
+
+	switch {
+	case len(parts) == 1 && parts[0] == "policy":
+		return request, nil
+	case len(parts) == 2 && parts[0] == "hu" && len(parts[1]) == 32:
+		request.Hash = parts[1]
+		return request, nil
+	}
+
+	return nil, ErrInvalidPath
+}
+
+// Export serializes the public key, keeping only the identities with an
+// address that matches and their self-signatures, like GnuPG's export
+// with the export-minimal option.
+func Export(body []byte, matches func(address string) bool) ([]byte, error) {
+	return export(body, matches, func(subkey *openpgp.Subkey) bool {
+		return true
+	})
+}
+
+// ExportEncryption is Export with only the first subkey that can encrypt at
+// the time, which is the minimal key that Autocrypt headers should carry.
+// Keys without such a subkey are exported without any.
+func ExportEncryption(body []byte, matches func(address string) bool, now time.Time) ([]byte, error) {
+	found := false
+	return export(body, matches, func(subkey *openpgp.Subkey) bool {
+		if found || !subkey.Sig.FlagsValid || !subkey.Sig.FlagEncryptCommunications ||
+			!subkey.PublicKey.PubKeyAlgo.CanEncrypt() || subkey.Sig.KeyExpired(now) {
+			return false
+		}
+		found = true
+		return true
+	})
+}
+
+func export(body []byte, matches func(address string) bool, keep func(subkey *openpgp.Subkey) bool) ([]byte, error) {
+	entities, err := openpgp.ReadKeyRing(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	entity := entities[0]
+
+	var buf bytes.Buffer
+	if err := entity.PrimaryKey.Serialize(&buf); err != nil {
+		return nil, err
+	}
+	for _, revocation := range entity.Revocations {
+		if err := revocation.Serialize(&buf); err != nil {
+			return nil, err
+		}
+	}
+
+	found := false
+	for _, identity := range entity.Identities {
+		if identity.UserId == nil || !matches(identity.UserId.Email) {
+			continue
+		}
+		found = true
+
+		if err := identity.UserId.Serialize(&buf); err != nil {
+			return nil, err
+		}
+		if err := identity.SelfSignature.Serialize(&buf); err != nil {
+			return nil, err
+		}
+	}
+	if !found {
+		return nil, ErrNoIdentity
+	}
+
+	for _, subkey := range entity.Subkeys {
+		if !keep(&subkey) {
+			continue
+		}
+		if err := subkey.PublicKey.Serialize(&buf); err != nil {
+			return nil, err
+		}
+		if err := subkey.Sig.Serialize(&buf); err != nil {
+			return nil, err
+		}
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,154 @@
+package wkd_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	. "github.com/pgpst/pgpst/internal/github.com/smartystreets/goconvey/convey"
+	"github.com/pgpst/pgpst/internal/golang.org/x/crypto/openpgp"
+
+	"github.com/pgpst/pgpst/pkg/wkd"
+)
+
+func TestHash(t *testing.T) {
+	Convey("Local parts should be hashed like GnuPG does", t, func() {
+		So(wkd.Hash("Joe.Doe"), ShouldEqual, "iy9q119eutrkn8s1mk4r39qejnbu3n5q")
+	})
+}
+
+func TestAddressHashes(t *testing.T) {
+	Convey("Every distinct local part of an address should be hashed", t, func() {
+		So(wkd.AddressHashes("joedoe@example.org", "Joe.Doe@example.org"), ShouldResemble, []string{
+			wkd.Hash("joedoe"),
+			wkd.Hash("joe.doe"),
+		})
+		So(wkd.AddressHashes("joedoe@example.org", "JoeDoe@example.org"), ShouldResemble, []string{
+			wkd.Hash("joedoe"),
+		})
+		So(wkd.AddressHashes("joedoe"), ShouldBeEmpty)
+	})
+}
+
+func TestParsePath(t *testing.T) {
+	hash := wkd.Hash("joe.doe")
+
+	Convey("Given paths of the directory", t, func() {
+		Convey("Keys in the direct layout should have no domain", func() {
+			request, err := wkd.ParsePath(wkd.Prefix + "hu/" + hash)
+			So(err, ShouldBeNil)
+			So(request.Domain, ShouldEqual, "")
+			So(request.Hash, ShouldEqual, hash)
+		})
+
+		Convey("Keys in the advanced layout should have the domain", func() {
+			request, err := wkd.ParsePath(wkd.Prefix + "Example.org/hu/" + hash)
+			So(err, ShouldBeNil)
+			So(request.Domain, ShouldEqual, "example.org")
+			So(request.Hash, ShouldEqual, hash)
+		})
+
+		Convey("The policy should be found in both layouts", func() {
+			request, err := wkd.ParsePath(wkd.Prefix + "policy")
+			So(err, ShouldBeNil)
+			So(request.Domain, ShouldEqual, "")
+			So(request.Hash, ShouldEqual, "")
+
+			request, err = wkd.ParsePath(wkd.Prefix + "example.org/policy")
+			So(err, ShouldBeNil)
+			So(request.Domain, ShouldEqual, "example.org")
+			So(request.Hash, ShouldEqual, "")
+		})
+
+		Convey("Other paths should be rejected", func() {
+			for _, path := range []string{
+				"/keys/" + hash,
+				wkd.Prefix + "hu/short",
+				wkd.Prefix + "submission-address",
+				wkd.Prefix + "example.org/hu/" + hash + "/extra",
+			} {
+				_, err := wkd.ParsePath(path)
+				So(err, ShouldEqual, wkd.ErrInvalidPath)
+			}
+		})
+	})
+}
+
+func TestExport(t *testing.T) {
+	bob, err := openpgp.NewEntity("Bob", "", "bob@pgp.st", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err := openpgp.NewEntity("Alice", "", "alice@example.org", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.SignIdentity("Bob <bob@pgp.st>", alice, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.SerializePrivate(ioutil.Discard, nil); err != nil {
+		t.Fatal(err)
+	}
+	var body bytes.Buffer
+	if err := bob.Serialize(&body); err != nil {
+		t.Fatal(err)
+	}
+
+	// The same key with a subkey that expires after a minute
+	lifetime := uint32(60)
+	bob.Subkeys[0].Sig.KeyLifetimeSecs = &lifetime
+	if err := bob.SerializePrivate(ioutil.Discard, nil); err != nil {
+		t.Fatal(err)
+	}
+	var expiring bytes.Buffer
+	if err := bob.Serialize(&expiring); err != nil {
+		t.Fatal(err)
+	}
+
+	Convey("Given a key certified by another one", t, func() {
+		Convey("The export should only keep the self-signatures", func() {
+			exported, err := wkd.Export(body.Bytes(), func(address string) bool {
+				return address == "bob@pgp.st"
+			})
+			So(err, ShouldBeNil)
+
+			entities, err := openpgp.ReadKeyRing(bytes.NewReader(exported))
+			So(err, ShouldBeNil)
+			So(entities[0].PrimaryKey.KeyId, ShouldEqual, bob.PrimaryKey.KeyId)
+			So(len(entities[0].Identities), ShouldEqual, 1)
+			So(len(entities[0].Subkeys), ShouldEqual, 1)
+			for _, identity := range entities[0].Identities {
+				So(identity.SelfSignature, ShouldNotBeNil)
+				So(len(identity.Signatures), ShouldEqual, 0)
+			}
+		})
+
+		Convey("Keys without a matching identity should not be exported", func() {
+			_, err := wkd.Export(body.Bytes(), func(address string) bool {
+				return address == "alice@example.org"
+			})
+			So(err, ShouldEqual, wkd.ErrNoIdentity)
+		})
+
+		Convey("Encryption exports should only keep a subkey that can be used", func() {
+			matches := func(address string) bool {
+				return address == "bob@pgp.st"
+			}
+
+			exported, err := wkd.ExportEncryption(body.Bytes(), matches, time.Now())
+			So(err, ShouldBeNil)
+			entities, err := openpgp.ReadKeyRing(bytes.NewReader(exported))
+			So(err, ShouldBeNil)
+			So(len(entities[0].Identities), ShouldEqual, 1)
+			So(len(entities[0].Subkeys), ShouldEqual, 1)
+			So(entities[0].Subkeys[0].PublicKey.KeyId, ShouldEqual, bob.Subkeys[0].PublicKey.KeyId)
+
+			exported, err = wkd.ExportEncryption(expiring.Bytes(), matches, time.Now().Add(time.Hour))
+			So(err, ShouldBeNil)
+			entities, err = openpgp.ReadKeyRing(bytes.NewReader(exported))
+			So(err, ShouldBeNil)
+			So(len(entities[0].Subkeys), ShouldEqual, 0)
+		})
+	})
+}